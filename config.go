@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper cased flag name to build its environment variable,
+// e.g "timeout.read" is read from SMTP2HTTP_TIMEOUT_READ
+const envPrefix = "SMTP2HTTP_"
+
+// loadConfig fills the flags that weren't set on the command line,
+// the precedence is: flag > environment variable > config file > default
+func loadConfig(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	// an alias shares its Value with its flag, setting either one sets both
+	fs.VisitAll(func(f *flag.Flag) {
+		fs.Visit(func(set *flag.Flag) {
+			if set.Value == f.Value {
+				explicit[f.Name] = true
+			}
+		})
+	})
+
+	configFile := fs.Lookup("config").Value.String()
+	if value, ok := lookupEnv(envName("config")); ok && !explicit["config"] {
+		configFile = value
+	}
+	explicit["config"] = true
+
+	fileValues, err := readConfigFile(fs, configFile)
+	if err != nil {
+		return err
+	}
+
+	var setErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if setErr != nil || explicit[f.Name] {
+			return
+		}
+
+		if value, ok := lookupEnv(envName(f.Name)); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value %q for %s: %s", value, envName(f.Name), err.Error())
+			}
+			return
+		}
+
+		for _, value := range fileValues[f.Name] {
+			if err := fs.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid value %q for %s in %s: %s", value, f.Name, configFile, err.Error())
+				return
+			}
+		}
+	})
+
+	return setErr
+}
+
+// readConfigFile reads the yaml config file, its keys are the flag names
+func readConfigFile(fs *flag.FlagSet, configFile string) (map[string][]string, error) {
+	ret := map[string][]string{}
+	if configFile == "" {
+		return ret, nil
+	}
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the config file: %s", err.Error())
+	}
+
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("cannot parse the config file: %s", err.Error())
+	}
+
+	for key, value := range raw {
+		if key == "config" || fs.Lookup(key) == nil {
+			return nil, fmt.Errorf("unknown key %q in the config file %s", key, configFile)
+		}
+
+		// lists are only meaningful for the repeatable flags, each item is set in order
+		if list, ok := value.([]interface{}); ok {
+			for _, item := range list {
+				ret[key] = append(ret[key], fmt.Sprint(item))
+			}
+			continue
+		}
+
+		ret[key] = []string{fmt.Sprint(value)}
+	}
+
+	return ret, nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFlags returns a flag set with a few flags of each kind, the way vars.go declares them
+func testFlags() (*flag.FlagSet, *string, *string, *string, *int, *[]string) {
+	fs := flag.NewFlagSet("smtp2http", flag.ContinueOnError)
+	fs.String("config", "", "")
+	webhook := fs.String("webhook", "default-webhook", "")
+	domain := fs.String("domain", "default-domain", "")
+	name := fs.String("name", "default-name", "")
+	read := fs.Int("timeout.read", 5, "")
+	listen := &[]string{}
+	fs.Var((*stringsValue)(listen), "listen", "")
+
+	return fs, webhook, domain, name, read, listen
+}
+
+// writeConfig writes the yaml config file of a test
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "smtp2http.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// mapEnv looks the variables up in env
+func mapEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	configFile := writeConfig(t, "webhook: file-webhook\ndomain: file-domain\nname: file-name\ntimeout.read: 10\nlisten: [\":25\", \":2525\"]\n")
+	env := mapEnv(map[string]string{
+		"SMTP2HTTP_CONFIG":  configFile,
+		"SMTP2HTTP_WEBHOOK": "env-webhook",
+		"SMTP2HTTP_DOMAIN":  "env-domain",
+	})
+
+	fs, webhook, domain, name, read, listen := testFlags()
+	if err := fs.Parse([]string{"-webhook", "flag-webhook"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs, env); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ name, got, want string }{
+		{"flag over env", *webhook, "flag-webhook"},
+		{"env over file", *domain, "env-domain"},
+		{"file over default", *name, "file-name"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+	if *read != 10 {
+		t.Errorf("timeout.read = %d, want 10 from the file", *read)
+	}
+	if strings.Join(*listen, ",") != ":25,:2525" {
+		t.Errorf("listen = %q, want both items of the file list", *listen)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	fs, webhook, _, _, read, _ := testFlags()
+	if err := loadConfig(fs, mapEnv(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if *webhook != "default-webhook" || *read != 5 {
+		t.Errorf("webhook = %q, timeout.read = %d, want the defaults", *webhook, *read)
+	}
+}
+
+func TestLoadConfigEnvNames(t *testing.T) {
+	fs, _, _, _, read, _ := testFlags()
+	if err := loadConfig(fs, mapEnv(map[string]string{"SMTP2HTTP_TIMEOUT_READ": "7"})); err != nil {
+		t.Fatal(err)
+	}
+	if *read != 7 {
+		t.Errorf("timeout.read = %d, want 7 from SMTP2HTTP_TIMEOUT_READ", *read)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for name, tt := range map[string]struct {
+		args []string
+		env  map[string]string
+		want string
+	}{
+		"unknown key":        {args: []string{"-config", writeConfig(t, "webhok: typo\n")}, want: `unknown key "webhok"`},
+		"config key":         {args: []string{"-config", writeConfig(t, "config: other.yaml\n")}, want: `unknown key "config"`},
+		"invalid yaml":       {args: []string{"-config", writeConfig(t, "webhook: [\n")}, want: "cannot parse the config file"},
+		"missing file":       {args: []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, want: "cannot read the config file"},
+		"invalid file value": {args: []string{"-config", writeConfig(t, "timeout.read: soon\n")}, want: "invalid value"},
+		"invalid env value":  {env: map[string]string{"SMTP2HTTP_TIMEOUT_READ": "soon"}, want: "SMTP2HTTP_TIMEOUT_READ"},
+	} {
+		fs, _, _, _, _, _ := testFlags()
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+
+		err := loadConfig(fs, mapEnv(tt.env))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: loadConfig returned %v, want %q", name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigAlias(t *testing.T) {
+	lookupEnv := mapEnv(map[string]string{
+		"SMTP2HTTP_CONFIG":                writeConfig(t, "webhook-body-template: file.tmpl\n"),
+		"SMTP2HTTP_WEBHOOK_BODY_TEMPLATE": "env.tmpl",
+	})
+
+	for _, name := range []string{"payload-transform", "webhook-body-template"} {
+		var template string
+		fs := flag.NewFlagSet("smtp2http", flag.ContinueOnError)
+		fs.String("config", "", "")
+		fs.StringVar(&template, "webhook-body-template", "", "")
+		fs.Var(fs.Lookup("webhook-body-template").Value, "payload-transform", "")
+
+		if err := fs.Parse([]string{"-" + name, "cli.tmpl"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfig(fs, lookupEnv); err != nil {
+			t.Fatal(err)
+		}
+		if template != "cli.tmpl" {
+			t.Errorf("-%s: template = %q, want the command line value", name, template)
+		}
+	}
+}
+
+func TestDeprecatedFlags(t *testing.T) {
+	for name, target := range deprecatedFlags {
+		if flag.Lookup(name).Value != flag.Lookup(target).Value {
+			t.Errorf("-%s doesn't set -%s", name, target)
+		}
+	}
+}
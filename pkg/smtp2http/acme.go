@@ -0,0 +1,95 @@
+package smtp2http
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// the acme challenges the certificate authority may use to validate the domains
+const (
+	acmeChallengeHTTP    = "http-01"
+	acmeChallengeTLSALPN = "tls-alpn-01"
+)
+
+// acmeConfig holds the settings of the automatic certificates
+type acmeConfig struct {
+	Domains       []string
+	CacheDir      string
+	Email         string
+	Challenge     string
+	ChallengeAddr string
+}
+
+// newACMETLSConfig returns a tls config whose certificates are obtained and renewed
+// by autocert on the first handshakes, and starts the server answering the challenges
+func newACMETLSConfig(cfg acmeConfig, minVersion, ciphers string) (*tls.Config, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, fmt.Errorf("-acme-domain requires at least one domain")
+	}
+
+	if cfg.CacheDir == "" {
+		return nil, fmt.Errorf("-acme-domain requires -acme-cache-dir, the certificates would be requested again on each restart")
+	}
+
+	base, err := tlsPolicy(minVersion, ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+	}
+
+	addr := cfg.ChallengeAddr
+	switch cfg.Challenge {
+	case acmeChallengeHTTP:
+		if addr == "" {
+			addr = ":80"
+		}
+	case acmeChallengeTLSALPN:
+		if addr == "" {
+			addr = ":443"
+		}
+	default:
+		return nil, fmt.Errorf("invalid acme challenge %q, expected %s or %s", cfg.Challenge, acmeChallengeHTTP, acmeChallengeTLSALPN)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on %s for the acme challenges: %s", addr, err.Error())
+	}
+
+	go func() {
+		var err error
+		if cfg.Challenge == acmeChallengeHTTP {
+			err = http.Serve(l, m.HTTPHandler(nil))
+		} else {
+			// the validation only needs the handshake, the requests themselves are never answered
+			err = http.Serve(tls.NewListener(l, m.TLSConfig()), http.NotFoundHandler())
+		}
+		slog.Error("acme challenge server stopped", "addr", addr, "error", err)
+	}()
+
+	slog.Info("acme enabled", "domains", cfg.Domains, "challenge", cfg.Challenge, "challenge_addr", addr)
+
+	// most smtp clients don't send SNI, those handshakes get the certificate of the first domain
+	base.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			named := *hello
+			named.ServerName = cfg.Domains[0]
+			hello = &named
+		}
+
+		return m.GetCertificate(hello)
+	}
+
+	return base, nil
+}
@@ -0,0 +1,113 @@
+package smtp2http
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// readinessCacheTTL bounds how often /readyz may probe the webhook
+const readinessCacheTTL = 5 * time.Second
+
+// smtpListening is set once the smtp listeners are bound
+var smtpListening int32
+
+// startAdminServers exposes /metrics on metricsAddr and /healthz, /readyz on healthAddr,
+// the health endpoints share the metrics listener when healthAddr is empty. A listener failing is sent on errc
+func startAdminServers(metricsAddr, healthAddr string, errc chan<- error) {
+	muxes := map[string]*http.ServeMux{}
+	muxFor := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if metricsAddr != "" {
+		muxFor(metricsAddr).Handle("/metrics", promhttp.Handler())
+	}
+
+	if healthAddr == "" {
+		healthAddr = metricsAddr
+	}
+
+	if healthAddr != "" {
+		probe := &readinessProbe{target: conf.ReadinessProbe}
+		muxFor(healthAddr).HandleFunc("/healthz", handleHealthz)
+		muxFor(healthAddr).Handle("/readyz", probe)
+	}
+
+	for addr, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			slog.Info("admin server started", "addr", addr)
+			errc <- fmt.Errorf("admin server %s: %s", addr, http.ListenAndServe(addr, mux))
+		}(addr, mux)
+	}
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&smtpListening) == 0 {
+		http.Error(w, "smtp listener not bound yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// readinessProbe checks that the webhook is reachable, target is either empty
+// (no probe), "head" (HEAD request against -webhook) or the url to GET
+type readinessProbe struct {
+	target string
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	lastErr   error
+}
+
+func (p *readinessProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&smtpListening) == 0 {
+		http.Error(w, "smtp listener not bound yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := p.check(); err != nil {
+		http.Error(w, "webhook unreachable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// check probes the webhook, the result is cached for readinessCacheTTL
+func (p *readinessProbe) check() error {
+	if p.target == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.checkedAt) < readinessCacheTTL {
+		return p.lastErr
+	}
+
+	var err error
+	if p.target == "head" {
+		for _, url := range webhookURLs {
+			if _, err = webhookClient.R().Head(url); err != nil {
+				break
+			}
+		}
+	} else {
+		_, err = callbackClient.R().Get(p.target)
+	}
+
+	p.checkedAt, p.lastErr = time.Now(), err
+
+	return err
+}
@@ -0,0 +1,222 @@
+package smtp2http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/mail"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// recipientAliases are the aliases loaded from -alias-file, nil when disabled
+var recipientAliases *aliasMap
+
+// aliasRule is a "pattern = target" line of the alias file, pattern is an address, a "*@domain" wildcard
+// or a /regex/ whose captures can be used in target ($1)
+type aliasRule struct {
+	pattern string
+	target  string
+	re      *regexp.Regexp
+}
+
+// aliases holds the rules of the alias file by kind, the exact addresses lowercased and the wildcard domains
+// in their A-label form
+type aliases struct {
+	exact   map[string]string
+	regexes []*aliasRule
+	domains map[string]string
+}
+
+// aliasMap rewrites the envelope recipients, the rules are replaced as a whole when the file is reloaded
+type aliasMap struct {
+	file string
+
+	mu      sync.RWMutex
+	aliases *aliases
+}
+
+// openAliasMap loads the aliases of file
+func openAliasMap(file string) (*aliasMap, error) {
+	a, err := loadAliases(file)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("aliases loaded", "alias_file", file, "aliases", a.count())
+
+	return &aliasMap{file: file, aliases: a}, nil
+}
+
+func (a *aliases) count() int {
+	return len(a.exact) + len(a.regexes) + len(a.domains)
+}
+
+// loadAliases parses the alias file, one "pattern = target" (or "pattern -> target") per line, the empty
+// lines and the ones starting with # ignored. Every line is checked so a bad one is reported at once
+func loadAliases(file string) (*aliases, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the alias file: %s", err.Error())
+	}
+
+	a := &aliases{exact: map[string]string{}, domains: map[string]string{}}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseAliasLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %d of the alias file %s: %s", n, file, err.Error())
+		}
+
+		switch {
+		case rule.re != nil:
+			a.regexes = append(a.regexes, rule)
+		case strings.HasPrefix(rule.pattern, "*@"):
+			a.domains[asciiDomain(normalizeDomain(rule.pattern[2:]))] = rule.target
+		default:
+			a.exact[strings.ToLower(rule.pattern)] = rule.target
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read the alias file: %s", err.Error())
+	}
+
+	return a, nil
+}
+
+// parseAliasLine splits a line on its "->", or else its first "=" outside of the regex
+func parseAliasLine(line string) (*aliasRule, error) {
+	rule := &aliasRule{}
+
+	rest := line
+	if strings.HasPrefix(line, "/") {
+		end := -1
+		for i := 1; i < len(line); i++ {
+			if line[i] == '\\' {
+				i++
+			} else if line[i] == '/' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated regex %q", line)
+		}
+
+		re, err := regexp.Compile(line[1:end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %s", err.Error())
+		}
+		rule.pattern, rule.re, rest = line[:end+1], re, line[end+1:]
+	}
+
+	sep := "->"
+	if !strings.Contains(rest, sep) {
+		sep = "="
+	}
+
+	pattern, target, ok := strings.Cut(rest, sep)
+	if !ok {
+		return nil, fmt.Errorf("expected pattern = target, got %q", line)
+	}
+	target = strings.TrimSpace(target)
+
+	if rule.re == nil {
+		rule.pattern = strings.TrimSpace(pattern)
+		if _, err := mail.ParseAddress(rule.pattern); err != nil {
+			return nil, fmt.Errorf("invalid address %q", rule.pattern)
+		}
+	} else if strings.TrimSpace(pattern) != "" {
+		return nil, fmt.Errorf("unexpected %q after the regex", strings.TrimSpace(pattern))
+	}
+
+	// the captures are only known once matched, the other targets are checked now
+	if target == "" {
+		return nil, fmt.Errorf("no target for %s", rule.pattern)
+	}
+	if !strings.Contains(target, "$") || rule.re == nil {
+		if _, err := mail.ParseAddress(target); err != nil {
+			return nil, fmt.Errorf("invalid target address %q", target)
+		}
+	}
+	rule.target = target
+
+	return rule, nil
+}
+
+// reloadOnSIGHUP reloads the aliases each time the process receives a SIGHUP until done is closed,
+// the current ones are kept when the file is invalid
+func (m *aliasMap) reloadOnSIGHUP(done <-chan struct{}) {
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	defer signal.Stop(hupc)
+
+	for {
+		select {
+		case <-hupc:
+		case <-done:
+			return
+		}
+
+		a, err := loadAliases(m.file)
+		if err != nil {
+			slog.Error("cannot reload the aliases, keeping the current ones", "alias_file", m.file, "error", err)
+			continue
+		}
+
+		m.mu.Lock()
+		m.aliases = a
+		m.mu.Unlock()
+
+		slog.Info("aliases reloaded", "alias_file", m.file, "aliases", a.count())
+	}
+}
+
+// rewrite returns the address rcpt is an alias of: the exact address first, then the regexes in the order of
+// the file and the wildcard of its domain last. rewritten is false when none matches, rcpt is then returned
+func (m *aliasMap) rewrite(rcpt *mail.Address) (addr *mail.Address, rewritten bool) {
+	if m == nil {
+		return rcpt, false
+	}
+
+	m.mu.RLock()
+	a := m.aliases
+	m.mu.RUnlock()
+
+	target, ok := a.exact[strings.ToLower(rcpt.Address)]
+	if !ok {
+		for _, rule := range a.regexes {
+			if match := rule.re.FindStringSubmatchIndex(rcpt.Address); match != nil {
+				target, ok = string(rule.re.ExpandString(nil, rule.target, rcpt.Address, match)), true
+				break
+			}
+		}
+	}
+	if !ok {
+		target, ok = a.domains[asciiDomain(addressDomain(rcpt.Address))]
+	}
+	if !ok {
+		return rcpt, false
+	}
+
+	addr, err := mail.ParseAddress(target)
+	if err != nil {
+		slog.Warn("alias ignored, invalid target address", "recipient", rcpt.Address, "target", target)
+		return rcpt, false
+	}
+
+	return &mail.Address{Name: rcpt.Name, Address: addr.Address}, true
+}
@@ -0,0 +1,132 @@
+package smtp2http
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAliasFile writes content to an alias file in a temp dir and returns its path
+func writeAliasFile(t *testing.T, content string) string {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "aliases")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+const testAliases = `# the exact addresses first
+sales@example.com = bob@example.com
+Support@Example.com -> carol@example.com
+sales@example.net = exact@example.com
+
+# then the regexes, in the order of the file
+/^(.+)\+.*@example\.com$/ -> $1@example.com
+/^dev-(.+)@example\.org$/ = $1@dev.example.com
+/^info@/ -> regex@example.com
+/^bad-(.*)@example\.com$/ -> $1
+
+# the wildcards last
+*@example.net = catchall@example.net
+*@müller.example = jürgen@example.com
+`
+
+func TestAliasRewrite(t *testing.T) {
+	m, err := openAliasMap(writeAliasFile(t, testAliases))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		rcpt string
+		want string
+	}{
+		{"exact", "sales@example.com", "bob@example.com"},
+		{"exact, whatever the case", "SALES@Example.COM", "bob@example.com"},
+		{"exact, the case of the file", "support@example.com", "carol@example.com"},
+		{"exact before the regexes and the wildcard", "sales@example.net", "exact@example.com"},
+		{"a regex capture", "bob+news@example.com", "bob@example.com"},
+		{"a regex with =", "dev-alice@example.org", "alice@dev.example.com"},
+		{"the first regex of the file", "info+x@example.com", "info@example.com"},
+		{"a regex before the wildcard", "info@example.net", "regex@example.com"},
+		{"the wildcard", "anyone@example.net", "catchall@example.net"},
+		{"the wildcard of a punycoded domain", "anyone@xn--mller-kva.example", "jürgen@example.com"},
+		{"the wildcard of a unicode domain", "anyone@MÜLLER.example", "jürgen@example.com"},
+		{"a capture that isn't an address", "bad-x@example.com", ""},
+		{"no alias", "alice@example.com", ""},
+	} {
+		rcpt := &mail.Address{Name: "Recipient", Address: c.rcpt}
+		got, rewritten := m.rewrite(rcpt)
+
+		if c.want == "" {
+			if rewritten || got != rcpt {
+				t.Errorf("%s: %s rewritten to %s, want it kept", c.name, c.rcpt, got.Address)
+			}
+			continue
+		}
+		if !rewritten || got.Address != c.want || got.Name != "Recipient" {
+			t.Errorf("%s: %s rewritten to %+v (%t), want %s with its name", c.name, c.rcpt, got, rewritten, c.want)
+		}
+	}
+}
+
+func TestAliasRewriteDisabled(t *testing.T) {
+	var m *aliasMap
+
+	rcpt := &mail.Address{Address: "sales@example.com"}
+	if got, rewritten := m.rewrite(rcpt); rewritten || got != rcpt {
+		t.Errorf("rewritten to %s without -alias-file", got.Address)
+	}
+}
+
+func TestLoadAliasesErrors(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want string
+	}{
+		{"sales@example.com", "expected pattern = target"},
+		{"sales@example.com bob@example.com", "expected pattern = target"},
+		{"/^sales@ -> bob@example.com", "unterminated regex"},
+		{"/(/ -> bob@example.com", "invalid regex"},
+		{"/^sales@/ trailing -> bob@example.com", `unexpected "trailing" after the regex`},
+		{"not an address = bob@example.com", `invalid address "not an address"`},
+		{"= bob@example.com", `invalid address ""`},
+		{"sales@example.com =", "no target for sales@example.com"},
+		{"sales@example.com = bob", `invalid target address "bob"`},
+		// the captures are only used by the regexes
+		{"sales@example.com = $1", `invalid target address "$1"`},
+		{"*@example.com -> catchall", `invalid target address "catchall"`},
+	} {
+		_, err := loadAliases(writeAliasFile(t, "# aliases\n"+c.line+"\n"))
+		if err == nil || !strings.Contains(err.Error(), "invalid line 2 of the alias file") || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: %v, want line 2 reported: %s", c.line, err, c.want)
+		}
+	}
+
+	if _, err := loadAliases(filepath.Join(t.TempDir(), "missing")); err == nil || !strings.Contains(err.Error(), "cannot read the alias file") {
+		t.Errorf("missing file: %v, want it reported", err)
+	}
+}
+
+func TestLoadAliases(t *testing.T) {
+	a, err := loadAliases(writeAliasFile(t, testAliases))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a.exact) != 3 || len(a.regexes) != 4 || len(a.domains) != 2 || a.count() != 9 {
+		t.Errorf("%d exact, %d regexes, %d wildcards, want 3, 4 and 2", len(a.exact), len(a.regexes), len(a.domains))
+	}
+	if a.exact["support@example.com"] != "carol@example.com" {
+		t.Errorf("exact = %v, want the addresses lowercased", a.exact)
+	}
+	if a.domains["xn--mller-kva.example"] != "jürgen@example.com" {
+		t.Errorf("wildcards = %v, want the domains in their A-label form", a.domains)
+	}
+}
@@ -0,0 +1,171 @@
+package smtp2http
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// amqpReconnectDelay is the delay before reconnecting to the broker, doubled after each failed attempt
+	amqpReconnectDelay = time.Second
+
+	// amqpMaxReconnectDelay caps the delay between the reconnection attempts
+	amqpMaxReconnectDelay = 30 * time.Second
+)
+
+var (
+	errAMQPDisconnected = errors.New("not connected to the amqp broker")
+	errAMQPNack         = errors.New("the amqp broker refused the message")
+)
+
+// amqpPublisher publishes the payloads as persistent messages and waits for the publisher confirms.
+// The connection is re-established in the background when it is lost
+type amqpPublisher struct {
+	url        string
+	exchange   string
+	routingKey string
+
+	mu      sync.RWMutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	closed  chan struct{}
+}
+
+// newAMQPPublisher starts connecting to the broker, a broker which isn't reachable yet only fails the publications
+func newAMQPPublisher(url, exchange, routingKey string) *amqpPublisher {
+	p := &amqpPublisher{url: url, exchange: exchange, routingKey: routingKey, closed: make(chan struct{})}
+	go p.connectLoop()
+
+	return p
+}
+
+// connectLoop keeps the connection open until the publisher is closed
+func (p *amqpPublisher) connectLoop() {
+	delay := amqpReconnectDelay
+
+	for {
+		conn, channel, err := p.connect()
+		if err != nil {
+			slog.Warn("cannot connect to the amqp broker", "error", err, "retry_in", delay.String())
+
+			select {
+			case <-p.closed:
+				return
+			case <-time.After(delay):
+			}
+
+			if delay *= 2; delay > amqpMaxReconnectDelay {
+				delay = amqpMaxReconnectDelay
+			}
+			continue
+		}
+
+		slog.Info("connected to the amqp broker")
+		delay = amqpReconnectDelay
+
+		p.mu.Lock()
+		p.conn, p.channel = conn, channel
+		p.mu.Unlock()
+
+		// a channel error (e.g. a missing exchange) closes the channel but not the connection
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+		select {
+		case <-p.closed:
+			return
+		case err := <-connClosed:
+			slog.Warn("amqp connection lost", "error", err)
+		case err := <-channelClosed:
+			slog.Warn("amqp channel closed", "error", err)
+		}
+
+		p.mu.Lock()
+		p.conn, p.channel = nil, nil
+		p.mu.Unlock()
+		conn.Close()
+	}
+}
+
+func (p *amqpPublisher) connect() (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := amqp.Dial(p.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, channel, nil
+}
+
+func (p *amqpPublisher) Name() string {
+	return "amqp"
+}
+
+func (p *amqpPublisher) Publish(ctx context.Context, pub *publication) error {
+	p.mu.RLock()
+	channel := p.channel
+	p.mu.RUnlock()
+
+	if channel == nil {
+		return errAMQPDisconnected
+	}
+
+	headers := amqp.Table{}
+	for name, value := range pub.Headers {
+		headers[name] = value
+	}
+
+	// the routing key isn't a url, the values are used as is
+	key := expandPlaceholders(p.routingKey, pub.Values, func(value string) string { return value })
+
+	confirm, err := channel.PublishWithDeferredConfirmWithContext(ctx, p.exchange, key, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  pub.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    pub.MessageID,
+		Timestamp:    time.Now(),
+		Body:         pub.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !acked {
+		return errAMQPNack
+	}
+
+	return nil
+}
+
+func (p *amqpPublisher) Close() error {
+	close(p.closed)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+
+	return p.conn.Close()
+}
@@ -0,0 +1,242 @@
+package smtp2http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// attachmentsInline sends the content of the files
+	attachmentsInline = "inline"
+
+	// attachmentsMetadata only sends the size and checksum of the files
+	attachmentsMetadata = "metadata"
+
+	// overflowDrop drops the files over the limits, their entry is marked as truncated
+	overflowDrop = "drop"
+
+	// overflowReject refuses the messages with files over the limits
+	overflowReject = "reject"
+
+	// partErrorReject fails the messages with an unreadable file with a temporary error
+	partErrorReject = "reject"
+
+	// partErrorAnnotate reports the unreadable files in the payload
+	partErrorAnnotate = "annotate"
+)
+
+var (
+	errAttachmentTooLarge = errors.New("attachment over -max-attachment-size")
+	errTooManyAttachments = errors.New("more attachments than -max-attachments")
+
+	errAttachmentLimit = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Message size exceeds limit",
+	}
+	errPartUnreadable = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Cannot read the attachments of your message, please try again later",
+	}
+)
+
+// fileEncoder fills the payload entries of the files of a message according to -attachments,
+// enforcing the size and count limits while the files are read
+type fileEncoder struct {
+	mode      string
+	multipart bool
+	maxSize   int64
+	maxCount  int
+	overflow  string
+	onError   string
+
+	// spill takes the files that don't fit in -max-memory-per-message, nil when the message stays in memory
+	spill *spillFiles
+
+	count    int
+	parts    []*filePart
+	warnings []string
+}
+
+func newFileEncoder(spill *spillFiles) *fileEncoder {
+	return &fileEncoder{
+		spill:     spill,
+		mode:      conf.Attachments,
+		multipart: conf.WebhookFormat == webhookFormatMultipart,
+		maxSize:   conf.MaxAttachmentSize,
+		maxCount:  conf.MaxAttachments,
+		overflow:  conf.AttachmentOverflow,
+		onError:   conf.OnPartError,
+	}
+}
+
+// Encode fills f from r, a file over the limits either fails the message or is dropped
+// and an unreadable one either fails the message or is annotated with its error
+func (e *fileEncoder) Encode(f *EmailFile, name, contentType, field string, r io.Reader) error {
+	// attachments and embedded files share the same count
+	e.count++
+	if e.maxCount > 0 && e.count > e.maxCount {
+		if e.overflow == overflowReject {
+			return errTooManyAttachments
+		}
+
+		f.Truncated = true
+		return nil
+	}
+
+	if e.maxSize > 0 {
+		r = &limitReader{r: r, n: e.maxSize}
+	}
+
+	err := e.write(f, name, contentType, field, r)
+	if errors.Is(err, errAttachmentTooLarge) {
+		if e.overflow == overflowReject {
+			return err
+		}
+
+		*f = EmailFile{Truncated: true}
+		return nil
+	}
+
+	var perr *PartError
+	if errors.As(err, &perr) && e.onError == partErrorAnnotate {
+		*f = EmailFile{Error: perr.Err.Error()}
+		e.warnings = append(e.warnings, perr.Error())
+		return nil
+	}
+
+	return err
+}
+
+func (e *fileEncoder) write(f *EmailFile, name, contentType, field string, r io.Reader) (err error) {
+	switch {
+	case e.mode == attachmentsMetadata:
+		if f.Size, f.SHA256, err = digest(r); err != nil {
+			return readError(name, err)
+		}
+		return nil
+	case e.mode == attachmentsStore:
+		counter := &countingReader{r: r}
+		if f.Path, f.URL, err = attachmentStore.Put(storeKey(name), contentType, counter); err != nil {
+			return err
+		}
+		f.Size = counter.n
+		return nil
+	case e.multipart:
+		// a size limit must be checked before the part is written, the file is then buffered
+		// up to the limit, otherwise it is copied straight from the parsed part
+		if e.maxSize > 0 {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return readError(name, err)
+			}
+			r = bytes.NewReader(data)
+		}
+
+		// the body is written to a temp file once the files no longer fit in memory
+		if n, ok := r.(interface{ Len() int }); ok {
+			e.spill.keep(int64(n.Len()))
+		}
+
+		f.Field = field
+		e.parts = append(e.parts, &filePart{field: field, filename: name, contentType: contentType, data: r})
+		return nil
+	}
+
+	// the files that no longer fit in memory are encoded to temp files, the ones of an unknown length are
+	// counted once encoded
+	n, known := r.(interface{ Len() int })
+	if known && !e.spill.keep(int64(n.Len())) {
+		if f.Data, err = e.spill.encode(r); err != nil {
+			return readError(name, err)
+		}
+		return nil
+	}
+
+	if f.Data, err = EncodeBase64(r); err != nil {
+		return readError(name, err)
+	}
+	if !known {
+		e.spill.keep(int64(base64.StdEncoding.DecodedLen(len(f.Data))))
+	}
+
+	return nil
+}
+
+// readError wraps the error of reading a file, going over the size limit isn't a read error
+func readError(name string, err error) error {
+	if errors.Is(err, errAttachmentTooLarge) {
+		return err
+	}
+
+	return &PartError{Name: name, Err: err}
+}
+
+// digest returns the size and hex encoded SHA-256 of r, it is streamed so memory use doesn't depend on the size
+func digest(r io.Reader) (int64, string, error) {
+	h := sha256.New()
+
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// limitReader fails with errAttachmentTooLarge as soon as more than n bytes are read
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+// Len is the length left of the file up to the limit so its encoded data is allocated at once, 0 when
+// the length isn't known
+func (l *limitReader) Len() int {
+	r, ok := l.r.(interface{ Len() int })
+	if !ok {
+		return 0
+	}
+
+	if int64(r.Len()) > l.n {
+		return int(l.n)
+	}
+
+	return r.Len()
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	// one byte past the limit tells a file of exactly n bytes from a larger one
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		return int(l.n), errAttachmentTooLarge
+	}
+	l.n -= int64(n)
+
+	return n, err
+}
@@ -0,0 +1,90 @@
+package smtp2http
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// MessageKind is what the headers tell of the origin of a message
+type MessageKind struct {
+	AutoReply       bool
+	MailingList     bool
+	ListID          string
+	ListUnsubscribe string
+}
+
+// HeaderRule matches the headers of a kind of message, the rules can be appended to AutoReplyRules and MailingListRules
+type HeaderRule func(header mail.Header) bool
+
+// autoReplySubjects are the subject prefixes of the out-of-office replies, lowercase
+var autoReplySubjects = []string{
+	"auto:",
+	"autoreply:",
+	"auto-reply:",
+	"auto reply:",
+	"automatic reply:",
+	"out of office:",
+	"out of the office:",
+	"abwesenheitsnotiz:",
+	"réponse automatique:",
+	"respuesta automática:",
+}
+
+// AutoReplyRules tell the automatic replies, a message matching any of them is one
+var AutoReplyRules = []HeaderRule{
+	func(header mail.Header) bool {
+		submitted := strings.TrimSpace(header.Get("Auto-Submitted"))
+		return submitted != "" && !strings.EqualFold(submitted, "no")
+	},
+	func(header mail.Header) bool { return header.Get("X-Autoreply") != "" },
+	func(header mail.Header) bool { return header.Get("X-Autorespond") != "" },
+	func(header mail.Header) bool { return precedence(header) == "auto_reply" },
+	func(header mail.Header) bool {
+		subject := strings.ToLower(strings.TrimSpace(DecodeHeader(header.Get("Subject"))))
+		for _, prefix := range autoReplySubjects {
+			if strings.HasPrefix(subject, prefix) {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+// MailingListRules tell the mailing list traffic, a message matching any of them is some
+var MailingListRules = []HeaderRule{
+	func(header mail.Header) bool { return header.Get("List-Id") != "" },
+	func(header mail.Header) bool { return header.Get("List-Unsubscribe") != "" },
+	func(header mail.Header) bool { return precedence(header) == "bulk" || precedence(header) == "list" },
+}
+
+// ClassifyMessage applies AutoReplyRules and MailingListRules to the headers of a message
+func ClassifyMessage(header mail.Header) MessageKind {
+	kind := MessageKind{
+		AutoReply:       matchAny(AutoReplyRules, header),
+		MailingList:     matchAny(MailingListRules, header),
+		ListUnsubscribe: strings.TrimSpace(header.Get("List-Unsubscribe")),
+	}
+
+	// the id is between the angle brackets, e.g "Announcements <announce.example.com>"
+	kind.ListID = strings.TrimSpace(DecodeHeader(header.Get("List-Id")))
+	if i, j := strings.LastIndex(kind.ListID, "<"), strings.LastIndex(kind.ListID, ">"); i >= 0 && j > i {
+		kind.ListID = kind.ListID[i+1 : j]
+	}
+
+	return kind
+}
+
+func matchAny(rules []HeaderRule, header mail.Header) bool {
+	for _, rule := range rules {
+		if rule(header) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// precedence returns the lowercased Precedence header
+func precedence(header mail.Header) string {
+	return strings.ToLower(strings.TrimSpace(header.Get("Precedence")))
+}
@@ -0,0 +1,122 @@
+package smtp2http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClassifyMessage(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		header mail.Header
+		want   MessageKind
+	}{
+		{"no header", mail.Header{}, MessageKind{}},
+		{"a person", mail.Header{"Subject": {"Re: your invoice"}, "Auto-Submitted": {"no"}}, MessageKind{}},
+		{"Auto-Submitted no, whatever the case", mail.Header{"Auto-Submitted": {" No "}}, MessageKind{}},
+		{"Auto-Submitted auto-replied", mail.Header{"Auto-Submitted": {"auto-replied"}}, MessageKind{AutoReply: true}},
+		{"Auto-Submitted auto-generated", mail.Header{"Auto-Submitted": {"auto-generated"}}, MessageKind{AutoReply: true}},
+		{"X-Autoreply", mail.Header{"X-Autoreply": {"yes"}}, MessageKind{AutoReply: true}},
+		{"X-Autorespond", mail.Header{"X-Autorespond": {"Out of office"}}, MessageKind{AutoReply: true}},
+		{"Precedence auto_reply", mail.Header{"Precedence": {"auto_reply"}}, MessageKind{AutoReply: true}},
+		{"Precedence bulk", mail.Header{"Precedence": {"bulk"}}, MessageKind{MailingList: true}},
+		{"Precedence list", mail.Header{"Precedence": {"list"}}, MessageKind{MailingList: true}},
+		{"Precedence, whatever the case", mail.Header{"Precedence": {" Bulk "}}, MessageKind{MailingList: true}},
+		{"Precedence junk", mail.Header{"Precedence": {"junk"}}, MessageKind{}},
+		{"Precedence first-class", mail.Header{"Precedence": {"first-class"}}, MessageKind{}},
+		{"subject prefix", mail.Header{"Subject": {"Out of Office: back on monday"}}, MessageKind{AutoReply: true}},
+		{"subject prefix, quoted-printable", mail.Header{"Subject": {"=?UTF-8?Q?R=C3=A9ponse_automatique=3A_absent?="}}, MessageKind{AutoReply: true}},
+		{"subject prefix, base64", mail.Header{"Subject": {"=?UTF-8?B?QXV0b21hdGljIHJlcGx5OiB2YWNhdGlvbg==?="}}, MessageKind{AutoReply: true}},
+		{"subject prefix, latin-1", mail.Header{"Subject": {"=?ISO-8859-1?Q?Respuesta_autom=E1tica=3A_vacaciones?="}}, MessageKind{AutoReply: true}},
+		{"subject prefix, after a Re:", mail.Header{"Subject": {"Re: Automatic reply: vacation"}}, MessageKind{}},
+		{
+			"List-Id with angle brackets",
+			mail.Header{"List-Id": {"Announcements <announce.example.com>"}},
+			MessageKind{MailingList: true, ListID: "announce.example.com"},
+		},
+		{
+			"List-Id with an encoded name",
+			mail.Header{"List-Id": {"=?UTF-8?Q?Ank=C3=BCndigungen?= <announce.example.com>"}},
+			MessageKind{MailingList: true, ListID: "announce.example.com"},
+		},
+		{"List-Id without angle brackets", mail.Header{"List-Id": {" announce.example.com "}}, MessageKind{MailingList: true, ListID: "announce.example.com"}},
+		{
+			"List-Unsubscribe",
+			mail.Header{"List-Unsubscribe": {" <mailto:leave@example.com>, <https://example.com/leave> "}},
+			MessageKind{MailingList: true, ListUnsubscribe: "<mailto:leave@example.com>, <https://example.com/leave>"},
+		},
+		{
+			"an automatic reply of a list",
+			mail.Header{"Auto-Submitted": {"auto-replied"}, "List-Id": {"<announce.example.com>"}},
+			MessageKind{AutoReply: true, MailingList: true, ListID: "announce.example.com"},
+		},
+	} {
+		if got := ClassifyMessage(c.header); got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestHeaderRulesAppended(t *testing.T) {
+	savedAutoReply, savedMailingList := AutoReplyRules, MailingListRules
+	t.Cleanup(func() { AutoReplyRules, MailingListRules = savedAutoReply, savedMailingList })
+
+	AutoReplyRules = append(AutoReplyRules, func(header mail.Header) bool { return header.Get("X-Vacation") != "" })
+	MailingListRules = append(MailingListRules, func(header mail.Header) bool { return header.Get("X-Mailman-Version") != "" })
+
+	for _, c := range []struct {
+		header mail.Header
+		want   MessageKind
+	}{
+		{mail.Header{"X-Vacation": {"1"}}, MessageKind{AutoReply: true}},
+		{mail.Header{"X-Mailman-Version": {"2.1"}}, MessageKind{MailingList: true}},
+		{mail.Header{"X-Mailer": {"mutt"}}, MessageKind{}},
+	} {
+		if got := ClassifyMessage(c.header); got != c.want {
+			t.Errorf("%v: got %+v, want %+v", c.header, got, c.want)
+		}
+	}
+}
+
+func TestDiscardAutoReplies(t *testing.T) {
+	var posted int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posted, 1)
+	}))
+	defer webhook.Close()
+
+	autoReply := strings.Replace(testMail, "Subject: test", "Subject: Automatic reply: test\r\nAuto-Submitted: auto-replied", 1)
+	list := strings.Replace(testMail, "Subject: test", "Subject: test\r\nList-Id: <announce.example.com>", 1)
+
+	for _, c := range []struct {
+		name    string
+		discard bool
+		data    string
+		posted  int32
+	}{
+		// accepted so the sender doesn't retry nor bounce it, but not posted
+		{"automatic reply, discarded", true, autoReply, 0},
+		{"list traffic, not an automatic reply", true, list, 1},
+		{"a person", true, testMail, 1},
+		{"automatic reply, without -discard-auto-replies", false, autoReply, 1},
+	} {
+		cfg := DefaultConfig()
+		cfg.Webhooks = []string{webhook.URL}
+		cfg.WebhookRetries = 0
+		cfg.DiscardAutoReplies = c.discard
+		addr := newTestServer(t, cfg)
+
+		atomic.StoreInt32(&posted, 0)
+		if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(c.data)); err != nil {
+			t.Errorf("%s: %v, want the message accepted", c.name, err)
+		}
+		if got := atomic.LoadInt32(&posted); got != c.posted {
+			t.Errorf("%s: posted %d times, want %d", c.name, got, c.posted)
+		}
+	}
+}
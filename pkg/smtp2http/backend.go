@@ -0,0 +1,294 @@
+package smtp2http
+
+import (
+	"context"
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/mail"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errTLSRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Must issue a STARTTLS command first",
+	}
+	errAuthRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Authentication required",
+	}
+	errInvalidCredentials = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	}
+)
+
+// HandlerFunc handles a fully received message
+type HandlerFunc func(*Context) error
+
+// RcptFunc validates an envelope recipient when RCPT TO is received, before the message
+type RcptFunc func(from, to *mail.Address) error
+
+// AuthFunc validates the credentials presented via SMTP AUTH
+type AuthFunc func(username, password string) error
+
+// Backend implements the smtp.Backend interface
+type Backend struct {
+	handler    HandlerFunc
+	auther     AuthFunc
+	limiter    *rateLimiter
+	listener   string
+	requireTLS bool
+	rcptCheck  RcptFunc
+	dnsbl      *dnsblChecker
+	client     *clientChecker
+	limits     sessionLimits
+	inflight   int64
+}
+
+// NewBackend creates a new backend, a nil auther disables authentication
+func NewBackend(auther AuthFunc, handler HandlerFunc) *Backend {
+	return &Backend{
+		handler: handler,
+		auther:  auther,
+	}
+}
+
+// Login handles a login command with username and password.
+func (bkd *Backend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if bkd.auther == nil {
+		return nil, finalReply(smtp.ErrAuthUnsupported)
+	}
+
+	if err := bkd.auther(username, password); err != nil {
+		return nil, finalReply(err)
+	}
+
+	return bkd.newSession(state, username), nil
+}
+
+// AnonymousLogin is called when the client sends MAIL FROM without authenticating,
+// it is refused when authentication is configured or when tls is required and not negotiated.
+// The authenticated sessions are always tls when tls is enabled, see AllowInsecureAuth
+func (bkd *Backend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	if bkd.requireTLS && !state.TLS.HandshakeComplete {
+		return nil, finalReply(errTLSRequired)
+	}
+
+	if bkd.auther != nil {
+		return nil, finalReply(errAuthRequired)
+	}
+
+	return bkd.newSession(state, ""), nil
+}
+
+func (bkd *Backend) newSession(state *smtp.ConnectionState, username string) *Session {
+	s := NewSession(state, bkd.track(bkd.handler), username)
+	s.limiter = bkd.limiter
+	s.listener = bkd.listener
+	s.rcptCheck = bkd.rcptCheck
+	s.dnsbl = bkd.dnsbl
+	s.client = bkd.client
+	s.limits = bkd.limits
+
+	return s
+}
+
+// InFlight returns how many messages are being handled right now
+func (bkd *Backend) InFlight() int64 {
+	return atomic.LoadInt64(&bkd.inflight)
+}
+
+// track counts the running handler invocations so the shutdown can wait for them
+func (bkd *Backend) track(handler HandlerFunc) HandlerFunc {
+	if handler == nil {
+		return nil
+	}
+
+	return func(c *Context) error {
+		atomic.AddInt64(&bkd.inflight, 1)
+		defer atomic.AddInt64(&bkd.inflight, -1)
+
+		return handler(c)
+	}
+}
+
+// sessionLimits caps what a single smtp session may do, 0 means unlimited
+type sessionLimits struct {
+	MaxRecipients int
+	MaxMessages   int
+
+	// HandlerTimeout bounds the handling of each message, the webhook requests included
+	HandlerTimeout time.Duration
+}
+
+// Session holds the state of a single smtp transaction
+type Session struct {
+	connState  *smtp.ConnectionState
+	From       *mail.Address
+	To         []*mail.Address
+	handler    HandlerFunc
+	raw        []byte
+	username   string
+	limiter    *rateLimiter
+	listener   string
+	rcptCheck  RcptFunc
+	dnsbl      *dnsblChecker
+	listings   []*EmailDNSBLResult
+	client     *clientChecker
+	fcrdns     string
+	heloValid  *bool
+	limits     sessionLimits
+	messages   int
+	receivedAt time.Time
+	deliveryID string
+	ctx        context.Context
+	phase      string
+}
+
+// NewSession initialize a new session
+func NewSession(state *smtp.ConnectionState, handler HandlerFunc, username string) *Session {
+	return &Session{
+		connState: state,
+		handler:   handler,
+		username:  username,
+	}
+}
+
+// Mail sets the envelope sender
+func (s *Session) Mail(from string, opts smtp.MailOptions) (err error) {
+	defer func() { err = finalReply(err) }()
+
+	if s.limits.MaxMessages > 0 && s.messages >= s.limits.MaxMessages {
+		slog.Warn("session closed, too many messages", "remote_ip", remoteIP(s.connState.RemoteAddr).String(), "messages", s.messages)
+		closeAfterReply(s.connState.RemoteAddr)
+		return errTooManyMessages
+	}
+
+	if !s.limiter.allow(remoteIP(s.connState.RemoteAddr).String(), time.Now()) {
+		slog.Info("message refused, rate limit exceeded", "remote_ip", remoteIP(s.connState.RemoteAddr).String())
+		return errRateLimited
+	}
+
+	// the null reverse-path of the bounces, "MAIL FROM:<>", has to be accepted
+	if from == "" {
+		s.From = &mail.Address{}
+	} else if s.From, err = mail.ParseAddress(from); err != nil {
+		return errBadSender
+	}
+
+	s.listings = s.dnsbl.check(remoteIP(s.connState.RemoteAddr))
+	if list := listedBy(s.listings); list != "" {
+		metricDNSBLListings.WithLabelValues(list).Inc()
+		if s.dnsbl.reject {
+			slog.Info("message refused, client listed by a dnsbl", "remote_ip", remoteIP(s.connState.RemoteAddr).String(), "dnsbl", list)
+			return rejectMessage(&Context{session: s}, "dnsbl", "", dnsblError(list))
+		}
+	}
+
+	s.fcrdns, s.heloValid, err = s.client.check(remoteIP(s.connState.RemoteAddr), s.connState.Hostname)
+	if err != nil {
+		reason := "fcrdns"
+		if err == errInvalidHelo {
+			reason = "helo"
+		}
+
+		slog.Info("message refused, client check failed", "remote_ip", remoteIP(s.connState.RemoteAddr).String(), "helo", s.connState.Hostname, "reason", reason)
+		return rejectMessage(&Context{session: s}, reason, "", err)
+	}
+
+	return nil
+}
+
+// Rcpt adds an envelope recipient
+func (s *Session) Rcpt(to string) (err error) {
+	defer func() { err = finalReply(err) }()
+
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return errBadRecipient
+	}
+
+	if s.limits.MaxRecipients > 0 && len(s.To) >= s.limits.MaxRecipients {
+		slog.Warn("recipient refused, too many recipients", "remote_ip", remoteIP(s.connState.RemoteAddr).String(), "recipient", addr.Address, "max_recipients", s.limits.MaxRecipients)
+		return errTooManyRecipients
+	}
+
+	if s.rcptCheck != nil {
+		if err := s.rcptCheck(s.From, addr); err != nil {
+			return err
+		}
+	}
+
+	s.To = append(s.To, addr)
+
+	return nil
+}
+
+// Data passes the message body to the handler
+func (s *Session) Data(r io.Reader) (err error) {
+	defer func() { err = finalReply(err) }()
+
+	if s.handler == nil {
+		return errInternal
+	}
+
+	s.deliveryID = newDeliveryID(time.Now())
+	s.messages++
+
+	// the raw bytes are kept untouched so they can be forwarded/verified as received
+	raw, err := ioutil.ReadAll(r)
+	if err == smtp.ErrDataTooLarge {
+		return rejectMessage(&Context{session: s}, "size", "", err)
+	} else if err != nil {
+		return err
+	}
+
+	s.raw = raw
+	s.receivedAt = time.Now()
+
+	// the webhook requests of the handler are canceled along with it on -handler-timeout
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if s.limits.HandlerTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.limits.HandlerTimeout)
+	}
+	defer cancel()
+	s.ctx, s.phase = ctx, ""
+
+	return s.handler(&Context{session: s})
+}
+
+// Reset discards the current transaction
+func (s *Session) Reset() {
+	s.From = nil
+	s.To = nil
+	s.raw = nil
+	s.receivedAt = time.Time{}
+	s.deliveryID = ""
+}
+
+// Logout frees the session
+func (s *Session) Logout() error {
+	return nil
+}
+
+// staticAuther returns an AuthFunc accepting exactly one username/password pair
+func staticAuther(username, password string) AuthFunc {
+	return func(u, p string) error {
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !userOK || !passOK {
+			return errInvalidCredentials
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,146 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// bodyTemplate renders the webhook bodies from the payload, nil when -webhook-body-template isn't set
+var bodyTemplate *template.Template
+
+// templateFuncs are the helpers available in the body templates, on top of the text/template ones (urlquery, printf...).
+// The ones named after the sprig helpers take their arguments in the same order, so a value can be piped as the last one
+var templateFuncs = template.FuncMap{
+	// base64 encodes a string
+	"base64": b64enc,
+	"b64enc": b64enc,
+
+	// b64dec decodes a base64 string, e.g the data of an inline attachment
+	"b64dec": func(s string) (string, error) {
+		data, err := base64.StdEncoding.DecodeString(s)
+		return string(data), err
+	},
+
+	// json marshals a value, a string becomes a quoted and escaped json string
+	"json":   toJSON,
+	"toJson": toJSON,
+
+	"toPrettyJson": func(v interface{}) (string, error) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		return string(data), err
+	},
+
+	// fromJson unmarshals a json document, e.g a json body part
+	"fromJson": func(s string) (interface{}, error) {
+		var v interface{}
+		err := json.Unmarshal([]byte(s), &v)
+		return v, err
+	},
+
+	"regexMatch": func(expr, s string) (bool, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(s), nil
+	},
+
+	// regexFind returns the first match of expr in s, empty when none
+	"regexFind": func(expr, s string) (string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return "", err
+		}
+		return re.FindString(s), nil
+	},
+
+	// regexFindAll returns up to n matches of expr in s, all of them when n is negative
+	"regexFindAll": func(expr, s string, n int) ([]string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return re.FindAllString(s, n), nil
+	},
+
+	// regexReplaceAll replaces the matches of expr in s, repl may refer to the groups with $1
+	"regexReplaceAll": func(expr, s, repl string) (string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(s, repl), nil
+	},
+
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"join":    func(sep string, elems []string) string { return strings.Join(elems, sep) },
+
+	// trunc keeps the first n characters of s
+	"trunc": func(n int, s string) string {
+		if runes := []rune(s); n >= 0 && len(runes) > n {
+			return string(runes[:n])
+		}
+		return s
+	},
+
+	// default returns def when the value is empty, e.g {{.Subject | default "(no subject)"}}
+	"default": func(def string, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+
+	// header returns the first value of the named header, the name is case insensitive
+	"header": func(headers map[string][]string, name string) string {
+		if values := headers[textproto.CanonicalMIMEHeaderKey(name)]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	},
+}
+
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// loadBodyTemplate parses the template file, a syntax error is reported at once
+func loadBodyTemplate(file string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the body template: %s", err.Error())
+	}
+
+	tmpl, err := template.New(file).Funcs(templateFuncs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the body template: %s", err.Error())
+	}
+
+	return tmpl, nil
+}
+
+// renderBody executes the body template with the payload, the error tells the line and column of the failed
+// action ("template: slack.tmpl:3:14: executing ...")
+func renderBody(tmpl *template.Template, msg *EmailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, msg); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
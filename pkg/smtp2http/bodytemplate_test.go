@@ -0,0 +1,201 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// golden compares got with testdata/name, rewritten with go test -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// testMessage is the payload the golden files are rendered from
+func testMessage() *EmailMessage {
+	msg := &EmailMessage{
+		ID:        "abc@example.com",
+		Subject:   "Invoice #42 & \"receipt\"",
+		Date:      "Wed, 01 May 2024 10:00:00 +0000",
+		SPFResult: "pass",
+		Attachments: []*EmailAttachment{
+			{Filename: "invoice 42.pdf", ContentType: "application/pdf"},
+		},
+	}
+	msg.Addresses.From = &EmailAddress{Name: "Alice", Address: "alice@example.com"}
+	msg.Addresses.To = []*EmailAddress{{Address: "bob@example.com"}, {Address: "billing+eu@example.com"}}
+	msg.Body.Text = "  Hello Bob,\n\nyour invoice is attached.\n"
+
+	return msg
+}
+
+func TestExampleTemplates(t *testing.T) {
+	for _, name := range []string{"slack.tmpl", "form.tmpl"} {
+		tmpl, err := loadBodyTemplate(filepath.Join("..", "..", "examples", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := renderBody(tmpl, testMessage())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if name == "slack.tmpl" && !json.Valid(got) {
+			t.Errorf("slack.tmpl rendered invalid json:\n%s", got)
+		}
+
+		golden(t, name+".golden", got)
+	}
+}
+
+func TestExampleTemplatesWithoutFrom(t *testing.T) {
+	tmpl, err := loadBodyTemplate(filepath.Join("..", "..", "examples", "slack.tmpl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testMessage()
+	msg.Addresses.From, msg.Subject, msg.Attachments = nil, "", nil
+	got, err := renderBody(tmpl, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden(t, "slack-minimal.tmpl.golden", got)
+}
+
+func TestBodyTemplateWebhook(t *testing.T) {
+	type received struct {
+		method, contentType string
+		form                url.Values
+	}
+	requests := make(chan received, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			t.Errorf("body %q: %v", body, err)
+		}
+		requests <- received{method: r.Method, contentType: r.Header.Get("Content-Type"), form: form}
+	}))
+	defer webhook.Close()
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.WebhookMethod = "put"
+	cfg.WebhookContentType = "application/x-www-form-urlencoded"
+	cfg.WebhookBodyTemplate = filepath.Join("testdata", "legacy-form.tmpl")
+	addr := newTestServer(t, cfg)
+
+	msg := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Invoice #42 & \"receipt\"\r\nX-Ticket-Id: T-7\r\nMessage-ID: <1@example.com>\r\n\r\nHello Bob\r\n"
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.method != http.MethodPut || r.contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("%s %s, want a PUT of a form", r.method, r.contentType)
+	}
+
+	meta, _ := base64.StdEncoding.DecodeString(r.form.Get("meta"))
+	body, _ := base64.StdEncoding.DecodeString(r.form.Get("body"))
+	for field, want := range map[string]string{
+		"sender":  "alice@example.com",
+		"subject": `Invoice #42 & "receipt"`,
+		"ticket":  "T-7",
+		"meta":    `"Invoice #42 \u0026 \"receipt\""`,
+		"body":    "Hello Bob",
+	} {
+		got := r.form.Get(field)
+		switch field {
+		case "meta":
+			got = string(meta)
+		case "body":
+			got = string(body)
+		}
+		if got != want {
+			t.Errorf("%s = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestBodyTemplateError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.tmpl")
+	if err := ioutil.WriteFile(path, []byte(`{"id": "{{.ID}}", "missing": "{{.Missing}}"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	webhook, requests := recordingServer(t)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.WebhookBodyTemplate = path
+	addr := newTestServer(t, cfg)
+
+	err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(testMail))
+	if replyCode(err) != 451 {
+		t.Errorf("SendMail: %v, want a 451", err)
+	}
+
+	select {
+	case r := <-requests:
+		t.Errorf("webhook called: %+v", r)
+	default:
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	msg := testMessage()
+	msg.Headers = map[string][]string{"X-Ticket-Id": {"T-7", "T-8"}}
+
+	for tmpl, want := range map[string]string{
+		`{{base64 "héllo"}}`:                               "aMOpbGxv",
+		`{{"aMOpbGxv" | b64dec}}`:                          "héllo",
+		`{{json .Subject}}`:                                `"Invoice #42 \u0026 \"receipt\""`,
+		`{{json .Addresses.From}}`:                         `{"name":"Alice","address":"alice@example.com","tag":""}`,
+		`{{header .Headers "x-ticket-id"}}`:                "T-7",
+		`{{header .Headers "X-Missing"}}`:                  "",
+		`{{"" | default "(no subject)"}}`:                  "(no subject)",
+		`{{.Subject | trunc 7}}`:                           "Invoice",
+		`{{regexFind "[0-9]+" .Subject}}`:                  "42",
+		`{{join ", " (regexFindAll "[a-z]+" "a1b2c" -1)}}`: "a, b, c",
+	} {
+		parsed, err := template.New("t").Funcs(templateFuncs).Parse(tmpl)
+		if err != nil {
+			t.Fatalf("%s: %v", tmpl, err)
+		}
+		got, err := renderBody(parsed, msg)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v, want %q", tmpl, got, err, want)
+		}
+	}
+}
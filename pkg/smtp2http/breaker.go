@@ -0,0 +1,143 @@
+package smtp2http
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// breakers are the circuit breakers of the webhooks configured via -breaker-threshold, nil when disabled
+var breakers *webhookBreakers
+
+// errCircuitOpen is the error of a webhook request not sent, its circuit being open
+var errCircuitOpen = errors.New("webhook circuit open")
+
+// the states of a circuit, exported as the value of smtp2http_webhook_circuit_state
+const (
+	circuitClosed   = "closed"
+	circuitHalfOpen = "half_open"
+	circuitOpen     = "open"
+)
+
+// webhookBreakers holds a circuit breaker per webhook url, so the targets of a fan-out trip independently
+type webhookBreakers struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newWebhookBreakers(threshold int, openDuration time.Duration) *webhookBreakers {
+	return &webhookBreakers{threshold: threshold, openDuration: openDuration, breakers: map[string]*circuitBreaker{}}
+}
+
+// get returns the circuit breaker of url, created closed the first time
+func (w *webhookBreakers) get(url string) *circuitBreaker {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	b, ok := w.breakers[url]
+	if !ok {
+		b = &circuitBreaker{url: url, threshold: w.threshold, openDuration: w.openDuration, state: circuitClosed}
+		w.breakers[url] = b
+		metricCircuitState.WithLabelValues(url).Set(0)
+	}
+
+	return b
+}
+
+// circuitBreaker stops the requests to a webhook once threshold attempts in a row failed. It stays open for
+// openDuration, then lets a single probe through: its success closes the circuit, its failure opens it again
+type circuitBreaker struct {
+	url          string
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a request can be sent, every allowed request must be followed by its record
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.openDuration {
+			return false
+		}
+		b.transition(circuitHalfOpen)
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		// the probe is still running
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+
+	return true
+}
+
+// record counts the outcome of a request, failed when the webhook was unreachable or answered a 5xx
+func (b *circuitBreaker) record(failed bool, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures, b.probing = 0, false
+		if b.state != circuitClosed {
+			b.transition(circuitClosed)
+		}
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == circuitHalfOpen:
+		b.probing = false
+		b.openedAt = now
+		b.transition(circuitOpen)
+	case b.state == circuitClosed && b.failures >= b.threshold:
+		b.openedAt = now
+		b.transition(circuitOpen)
+	}
+}
+
+// transition moves the circuit to state, b.mu held
+func (b *circuitBreaker) transition(state string) {
+	b.state = state
+	metricCircuitTransitions.WithLabelValues(b.url, state).Inc()
+
+	switch state {
+	case circuitOpen:
+		metricCircuitState.WithLabelValues(b.url).Set(2)
+		slog.Warn("webhook circuit opened", "webhook", b.url, "failures", b.failures, "breaker_open_duration", b.openDuration)
+	case circuitHalfOpen:
+		metricCircuitState.WithLabelValues(b.url).Set(1)
+		slog.Info("webhook circuit half-open, sending a probe", "webhook", b.url)
+	default:
+		metricCircuitState.WithLabelValues(b.url).Set(0)
+		slog.Info("webhook circuit closed", "webhook", b.url)
+	}
+}
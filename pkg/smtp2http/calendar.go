@@ -0,0 +1,214 @@
+package smtp2http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExtractCalendar parses the text/calendar (and application/ics) parts of the raw message, whether they are a body
+// alternative or an attachment. The events sent twice (an invite usually carries both) are only listed once.
+// It returns nil when the message has no event, the parts that can't be parsed are reported in the warnings
+func ExtractCalendar(raw []byte) (*EmailCalendar, []string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil
+	}
+
+	parts := []calendarPart{}
+	walkCalendars(textproto.MIMEHeader(msg.Header), msg.Body, &parts, 0)
+
+	calendar, warnings := &EmailCalendar{Events: []*EmailCalendarEvent{}}, []string{}
+	seen := map[string]bool{}
+	for _, part := range parts {
+		method, events, err := ParseCalendar(part.data)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("cannot parse the calendar %s: %s", part.name, err.Error()))
+			continue
+		}
+
+		if calendar.Method == "" {
+			calendar.Method = method
+		}
+		if calendar.Method == "" {
+			calendar.Method = strings.ToUpper(part.method)
+		}
+
+		for _, event := range events {
+			key := event.UID + "\x00" + event.RecurrenceID + "\x00" + event.Start
+			if event.UID != "" && seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			calendar.Events = append(calendar.Events, event)
+		}
+	}
+
+	if len(calendar.Events) == 0 {
+		return nil, warnings
+	}
+
+	return calendar, warnings
+}
+
+// calendarPart is the decoded data of a calendar part, name names it in the warnings
+type calendarPart struct {
+	name   string
+	method string
+	data   []byte
+}
+
+func walkCalendars(header textproto.MIMEHeader, body io.Reader, parts *[]calendarPart, depth int) {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+
+	if strings.HasPrefix(contentType, "multipart/") {
+		if depth >= maxPartDepth {
+			return
+		}
+
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+
+			walkCalendars(part.Header, part, parts, depth+1)
+		}
+	}
+
+	name := params["name"]
+	if _, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+		name = dparams["filename"]
+	}
+
+	if contentType != "text/calendar" && contentType != "application/ics" &&
+		!(contentType == "application/octet-stream" && strings.HasSuffix(strings.ToLower(name), ".ics")) {
+		return
+	}
+
+	data, err := ioutil.ReadAll(decodeTransferEncoding(body, header.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return
+	}
+
+	if name == "" {
+		name = contentType + " part"
+	}
+
+	*parts = append(*parts, calendarPart{name: DecodeHeader(name), method: params["method"], data: data})
+}
+
+// ParseCalendar parses iCalendar data, it returns the METHOD of the calendar (REQUEST, REPLY, CANCEL...) and its events
+func ParseCalendar(data []byte) (string, []*EmailCalendarEvent, error) {
+	root, err := parseICal(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	method, events := "", []*EmailCalendarEvent{}
+	for _, calendar := range root.children("VCALENDAR") {
+		if method == "" {
+			method = strings.ToUpper(calendar.value("METHOD"))
+		}
+
+		zones := newICalZones(calendar)
+		for _, vevent := range calendar.children("VEVENT") {
+			event, err := calendarEvent(vevent, zones)
+			if err != nil {
+				return "", nil, err
+			}
+			events = append(events, event)
+		}
+	}
+
+	return method, events, nil
+}
+
+// calendarEvent converts a VEVENT, the times are RFC3339 in the zone of their TZID and the dates of the
+// all-day events are YYYY-MM-DD
+func calendarEvent(vevent *icalComponent, zones icalZones) (*EmailCalendarEvent, error) {
+	event := &EmailCalendarEvent{
+		UID:            vevent.value("UID"),
+		Summary:        icalText(vevent.value("SUMMARY")),
+		Location:       icalText(vevent.value("LOCATION")),
+		Status:         strings.ToUpper(vevent.value("STATUS")),
+		RecurrenceRule: vevent.value("RRULE"),
+		Attendees:      []*EmailCalendarAttendee{},
+	}
+
+	if sequence, err := strconv.Atoi(vevent.value("SEQUENCE")); err == nil {
+		event.Sequence = sequence
+	}
+
+	if p := vevent.property("ORGANIZER"); p != nil {
+		event.Organizer = calendarAttendee(p)
+	}
+
+	for _, p := range vevent.Properties {
+		if p.Name == "ATTENDEE" {
+			event.Attendees = append(event.Attendees, calendarAttendee(p))
+		}
+	}
+
+	format := func(t time.Time, allDay bool) string {
+		if allDay {
+			return t.Format("2006-01-02")
+		}
+		return t.Format(time.RFC3339)
+	}
+
+	var start time.Time
+	if p := vevent.property("DTSTART"); p != nil {
+		t, allDay, err := zones.parseTime(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DTSTART %q", p.Value)
+		}
+		start, event.Start, event.AllDay, event.Timezone = t, format(t, allDay), allDay, p.Params["TZID"]
+	}
+
+	if p := vevent.property("DTEND"); p != nil {
+		t, allDay, err := zones.parseTime(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DTEND %q", p.Value)
+		}
+		event.End = format(t, allDay)
+	} else if d, ok := icalDuration(vevent.value("DURATION")); ok && event.Start != "" {
+		event.End = format(start.Add(d), event.AllDay)
+	}
+
+	if p := vevent.property("RECURRENCE-ID"); p != nil {
+		if t, allDay, err := zones.parseTime(p); err == nil {
+			event.RecurrenceID = format(t, allDay)
+		}
+	}
+
+	return event, nil
+}
+
+// calendarAttendee converts an ORGANIZER or ATTENDEE property, e.g "ATTENDEE;CN=Bob;PARTSTAT=ACCEPTED:mailto:bob@example.com"
+func calendarAttendee(p *icalProperty) *EmailCalendarAttendee {
+	address := strings.TrimSpace(p.Value)
+	if len(address) > len("mailto:") && strings.EqualFold(address[:len("mailto:")], "mailto:") {
+		address = address[len("mailto:"):]
+	}
+
+	return &EmailCalendarAttendee{
+		Address:  address,
+		Name:     p.Params["CN"],
+		PartStat: strings.ToUpper(p.Params["PARTSTAT"]),
+		Role:     strings.ToUpper(p.Params["ROLE"]),
+	}
+}
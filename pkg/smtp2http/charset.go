@@ -0,0 +1,280 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+)
+
+// maxPartDepth bounds the nesting of multiparts walked while looking for the bodies
+const maxPartDepth = 10
+
+// Bodies are the text and html bodies of a message, the EncodingApplied lists name the repairs of the
+// broken encodings: "quoted-printable" or "base64" when a body still was encoded, "sniffed:<charset>"
+// when the declared charset was missing or wrong
+type Bodies struct {
+	Text                string
+	HTML                string
+	TextEncodingApplied []string
+	HTMLEncodingApplied []string
+}
+
+// ExtractBodies walks the raw message and returns its text and html bodies converted to UTF-8,
+// any charset registered in x/net/html/charset is supported (aliases like latin1 or cp1251 included)
+func ExtractBodies(raw []byte) (text, html string, err error) {
+	bodies, err := ParseBodies(raw)
+	if err != nil {
+		return "", "", err
+	}
+
+	return bodies.Text, bodies.HTML, nil
+}
+
+// ParseBodies is ExtractBodies along with the repairs applied to the bodies
+func ParseBodies(raw []byte) (*Bodies, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	var w bodyWalker
+	if err := w.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+
+	return &Bodies{
+		Text:                w.text.String(),
+		HTML:                w.html.String(),
+		TextEncodingApplied: w.textApplied,
+		HTMLEncodingApplied: w.htmlApplied,
+	}, nil
+}
+
+// bodyWalker collects the text and html parts of a message
+type bodyWalker struct {
+	text, html               strings.Builder
+	textApplied, htmlApplied []string
+}
+
+func (w *bodyWalker) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		contentType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(contentType, "multipart/") {
+		if depth >= maxPartDepth {
+			return nil
+		}
+
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if err := w.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if isAttachmentPart(header) {
+		return nil
+	}
+
+	var target *strings.Builder
+	var applied *[]string
+	switch contentType {
+	case "text/plain":
+		target, applied = &w.text, &w.textApplied
+	case "text/html":
+		target, applied = &w.html, &w.htmlApplied
+	default:
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(decodeTransferEncoding(body, header.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return err
+	}
+
+	data, repairs := repairTransferEncoding(data)
+	decoded, sniffed := convertBodyCharset(data, params["charset"])
+	if sniffed != "" {
+		repairs = append(repairs, "sniffed:"+sniffed)
+	}
+
+	target.WriteString(strings.TrimSuffix(strings.TrimSuffix(decoded, "\n"), "\r"))
+	*applied = appendMissing(*applied, repairs...)
+
+	return nil
+}
+
+// RepairBody applies the repairs of ParseBodies to a body decoded by another parser, the bytes of the
+// strings being the ones of the part
+func RepairBody(body string) (string, []string) {
+	data, repairs := repairTransferEncoding([]byte(body))
+	if len(repairs) == 0 && utf8.ValidString(body) {
+		return body, nil
+	}
+
+	decoded, sniffed := convertBodyCharset(data, "")
+	if sniffed != "" {
+		repairs = append(repairs, "sniffed:"+sniffed)
+	}
+
+	return decoded, repairs
+}
+
+var (
+	// qpEscapePattern matches the escapes and the soft line breaks of a quoted-printable body
+	qpEscapePattern = regexp.MustCompile(`=(?:[0-9A-F]{2}|\r?\n)`)
+
+	// base64BodyPattern matches a body made of base64 lines
+	base64BodyPattern = regexp.MustCompile(`^(?:[A-Za-z0-9+/]{4})+(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=)?$`)
+)
+
+// minEncodedEscapes is how many quoted-printable escapes a decoded body needs to be taken as still encoded
+const minEncodedEscapes = 3
+
+// repairTransferEncoding undoes the transfer encoding of a body that still is quoted-printable or base64,
+// its Content-Transfer-Encoding being missing or wrong
+func repairTransferEncoding(data []byte) ([]byte, []string) {
+	if compact := bytes.Join(bytes.Fields(data), nil); len(compact) >= 24 && base64BodyPattern.Match(compact) {
+		if decoded, err := base64.StdEncoding.DecodeString(string(compact)); err == nil && looksLikeText(decoded) {
+			return decoded, []string{"base64"}
+		}
+	}
+
+	if len(qpEscapePattern.FindAllIndex(data, minEncodedEscapes)) == minEncodedEscapes {
+		if decoded, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(data))); err == nil {
+			return decoded, []string{"quoted-printable"}
+		}
+	}
+
+	return data, nil
+}
+
+// looksLikeText reports whether data has words and next to no control characters, whatever its charset
+func looksLikeText(data []byte) bool {
+	if !bytes.ContainsAny(data, " \n") {
+		return false
+	}
+
+	controls := 0
+	for _, b := range data {
+		if (b < 0x20 && b != '\t' && b != '\r' && b != '\n') || b == 0x7f {
+			controls++
+		}
+	}
+
+	return controls*20 <= len(data)
+}
+
+// appendMissing appends the values list doesn't have yet
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			found = found || l == v
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// isAttachmentPart reports whether the part is a file rather than a body
+func isAttachmentPart(header textproto.MIMEHeader) bool {
+	disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil {
+		return false
+	}
+
+	return disposition == "attachment" || params["filename"] != ""
+}
+
+// decodeTransferEncoding undoes the Content-Transfer-Encoding, multipart.Reader
+// already takes care of quoted-printable for the nested parts
+func decodeTransferEncoding(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+
+	return r
+}
+
+// decodeBodyCharset converts data to UTF-8, when the declared charset is unknown
+// or missing the encoding is sniffed, the raw bytes are kept as a last resort
+func decodeBodyCharset(data []byte, label string) string {
+	decoded, _ := convertBodyCharset(data, label)
+	return decoded
+}
+
+// convertBodyCharset is decodeBodyCharset, sniffed names the charset detected when the declared one
+// couldn't be used and the data isn't UTF-8
+func convertBodyCharset(data []byte, label string) (decoded, sniffed string) {
+	// a body declared as UTF-8 that isn't would only get replacement characters
+	if label != "" {
+		if enc, name := charset.Lookup(label); enc != nil && (name != "utf-8" || utf8.Valid(data)) {
+			if decoded, err := enc.NewDecoder().Bytes(data); err == nil {
+				return string(decoded), ""
+			}
+		}
+	}
+
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+
+	// the declared charset already failed, only the content (e.g a html meta) is looked at
+	if enc, name, _ := charset.DetermineEncoding(data, ""); enc != nil {
+		if decoded, err := enc.NewDecoder().Bytes(data); err == nil {
+			return string(decoded), name
+		}
+	}
+
+	return string(data), ""
+}
+
+// newlineStripper drops the line breaks base64.NewDecoder chokes on
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		read, err := n.r.Read(p)
+		kept := 0
+		for _, b := range p[:read] {
+			if b != '\r' && b != '\n' {
+				p[kept] = b
+				kept++
+			}
+		}
+
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package smtp2http
+
+import (
+	"encoding/base64"
+	"net/smtp"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// charsetFixtures are bodies in their charset, base64 so the file stays UTF-8
+var charsetFixtures = []struct {
+	label string
+	body  string
+	want  string
+}{
+	{"iso-8859-1", "R3L832U=", "Grüße"},
+	{"latin1", "R3L832U=", "Grüße"},
+	{"windows-1251", "z/Do4uXy", "Привет"},
+	{"cp1251", "z/Do4uXy", "Привет"},
+	{"koi8-r", "8NLJ18XU", "Привет"},
+	{"windows-1255", "+ezl7Q==", "שלום"},
+	{"gb2312", "1tDOxA==", "中文"},
+	{"shift_jis", "k/qWew==", "日本"},
+	{"big5", "pKSk5Q==", "中文"},
+	{"UTF-8", "R3LDvMOfZQ==", "Grüße"},
+}
+
+func TestConvertBodyCharset(t *testing.T) {
+	for _, f := range charsetFixtures {
+		data, err := base64.StdEncoding.DecodeString(f.body)
+		if err != nil {
+			t.Fatalf("%s: %v", f.label, err)
+		}
+
+		decoded, sniffed := convertBodyCharset(data, f.label)
+		if decoded != f.want {
+			t.Errorf("%s: decoded %q, want %q", f.label, decoded, f.want)
+		}
+		if sniffed != "" {
+			t.Errorf("%s: sniffed %q with a known charset", f.label, sniffed)
+		}
+	}
+}
+
+func TestParseBodiesCharset(t *testing.T) {
+	for _, f := range charsetFixtures {
+		raw := "From: alice@example.com\r\n" +
+			"Content-Type: text/plain; charset=\"" + f.label + "\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n\r\n" +
+			f.body + "\r\n"
+
+		bodies, err := ParseBodies([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: %v", f.label, err)
+		}
+		if bodies.Text != f.want {
+			t.Errorf("%s: text %q, want %q", f.label, bodies.Text, f.want)
+		}
+		if len(bodies.TextEncodingApplied) != 0 {
+			t.Errorf("%s: repairs %v, want none", f.label, bodies.TextEncodingApplied)
+		}
+	}
+}
+
+func TestConvertBodyCharsetSniffed(t *testing.T) {
+	// a windows-1255 html body declared with an unknown charset, its meta names the real one
+	html := append([]byte(`<html><head><meta charset="windows-1255"></head><body>`), 0xf9, 0xec, 0xe5, 0xed)
+	html = append(html, "</body></html>"...)
+
+	for _, label := range []string{"", "x-unknown"} {
+		decoded, sniffed := convertBodyCharset(html, label)
+		if want := `<html><head><meta charset="windows-1255"></head><body>שלום</body></html>`; decoded != want {
+			t.Errorf("%q: decoded %q, want %q", label, decoded, want)
+		}
+		if sniffed != "windows-1255" {
+			t.Errorf("%q: sniffed %q, want windows-1255", label, sniffed)
+		}
+	}
+}
+
+func TestConvertBodyCharsetFallback(t *testing.T) {
+	// UTF-8 without a charset is kept as is
+	if decoded, sniffed := convertBodyCharset([]byte("Grüße"), ""); decoded != "Grüße" || sniffed != "" {
+		t.Errorf("utf-8: decoded %q, sniffed %q, want the body as is", decoded, sniffed)
+	}
+
+	// a body declared as UTF-8 that isn't is sniffed rather than filled with replacement characters
+	decoded, sniffed := convertBodyCharset([]byte{'G', 'r', 0xfc, 0xdf, 'e'}, "utf-8")
+	if decoded != "Grüße" || sniffed != "windows-1252" {
+		t.Errorf("broken utf-8: decoded %q, sniffed %q, want Grüße from windows-1252", decoded, sniffed)
+	}
+}
+
+// brokenBodies are the messages of testdata/broken, real-world bodies whose encoding is missing or wrong
+var brokenBodies = []struct {
+	name        string
+	text        string
+	html        string
+	textApplied []string
+	htmlApplied []string
+}{
+	{
+		name:        "qp-undeclared.eml",
+		text:        "Grüße aus München,\r\nIhre Bestellung wurde versandt. Schönen Tag!",
+		textApplied: []string{"quoted-printable"},
+	},
+	{
+		name:        "qp-bogus-charset.eml",
+		text:        "Grüße aus München, das Café öffnet am Montag.",
+		textApplied: []string{"quoted-printable", "sniffed:windows-1252"},
+	},
+	{
+		name:        "base64-undeclared.eml",
+		text:        "Hello Bob,\nyour invoice is attached, thanks for your order.",
+		html:        "<p>Hello Bob</p>",
+		textApplied: []string{"base64"},
+	},
+	{
+		name:        "html-meta.eml",
+		text:        "Privet",
+		html:        `<html><head><meta http-equiv="Content-Type" content="text/html; charset=windows-1251"></head><body>Привет</body></html>`,
+		htmlApplied: []string{"sniffed:windows-1251"},
+	},
+	{
+		name: "qp-declared.eml",
+		text: "Grüße aus München, 1+1=2",
+	},
+}
+
+func TestParseBodiesBroken(t *testing.T) {
+	for _, f := range brokenBodies {
+		_, raw := readFixture(t, filepath.Join("broken", f.name))
+
+		bodies, err := ParseBodies(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		if bodies.Text != f.text || bodies.HTML != f.html {
+			t.Errorf("%s: text %q, html %q, want %q, %q", f.name, bodies.Text, bodies.HTML, f.text, f.html)
+		}
+		if !reflect.DeepEqual(bodies.TextEncodingApplied, f.textApplied) || !reflect.DeepEqual(bodies.HTMLEncodingApplied, f.htmlApplied) {
+			t.Errorf("%s: repairs %v, %v, want %v, %v", f.name, bodies.TextEncodingApplied, bodies.HTMLEncodingApplied, f.textApplied, f.htmlApplied)
+		}
+	}
+}
+
+func TestBrokenBodiesPayload(t *testing.T) {
+	webhook, payloads := payloadWebhook(t)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	addr := newTestServer(t, cfg)
+
+	for _, f := range brokenBodies {
+		_, raw := readFixture(t, filepath.Join("broken", f.name))
+		if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, raw); err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		p := <-payloads
+
+		// the server receives the lines without their CR
+		if want := strings.ReplaceAll(f.text, "\r\n", "\n"); p.Body.Text != want {
+			t.Errorf("%s: body.text %q, want %q", f.name, p.Body.Text, want)
+		}
+		if !reflect.DeepEqual(p.Body.TextEncodingApplied, f.textApplied) || !reflect.DeepEqual(p.Body.HTMLEncodingApplied, f.htmlApplied) {
+			t.Errorf("%s: text_encoding_applied %v, html_encoding_applied %v, want %v, %v", f.name, p.Body.TextEncodingApplied, p.Body.HTMLEncodingApplied, f.textApplied, f.htmlApplied)
+		}
+	}
+}
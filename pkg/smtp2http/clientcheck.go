@@ -0,0 +1,226 @@
+package smtp2http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// clientCheckOff disables a client check
+	clientCheckOff = "off"
+
+	// clientCheckMark adds the result of a client check to the payload
+	clientCheckMark = "mark"
+
+	// clientCheckReject refuses the clients failing a check, the result is added to the payload too
+	clientCheckReject = "reject"
+
+	// clientCheckCacheTTL is how long the results of the lookups are cached
+	clientCheckCacheTTL = 10 * time.Minute
+
+	// clientCheckCacheMaxEntries caps the cached results, the expired ones are evicted first
+	clientCheckCacheMaxEntries = 10000
+
+	// fcrdnsMaxNames caps the ptr names resolved back to the client ip
+	fcrdnsMaxNames = 5
+)
+
+// the results of the forward confirmed reverse dns check
+const (
+	fcrdnsPass      = "pass"
+	fcrdnsFail      = "fail"
+	fcrdnsTempError = "temperror"
+)
+
+// the results of the HELO hostname check, a temporary failure is fcrdnsTempError
+const (
+	heloResultValid   = "valid"
+	heloResultInvalid = "invalid"
+)
+
+var (
+	errFCrDNSFailed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 25},
+		Message:      "Reverse DNS validation failed for your ip",
+	}
+	errInvalidHelo = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Your HELO hostname doesn't resolve",
+	}
+)
+
+// clientCheckEntry is a cached lookup result
+type clientCheckEntry struct {
+	result  string
+	expires time.Time
+}
+
+// clientChecker checks the reverse dns of the client ips and the HELO hostnames
+type clientChecker struct {
+	fcrdns  string
+	helo    string
+	timeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]clientCheckEntry
+}
+
+// newClientChecker returns the checker of the -fcrdns-policy and -helo-policy policies, nil when both are off
+func newClientChecker(fcrdns, helo string, timeout time.Duration) (*clientChecker, error) {
+	for name, policy := range map[string]string{"fcrdns": fcrdns, "helo": helo} {
+		if policy != clientCheckOff && policy != clientCheckMark && policy != clientCheckReject {
+			return nil, fmt.Errorf("invalid %s policy %q, expected off, mark or reject", name, policy)
+		}
+	}
+
+	if fcrdns == clientCheckOff && helo == clientCheckOff {
+		return nil, nil
+	}
+
+	return &clientChecker{fcrdns: fcrdns, helo: helo, timeout: timeout, cache: map[string]clientCheckEntry{}}, nil
+}
+
+// check returns the fcrdns result and whether the HELO hostname is valid, empty/nil for a check that is off.
+// The private and loopback clients aren't checked. err is the reply when a rejecting check failed
+func (c *clientChecker) check(ip net.IP, helo string) (fcrdns string, heloValid *bool, err error) {
+	if c == nil || ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return "", nil, nil
+	}
+
+	if c.fcrdns != clientCheckOff {
+		fcrdns = c.cached("ptr:"+ip.String(), func(ctx context.Context) string {
+			return checkFCrDNS(ctx, ip)
+		})
+
+		if fcrdns == fcrdnsFail && c.fcrdns == clientCheckReject {
+			err = errFCrDNSFailed
+		}
+	}
+
+	if c.helo != clientCheckOff {
+		// a temporary dns failure gives the client the benefit of the doubt
+		valid := c.cached("helo:"+ip.String()+" "+strings.ToLower(helo), func(ctx context.Context) string {
+			return checkHelo(ctx, ip, helo)
+		}) != heloResultInvalid
+		heloValid = &valid
+
+		if !valid && c.helo == clientCheckReject && err == nil {
+			err = errInvalidHelo
+		}
+	}
+
+	return fcrdns, heloValid, err
+}
+
+// cached returns the cached result of key or runs lookup within the timeout, the temporary errors aren't cached
+func (c *clientChecker) cached(key string, lookup func(ctx context.Context) string) string {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.result
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	result := lookup(ctx)
+	if result == fcrdnsTempError {
+		return result
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.cache) >= clientCheckCacheMaxEntries {
+		for k, e := range c.cache {
+			if now.After(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+
+		if len(c.cache) >= clientCheckCacheMaxEntries {
+			c.cache = map[string]clientCheckEntry{}
+		}
+	}
+	c.cache[key] = clientCheckEntry{result: result, expires: now.Add(clientCheckCacheTTL)}
+
+	return result
+}
+
+// checkFCrDNS passes when one of the ptr names of ip resolves back to ip
+func checkFCrDNS(ctx context.Context, ip net.IP) string {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if isNotFound(err) {
+			return fcrdnsFail
+		}
+		return fcrdnsTempError
+	}
+
+	if len(names) > fcrdnsMaxNames {
+		names = names[:fcrdnsMaxNames]
+	}
+
+	temporary := false
+	for _, name := range names {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil && !isNotFound(err) {
+			temporary = true
+			continue
+		}
+
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return fcrdnsPass
+			}
+		}
+	}
+
+	if temporary {
+		return fcrdnsTempError
+	}
+
+	return fcrdnsFail
+}
+
+// checkHelo accepts a fully qualified hostname that resolves, or the address literal of the client ip
+func checkHelo(ctx context.Context, ip net.IP, helo string) string {
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		literal := strings.TrimPrefix(strings.Trim(helo, "[]"), "IPv6:")
+		if net.ParseIP(literal).Equal(ip) {
+			return heloResultValid
+		}
+		return heloResultInvalid
+	}
+
+	host := strings.TrimSuffix(helo, ".")
+	if !strings.Contains(host, ".") || net.ParseIP(host) != nil {
+		return heloResultInvalid
+	}
+
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		if isNotFound(err) {
+			return heloResultInvalid
+		}
+		return fcrdnsTempError
+	}
+
+	return heloResultValid
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,87 @@
+package smtp2http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+const (
+	// payloadFormatDefault posts the payload as is
+	payloadFormatDefault = "default"
+
+	// payloadFormatCloudEvents wraps the payload in a cloudevents 1.0 event
+	payloadFormatCloudEvents = "cloudevents"
+
+	// cloudEventsStructured sends the whole event as the json body
+	cloudEventsStructured = "structured"
+
+	// cloudEventsBinary sends the event attributes as ce-* headers and the payload as the body
+	cloudEventsBinary = "binary"
+
+	// cloudEventType is the type of the events
+	cloudEventType = "email.received"
+)
+
+// cloudEvent is a structured mode cloudevents 1.0 event
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// wrapCloudEvent turns the json payload of the request into a cloudevents event, its id is the
+// Message-ID (the generated one when the message has none) and its time the Date header (or when it was received)
+func wrapCloudEvent(req *webhookRequest, mode, messageID string, date time.Time) error {
+	event := &cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            cloudEventType,
+		Source:          "smtp2http/" + conf.ServerName,
+		ID:              messageID,
+		Time:            date.Format(time.RFC3339),
+		DataContentType: req.ContentType,
+		Data:            req.Body,
+	}
+
+	if mode == cloudEventsBinary {
+		headers := map[string]string{}
+		for name, value := range req.Headers {
+			headers[name] = value
+		}
+
+		headers["Ce-Specversion"] = event.SpecVersion
+		headers["Ce-Type"] = event.Type
+		headers["Ce-Source"] = event.Source
+		headers["Ce-Id"] = event.ID
+		headers["Ce-Time"] = event.Time
+		req.Headers = headers
+
+		return nil
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req.Body, req.ContentType = body, "application/cloudevents+json; charset=utf-8"
+
+	return nil
+}
+
+// newUUID returns a random (version 4) uuid
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	s := hex.EncodeToString(b)
+
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
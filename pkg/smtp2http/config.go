@@ -0,0 +1,238 @@
+package smtp2http
+
+import "time"
+
+// Config is the configuration of a Server, each field holds the value of the command line flag named in its
+// comment and the flag usage tells what it does
+type Config struct {
+	// Version is the version of the producer, sent in the X-Smtp2http-Version header and the payloads
+	Version string
+
+	ServerName                  string        // -name
+	ListenAddrs                 []string      // -listen
+	Webhooks                    []string      // -webhook
+	FanoutPolicy                string        // -fanout-policy
+	Routes                      []string      // -route
+	AliasFile                   string        // -alias-file
+	FilterFile                  string        // -filter-file
+	DiscardAutoReplies          bool          // -discard-auto-replies
+	DNSBL                       string        // -dnsbl
+	DNSBLAction                 string        // -dnsbl-action
+	DNSBLTimeout                time.Duration // -dnsbl-timeout
+	FCrDNSPolicy                string        // -fcrdns-policy
+	HeloPolicy                  string        // -helo-policy
+	RcptCheckURL                string        // -rcpt-check-url
+	RcptCheckMethod             string        // -rcpt-check-method
+	RcptCheckTimeout            time.Duration // -rcpt-check-timeout
+	RcptCheckTTL                time.Duration // -rcpt-check-ttl
+	RcptCheckFailOpen           bool          // -rcpt-check-fail-open
+	RejectWebhook               string        // -reject-webhook
+	WebhookSecret               string        // -webhook-secret
+	WebhookHeaders              []string      // -webhook-header
+	WebhookMethod               string        // -webhook-method
+	WebhookContentType          string        // -webhook-content-type
+	WebhookBodyTemplate         string        // -webhook-body-template
+	NotifyFormat                string        // -notify-format
+	NotifyBodyLength            int           // -notify-body-length
+	WebhookCompress             bool          // -webhook-compress
+	WebhookTimeout              time.Duration // -webhook-timeout
+	WebhookClientCert           string        // -webhook-client-cert
+	WebhookClientKey            string        // -webhook-client-key
+	WebhookCAFile               string        // -webhook-ca-file
+	WebhookInsecureSkipVerify   bool          // -webhook-insecure-skip-verify
+	WebhookAuth                 string        // -webhook-auth
+	AWSRegion                   string        // -aws-region
+	AWSService                  string        // -aws-service
+	OAuth2TokenURL              string        // -oauth2-token-url
+	OAuth2ClientID              string        // -oauth2-client-id
+	OAuth2ClientSecret          string        // -oauth2-client-secret
+	OAuth2Scopes                string        // -oauth2-scopes
+	WebhookProxy                string        // -webhook-proxy
+	WebhookConcurrency          int           // -webhook-concurrency
+	WebhookRetries              int           // -webhook-retries
+	BreakerThreshold            int           // -breaker-threshold
+	BreakerOpenDuration         time.Duration // -breaker-open-duration
+	WebhookRetryDelay           time.Duration // -webhook-retry-delay
+	DisableWebhook              bool          // -disable-webhook
+	DryRun                      bool          // -dry-run
+	DryRunDir                   string        // -dry-run-dir
+	FailDryRun                  bool          // -fail-dry-run
+	HandlerTimeout              time.Duration // -handler-timeout
+	PublishTimeout              time.Duration // -publish-timeout
+	KafkaBrokers                string        // -kafka-brokers
+	KafkaTopic                  string        // -kafka-topic
+	KafkaKey                    string        // -kafka-key
+	KafkaTLS                    bool          // -kafka-tls
+	KafkaTLSCA                  string        // -kafka-tls-ca
+	KafkaUsername               string        // -kafka-sasl-username
+	KafkaPassword               string        // -kafka-sasl-password
+	AMQPURL                     string        // -amqp-url
+	AMQPExchange                string        // -amqp-exchange
+	AMQPRoutingKey              string        // -amqp-routing-key
+	NATSURL                     string        // -nats-url
+	NATSSubject                 string        // -nats-subject
+	NATSRequireAck              bool          // -nats-require-ack
+	NATSCredentials             string        // -nats-credentials
+	NATSNKey                    string        // -nats-nkey
+	DBDSN                       string        // -db-dsn
+	DBMaxConns                  int           // -db-max-conns
+	SinkPolicy                  string        // -sink-policy
+	PubSubTopic                 string        // -pubsub-topic
+	SQSQueueURL                 string        // -sqs-queue-url
+	SNSTopicARN                 string        // -sns-topic-arn
+	Exec                        string        // -exec
+	ExecTimeout                 time.Duration // -exec-timeout
+	ElasticURL                  string        // -elastic-url
+	ElasticIndex                string        // -elastic-index
+	ElasticUsername             string        // -elastic-username
+	ElasticPassword             string        // -elastic-password
+	ElasticAPIKey               string        // -elastic-api-key
+	ElasticCAFile               string        // -elastic-ca-file
+	ElasticBatchSize            int           // -elastic-batch-size
+	ElasticFlushInterval        time.Duration // -elastic-flush-interval
+	Maildir                     string        // -maildir
+	MaildirOnFailureOnly        bool          // -maildir-on-failure-only
+	DedupeWindow                time.Duration // -dedupe-window
+	DedupeMaxEntries            int           // -dedupe-max-entries
+	SpoolDir                    string        // -spool-dir
+	SpoolMaxAge                 time.Duration // -spool-max-age
+	DeliveryMode                string        // -delivery-mode
+	Workers                     int           // -workers
+	QueueSize                   int           // -queue-size
+	QueuePath                   string        // -queue-path
+	QueueMaxEntries             int           // -queue-max-entries
+	QueueMaxAge                 time.Duration // -queue-max-age
+	DeadLetterDir               string        // -dead-letter-dir
+	DeadLetterMaxAge            time.Duration // -dead-letter-max-age
+	WebhookFormat               string        // -webhook-format
+	PayloadFormat               string        // -payload-format
+	CloudEventsMode             string        // -cloudevents-mode
+	Attachments                 string        // -attachments
+	AttachmentStoreDir          string        // -attachment-store-dir
+	AttachmentStoreRetention    time.Duration // -attachment-store-retention
+	MaxAttachmentSize           int64         // -max-attachment-size
+	MaxAttachments              int           // -max-attachments
+	AttachmentOverflow          string        // -attachment-overflow
+	KeepWinmailDat              bool          // -keep-winmail-dat
+	OnPartError                 string        // -on-part-error
+	AllowedAttachmentTypes      string        // -allowed-attachment-types
+	BlockedAttachmentExtensions string        // -blocked-attachment-extensions
+	AttachmentFilter            string        // -attachment-filter
+	PayloadVersion              int           // -payload-version
+	Payload                     string        // -payload
+	Fields                      string        // -fields
+	Headers                     string        // -headers
+	DeriveTextFromHTML          bool          // -derive-text-from-html
+	InlineCID                   bool          // -inline-cid
+	InlineCIDOmit               bool          // -inline-cid-omit
+	InlineCIDMaxSize            int64         // -inline-cid-max-size
+	IncludeRaw                  bool          // -include-raw
+	ParseNested                 bool          // -parse-nested
+	NestedDepth                 int           // -nested-depth
+	SMIMECABundle               string        // -smime-ca-bundle
+	PGPPrivateKey               string        // -pgp-private-key
+	PGPPassphrase               string        // -pgp-passphrase
+	PGPPassphraseFile           string        // -pgp-passphrase-file
+	SubaddressSeparator         string        // -subaddress-separator
+	SubaddressStripDots         bool          // -subaddress-strip-dots
+	StrictHeaders               bool          // -strict-headers
+	RawOnly                     bool          // -raw-only
+	MaxMessageSize              int64         // -msglimit
+	MaxMessageMemory            int64         // -max-memory-per-message
+	TmpDir                      string        // -tmp-dir
+	ReadTimeout                 time.Duration // -timeout.read
+	WriteTimeout                time.Duration // -timeout.write
+	MaxConnections              int           // -max-connections
+	MaxRecipients               int           // -max-recipients
+	MaxSessionMessages          int           // -max-messages-per-session
+	RateLimit                   int           // -rate-limit
+	ProxyProtocol               bool          // -proxy-protocol
+	AllowIPs                    string        // -allow-ips
+	DenyIPs                     string        // -deny-ips
+	SPFPolicy                   string        // -spf-policy
+	DKIMPolicy                  string        // -dkim-policy
+	DMARCPolicy                 string        // -dmarc-policy
+	DNSTimeout                  time.Duration // -dns-timeout
+	Domain                      string        // -domain
+	ShutdownTimeout             time.Duration // -shutdown-timeout
+	MetricsAddr                 string        // -metrics-addr
+	HealthAddr                  string        // -health-addr
+	ReadinessProbe              string        // -readiness-probe
+	TLSCert                     string        // -tls-cert
+	TLSKey                      string        // -tls-key
+	TLSMinVersion               string        // -tls-min-version
+	TLSCiphers                  string        // -tls-ciphers
+	ACMEDomains                 string        // -acme-domain
+	ACMECacheDir                string        // -acme-cache-dir
+	ACMEEmail                   string        // -acme-email
+	ACMEChallenge               string        // -acme-challenge
+	ACMEChallengeAddr           string        // -acme-challenge-addr
+	RequireTLS                  bool          // -require-tls
+	AuthUsername                string        // -auth-username
+	AuthPassword                string        // -auth-password
+	ReplyPrefix                 string        // -reply-prefix
+	ReplayFrom                  string        // -replay-from
+	ReplayTo                    []string      // -replay-to
+}
+
+// DefaultConfig returns the configuration of the flag defaults
+func DefaultConfig() Config {
+	return Config{
+		Version:              "dev",
+		ServerName:           "smtp2http",
+		FanoutPolicy:         "any",
+		DNSBLAction:          "reject",
+		DNSBLTimeout:         2 * time.Second,
+		FCrDNSPolicy:         "off",
+		HeloPolicy:           "off",
+		RcptCheckMethod:      "POST",
+		RcptCheckTimeout:     5 * time.Second,
+		RcptCheckTTL:         5 * time.Minute,
+		WebhookMethod:        "POST",
+		NotifyBodyLength:     500,
+		WebhookTimeout:       30 * time.Second,
+		AWSService:           "execute-api",
+		WebhookRetries:       2,
+		BreakerOpenDuration:  30 * time.Second,
+		WebhookRetryDelay:    500 * time.Millisecond,
+		PublishTimeout:       10 * time.Second,
+		KafkaKey:             "recipient",
+		DBMaxConns:           4,
+		SinkPolicy:           "all",
+		ExecTimeout:          30 * time.Second,
+		ElasticBatchSize:     100,
+		ElasticFlushInterval: time.Second,
+		DedupeMaxEntries:     100000,
+		SpoolMaxAge:          24 * time.Hour,
+		DeliveryMode:         "sync",
+		Workers:              16,
+		QueueSize:            1000,
+		QueueMaxEntries:      100000,
+		QueueMaxAge:          24 * time.Hour,
+		DeadLetterMaxAge:     7 * 24 * time.Hour,
+		WebhookFormat:        "json",
+		PayloadFormat:        "default",
+		CloudEventsMode:      "structured",
+		Attachments:          "inline",
+		AttachmentOverflow:   "drop",
+		OnPartError:          "reject",
+		AttachmentFilter:     "reject",
+		PayloadVersion:       1,
+		Payload:              "full",
+		Headers:              "all",
+		DeriveTextFromHTML:   true,
+		InlineCIDMaxSize:     10 << 20,
+		NestedDepth:          3,
+		SubaddressSeparator:  "+",
+		MaxMessageSize:       1024 * 1024 * 2,
+		ReadTimeout:          5 * time.Second,
+		WriteTimeout:         5 * time.Second,
+		SPFPolicy:            "mark",
+		DKIMPolicy:           "mark",
+		DMARCPolicy:          "observe",
+		DNSTimeout:           5 * time.Second,
+		ShutdownTimeout:      30 * time.Second,
+		TLSMinVersion:        "1.2",
+		ACMEChallenge:        "http-01",
+	}
+}
@@ -0,0 +1,217 @@
+package smtp2http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/alash3al/go-smtpsrv"
+	"github.com/emersion/go-smtp"
+	"gopkg.in/yaml.v3"
+)
+
+// the actions of a content rule, from the strongest to the weakest
+const (
+	ruleActionReject  = "reject"
+	ruleActionDiscard = "discard"
+	ruleActionTag     = "tag"
+)
+
+// errContentPolicy is the reply of the messages refused by a content rule, it doesn't name the rule
+var errContentPolicy = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message refused by the content policy",
+}
+
+// contentRules are the rules loaded from -filter-file, nil when disabled
+var contentRules *contentFilter
+
+// contentRule is a rule of the filter file
+type contentRule struct {
+	Name    string `yaml:"name"`
+	Target  string `yaml:"target"`
+	Pattern string `yaml:"pattern"`
+	Action  string `yaml:"action"`
+
+	re *regexp.Regexp
+}
+
+// contentFilter holds the rules of the filter file, they are replaced as a whole when it is reloaded
+type contentFilter struct {
+	file string
+
+	mu    sync.RWMutex
+	rules []*contentRule
+}
+
+// contentMatch is the outcome of the rules for a message, the strongest action and the names of the matched rules
+type contentMatch struct {
+	Action string
+	Rules  []string
+}
+
+// openContentFilter loads the rules of file
+func openContentFilter(file string) (*contentFilter, error) {
+	rules, err := loadContentRules(file)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("content rules loaded", "filter_file", file, "rules", len(rules))
+
+	return &contentFilter{file: file, rules: rules}, nil
+}
+
+// loadContentRules parses a yaml list of rules, every regex is compiled so a bad one is reported at once
+func loadContentRules(file string) ([]*contentRule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the filter file: %s", err.Error())
+	}
+
+	rules := []*contentRule{}
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("cannot parse the filter file %s: %s", file, err.Error())
+	}
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+
+		target := strings.ToLower(rule.Target)
+		switch {
+		case target == "subject", target == "text", target == "html", target == "from":
+		case strings.HasPrefix(target, "header:") && len(target) > len("header:"):
+		default:
+			return nil, fmt.Errorf("invalid target %q of the rule %s, expected subject, text, html, from or header:<name>", rule.Target, rule.Name)
+		}
+		rule.Target = target
+
+		switch rule.Action {
+		case ruleActionReject, ruleActionDiscard, ruleActionTag:
+		default:
+			return nil, fmt.Errorf("invalid action %q of the rule %s, expected reject, discard or tag", rule.Action, rule.Name)
+		}
+
+		if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern of the rule %s: %s", rule.Name, err.Error())
+		}
+	}
+
+	return rules, nil
+}
+
+// reloadOnSIGHUP reloads the rules each time the process receives a SIGHUP until done is closed,
+// the current rules are kept when the file is invalid
+func (f *contentFilter) reloadOnSIGHUP(done <-chan struct{}) {
+	hupc := make(chan os.Signal, 1)
+	signal.Notify(hupc, syscall.SIGHUP)
+	defer signal.Stop(hupc)
+
+	for {
+		select {
+		case <-hupc:
+		case <-done:
+			return
+		}
+
+		rules, err := loadContentRules(f.file)
+		if err != nil {
+			slog.Error("cannot reload the content rules, keeping the current ones", "filter_file", f.file, "error", err)
+			continue
+		}
+
+		f.mu.Lock()
+		f.rules = rules
+		f.mu.Unlock()
+
+		slog.Info("content rules reloaded", "filter_file", f.file, "rules", len(rules))
+	}
+}
+
+// match runs the rules against the message, msg is nil in raw only mode and the text and html rules are then skipped
+func (f *contentFilter) match(c *Context, header mail.Header, msg *smtpsrv.Email) *contentMatch {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.RLock()
+	rules := f.rules
+	f.mu.RUnlock()
+
+	ret := &contentMatch{}
+	for _, rule := range rules {
+		if !rule.matches(c, header, msg) {
+			continue
+		}
+
+		ret.Rules = append(ret.Rules, rule.Name)
+		if actionStrength(rule.Action) > actionStrength(ret.Action) {
+			ret.Action = rule.Action
+		}
+	}
+
+	if len(ret.Rules) == 0 {
+		return nil
+	}
+
+	return ret
+}
+
+func (r *contentRule) matches(c *Context, header mail.Header, msg *smtpsrv.Email) bool {
+	values := []string{}
+
+	switch r.Target {
+	case "subject":
+		if msg != nil {
+			values = append(values, msg.Subject)
+		} else {
+			values = append(values, header.Get("Subject"))
+		}
+	case "text":
+		if msg != nil {
+			values = append(values, msg.TextBody)
+		}
+	case "html":
+		if msg != nil {
+			values = append(values, msg.HTMLBody)
+		}
+	case "from":
+		// the envelope sender as well as the From header, a campaign forges either
+		values = append(values, c.From().Address)
+		values = append(values, header["From"]...)
+	default:
+		values = append(values, header[textproto.CanonicalMIMEHeaderKey(strings.TrimPrefix(r.Target, "header:"))]...)
+	}
+
+	for _, value := range values {
+		if r.re.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func actionStrength(action string) int {
+	switch action {
+	case ruleActionReject:
+		return 3
+	case ruleActionDiscard:
+		return 2
+	case ruleActionTag:
+		return 1
+	}
+
+	return 0
+}
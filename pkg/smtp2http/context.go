@@ -0,0 +1,157 @@
+package smtp2http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"time"
+
+	"github.com/alash3al/go-smtpsrv"
+	"github.com/zaccone/spf"
+)
+
+// Context exposes the current smtp transaction to the handler
+type Context struct {
+	session *Session
+}
+
+// From returns the envelope sender
+func (c Context) From() *mail.Address {
+	return c.session.From
+}
+
+// To returns the envelope recipients
+func (c Context) To() []*mail.Address {
+	return c.session.To
+}
+
+// User returns the authenticated username, empty when the session isn't authenticated
+func (c Context) User() string {
+	return c.session.username
+}
+
+// RemoteAddr returns the client address
+func (c Context) RemoteAddr() net.Addr {
+	return c.session.connState.RemoteAddr
+}
+
+// Listener returns the configured address of the listener that accepted the connection
+func (c Context) Listener() string {
+	return c.session.listener
+}
+
+// DNSBL returns the dns blocklist results of the client ip, nil when the lists weren't queried
+func (c Context) DNSBL() []*EmailDNSBLResult {
+	return c.session.listings
+}
+
+// FCrDNS returns the forward confirmed reverse dns result of the client ip, empty when it wasn't checked
+func (c Context) FCrDNS() string {
+	return c.session.fcrdns
+}
+
+// HeloValid returns whether the HELO hostname resolves, nil when it wasn't checked
+func (c Context) HeloValid() *bool {
+	return c.session.heloValid
+}
+
+// Helo returns the hostname presented by the client in HELO/EHLO
+func (c Context) Helo() string {
+	return c.session.connState.Hostname
+}
+
+// TLS returns the tls state of the connection
+func (c Context) TLS() *tls.ConnectionState {
+	return &c.session.connState.TLS
+}
+
+// Raw returns the message exactly as it was received
+func (c Context) Raw() []byte {
+	return c.session.raw
+}
+
+// ReceivedAt returns when the DATA command completed
+func (c Context) ReceivedAt() time.Time {
+	return c.session.receivedAt
+}
+
+// Context returns the context of the handling of the message, canceled once -handler-timeout expired
+func (c Context) Context() context.Context {
+	if c.session.ctx == nil {
+		return context.Background()
+	}
+
+	return c.session.ctx
+}
+
+// SetPhase records what the handler is busy with, the phase reported when -handler-timeout expires
+func (c Context) SetPhase(phase string) {
+	c.session.phase = phase
+}
+
+// Phase returns the last phase set by the handler
+func (c Context) Phase() string {
+	return c.session.phase
+}
+
+// DeliveryID returns the id generated for the message, it correlates the logs and the webhook requests
+func (c Context) DeliveryID() string {
+	return c.session.deliveryID
+}
+
+// Size returns the size of the raw message
+func (c Context) Size() int {
+	return len(c.session.raw)
+}
+
+// Parse parses the message body, the files go-smtpsrv can't read are rewritten first (see salvageEmail):
+// reading one that is cut short or badly encoded returns its error
+func (c Context) Parse() (*smtpsrv.Email, error) {
+	msg, err := smtpsrv.ParseEmail(bytes.NewReader(c.session.raw))
+	if err != nil || lostFiles(msg) {
+		if salvaged, ok := salvageEmail(c.session.raw); ok {
+			return salvaged, nil
+		}
+	}
+
+	return msg, err
+}
+
+// Header parses the header section of the raw message, encoded-words are left untouched
+func (c Context) Header() (mail.Header, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(c.session.raw))
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Header, nil
+}
+
+// checkSPF evaluates the spf record of a domain, replaced by the tests to stay off the dns
+var checkSPF = spf.CheckHost
+
+// SPF checks the envelope sender against the client ip
+func (c Context) SPF() (smtpsrv.SPFResult, string, error) {
+	_, host, err := smtpsrv.SplitAddress(c.From().Address)
+	if err != nil {
+		return spf.None, "", err
+	}
+
+	return checkSPF(remoteIP(c.RemoteAddr()), asciiDomain(host), c.From().Address)
+}
+
+// remoteIP extracts the ip from a net.Addr
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return net.ParseIP(addr.String())
+	}
+
+	return net.ParseIP(host)
+}
@@ -0,0 +1,302 @@
+package smtp2http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// deadLetterPruneInterval is how often the dead letters older than -dead-letter-max-age are removed
+const deadLetterPruneInterval = time.Hour
+
+// the reasons of a dead letter, the reason label of smtp2http_dead_letters_total
+const (
+	// deadLetterFailed is a delivery of the in-memory queue that failed, nothing retries it, or a spooled file that can't be read
+	deadLetterFailed = "failed"
+
+	// deadLetterRefused is a delivery the webhook refused with a 4xx
+	deadLetterRefused = "refused"
+
+	// deadLetterExpired is a delivery of -queue-path still failing after -queue-max-age
+	deadLetterExpired = "expired"
+)
+
+// deadLetters keeps the deliveries given up on, in -dead-letter-dir or in the bucket of -queue-path, nil when disabled
+var deadLetters deadLetterStore
+
+// deliveryAttempt is an attempt of a queued delivery, as the dead letters record it
+type deliveryAttempt struct {
+	Time          time.Time `json:"time"`
+	WebhookStatus int       `json:"webhook_status,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// newDeliveryAttempt returns the attempt d made at t
+func newDeliveryAttempt(d *delivery, t time.Time) deliveryAttempt {
+	a := deliveryAttempt{Time: t, WebhookStatus: d.status}
+	if d.err != nil {
+		a.Error = d.err.Error()
+	}
+
+	return a
+}
+
+// deadLetter is a delivery given up on, with the history of its attempts
+type deadLetter struct {
+	ID       string      `json:"id"`
+	Reason   string      `json:"reason"`
+	Dead     time.Time   `json:"dead"`
+	Delivery *queueEntry `json:"delivery"`
+}
+
+// deadLetterStore persists the dead letters until they are replayed or pruned
+type deadLetterStore interface {
+	// put stores the letter and sets its id
+	put(l *deadLetter) error
+
+	// list returns the letters in the order they died, without their body and raw message
+	list() ([]*deadLetter, error)
+
+	get(id string) (*deadLetter, error)
+	remove(id string) error
+}
+
+// buryEntry moves the delivery of entry to the dead letters and counts it, it returns the id of the letter,
+// empty when the dead letters are disabled or it couldn't be stored
+func buryEntry(logger *slog.Logger, entry *queueEntry, reason string) string {
+	if deadLetters == nil {
+		return ""
+	}
+
+	l := &deadLetter{Reason: reason, Dead: time.Now(), Delivery: entry}
+	if err := deadLetters.put(l); err != nil {
+		logger.Error("cannot store the dead letter, the delivery is lost", "error", err)
+		return ""
+	}
+
+	metricDeadLetters.WithLabelValues(reason).Inc()
+	logger.Warn("delivery moved to the dead letters", "dead_letter", l.ID, "reason", reason, "attempts", len(entry.History))
+
+	return l.ID
+}
+
+// newDeadLetterID returns a unique id sorting in the order the letters died
+func newDeadLetterID(t time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return strconv.FormatInt(t.UnixNano(), 10) + "-" + hex.EncodeToString(suffix)
+}
+
+// pruneDeadLetters removes every interval the letters dead for longer than maxAge, until the process exits
+func pruneDeadLetters(store deadLetterStore, maxAge, interval time.Duration) {
+	for {
+		letters, err := store.list()
+		if err != nil {
+			slog.Error("cannot list the dead letters", "error", err)
+		}
+
+		for _, l := range letters {
+			if time.Since(l.Dead) <= maxAge {
+				continue
+			}
+			if err := store.remove(l.ID); err != nil {
+				slog.Error("cannot remove the expired dead letter", "dead_letter", l.ID, "error", err)
+				continue
+			}
+			slog.Info("expired dead letter removed", "dead_letter", l.ID, "dead", l.Dead.Format(time.RFC3339))
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// deadLetterDir stores a letter as three files: <id>.body holds the payload, <id>.eml the original message when
+// kept and <id>.json the metadata sidecar, written last so a letter is only listed once complete
+type deadLetterDir struct {
+	dir string
+}
+
+func openDeadLetterDir(dir string) (*deadLetterDir, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &deadLetterDir{dir: dir}, nil
+}
+
+func (s *deadLetterDir) put(l *deadLetter) error {
+	l.ID = newDeadLetterID(l.Dead)
+	base := filepath.Join(s.dir, l.ID)
+
+	if err := ioutil.WriteFile(base+".body", l.Delivery.Body, 0600); err != nil {
+		return err
+	}
+	if l.Delivery.Raw != nil {
+		if err := ioutil.WriteFile(base+".eml", l.Delivery.Raw, 0600); err != nil {
+			return err
+		}
+	}
+
+	meta := *l.Delivery
+	meta.Body, meta.Raw = nil, nil
+	data, err := json.MarshalIndent(&deadLetter{ID: l.ID, Reason: l.Reason, Dead: l.Dead, Delivery: &meta}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(base+".json.tmp", data, 0600); err != nil {
+		os.Remove(base + ".json.tmp")
+		return err
+	}
+
+	return os.Rename(base+".json.tmp", base+".json")
+}
+
+func (s *deadLetterDir) list() ([]*deadLetter, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	letters := []*deadLetter{}
+	for _, name := range names {
+		l, err := s.meta(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			slog.Error("cannot read the dead letter", "file", name, "error", err)
+			continue
+		}
+		letters = append(letters, l)
+	}
+
+	return letters, nil
+}
+
+// meta reads the sidecar of the letter
+func (s *deadLetterDir) meta(id string) (*deadLetter, error) {
+	if strings.ContainsAny(id, `/\`) {
+		return nil, errors.New("invalid dead letter id")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &deadLetter{}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, err
+	}
+	if l.Delivery == nil {
+		return nil, errors.New("no delivery in the dead letter")
+	}
+
+	return l, nil
+}
+
+func (s *deadLetterDir) get(id string) (*deadLetter, error) {
+	l, err := s.meta(id)
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.Join(s.dir, id)
+	if l.Delivery.Body, err = ioutil.ReadFile(base + ".body"); err != nil {
+		return nil, err
+	}
+	if l.Delivery.Raw, err = ioutil.ReadFile(base + ".eml"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (s *deadLetterDir) remove(id string) error {
+	if strings.ContainsAny(id, `/\`) {
+		return errors.New("invalid dead letter id")
+	}
+	base := filepath.Join(s.dir, id)
+
+	// the sidecar first, a letter half removed is no longer listed
+	if err := os.Remove(base + ".json"); err != nil {
+		return err
+	}
+	os.Remove(base + ".body")
+	os.Remove(base + ".eml")
+
+	return nil
+}
+
+// deadLetterBucket stores the letters in the dead bucket of the -queue-path file, keyed by id
+type deadLetterBucket struct {
+	db *bolt.DB
+}
+
+func (s *deadLetterBucket) put(l *deadLetter) error {
+	l.ID = newDeadLetterID(l.Dead)
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueDeadBucket).Put([]byte(l.ID), data)
+	})
+}
+
+func (s *deadLetterBucket) list() ([]*deadLetter, error) {
+	letters := []*deadLetter{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueDeadBucket).ForEach(func(k, v []byte) error {
+			l := &deadLetter{}
+			if err := json.Unmarshal(v, l); err != nil || l.Delivery == nil {
+				slog.Error("cannot read the dead letter", "dead_letter", string(k), "error", err)
+				return nil
+			}
+			l.Delivery.Body, l.Delivery.Raw = nil, nil
+			letters = append(letters, l)
+			return nil
+		})
+	})
+
+	return letters, err
+}
+
+func (s *deadLetterBucket) get(id string) (*deadLetter, error) {
+	l := &deadLetter{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(queueDeadBucket).Get([]byte(id))
+		if data == nil {
+			return os.ErrNotExist
+		}
+		return json.Unmarshal(data, l)
+	})
+	if err == nil && l.Delivery == nil {
+		err = errors.New("no delivery in the dead letter")
+	}
+
+	return l, err
+}
+
+func (s *deadLetterBucket) remove(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queueDeadBucket)
+		if b.Get([]byte(id)) == nil {
+			return os.ErrNotExist
+		}
+		return b.Delete([]byte(id))
+	})
+}
@@ -0,0 +1,123 @@
+package smtp2http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// deadLetterCommand is the subcommand listing and replaying the dead letters, see runDeadLetterCommand
+const deadLetterCommand = "deadletter"
+
+const deadLetterUsage = "usage: smtp2http deadletter ls|replay ID...|all [-dead-letter-dir DIR | -queue-path FILE]"
+
+// runDeadLetterCommand lists the dead letters (ls) or delivers them again to their target (replay), a letter
+// is removed once delivered. It returns the exit code: 0 on success, 1 when a letter failed again or isn't
+// found, 2 on a usage or a store error
+func runDeadLetterCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, deadLetterUsage)
+		return 2
+	}
+
+	store := deadLetters
+	if store == nil {
+		if conf.QueuePath == "" {
+			fmt.Fprintln(os.Stderr, "the dead letters require -dead-letter-dir or -queue-path")
+			return 2
+		}
+
+		db, err := openQueueFile(conf.QueuePath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer db.Close()
+		store = &deadLetterBucket{db: db}
+	}
+
+	switch {
+	case args[0] == "ls" && len(args) == 1:
+		if err := listDeadLetters(store); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return 0
+	case args[0] == "replay" && len(args) > 1:
+		return replayDeadLetters(store, args[1:])
+	}
+
+	fmt.Fprintln(os.Stderr, deadLetterUsage)
+	return 2
+}
+
+func listDeadLetters(store deadLetterStore) error {
+	letters, err := store.list()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDEAD\tREASON\tATTEMPTS\tTARGET\tDELIVERY ID\tLAST ERROR")
+	for _, l := range letters {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", l.ID, l.Dead.Format(time.RFC3339), l.Reason, len(l.Delivery.History),
+			l.Delivery.target(), l.Delivery.Headers[deliveryIDHeader], l.Delivery.LastError)
+	}
+
+	return w.Flush()
+}
+
+// replayDeadLetters delivers the letters of ids, or every one for "all", with the retries of the webhook
+func replayDeadLetters(store deadLetterStore, ids []string) int {
+	if len(ids) == 1 && ids[0] == "all" {
+		letters, err := store.list()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		ids = []string{}
+		for _, l := range letters {
+			ids = append(ids, l.ID)
+		}
+	}
+
+	code := 0
+	for _, id := range ids {
+		if err := replayDeadLetter(store, id); err != nil {
+			fmt.Printf("%s: %s\n", id, err.Error())
+			code = 1
+			continue
+		}
+
+		fmt.Printf("%s: delivered\n", id)
+	}
+
+	return code
+}
+
+func replayDeadLetter(store deadLetterStore, id string) error {
+	l, err := store.get(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("no such dead letter")
+	}
+	if err != nil {
+		return err
+	}
+
+	d, err := l.Delivery.delivery(0)
+	if err != nil {
+		return err
+	}
+
+	logger := slog.With("dead_letter", id, "delivery_id", l.Delivery.Headers[deliveryIDHeader])
+	if _, err := deliverAll(context.Background(), logger, []*delivery{d}, l.Delivery.Raw, time.Now()); err != nil {
+		return err
+	}
+
+	return store.remove(id)
+}
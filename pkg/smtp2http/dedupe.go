@@ -0,0 +1,105 @@
+package smtp2http
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupe is the cache of the recently delivered messages configured via -dedupe-window, nil when disabled
+var dedupe *dedupeCache
+
+// dedupeEntry is a delivered message
+type dedupeEntry struct {
+	key  string
+	seen time.Time
+}
+
+// dedupeCache remembers the messages delivered within the window, the least recently delivered
+// ones are evicted first once it holds maxEntries
+type dedupeCache struct {
+	window     time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newDedupeCache(window time.Duration, maxEntries int) *dedupeCache {
+	return &dedupeCache{window: window, maxEntries: maxEntries, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// dedupeKey identifies a message for its recipients: its Message-ID, or the hash of the raw message without one.
+// The recipients are part of it so the copies an MTA splits per recipient aren't duplicates of each other
+func dedupeKey(messageID string, raw []byte, recipients []*mail.Address) string {
+	if messageID == "" {
+		sum := sha256.Sum256(raw)
+		messageID = "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	rcpts := extractEmails(recipients)
+	for i := range rcpts {
+		rcpts[i] = strings.ToLower(rcpts[i])
+	}
+	sort.Strings(rcpts)
+
+	return messageID + "\n" + strings.Join(rcpts, ",")
+}
+
+// seen reports whether the message was delivered within the window
+func (d *dedupeCache) seen(key string, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	el, ok := d.entries[key]
+	if !ok {
+		return false
+	}
+
+	if now.Sub(el.Value.(*dedupeEntry).seen) > d.window {
+		d.order.Remove(el)
+		delete(d.entries, key)
+		return false
+	}
+
+	return true
+}
+
+// add remembers a delivered message
+func (d *dedupeCache) add(key string, now time.Time) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[key]; ok {
+		el.Value.(*dedupeEntry).seen = now
+		d.order.MoveToFront(el)
+		return
+	}
+
+	d.entries[key] = d.order.PushFront(&dedupeEntry{key: key, seen: now})
+
+	// the oldest entries go first, whether they expired or the cache is full
+	for el := d.order.Back(); el != nil; el = d.order.Back() {
+		entry := el.Value.(*dedupeEntry)
+		if d.order.Len() <= d.maxEntries && now.Sub(entry.seen) <= d.window {
+			break
+		}
+
+		d.order.Remove(el)
+		delete(d.entries, entry.key)
+	}
+}
@@ -0,0 +1,34 @@
+package smtp2http
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+)
+
+// deliveryIDHeader is the request header carrying the delivery id of the message
+const deliveryIDHeader = "X-Delivery-Id"
+
+// newDeliveryID returns a uuid v7, the ids of the messages sort by their reception time
+func newDeliveryID(t time.Time) string {
+	b := make([]byte, 16)
+	rand.Read(b[6:])
+
+	// the 48 bits unix timestamp in milliseconds, big endian
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixMilli()))
+	copy(b[0:6], ms[2:8])
+
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+
+	s := hex.EncodeToString(b)
+
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// generatedMessageID is the Message-ID given to a message without one, the delivery id at the server name
+func generatedMessageID(c *Context) string {
+	return c.DeliveryID() + "@" + conf.ServerName
+}
@@ -0,0 +1,142 @@
+package smtp2http
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+)
+
+// dkimPolicy is the action taken on the dkim results, configured via -dkim-policy
+type dkimPolicy string
+
+const (
+	// dkimPolicyNone skips the dkim verification
+	dkimPolicyNone dkimPolicy = "none"
+
+	// dkimPolicyMark forwards the dkim results in the payload
+	dkimPolicyMark dkimPolicy = "mark"
+
+	// dkimPolicyReject refuses the messages without a valid signature
+	dkimPolicyReject dkimPolicy = "reject"
+)
+
+var errNoValidDKIM = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 20},
+	Message:      "No passing DKIM signature found",
+}
+
+// parseDKIMPolicy validates the -dkim-policy value
+func parseDKIMPolicy(s string) (dkimPolicy, error) {
+	switch p := dkimPolicy(s); p {
+	case dkimPolicyNone, dkimPolicyMark, dkimPolicyReject:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("invalid dkim policy %q, expected none, mark or reject", s)
+}
+
+// rejects reports whether a message with the given dkim results must be refused,
+// like with spf a temperror alone never refuses a message
+func (p dkimPolicy) rejects(results []*EmailDKIMResult) bool {
+	if p != dkimPolicyReject {
+		return false
+	}
+
+	for _, r := range results {
+		if r.Result == "pass" || r.Result == "temperror" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifyDKIM verifies every DKIM-Signature of the raw message, the results are in header order.
+// Each key lookup is bounded by timeout so a slow resolver can't stall the smtp session
+func verifyDKIM(raw []byte, timeout time.Duration) ([]*EmailDKIMResult, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := msg.Header["Dkim-Signature"]
+	if len(signatures) == 0 {
+		return []*EmailDKIMResult{}, nil
+	}
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT: lookupTXT(timeout),
+	})
+	if err != nil && len(verifications) == 0 {
+		return nil, err
+	}
+
+	ret := []*EmailDKIMResult{}
+	for i, v := range verifications {
+		result := &EmailDKIMResult{Domain: v.Domain, Result: dkimResult(v.Err)}
+		if i < len(signatures) {
+			tags := dkimTags(signatures[i])
+			result.Selector = tags["s"]
+			if result.Domain == "" {
+				result.Domain = tags["d"]
+			}
+		}
+
+		if v.Err != nil {
+			result.Error = v.Err.Error()
+		}
+
+		ret = append(ret, result)
+	}
+
+	return ret, nil
+}
+
+// dkimResult maps a verification error to its rfc8601 result
+func dkimResult(err error) string {
+	switch {
+	case err == nil:
+		return "pass"
+	case dkim.IsTempFail(err):
+		return "temperror"
+	case dkim.IsPermFail(err):
+		// the signature couldn't be processed at all
+		return "neutral"
+	}
+
+	return "fail"
+}
+
+// dkimTags parses the "tag=value" list of a DKIM-Signature header
+func dkimTags(value string) map[string]string {
+	ret := map[string]string{}
+
+	for _, tag := range strings.Split(value, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		ret[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+	}
+
+	return ret
+}
+
+// lookupTXT returns a TXT lookup bounded by timeout
+func lookupTXT(timeout time.Duration) func(string) ([]string, error) {
+	return func(domain string) ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		return net.DefaultResolver.LookupTXT(ctx, domain)
+	}
+}
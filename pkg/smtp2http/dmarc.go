@@ -0,0 +1,171 @@
+package smtp2http
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/net/publicsuffix"
+)
+
+// dmarcCacheTTL is how long a dmarc record (or its absence) is cached, the resolver
+// of the standard library doesn't expose the record ttl so a fixed one is used
+const dmarcCacheTTL = time.Hour
+
+// dmarcMode is the action taken on the dmarc verdict, configured via -dmarc-policy
+type dmarcMode string
+
+const (
+	// dmarcModeObserve only forwards the verdict in the payload
+	dmarcModeObserve dmarcMode = "observe"
+
+	// dmarcModeEnforce also refuses the messages whose disposition is reject
+	dmarcModeEnforce dmarcMode = "enforce"
+)
+
+// parseDMARCMode validates the -dmarc-policy value
+func parseDMARCMode(s string) (dmarcMode, error) {
+	switch m := dmarcMode(s); m {
+	case dmarcModeObserve, dmarcModeEnforce:
+		return m, nil
+	}
+
+	return "", fmt.Errorf("invalid dmarc policy %q, expected observe or enforce", s)
+}
+
+// dmarcError is the reply sent when the dmarc policy of the domain refuses a message
+func dmarcError(domain string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message rejected per the DMARC policy of " + domain,
+	}
+}
+
+// dmarcCacheEntry is a cached lookup, record is nil when the domain has no policy
+type dmarcCacheEntry struct {
+	record  *dmarc.Record
+	err     error
+	expires time.Time
+}
+
+// dmarcCache caches the dmarc records by domain
+var dmarcCache = struct {
+	sync.Mutex
+	entries map[string]*dmarcCacheEntry
+}{entries: map[string]*dmarcCacheEntry{}}
+
+// lookupDMARC returns the dmarc record of domain, temporary failures aren't cached
+func lookupDMARC(domain string, timeout time.Duration) (*dmarc.Record, error) {
+	dmarcCache.Lock()
+	entry := dmarcCache.entries[domain]
+	if entry != nil && time.Now().After(entry.expires) {
+		delete(dmarcCache.entries, domain)
+		entry = nil
+	}
+	dmarcCache.Unlock()
+
+	if entry != nil {
+		return entry.record, entry.err
+	}
+
+	record, err := dmarc.LookupWithOptions(domain, &dmarc.LookupOptions{LookupTXT: lookupTXT(timeout)})
+	if err != nil && dmarc.IsTempFail(err) {
+		return nil, err
+	}
+
+	dmarcCache.Lock()
+	dmarcCache.entries[domain] = &dmarcCacheEntry{record: record, err: err, expires: time.Now().Add(dmarcCacheTTL)}
+	dmarcCache.Unlock()
+
+	return record, err
+}
+
+// evaluateDMARC computes the dmarc verdict of a message whose From header is in fromDomain
+// from its spf result (checked against spfDomain) and dkim results
+func evaluateDMARC(fromDomain, spfResult, spfDomain string, dkimResults []*EmailDKIMResult, timeout time.Duration) *EmailDMARCResult {
+	ret := &EmailDMARCResult{Domain: fromDomain, Result: "none", Disposition: string(dmarc.PolicyNone)}
+
+	// the organizational domain record applies when the exact domain has none
+	orgDomain := organizationalDomain(fromDomain)
+	record, err := lookupDMARC(fromDomain, timeout)
+	subdomain := false
+	if errors.Is(err, dmarc.ErrNoPolicy) && orgDomain != fromDomain {
+		record, err = lookupDMARC(orgDomain, timeout)
+		subdomain = true
+	}
+
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		return ret
+	case err != nil && dmarc.IsTempFail(err):
+		ret.Result, ret.Error = "temperror", err.Error()
+		return ret
+	case err != nil:
+		ret.Result, ret.Error = "permerror", err.Error()
+		return ret
+	}
+
+	policy := record.Policy
+	if subdomain && record.SubdomainPolicy != "" {
+		policy = record.SubdomainPolicy
+	}
+	ret.Policy = string(policy)
+
+	ret.SPFAligned = spfResult == "pass" && aligned(spfDomain, fromDomain, record.SPFAlignment)
+	for _, r := range dkimResults {
+		if r.Result == "pass" && aligned(r.Domain, fromDomain, record.DKIMAlignment) {
+			ret.DKIMAligned = true
+		}
+	}
+
+	if ret.SPFAligned || ret.DKIMAligned {
+		ret.Result = "pass"
+		return ret
+	}
+
+	ret.Result = "fail"
+	ret.Disposition = string(policy)
+
+	// messages outside of the pct sample get the next weaker disposition
+	if record.Percent != nil && rand.Intn(100) >= *record.Percent {
+		switch policy {
+		case dmarc.PolicyReject:
+			ret.Disposition = dmarc.PolicyQuarantine
+		case dmarc.PolicyQuarantine:
+			ret.Disposition = string(dmarc.PolicyNone)
+		}
+	}
+
+	return ret
+}
+
+// aligned checks the identifier alignment of domain with the From header domain,
+// strict mode requires the same domain while relaxed only the same organizational domain
+func aligned(domain, fromDomain string, mode dmarc.AlignmentMode) bool {
+	domain, fromDomain = normalizeDomain(domain), normalizeDomain(fromDomain)
+	if domain == "" {
+		return false
+	}
+
+	if mode == dmarc.AlignmentStrict {
+		return domain == fromDomain
+	}
+
+	return organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+// organizationalDomain returns the registrable part of domain according to the public suffix list
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(domain))
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+
+	return org
+}
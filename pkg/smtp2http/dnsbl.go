@@ -0,0 +1,161 @@
+package smtp2http
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// dnsblReject refuses the clients listed by any of the lists
+	dnsblReject = "reject"
+
+	// dnsblMark only adds the listings to the payload
+	dnsblMark = "mark"
+
+	// dnsblCacheTTL is how long the listings of an ip are cached
+	dnsblCacheTTL = 5 * time.Minute
+
+	// dnsblCacheMaxEntries caps the cached ips, the expired ones are evicted first
+	dnsblCacheMaxEntries = 10000
+)
+
+// dnsblError is the reply to a client listed by list
+func dnsblError(list string) error {
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Service unavailable, your ip is listed by " + list,
+	}
+}
+
+// dnsblEntry are the cached results of an ip
+type dnsblEntry struct {
+	results []*EmailDNSBLResult
+	expires time.Time
+}
+
+// dnsblChecker queries the dns blocklists about the client ips
+type dnsblChecker struct {
+	lists   []string
+	reject  bool
+	timeout time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsblEntry
+}
+
+// newDNSBLChecker returns the checker of the lists, all of them are queried within timeout
+func newDNSBLChecker(lists []string, action string, timeout time.Duration) (*dnsblChecker, error) {
+	if action != dnsblReject && action != dnsblMark {
+		return nil, fmt.Errorf("invalid dnsbl action %q, expected reject or mark", action)
+	}
+
+	return &dnsblChecker{lists: lists, reject: action == dnsblReject, timeout: timeout, cache: map[string]dnsblEntry{}}, nil
+}
+
+// check returns the result of each list for ip, nil for the private and loopback addresses
+func (d *dnsblChecker) check(ip net.IP) []*EmailDNSBLResult {
+	if d == nil || ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+
+	now := time.Now()
+	key := ip.String()
+
+	d.mu.Lock()
+	entry, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.results
+	}
+
+	// the lists are queried concurrently so the slowest one bounds the delay, never their sum
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	results := make([]*EmailDNSBLResult, len(d.lists))
+	var wg sync.WaitGroup
+	for i, list := range d.lists {
+		wg.Add(1)
+		go func(i int, list string) {
+			defer wg.Done()
+			results[i] = lookupDNSBL(ctx, ip, list)
+		}(i, list)
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	if len(d.cache) >= dnsblCacheMaxEntries {
+		for k, e := range d.cache {
+			if now.After(e.expires) {
+				delete(d.cache, k)
+			}
+		}
+
+		if len(d.cache) >= dnsblCacheMaxEntries {
+			d.cache = map[string]dnsblEntry{}
+		}
+	}
+	d.cache[key] = dnsblEntry{results: results, expires: now.Add(dnsblCacheTTL)}
+	d.mu.Unlock()
+
+	return results
+}
+
+// listedBy returns the first list the results of check list the ip on, empty when none
+func listedBy(results []*EmailDNSBLResult) string {
+	for _, r := range results {
+		if r.Listed {
+			return r.List
+		}
+	}
+
+	return ""
+}
+
+// lookupDNSBL queries list for ip, an NXDOMAIN means the ip isn't listed
+func lookupDNSBL(ctx context.Context, ip net.IP, list string) *EmailDNSBLResult {
+	result := &EmailDNSBLResult{List: list}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, reverseIP(ip)+"."+list)
+	if isNotFound(err) {
+		return result
+	} else if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	for _, addr := range addrs {
+		// 127.255.255.x are the error codes of spamhaus (e.g. queried through a public resolver), not listings
+		if strings.HasPrefix(addr, "127.255.255.") {
+			result.Error = "the list refused the query: " + addr
+			return result
+		}
+	}
+
+	result.Listed, result.Codes = true, addrs
+
+	return result
+}
+
+// reverseIP returns the dnsbl query name of ip: the reversed octets for ipv4, the reversed nibbles for ipv6
+func reverseIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	const digits = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	v6 := ip.To16()
+	for i := len(v6) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(digits[v6[i]&0x0f]), string(digits[v6[i]>>4]))
+	}
+
+	return strings.Join(nibbles, ".")
+}
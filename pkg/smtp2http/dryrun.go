@@ -0,0 +1,121 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errDryRunFailed is the reply of -fail-dry-run, a temporary failure so the sender retries
+var errDryRunFailed = &smtp.SMTPError{
+	Code:         450,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Dry run, the message was not delivered, please try again later",
+}
+
+// dryRunMu keeps the payloads of concurrent messages from interleaving on stdout
+var dryRunMu sync.Mutex
+
+// dryRun prints the requests the deliveries would send instead of sending them, to stdout or
+// as files of -dry-run-dir named by the message id. It returns the reply chosen by -fail-dry-run
+func dryRun(logger *slog.Logger, messageID, deliveryID string, deliveries []*delivery) error {
+	name := messageID
+	if name == "" {
+		name = deliveryID
+	}
+
+	for i, d := range deliveries {
+		body, contentType, headers, err := d.dryRunRequest()
+		if err != nil {
+			logger.Error("cannot read the dry run payload", "target", d.target(), "error", err)
+			return errInternal
+		}
+
+		if conf.DryRunDir == "" {
+			dryRunMu.Lock()
+			writeDryRun(os.Stdout, d.target(), contentType, headers, body)
+			dryRunMu.Unlock()
+			continue
+		}
+
+		file := sanitizeFilename(name)
+		if i > 0 {
+			file += fmt.Sprintf("-%d", i+1)
+		}
+		file = filepath.Join(conf.DryRunDir, file+dryRunExtension(contentType))
+
+		if err := ioutil.WriteFile(file, prettyBody(body, contentType), 0600); err != nil {
+			logger.Error("cannot write the dry run payload", "dry_run_file", file, "error", err)
+			return errInternal
+		}
+		logger.Debug("dry run payload written", "target", d.target(), "dry_run_file", file)
+	}
+
+	logger.Info("message not delivered, dry run", "targets", len(deliveries), "fail_dry_run", conf.FailDryRun)
+
+	if conf.FailDryRun {
+		return errDryRunFailed
+	}
+
+	return nil
+}
+
+// dryRunRequest returns what the delivery would send
+func (d *delivery) dryRunRequest() ([]byte, string, map[string]string, error) {
+	if d.publisher != nil {
+		return d.publication.Body, d.publication.ContentType, d.publication.Headers, nil
+	}
+
+	body, err := d.req.bodyBytes()
+	return body, d.req.ContentType, d.req.Headers, err
+}
+
+// writeDryRun prints the target, the headers and the body of a request
+func writeDryRun(w io.Writer, target, contentType string, headers map[string]string, body []byte) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "--- %s\nContent-Type: %s\n", target, contentType)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %s\n", name, headers[name])
+	}
+	fmt.Fprintf(w, "\n%s\n", prettyBody(body, contentType))
+}
+
+// prettyBody indents a json body, the other bodies are returned as is
+func prettyBody(body []byte, contentType string) []byte {
+	if !strings.Contains(contentType, "json") {
+		return body
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "  "); err != nil {
+		return body
+	}
+
+	return buf.Bytes()
+}
+
+func dryRunExtension(contentType string) string {
+	switch {
+	case strings.Contains(contentType, "json"):
+		return ".json"
+	case strings.HasPrefix(contentType, "message/rfc822"):
+		return ".eml"
+	}
+
+	return ".txt"
+}
@@ -0,0 +1,143 @@
+package smtp2http
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// IsBounce reports whether the message is a delivery status notification: a multipart/report of the
+// delivery-status type, a message sent with the null envelope sender, or one marked by the
+// Auto-Submitted or X-Failed-Recipients headers
+func IsBounce(header mail.Header, env *Envelope) bool {
+	if contentType, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil &&
+		contentType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status") {
+		return true
+	}
+
+	if env.From == nil || env.From.Address == "" {
+		return true
+	}
+
+	if submitted := strings.TrimSpace(header.Get("Auto-Submitted")); submitted != "" && !strings.EqualFold(submitted, "no") {
+		return true
+	}
+
+	return header.Get("X-Failed-Recipients") != ""
+}
+
+// ParseDSN extracts the delivery status of a bounce, from its message/delivery-status part and the
+// X-Failed-Recipients header. It returns nil when the message has neither
+func ParseDSN(header mail.Header, raw []byte) *EmailDSN {
+	dsn := &EmailDSN{}
+
+	for _, value := range header["X-Failed-Recipients"] {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				dsn.FailedRecipients = append(dsn.FailedRecipients, addr)
+			}
+		}
+	}
+
+	if status := deliveryStatusPart(raw); status != nil {
+		parseDeliveryStatus(status, dsn)
+	}
+
+	if dsn.ReportingMTA == "" && len(dsn.Recipients) == 0 && len(dsn.FailedRecipients) == 0 {
+		return nil
+	}
+
+	return dsn
+}
+
+// deliveryStatusPart returns the decoded message/delivery-status part of the multipart/report in raw, nil if there is none
+func deliveryStatusPart(raw []byte) []byte {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+
+	contentType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || contentType != "multipart/report" {
+		return nil
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil
+		}
+
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if contentType != "message/delivery-status" && contentType != "message/global-delivery-status" {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding")))
+		if err != nil {
+			return nil
+		}
+
+		return data
+	}
+}
+
+// parseDeliveryStatus reads the per-message fields then the per-recipient blocks of a delivery-status
+// body (RFC 3464), the blocks are separated by blank lines and use the header syntax
+func parseDeliveryStatus(data []byte, dsn *EmailDSN) {
+	// a trailing blank line would end the last block early, the reader wants one to end a block
+	r := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(bytes.TrimSpace(data)), strings.NewReader("\r\n\r\n"))))
+
+	first := true
+	for {
+		fields, err := r.ReadMIMEHeader()
+		if len(fields) == 0 {
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		// the per-message fields come first, some MTAs don't separate them from the first recipient
+		if first {
+			first = false
+			dsn.ReportingMTA = dsnValue(fields.Get("Reporting-MTA"))
+		}
+
+		if fields.Get("Final-Recipient") == "" {
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		dsn.Recipients = append(dsn.Recipients, &EmailDSNRecipient{
+			FinalRecipient:    dsnValue(fields.Get("Final-Recipient")),
+			OriginalRecipient: dsnValue(fields.Get("Original-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:            strings.TrimSpace(fields.Get("Status")),
+			DiagnosticCode:    dsnValue(fields.Get("Diagnostic-Code")),
+			RemoteMTA:         dsnValue(fields.Get("Remote-MTA")),
+		})
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dsnValue drops the type of a delivery-status field, e.g "rfc822; bob@example.com" is "bob@example.com"
+func dsnValue(value string) string {
+	if _, v, ok := strings.Cut(value, ";"); ok {
+		value = v
+	}
+
+	return strings.Join(strings.Fields(value), " ")
+}
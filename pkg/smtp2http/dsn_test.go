@@ -0,0 +1,151 @@
+package smtp2http
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/smtp"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readFixture parses testdata/name, returned along with its header
+func readFixture(t *testing.T, name string) (mail.Header, []byte) {
+	t.Helper()
+
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+
+	return msg.Header, raw
+}
+
+func TestParseDSN(t *testing.T) {
+	for _, c := range []struct {
+		fixture string
+		want    *EmailDSN
+	}{
+		{"dsn/postfix.eml", &EmailDSN{
+			ReportingMTA: "mail.example.com",
+			Recipients: []*EmailDSNRecipient{{
+				FinalRecipient:    "nobody@example.org",
+				OriginalRecipient: "nobody@example.org",
+				Action:            "failed",
+				Status:            "5.1.1",
+				DiagnosticCode:    "550 5.1.1 <nobody@example.org>: Recipient address rejected: User unknown",
+				RemoteMTA:         "mx.example.org",
+			}},
+		}},
+		{"dsn/exchange.eml", &EmailDSN{
+			ReportingMTA: "DM6PR01MB1234.namprd01.prod.outlook.com",
+			Recipients: []*EmailDSNRecipient{{
+				FinalRecipient: "jane@contoso.com",
+				Action:         "failed",
+				Status:         "5.2.2",
+				DiagnosticCode: "554 5.2.2 mailbox full;STOREDRV.Deliver.Exception:QuotaExceededException.MapiExceptionShutoffQuotaExceeded",
+				RemoteMTA:      "DM6PR01MB1234.namprd01.prod.outlook.com",
+			}},
+		}},
+		{"dsn/gmail.eml", &EmailDSN{
+			ReportingMTA: "googlemail.com",
+			Recipients: []*EmailDSNRecipient{{
+				FinalRecipient: "nobody@example.org",
+				Action:         "failed",
+				Status:         "5.1.1",
+				DiagnosticCode: "550 5.1.1 The email account that you tried to reach does not exist.",
+				RemoteMTA:      "mx.example.org. (192.0.2.25, the server for the domain example.org.)",
+			}},
+			FailedRecipients: []string{"nobody@example.org"},
+		}},
+	} {
+		header, raw := readFixture(t, c.fixture)
+
+		if !IsBounce(header, &Envelope{From: &mail.Address{Address: "alice@example.com"}}) {
+			t.Errorf("%s: not a bounce", c.fixture)
+		}
+
+		got := ParseDSN(header, raw)
+		if got == nil {
+			t.Fatalf("%s: no dsn", c.fixture)
+		}
+		if got.ReportingMTA != c.want.ReportingMTA || !reflect.DeepEqual(got.FailedRecipients, c.want.FailedRecipients) {
+			t.Errorf("%s: got %+v, want %+v", c.fixture, got, c.want)
+		}
+		if len(got.Recipients) != len(c.want.Recipients) {
+			t.Fatalf("%s: %d recipients, want %d", c.fixture, len(got.Recipients), len(c.want.Recipients))
+		}
+		for i, rcpt := range got.Recipients {
+			if *rcpt != *c.want.Recipients[i] {
+				t.Errorf("%s: recipient %d = %+v, want %+v", c.fixture, i, rcpt, c.want.Recipients[i])
+			}
+		}
+	}
+}
+
+func TestIsBounce(t *testing.T) {
+	alice := &Envelope{From: &mail.Address{Address: "alice@example.com"}}
+
+	for _, c := range []struct {
+		name   string
+		header mail.Header
+		env    *Envelope
+		want   bool
+	}{
+		{"plain", mail.Header{"Subject": {"hello"}}, alice, false},
+		{"null sender", mail.Header{}, &Envelope{From: &mail.Address{}}, true},
+		{"no sender", mail.Header{}, &Envelope{}, true},
+		{"auto-submitted", mail.Header{"Auto-Submitted": {"auto-replied"}}, alice, true},
+		{"auto-submitted no", mail.Header{"Auto-Submitted": {"no"}}, alice, false},
+		{"failed recipients", mail.Header{"X-Failed-Recipients": {"bob@example.com"}}, alice, true},
+		{"report", mail.Header{"Content-Type": {`multipart/report; report-type="delivery-status"; boundary=b`}}, alice, true},
+		{"disposition report", mail.Header{"Content-Type": {`multipart/report; report-type=disposition-notification; boundary=b`}}, alice, false},
+	} {
+		if got := IsBounce(c.header, c.env); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseDSNNotABounce(t *testing.T) {
+	header, raw := readFixture(t, "inbound.eml")
+	if dsn := ParseDSN(header, raw); dsn != nil {
+		t.Errorf("got %+v, want no dsn", dsn)
+	}
+}
+
+func TestBouncePayload(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer webhook.Close()
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	addr := newTestServer(t, cfg)
+
+	_, bounce := readFixture(t, "dsn/postfix.eml")
+	if err := smtp.SendMail(addr, nil, "", []string{"alice@example.com"}, bounce); err != nil {
+		t.Fatal(err)
+	}
+	if body := <-bodies; !bytes.Contains(body, []byte(`"is_bounce":true`)) || !bytes.Contains(body, []byte(`"dsn":{"reporting_mta":"mail.example.com"`)) {
+		t.Errorf("payload %s, want the bounce and its dsn", body)
+	}
+
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(testMail)); err != nil {
+		t.Fatal(err)
+	}
+	if body := <-bodies; !bytes.Contains(body, []byte(`"is_bounce":false`)) || bytes.Contains(body, []byte(`"dsn"`)) {
+		t.Errorf("payload %s, want is_bounce false and no dsn", body)
+	}
+}
@@ -0,0 +1,312 @@
+package smtp2http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// elasticConfig is the configuration of the elasticsearch (or opensearch) output
+type elasticConfig struct {
+	URL           string
+	Index         string
+	Username      string
+	Password      string
+	APIKey        string
+	CAFile        string
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// elasticPublisher indexes the payloads with the bulk api. The documents are batched until BatchSize of them
+// are waiting or FlushInterval elapsed since the first one, every Publish returns once its batch was indexed
+type elasticPublisher struct {
+	url    string
+	index  string
+	client *http.Client
+
+	username string
+	password string
+	apiKey   string
+
+	batchSize int
+	interval  time.Duration
+
+	docs chan *elasticDoc
+	done chan struct{}
+	once sync.Once
+}
+
+// elasticDoc is a document waiting for its batch, the outcome of its indexing is sent on result
+type elasticDoc struct {
+	id     string
+	body   []byte
+	result chan error
+}
+
+// newElasticPublisher creates the index template of the index and starts the batcher
+func newElasticPublisher(cfg elasticConfig) (*elasticPublisher, error) {
+	if cfg.Index == "" {
+		return nil, errors.New("-elastic-url requires -elastic-index")
+	}
+	if cfg.BatchSize < 1 || cfg.FlushInterval <= 0 {
+		return nil, errors.New("-elastic-batch-size and -elastic-flush-interval must be positive")
+	}
+	if cfg.APIKey != "" && cfg.Username != "" {
+		return nil, errors.New("-elastic-api-key and -elastic-username are exclusive")
+	}
+
+	tlsConfig, err := clientTLSConfig(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &elasticPublisher{
+		url:       strings.TrimSuffix(cfg.URL, "/"),
+		index:     cfg.Index,
+		client:    &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}},
+		username:  cfg.Username,
+		password:  cfg.Password,
+		apiKey:    cfg.APIKey,
+		batchSize: cfg.BatchSize,
+		interval:  cfg.FlushInterval,
+		docs:      make(chan *elasticDoc),
+		done:      make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := p.putTemplate(ctx); err != nil {
+		return nil, fmt.Errorf("cannot create the elasticsearch index template: %s", err.Error())
+	}
+
+	go p.run()
+
+	return p, nil
+}
+
+// elasticTemplate maps the addresses and the other strings as keywords, the subject and the bodies as text
+// and the timestamps as dates. The v1 dates aren't parseable, date_unix is their date
+const elasticTemplate = `{
+  "index_patterns": [%q, %q],
+  "priority": 100,
+  "template": {
+    "mappings": {
+      "dynamic_templates": [
+        {"strings": {"match_mapping_type": "string", "mapping": {"type": "keyword", "ignore_above": 1024}}}
+      ],
+      "properties": {
+        "subject": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 1024}}},
+        "body": {"properties": {"text": {"type": "text"}, "html": {"type": "text"}, "rtf": {"type": "text", "index": false}}},
+        "received_at": {"type": "date"},
+        "date_unix": {"type": "date", "format": "epoch_second"},
+        "resent_date_unix": {"type": "date", "format": "epoch_second"},
+        "connection": {"properties": {"received_at": {"type": "date"}}},
+        "attachments": {"properties": {"filename": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 1024}}}, "size": {"type": "long"}}},
+        "embedded_files": {"properties": {"size": {"type": "long"}}}
+      }
+    }
+  }
+}`
+
+// putTemplate creates or updates the index template of the index, the index itself is created on the first
+// document
+func (p *elasticPublisher) putTemplate(ctx context.Context) error {
+	body := fmt.Sprintf(elasticTemplate, p.index, p.index+"-*")
+
+	_, err := p.do(ctx, http.MethodPut, "/_index_template/smtp2http-"+p.index, "application/json", []byte(body))
+	return err
+}
+
+// do sends a request to the cluster, it fails on any status but a 2xx
+func (p *elasticPublisher) do(ctx context.Context, method, path, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case p.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+p.apiKey)
+	case p.username != "":
+		req.SetBasicAuth(p.username, p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(data) > 512 {
+			data = data[:512]
+		}
+		return nil, fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	return data, nil
+}
+
+func (p *elasticPublisher) Name() string {
+	return "elasticsearch"
+}
+
+// Publish indexes the payload with the files reduced to their metadata and hash, its id is the Message-ID (the
+// delivery id when it was generated) so a retry replaces the document. The recipient is appended with -route,
+// a message can then be split in several payloads
+func (p *elasticPublisher) Publish(ctx context.Context, pub *publication) error {
+	msg := &EmailMessage{}
+	if err := json.Unmarshal(pub.Body, msg); err != nil {
+		return fmt.Errorf("cannot read the payload: %s", err.Error())
+	}
+
+	for _, a := range msg.Attachments {
+		if err := fileMetadata(&a.EmailFile, a.Filename, a.ContentType); err != nil {
+			return err
+		}
+	}
+	for _, e := range msg.EmbeddedFiles {
+		if err := fileMetadata(&e.EmailFile, e.Filename, e.ContentType); err != nil {
+			return err
+		}
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	id := msg.ID
+	if id == "" || msg.MessageIDGenerated {
+		id = msg.DeliveryID
+	}
+	if len(webhookRoutes) > 0 {
+		id += "/" + strings.ToLower(pub.Recipient)
+	}
+	if len(id) > 512 {
+		// the longest id elasticsearch accepts
+		sum := sha256.Sum256([]byte(id))
+		id = hex.EncodeToString(sum[:])
+	}
+
+	doc := &elasticDoc{id: id, body: body, result: make(chan error, 1)}
+	select {
+	case p.docs <- doc:
+	case <-p.done:
+		return errors.New("the elasticsearch output is closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-doc.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run batches the documents until the publisher is closed, the last batch is flushed then
+func (p *elasticPublisher) run() {
+	batch := []*elasticDoc{}
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case doc := <-p.docs:
+			batch = append(batch, doc)
+			if len(batch) == 1 {
+				timer = time.After(p.interval)
+			}
+			if len(batch) < p.batchSize {
+				continue
+			}
+		case <-timer:
+		case <-p.done:
+			p.flush(batch)
+			return
+		}
+
+		p.flush(batch)
+		batch, timer = []*elasticDoc{}, nil
+	}
+}
+
+// elasticBulkResponse is the part of the bulk api response telling the outcome of each document
+type elasticBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// flush indexes the batch with a single bulk request and sends each document its outcome
+func (p *elasticPublisher) flush(batch []*elasticDoc) {
+	if len(batch) == 0 {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	for _, doc := range batch {
+		action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": p.index, "_id": doc.id}})
+		buf.Write(action)
+		buf.WriteByte('\n')
+		buf.Write(doc.body)
+		buf.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.PublishTimeout)
+	defer cancel()
+
+	start := time.Now()
+	data, err := p.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", buf.Bytes())
+
+	resp := &elasticBulkResponse{}
+	if err == nil {
+		if err = json.Unmarshal(data, resp); err == nil && len(resp.Items) != len(batch) {
+			err = fmt.Errorf("the bulk response has %d items for %d documents", len(resp.Items), len(batch))
+		}
+	}
+	if err != nil {
+		slog.Error("elasticsearch bulk request failed", "documents", len(batch), "error", err)
+		for _, doc := range batch {
+			doc.result <- err
+		}
+		return
+	}
+
+	slog.Debug("elasticsearch batch indexed", "documents", len(batch), "errors", resp.Errors, "duration_ms", time.Since(start).Milliseconds())
+	for i, doc := range batch {
+		var err error
+		for _, item := range resp.Items[i] {
+			if item.Status < 200 || item.Status > 299 {
+				err = fmt.Errorf("elasticsearch refused the document %s with %d: %s", doc.id, item.Status, string(item.Error))
+			}
+		}
+		doc.result <- err
+	}
+}
+
+// Close flushes the waiting documents
+func (p *elasticPublisher) Close() error {
+	p.once.Do(func() { close(p.done) })
+
+	return nil
+}
@@ -0,0 +1,375 @@
+package smtp2http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// elasticRequest is a request the fake cluster received
+type elasticRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// elasticCluster serves the index template and the bulk apis until the test ends, bulk answers a bulk request
+// with its status and response. It returns the url of the cluster and its requests
+func elasticCluster(t *testing.T, bulk func(docs int) (int, string)) (string, chan elasticRequest) {
+	t.Helper()
+
+	requests := make(chan elasticRequest, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- elasticRequest{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: body}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/_bulk" {
+			w.Write([]byte(`{"acknowledged":true}`))
+			return
+		}
+
+		status, resp := bulk(bytes.Count(body, []byte("\n")) / 2)
+		w.WriteHeader(status)
+		w.Write([]byte(resp))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL, requests
+}
+
+// bulkIndexed answers a bulk request of docs documents the way elasticsearch does once they are indexed
+func bulkIndexed(docs int) (int, string) {
+	items := make([]string, docs)
+	for i := range items {
+		items[i] = `{"index":{"_index":"emails","_id":"` + fmt.Sprint(i) + `","result":"created","status":201}}`
+	}
+
+	return http.StatusOK, `{"took":3,"errors":false,"items":[` + strings.Join(items, ",") + `]}`
+}
+
+// newTestElastic returns the elastic publisher of cfg, started with the default configuration and closed when
+// the test ends
+func newTestElastic(t *testing.T, cfg elasticConfig) *elasticPublisher {
+	t.Helper()
+
+	restoreGlobals(t)
+	conf = DefaultConfig()
+
+	if cfg.Index == "" {
+		cfg.Index = "emails"
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 1
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = time.Minute
+	}
+
+	p, err := newElasticPublisher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+// elasticPublication is the payload of a message with an attachment
+func elasticPublication(t *testing.T, id string) *publication {
+	t.Helper()
+
+	body, err := json.Marshal(&EmailMessage{
+		ID:          id,
+		DeliveryID:  "delivery-" + id,
+		Subject:     "test",
+		Attachments: []*EmailAttachment{{Filename: "a.txt", ContentType: "text/plain", EmailFile: EmailFile{Data: base64.StdEncoding.EncodeToString([]byte("hello"))}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub := testPublication()
+	pub.Body = body
+
+	return pub
+}
+
+// bulkDocs returns the ids and the documents of a bulk request
+func bulkDocs(t *testing.T, body []byte) ([]string, []*EmailMessage) {
+	t.Helper()
+
+	ids, docs := []string{}, []*EmailMessage{}
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for s.Scan() {
+		action := map[string]map[string]string{}
+		if err := json.Unmarshal(s.Bytes(), &action); err != nil || action["index"]["_index"] != "emails" {
+			t.Fatalf("action %s: %v, want an index of emails", s.Bytes(), err)
+		}
+		ids = append(ids, action["index"]["_id"])
+
+		doc := &EmailMessage{}
+		if !s.Scan() || json.Unmarshal(s.Bytes(), doc) != nil {
+			t.Fatalf("no document after the action %s", action)
+		}
+		docs = append(docs, doc)
+	}
+
+	return ids, docs
+}
+
+func TestNewElasticPublisherErrors(t *testing.T) {
+	restoreGlobals(t)
+	conf = DefaultConfig()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"missing authentication credentials"}`))
+	}))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		name string
+		cfg  elasticConfig
+		want string
+	}{
+		{"no index", elasticConfig{URL: srv.URL, BatchSize: 1, FlushInterval: time.Second}, "-elastic-url requires -elastic-index"},
+		{"no batch", elasticConfig{URL: srv.URL, Index: "emails", FlushInterval: time.Second}, "-elastic-batch-size and -elastic-flush-interval must be positive"},
+		{"no interval", elasticConfig{URL: srv.URL, Index: "emails", BatchSize: 1}, "-elastic-batch-size and -elastic-flush-interval must be positive"},
+		{"api key and username", elasticConfig{URL: srv.URL, Index: "emails", BatchSize: 1, FlushInterval: time.Second, APIKey: "key", Username: "elastic"}, "-elastic-api-key and -elastic-username are exclusive"},
+		{
+			"the template refused",
+			elasticConfig{URL: srv.URL, Index: "emails", BatchSize: 1, FlushInterval: time.Second},
+			`cannot create the elasticsearch index template: PUT /_index_template/smtp2http-emails returned 401: {"error":"missing authentication credentials"}`,
+		},
+	} {
+		if _, err := newElasticPublisher(c.cfg); err == nil || err.Error() != c.want {
+			t.Errorf("%s: %v, want %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestElasticTemplate(t *testing.T) {
+	url, requests := elasticCluster(t, bulkIndexed)
+	newTestElastic(t, elasticConfig{URL: url + "/", APIKey: "a2V5"})
+
+	req := <-requests
+	if req.method != http.MethodPut || req.path != "/_index_template/smtp2http-emails" {
+		t.Errorf("%s %s, want the index template of emails", req.method, req.path)
+	}
+	if auth := req.header.Get("Authorization"); auth != "ApiKey a2V5" {
+		t.Errorf("Authorization = %q, want the api key", auth)
+	}
+
+	template := struct {
+		IndexPatterns []string `json:"index_patterns"`
+	}{}
+	if err := json.Unmarshal(req.body, &template); err != nil {
+		t.Fatalf("template %s: %v", req.body, err)
+	}
+	if len(template.IndexPatterns) != 2 || template.IndexPatterns[0] != "emails" || template.IndexPatterns[1] != "emails-*" {
+		t.Errorf("index patterns = %q, want the index and its rollovers", template.IndexPatterns)
+	}
+}
+
+func TestElasticBulk(t *testing.T) {
+	url, requests := elasticCluster(t, bulkIndexed)
+	p := newTestElastic(t, elasticConfig{URL: url, Username: "elastic", Password: "secret", BatchSize: 3})
+	<-requests
+
+	// a batch is sent once it is full
+	wg := sync.WaitGroup{}
+	for _, id := range []string{"1@example.com", "2@example.com", "3@example.com"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if err := p.Publish(context.Background(), elasticPublication(t, id)); err != nil {
+				t.Errorf("%s: %v", id, err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	req := <-requests
+	if req.method != http.MethodPost || req.path != "/_bulk" || req.header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("%s %s of %s, want a bulk request", req.method, req.path, req.header.Get("Content-Type"))
+	}
+	if user, password, ok := (&http.Request{Header: req.header}).BasicAuth(); !ok || user != "elastic" || password != "secret" {
+		t.Errorf("basic auth %q %q, want the username and the password", user, password)
+	}
+	if !bytes.HasSuffix(req.body, []byte("\n")) {
+		t.Error("the bulk body doesn't end with a newline")
+	}
+
+	ids, docs := bulkDocs(t, req.body)
+	if len(ids) != 3 {
+		t.Fatalf("%d documents in the batch, want 3", len(ids))
+	}
+	for i, doc := range docs {
+		if ids[i] != doc.ID {
+			t.Errorf("document %s indexed as %s, want its Message-ID", doc.ID, ids[i])
+		}
+		if a := doc.Attachments[0]; a.Data != "" || a.Size != 5 || a.SHA256 != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+			t.Errorf("document %s: attachment %+v, want its metadata without its content", doc.ID, a.EmailFile)
+		}
+	}
+
+	select {
+	case req := <-requests:
+		t.Errorf("%s %s, want a single bulk request", req.method, req.path)
+	default:
+	}
+}
+
+func TestElasticFlushInterval(t *testing.T) {
+	url, requests := elasticCluster(t, bulkIndexed)
+	p := newTestElastic(t, elasticConfig{URL: url, BatchSize: 100, FlushInterval: 50 * time.Millisecond})
+	<-requests
+
+	start := time.Now()
+	if err := p.Publish(context.Background(), elasticPublication(t, "1@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Publish returned after %s, want the batch flushed at the interval", elapsed)
+	}
+
+	if ids, _ := bulkDocs(t, (<-requests).body); len(ids) != 1 {
+		t.Errorf("%d documents in the batch, want 1", len(ids))
+	}
+}
+
+func TestElasticClose(t *testing.T) {
+	url, requests := elasticCluster(t, bulkIndexed)
+	p := newTestElastic(t, elasticConfig{URL: url, BatchSize: 100})
+	<-requests
+
+	result := make(chan error, 1)
+	go func() { result <- p.Publish(context.Background(), elasticPublication(t, "1@example.com")) }()
+
+	// the waiting document is flushed
+	time.Sleep(50 * time.Millisecond)
+	p.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("document waiting on Close: %v, want it indexed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't flush the waiting document")
+	}
+	<-requests
+
+	if err := p.Publish(context.Background(), elasticPublication(t, "2@example.com")); err == nil {
+		t.Error("Publish after Close accepted")
+	}
+}
+
+func TestElasticDocumentID(t *testing.T) {
+	url, requests := elasticCluster(t, bulkIndexed)
+	p := newTestElastic(t, elasticConfig{URL: url})
+	<-requests
+
+	long := strings.Repeat("a", 600) + "@example.com"
+	for _, c := range []struct {
+		name      string
+		msg       EmailMessage
+		routes    map[string]string
+		recipient string
+		want      string
+	}{
+		{"the Message-ID", EmailMessage{ID: "1@example.com", DeliveryID: "d1"}, nil, "bob@example.com", "1@example.com"},
+		{"a generated Message-ID", EmailMessage{ID: "d2@smtp2http.test", DeliveryID: "d2", MessageIDGenerated: true}, nil, "bob@example.com", "d2"},
+		{"no Message-ID", EmailMessage{DeliveryID: "d3"}, nil, "bob@example.com", "d3"},
+		{"-route", EmailMessage{ID: "4@example.com", DeliveryID: "d4"}, map[string]string{"example.com": url}, "Bob@Example.com", "4@example.com/bob@example.com"},
+		{"too long", EmailMessage{ID: long, DeliveryID: "d5"}, nil, "bob@example.com", "2ebe6568230005a064d7405fbbd300fef519b2dde6ac3fad0988b244022fd198"},
+	} {
+		webhookRoutes = c.routes
+		body, err := json.Marshal(&c.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := testPublication()
+		pub.Body, pub.Recipient = body, c.recipient
+
+		if err := p.Publish(context.Background(), pub); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if ids, _ := bulkDocs(t, (<-requests).body); len(ids) != 1 || ids[0] != c.want {
+			t.Errorf("%s: indexed as %q, want %q", c.name, ids, c.want)
+		}
+	}
+}
+
+func TestElasticBulkErrors(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		status int
+		resp   string
+		want   []string
+	}{
+		{
+			"a document refused",
+			http.StatusOK,
+			`{"errors":true,"items":[{"index":{"_id":"1@example.com","status":201}},{"index":{"_id":"2@example.com","status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [date_unix]"}}}]}`,
+			[]string{"", `elasticsearch refused the document 2@example.com with 400: {"type":"mapper_parsing_exception","reason":"failed to parse field [date_unix]"}`},
+		},
+		{
+			"the bulk request refused",
+			http.StatusTooManyRequests,
+			`{"error":{"type":"es_rejected_execution_exception"},"status":429}`,
+			[]string{`POST /_bulk returned 429: {"error":{"type":"es_rejected_execution_exception"},"status":429}`, `POST /_bulk returned 429: {"error":{"type":"es_rejected_execution_exception"},"status":429}`},
+		},
+		{
+			"a long error",
+			http.StatusInternalServerError,
+			strings.Repeat("x", 1000),
+			[]string{"POST /_bulk returned 500: " + strings.Repeat("x", 512), "POST /_bulk returned 500: " + strings.Repeat("x", 512)},
+		},
+		{
+			"items missing",
+			http.StatusOK,
+			`{"errors":false,"items":[{"index":{"_id":"1@example.com","status":201}}]}`,
+			[]string{"the bulk response has 1 items for 2 documents", "the bulk response has 1 items for 2 documents"},
+		},
+		{
+			"not json",
+			http.StatusOK,
+			"ok",
+			[]string{"invalid character 'o' looking for beginning of value", "invalid character 'o' looking for beginning of value"},
+		},
+	} {
+		url, requests := elasticCluster(t, func(int) (int, string) { return c.status, c.resp })
+		p := newTestElastic(t, elasticConfig{URL: url, BatchSize: 2})
+		<-requests
+
+		// the documents are sent in the order they were published
+		errs := make([]chan error, len(c.want))
+		for i := range errs {
+			errs[i] = make(chan error, 1)
+			go func(i int) {
+				errs[i] <- p.Publish(context.Background(), elasticPublication(t, fmt.Sprintf("%d@example.com", i+1)))
+			}(i)
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		for i, want := range c.want {
+			err := <-errs[i]
+			if got := fmt.Sprint(err); (want == "" && err != nil) || (want != "" && got != want) {
+				t.Errorf("%s: document %d: %v, want %q", c.name, i+1, err, want)
+			}
+		}
+		<-requests
+	}
+}
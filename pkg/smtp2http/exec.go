@@ -0,0 +1,139 @@
+package smtp2http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// execMaxStderr caps the stderr kept from an -exec command, only its first line is used
+const execMaxStderr = 4 << 10
+
+// execPublisher pipes the payloads to the stdin of a command, run once per payload. Its exit code is the
+// outcome: 0 accepts the message, 1 to 63 refuse it for good with the first line of stderr as the reply,
+// anything else fails it temporarily
+type execPublisher struct {
+	argv    []string
+	timeout time.Duration
+}
+
+// newExecPublisher parses command, the path of the executable and its arguments separated by spaces. There is
+// no shell involved, a script needing one names it
+func newExecPublisher(command string, timeout time.Duration) (*execPublisher, error) {
+	argv := strings.Fields(command)
+	if len(argv) == 0 {
+		return nil, errors.New("-exec requires a command")
+	}
+	if timeout <= 0 {
+		return nil, errors.New("-exec-timeout must be positive")
+	}
+
+	path, err := exec.LookPath(argv[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the -exec command: %s", err.Error())
+	}
+	argv[0] = path
+
+	return &execPublisher{argv: argv, timeout: timeout}, nil
+}
+
+func (p *execPublisher) Name() string {
+	return "exec"
+}
+
+func (p *execPublisher) Timeout() time.Duration {
+	return p.timeout
+}
+
+// Publish runs the command with the payload on its stdin and the envelope in its environment, the command and
+// the processes it started are killed once ctx is done
+func (p *execPublisher) Publish(ctx context.Context, pub *publication) error {
+	stderr := &cappedBuffer{max: execMaxStderr}
+
+	cmd := exec.Command(p.argv[0], p.argv[1:]...)
+	cmd.Stdin = bytes.NewReader(pub.Body)
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(),
+		"SMTP_FROM="+pub.From,
+		"SMTP_TO="+strings.Join(pub.Recipients, ","),
+		"MESSAGE_ID="+pub.MessageID,
+		"SPF_RESULT="+pub.Values["spf"],
+		"DELIVERY_ID="+pub.Headers[deliveryIDHeader],
+		"CONTENT_TYPE="+pub.ContentType,
+	)
+	// a child left running with the pipes open doesn't hold the delivery
+	cmd.WaitDelay = time.Second
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start the -exec command: %s", err.Error())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return fmt.Errorf("the -exec command was killed after %s", p.timeout)
+	}
+
+	line, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n")
+	line = strings.TrimSpace(line)
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case !errors.As(err, &exitErr):
+		return err
+	case exitErr.ExitCode() >= 1 && exitErr.ExitCode() <= 63:
+		// the text ends up in the smtp stream, it must not be able to inject another reply
+		message := sanitizeReply(line)
+		if message == "" {
+			message = "Your message was rejected by the recipient system"
+		}
+
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      message,
+		}
+	}
+
+	return fmt.Errorf("the -exec command failed (%s): %s", exitErr.String(), line)
+}
+
+func (p *execPublisher) Close() error {
+	return nil
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the rest
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
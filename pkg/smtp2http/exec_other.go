@@ -0,0 +1,13 @@
+//go:build !unix
+
+package smtp2http
+
+import "os/exec"
+
+// setProcessGroup does nothing without process groups
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the command, its children are left running
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
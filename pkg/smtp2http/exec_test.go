@@ -0,0 +1,220 @@
+//go:build unix
+
+package smtp2http
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// execScript writes a shell script running body in a temp dir and returns its path
+func execScript(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestExecAccepts(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	p, err := newExecPublisher(execScript(t, `{ cat; echo; env | grep -E '^(SMTP_FROM|SMTP_TO|MESSAGE_ID|SPF_RESULT|DELIVERY_ID|CONTENT_TYPE)=' | sort; } > `+out), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Publish(context.Background(), testPublication()); err != nil {
+		t.Fatalf("exit 0: %v, want the message accepted", err)
+	}
+
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":"1"}` + "\n" +
+		"CONTENT_TYPE=application/json\n" +
+		"DELIVERY_ID=delivery-1\n" +
+		"MESSAGE_ID=1@example.com\n" +
+		"SMTP_FROM=alice@example.com\n" +
+		"SMTP_TO=bob@example.com,carol@example.com\n" +
+		"SPF_RESULT=pass\n"
+	if string(got) != want {
+		t.Errorf("the command read\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExecRefuses(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"exit 1", "echo 'mailbox unknown' >&2; exit 1", "mailbox unknown"},
+		{"exit 63", "echo 'quota exceeded' >&2; exit 63", "quota exceeded"},
+		{"the first line of stderr", "printf '  spam detected  \\nscore 12.5\\n' >&2; exit 10", "spam detected"},
+		{"a reply injected", "printf 'refused\\r250 OK\\n' >&2; exit 2", "refused?250 OK"},
+		{"non ascii", "echo 'boîte pleine' >&2; exit 3", "bo?te pleine"},
+		{"no stderr", "exit 5", "Your message was rejected by the recipient system"},
+	} {
+		p, err := newExecPublisher(execScript(t, c.script), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = p.Publish(context.Background(), testPublication())
+		var reply *gosmtp.SMTPError
+		if !errors.As(err, &reply) {
+			t.Errorf("%s: %v, want a 550 reply", c.name, err)
+			continue
+		}
+		if reply.Code != 550 || reply.EnhancedCode != (gosmtp.EnhancedCode{5, 7, 1}) || reply.Message != c.want {
+			t.Errorf("%s: %d %v %q, want 550 5.7.1 %q", c.name, reply.Code, reply.EnhancedCode, reply.Message, c.want)
+		}
+	}
+}
+
+func TestExecTemporaryFailure(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		script string
+	}{
+		{"exit 64", "echo 'usage' >&2; exit 64"},
+		{"exit 75", "echo 'try again later' >&2; exit 75"},
+		{"exit 255", "exit 255"},
+		{"killed", "kill -9 $$"},
+	} {
+		p, err := newExecPublisher(execScript(t, c.script), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = p.Publish(context.Background(), testPublication())
+		var reply *gosmtp.SMTPError
+		if err == nil || errors.As(err, &reply) {
+			t.Errorf("%s: %v, want a temporary failure", c.name, err)
+		}
+	}
+}
+
+// processGone reports whether the process pid exited, a zombie no one reaped included
+func processGone(t *testing.T, pid int) bool {
+	t.Helper()
+
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if os.IsNotExist(err) {
+		return true
+	} else if err != nil {
+		t.Skipf("no /proc to look the process up: %v", err)
+	}
+
+	// the state follows the command name in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+
+	return len(fields) > 0 && (fields[0] == "Z" || fields[0] == "X")
+}
+
+func TestExecTimeoutKillsTheProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	p, err := newExecPublisher(execScript(t, "sleep 30 & echo $! > "+pidFile+"; sleep 30"), 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout())
+	defer cancel()
+
+	start := time.Now()
+	err = p.Publish(ctx, testPublication())
+	var reply *gosmtp.SMTPError
+	if err == nil || errors.As(err, &reply) || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("timed out command: %v, want a temporary failure", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Publish returned after %s, want the command killed at the timeout", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !processGone(t, pid) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !processGone(t, pid) {
+		t.Errorf("the child %d of the command is still running", pid)
+	}
+}
+
+func TestNewExecPublisher(t *testing.T) {
+	for _, c := range []struct {
+		command string
+		timeout time.Duration
+	}{
+		{"", time.Second},
+		{"   ", time.Second},
+		{"/nonexistent/hook", time.Second},
+		{"true", 0},
+	} {
+		if _, err := newExecPublisher(c.command, c.timeout); err == nil {
+			t.Errorf("newExecPublisher(%q, %s) accepted", c.command, c.timeout)
+		}
+	}
+
+	p, err := newExecPublisher("true --flag value", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.argv) != 3 || !filepath.IsAbs(p.argv[0]) || p.argv[1] != "--flag" || p.argv[2] != "value" {
+		t.Errorf("argv = %q, want the path of true and its arguments", p.argv)
+	}
+}
+
+func TestExecReplies(t *testing.T) {
+	for _, c := range []struct {
+		script string
+		code   int
+		msg    string
+	}{
+		{"cat > /dev/null", 0, ""},
+		{"echo 'unknown user' >&2; exit 1", 550, "5.7.1 unknown user"},
+		{"exit 75", 451, ""},
+	} {
+		webhook, _ := recordingServer(t)
+
+		cfg := DefaultConfig()
+		cfg.Webhooks = []string{webhook.URL}
+		cfg.WebhookRetries = 0
+		cfg.Exec = execScript(t, c.script)
+		cfg.ExecTimeout = time.Second
+		addr := newTestServer(t, cfg)
+
+		err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(testMail))
+		if code := replyCode(err); code != c.code {
+			t.Errorf("%q: %v, want a %d", c.script, err, c.code)
+		}
+		var tpErr *textproto.Error
+		if c.msg != "" && (!errors.As(err, &tpErr) || tpErr.Msg != c.msg) {
+			t.Errorf("%q: %v, want %q", c.script, err, c.msg)
+		}
+	}
+}
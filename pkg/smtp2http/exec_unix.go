@@ -0,0 +1,18 @@
+//go:build unix
+
+package smtp2http
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs the command in a process group of its own, the processes it starts are killed with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the process group of the command
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
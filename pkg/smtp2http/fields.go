@@ -0,0 +1,140 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// payloadFull sends every field of the payload
+	payloadFull = "full"
+
+	// payloadMinimal only sends the sender, the recipients, the subject and the text body
+	payloadMinimal = "minimal"
+)
+
+// minimalFields are the fields of -payload=minimal
+const minimalFields = "addresses.from,addresses.to,subject,body.text"
+
+// fieldAliases are the short names accepted by -fields
+var fieldAliases = map[string]string{
+	"from": "addresses.from",
+	"to":   "addresses.to",
+}
+
+// payloadFields is the selection of -fields, nil when the whole payload is sent
+var payloadFields fieldTree
+
+// fieldTree holds the selected json paths, a nil subtree keeps the whole value
+type fieldTree map[string]fieldTree
+
+// parseFields validates the comma separated dotted paths against the fields of the payload
+func parseFields(value string) (fieldTree, error) {
+	known := map[string]bool{}
+	jsonPaths(reflect.TypeOf(EmailMessage{}), "", known, map[reflect.Type]bool{})
+
+	tree := fieldTree{}
+	for _, path := range splitList(value) {
+		if alias, ok := fieldAliases[path]; ok {
+			path = alias
+		}
+
+		if !known[path] {
+			return nil, fmt.Errorf("unknown payload field %q", path)
+		}
+
+		tree.add(strings.Split(path, "."))
+	}
+
+	if len(tree) == 0 {
+		return nil, fmt.Errorf("no payload field selected")
+	}
+
+	return tree, nil
+}
+
+func (t fieldTree) add(path []string) {
+	sub, ok := t[path[0]]
+	if ok && sub == nil {
+		// the whole value already is selected
+		return
+	}
+
+	if len(path) == 1 {
+		t[path[0]] = nil
+		return
+	}
+
+	if sub == nil {
+		sub = fieldTree{}
+		t[path[0]] = sub
+	}
+	sub.add(path[1:])
+}
+
+// jsonPaths collects the dotted json paths of the fields of typ, the fields of the list elements are
+// addressed through the list (e.g "attachments.filename"). A recursive type (the nested messages) is only
+// selectable as a whole
+func jsonPaths(typ reflect.Type, prefix string, paths map[string]bool, visiting map[reflect.Type]bool) {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+
+	if typ.Kind() != reflect.Struct || visiting[typ] {
+		return
+	}
+	visiting[typ] = true
+	defer delete(visiting, typ)
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			jsonPaths(field.Type, prefix, paths, visiting)
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		paths[prefix+name] = true
+		jsonPaths(field.Type, prefix+name+".", paths, visiting)
+	}
+}
+
+// pruneFields keeps the selected fields of the json payload
+func pruneFields(body []byte, fields fieldTree) ([]byte, error) {
+	var payload interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields.prune(payload))
+}
+
+func (t fieldTree) prune(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			sub, ok := t[key]
+			if !ok {
+				delete(value, key)
+			} else if sub != nil {
+				value[key] = sub.prune(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			value[i] = t.prune(child)
+		}
+	}
+
+	return v
+}
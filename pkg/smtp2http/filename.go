@@ -0,0 +1,236 @@
+package smtp2http
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PartName is the filename of an attachment or an embedded file, Raw is the parameter as it was sent
+type PartName struct {
+	Name string
+	Raw  string
+}
+
+// PartNames returns the filenames of the attachments and of the embedded files of the raw message, in the order
+// of the Attachments and the EmbeddedFiles of the go-smtpsrv parser, whose own decoding leaves the encoded-words
+// of the charsets other than UTF-8 and latin1 as they are
+func PartNames(raw []byte) (attachments, embedded []PartName) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil
+	}
+
+	contentType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil
+	}
+
+	switch contentType {
+	case "multipart/mixed":
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+
+			contentType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			switch {
+			case contentType == "multipart/alternative" || contentType == "multipart/related":
+				// the parser keeps the embedded files of the last one
+				embedded = embeddedNames(part, params["boundary"])
+			case contentType == "text/plain" || contentType == "text/html":
+			case part.FileName() != "":
+				attachments = append(attachments, partName(part.Header))
+			}
+		}
+	case "multipart/alternative", "multipart/related":
+		embedded = embeddedNames(msg.Body, params["boundary"])
+	}
+
+	return attachments, embedded
+}
+
+// embeddedNames returns the names of the embedded files of a multipart/alternative or related part
+func embeddedNames(r io.Reader, boundary string) []PartName {
+	ret := []PartName{}
+
+	mr := multipart.NewReader(r, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return ret
+		}
+
+		contentType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch {
+		case contentType == "multipart/alternative" || contentType == "multipart/related":
+			ret = append(ret, embeddedNames(part, params["boundary"])...)
+		case contentType == "text/plain" || contentType == "text/html":
+		case part.Header.Get("Content-Transfer-Encoding") != "":
+			ret = append(ret, partName(part.Header))
+		}
+	}
+}
+
+// partName decodes the filename of the Content-Disposition, or else the name of the Content-Type: the RFC 2231
+// extended and continued parameters (filename*0*=, the charset prefixing the percent-encoded value) and the
+// encoded-words (=?windows-1255?B?...?=), in any charset of x/net/html/charset. The path separators and the
+// control characters are removed
+func partName(header textproto.MIMEHeader) PartName {
+	for _, p := range []struct{ header, param string }{{"Content-Disposition", "filename"}, {"Content-Type", "name"}} {
+		params := rawParams(header.Get(p.header))
+		if name, raw, ok := decodeParam(params, p.param); ok {
+			return PartName{Name: cleanFilename(name), Raw: raw}
+		}
+	}
+
+	return PartName{}
+}
+
+// rawParams splits the parameters of a header value, the names are lowercased and the quoted values unquoted
+// but nothing is decoded
+func rawParams(value string) map[string]string {
+	params := map[string]string{}
+
+	_, rest, _ := strings.Cut(value, ";")
+	for rest != "" {
+		var param string
+		param, rest = cutParam(rest)
+
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+		}
+
+		params[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+
+	return params
+}
+
+// cutParam returns the parameter up to the first ';' outside of the quotes, and what follows it
+func cutParam(s string) (string, string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return s[:i], s[i+1:]
+			}
+		}
+	}
+
+	return s, ""
+}
+
+// decodeParam decodes the parameter name of params, raw being its value as sent (the continuations joined)
+func decodeParam(params map[string]string, name string) (decoded, raw string, ok bool) {
+	if value, ok := params[name+"*"]; ok {
+		return decode2231(value), value, true
+	}
+
+	// the continuations, "name*0*" (extended, the first one carries the charset) or "name*0" (a plain value)
+	type segment struct {
+		index    int
+		value    string
+		extended bool
+	}
+	segments := []segment{}
+	for key, value := range params {
+		if !strings.HasPrefix(key, name+"*") {
+			continue
+		}
+
+		suffix := key[len(name)+1:]
+		extended := strings.HasSuffix(suffix, "*")
+		index, err := strconv.Atoi(strings.TrimSuffix(suffix, "*"))
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, segment{index: index, value: value, extended: extended})
+	}
+
+	if len(segments) > 0 {
+		sort.Slice(segments, func(i, j int) bool { return segments[i].index < segments[j].index })
+
+		label, encoded, rawValue := "", []byte{}, ""
+		for i, s := range segments {
+			value := s.value
+			if s.extended {
+				if i == 0 {
+					label, value = split2231(value)
+				}
+				if unescaped, err := url.PathUnescape(value); err == nil {
+					value = unescaped
+				}
+			}
+
+			encoded = append(encoded, value...)
+			rawValue += s.value
+		}
+
+		return decodeBodyCharset(encoded, label), rawValue, true
+	}
+
+	if value, ok := params[name]; ok {
+		return DecodeHeader(value), value, true
+	}
+
+	return "", "", false
+}
+
+// decode2231 decodes an extended value, e.g "utf-8'en'%E2%82%AC"
+func decode2231(value string) string {
+	label, value := split2231(value)
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		value = unescaped
+	}
+
+	return decodeBodyCharset([]byte(value), label)
+}
+
+// split2231 splits the charset and the language off an extended value
+func split2231(value string) (string, string) {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return "", value
+	}
+
+	return parts[0], parts[2]
+}
+
+// cleanFilename replaces the path separators and drops the control characters, the name being used
+// by the receivers to write the files
+func cleanFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, name)
+
+	return strings.TrimSpace(name)
+}
@@ -0,0 +1,117 @@
+package smtp2http
+
+import (
+	"net/smtp"
+	"net/textproto"
+	"testing"
+)
+
+func TestPartName(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		disposition string
+		contentType string
+		want        PartName
+	}{
+		{"plain", `attachment; filename="report.pdf"`, "", PartName{Name: "report.pdf", Raw: "report.pdf"}},
+		{"percent-encoded", `attachment; filename*=utf-8''%E2%82%AC%20rates.pdf`, "", PartName{Name: "€ rates.pdf", Raw: "utf-8''%E2%82%AC%20rates.pdf"}},
+		{"percent-encoded with a language", `attachment; filename*=iso-8859-1'en'%A3%20rates.pdf`, "", PartName{Name: "£ rates.pdf", Raw: "iso-8859-1'en'%A3%20rates.pdf"}},
+		{
+			"continued, a character split between the segments",
+			"attachment; filename*0*=utf-8''%D7%A9%D7; filename*1*=%9C%D7%95%D7%9D.pdf",
+			"",
+			PartName{Name: "שלום.pdf", Raw: "utf-8''%D7%A9%D7%9C%D7%95%D7%9D.pdf"},
+		},
+		{
+			"continued, the segments out of order",
+			`attachment; filename*1="name.pdf"; filename*0="a very long "`,
+			"",
+			PartName{Name: "a very long name.pdf", Raw: "a very long name.pdf"},
+		},
+		{
+			"continued, a windows-1255 charset",
+			"attachment; filename*0*=windows-1255''%F9%EC; filename*1*=%E5%ED.pdf",
+			"",
+			PartName{Name: "שלום.pdf", Raw: "windows-1255''%F9%EC%E5%ED.pdf"},
+		},
+		{"encoded-word windows-1255", `attachment; filename="=?windows-1255?B?+ezl7S5wZGY=?="`, "", PartName{Name: "שלום.pdf", Raw: "=?windows-1255?B?+ezl7S5wZGY=?="}},
+		{"encoded-word iso-2022-jp", `attachment; filename="=?iso-2022-jp?B?GyRCRnxLXDhsGyhCLnR4dA==?="`, "", PartName{Name: "日本語.txt", Raw: "=?iso-2022-jp?B?GyRCRnxLXDhsGyhCLnR4dA==?="}},
+		{"encoded-word quoted-printable", `attachment; filename="=?utf-8?Q?caf=C3=A9.txt?="`, "", PartName{Name: "café.txt", Raw: "=?utf-8?Q?caf=C3=A9.txt?="}},
+		{"the name of the content type", "", `application/pdf; name="=?utf-8?B?w6l0w6kucGRm?="`, PartName{Name: "été.pdf", Raw: "=?utf-8?B?w6l0w6kucGRm?="}},
+		{"the filename before the name", `attachment; filename="a.pdf"`, `application/pdf; name="b.pdf"`, PartName{Name: "a.pdf", Raw: "a.pdf"}},
+		{"path separators", `attachment; filename="../../etc/passwd"`, "", PartName{Name: ".._.._etc_passwd", Raw: "../../etc/passwd"}},
+		{"backslashes", `attachment; filename*=utf-8''..%5C..%5Cboot.ini`, "", PartName{Name: ".._.._boot.ini", Raw: "utf-8''..%5C..%5Cboot.ini"}},
+		{"control characters", `attachment; filename*=utf-8''evil%0D%0AX-Header%3A%201%00.txt`, "", PartName{Name: "evilX-Header: 1.txt", Raw: "utf-8''evil%0D%0AX-Header%3A%201%00.txt"}},
+		{"surrounding spaces", `attachment; filename="  notes.txt "`, "", PartName{Name: "notes.txt", Raw: "  notes.txt "}},
+		{"no name", "inline", "image/png", PartName{}},
+	} {
+		header := textproto.MIMEHeader{}
+		if c.disposition != "" {
+			header.Set("Content-Disposition", c.disposition)
+		}
+		if c.contentType != "" {
+			header.Set("Content-Type", c.contentType)
+		}
+
+		if got := partName(header); got != c.want {
+			t.Errorf("%s: partName = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPartNames(t *testing.T) {
+	_, raw := readFixture(t, "filenames.eml")
+
+	attachments, embedded := PartNames(raw)
+
+	wantAttachments := []PartName{
+		{Name: "שלום.pdf", Raw: "utf-8''%D7%A9%D7%9C%D7%95%D7%9D.pdf"},
+		{Name: "שלום.pdf", Raw: "=?windows-1255?B?+ezl7S5wZGY=?="},
+		{Name: ".._.._evil_run.sh", Raw: `..\..\evil/run.sh`},
+	}
+	if len(attachments) != len(wantAttachments) {
+		t.Fatalf("attachments = %+v, want %+v", attachments, wantAttachments)
+	}
+	for i, want := range wantAttachments {
+		if attachments[i] != want {
+			t.Errorf("attachment %d = %+v, want %+v", i, attachments[i], want)
+		}
+	}
+
+	if want := (PartName{Name: "€ logo.png", Raw: "utf-8''%E2%82%AC%20logo.png"}); len(embedded) != 1 || embedded[0] != want {
+		t.Errorf("embedded = %+v, want %+v", embedded, want)
+	}
+}
+
+func TestPartNamesPayload(t *testing.T) {
+	webhook, payloads := payloadWebhook(t)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	addr := newTestServer(t, cfg)
+
+	_, raw := readFixture(t, "filenames.eml")
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, raw); err != nil {
+		t.Fatal(err)
+	}
+	p := <-payloads
+
+	want := []struct{ filename, raw string }{
+		{"שלום.pdf", "utf-8''%D7%A9%D7%9C%D7%95%D7%9D.pdf"},
+		{"שלום.pdf", "=?windows-1255?B?+ezl7S5wZGY=?="},
+		{".._.._evil_run.sh", `..\..\evil/run.sh`},
+	}
+	if len(p.Attachments) != len(want) {
+		t.Fatalf("%d attachments, want %d", len(p.Attachments), len(want))
+	}
+	for i, w := range want {
+		if a := p.Attachments[i]; a.Filename != w.filename || a.FilenameRaw != w.raw {
+			t.Errorf("attachment %d: filename %q, filename_raw %q, want %q, %q", i, a.Filename, a.FilenameRaw, w.filename, w.raw)
+		}
+	}
+
+	if len(p.EmbeddedFiles) != 1 || p.EmbeddedFiles[0].Filename != "€ logo.png" || p.EmbeddedFiles[0].FilenameRaw != "utf-8''%E2%82%AC%20logo.png" {
+		t.Errorf("embedded files = %+v, want the decoded name of the logo", p.EmbeddedFiles)
+	}
+}
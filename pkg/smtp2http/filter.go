@@ -0,0 +1,152 @@
+package smtp2http
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alash3al/go-smtpsrv"
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// filterReject refuses the messages carrying a disallowed attachment
+	filterReject = "reject"
+
+	// filterStrip drops the disallowed attachments, their entry is marked as stripped
+	filterStrip = "strip"
+)
+
+// attachmentTypes is the filter configured via -allowed-attachment-types
+// and -blocked-attachment-extensions, nil when both are empty
+var attachmentTypes *attachmentFilter
+
+// attachmentFilter decides which attachments are accepted from their content type and extension
+type attachmentFilter struct {
+	types      []string
+	extensions []string
+}
+
+// newAttachmentFilter parses the comma separated lists of allowed mime types
+// (globs like "image/*" are accepted) and of blocked extensions
+func newAttachmentFilter(types, extensions string) (*attachmentFilter, error) {
+	f := &attachmentFilter{}
+
+	for _, t := range strings.Split(types, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+
+		if _, err := path.Match(t, ""); err != nil {
+			return nil, fmt.Errorf("invalid attachment type %q", t)
+		}
+		f.types = append(f.types, t)
+	}
+
+	for _, ext := range strings.Split(extensions, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		f.extensions = append(f.extensions, ext)
+	}
+
+	if len(f.types) == 0 && len(f.extensions) == 0 {
+		return nil, nil
+	}
+
+	return f, nil
+}
+
+// allowed reports whether a file may go through. Senders lie about types so when the
+// extension maps to a known type, that type must be allowed as well as the declared one
+func (f *attachmentFilter) allowed(filename, contentType string) bool {
+	if f == nil {
+		return true
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, blocked := range f.extensions {
+		if ext == blocked {
+			return false
+		}
+	}
+
+	if len(f.types) == 0 {
+		return true
+	}
+
+	if !f.typeAllowed(contentType) {
+		return false
+	}
+
+	if guessed := mime.TypeByExtension(ext); ext != "" && guessed != "" && !f.typeAllowed(guessed) {
+		return false
+	}
+
+	return true
+}
+
+func (f *attachmentFilter) typeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range f.types {
+		if ok, _ := path.Match(pattern, strings.ToLower(mediaType)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// disallowedFile returns the name of the first file of msg the filter refuses, ok is false when there is one.
+// The names are the ones decoded from the raw message, as in the payload
+func disallowedFile(msg *smtpsrv.Email, raw []byte) (name string, ok bool) {
+	attachmentNames, embeddedNames := PartNames(raw)
+
+	for i, a := range msg.Attachments {
+		name := a.Filename
+		if len(attachmentNames) == len(msg.Attachments) && attachmentNames[i].Name != "" {
+			name = attachmentNames[i].Name
+		}
+
+		if !attachmentTypes.allowed(name, a.ContentType) {
+			return name, false
+		}
+	}
+
+	for i, a := range msg.EmbeddedFiles {
+		name := ""
+		if len(embeddedNames) == len(msg.EmbeddedFiles) {
+			name = embeddedNames[i].Name
+		}
+
+		if !attachmentTypes.allowed(name, a.ContentType) {
+			if name == "" {
+				name = a.CID
+			}
+			return name, false
+		}
+	}
+
+	return "", true
+}
+
+// attachmentTypeError is the reply sent when a message carries a disallowed attachment
+func attachmentTypeError(filename string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Attachment type not allowed: " + sanitizeReply(filename),
+	}
+}
@@ -0,0 +1,832 @@
+package smtp2http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/mail"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alash3al/go-smtpsrv"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/emersion/go-smtp"
+	"github.com/zaccone/spf"
+	"golang.org/x/crypto/openpgp"
+)
+
+// messagePolicies are the sender authentication checks applied to each message
+type messagePolicies struct {
+	SPF   spfPolicy
+	DKIM  dkimPolicy
+	DMARC dmarcMode
+}
+
+// newHandler returns the handler turning each received message into a webhook request
+func newHandler(allowedDomains []string, policies messagePolicies) HandlerFunc {
+	return func(c *Context) error {
+		start := time.Now()
+		logger := slog.With(
+			"delivery_id", c.DeliveryID(),
+			"remote_ip", remoteIP(c.RemoteAddr()).String(),
+			"from", c.From().Address,
+			"to", strings.Join(extractEmails(c.To()), ","),
+			"tls", c.TLS().HandshakeComplete,
+		)
+
+		metricMessagesReceived.Inc()
+		metricMessageSize.Observe(float64(c.Size()))
+		c.SetPhase(phaseChecks)
+
+		// every envelope recipient is forwarded, the ones outside of -domain are dropped. The aliases are
+		// resolved first, originals keeps what the rewritten ones were received as
+		recipients, refused := []*mail.Address{}, []string{}
+		originals := map[*mail.Address]*mail.Address{}
+		for _, received := range c.To() {
+			rcpt, rewritten := recipientAliases.rewrite(received)
+			if rewritten {
+				logger.Debug("recipient rewritten", "recipient", received.Address, "alias_of", rcpt.Address)
+				originals[rcpt] = received
+			}
+
+			if !domainAllowed(rcpt.Address, allowedDomains) {
+				logger.Debug("domain not allowed for recipient", "recipient", rcpt.Address)
+				refused = append(refused, addressDomain(rcpt.Address))
+				continue
+			}
+
+			recipients = append(recipients, rcpt)
+		}
+
+		if len(recipients) < 1 {
+			logger.Warn("message rejected, recipient domain not allowed", "refused", refused)
+			return rejectMessage(c, "domain", "", domainError(refused))
+		}
+
+		var spfResult, spfDomain, spfExplanation string
+		if policies.SPF != spfPolicyNone {
+			result, explanation, err := c.SPF()
+			spfResult, spfDomain, spfExplanation = result.String(), asciiDomain(addressDomain(c.From().Address)), explanation
+			logger = logger.With("spf_result", spfResult)
+
+			if result == spf.Temperror || result == spf.Permerror {
+				logger.Warn("spf check inconclusive", "spf_domain", spfDomain, "error", err)
+			}
+
+			if policies.SPF.rejects(result) {
+				logger.Warn("message rejected, spf check failed", "spf_domain", spfDomain, "spf_explanation", explanation)
+				return rejectMessage(c, "spf", "", spfError(spfDomain, result))
+			}
+		}
+
+		var dkimResults []*EmailDKIMResult
+		if policies.DKIM != dkimPolicyNone {
+			results, err := verifyDKIM(c.Raw(), conf.DNSTimeout)
+			if err != nil {
+				logger.Warn("cannot verify the dkim signatures", "error", err)
+			}
+			dkimResults = results
+
+			if policies.DKIM.rejects(results) {
+				logger.Warn("message rejected, no valid dkim signature", "signatures", len(results))
+				return rejectMessage(c, "dkim", "", errNoValidDKIM)
+			}
+		}
+
+		// dmarc needs the domain of the From header, without it there is nothing to evaluate. The domains
+		// are the A-labels of the dns and of the dkim signatures
+		var dmarcResult *EmailDMARCResult
+		if header, err := c.Header(); err == nil {
+			if from := ParseAddressList(header, "From", nil); len(from) > 0 && addressDomain(from[0].Address) != "" {
+				dmarcResult = evaluateDMARC(asciiDomain(addressDomain(from[0].Address)), spfResult, spfDomain, dkimResults, conf.DNSTimeout)
+				logger = logger.With("dmarc_result", dmarcResult.Result)
+
+				if dmarcResult.Result == "temperror" || dmarcResult.Result == "permerror" {
+					logger.Warn("dmarc evaluation inconclusive", "dmarc_domain", dmarcResult.Domain, "error", dmarcResult.Error)
+				}
+
+				if policies.DMARC == dmarcModeEnforce && dmarcResult.Disposition == dmarc.PolicyReject {
+					logger.Warn("message rejected, dmarc policy is reject", "dmarc_domain", dmarcResult.Domain)
+					return rejectMessage(c, "dmarc", "", dmarcError(dmarcResult.Domain))
+				}
+			}
+		}
+
+		// the messages without a Message-ID or a valid Date get ones, unless -strict-headers rejects them
+		if header, err := c.Header(); err == nil && conf.StrictHeaders {
+			if name := missingHeader(header); name != "" {
+				logger.Warn("message rejected, missing header", "header", name)
+				return rejectMessage(c, "missing_header", "", missingHeaderError(name))
+			}
+		}
+
+		if err := handlerTimedOut(c, logger, ""); err != nil {
+			return err
+		}
+		c.SetPhase(phaseParse)
+
+		var msg *smtpsrv.Email
+		var messageID string
+		if conf.RawOnly {
+			if header, err := c.Header(); err == nil {
+				messageID = strings.Trim(header.Get("Message-Id"), "<> ")
+			}
+		} else {
+			parsed, err := c.Parse()
+			if err != nil {
+				logger.Warn("message rejected, cannot parse it", "error", err)
+				return rejectMessage(c, "parse_error", "", errUnparseable)
+			}
+
+			msg, messageID = parsed, parsed.MessageID
+			if messageID != "" {
+				logger = logger.With("message_id", messageID)
+			}
+
+			if conf.AttachmentFilter == filterReject {
+				if name, ok := disallowedFile(msg, c.Raw()); !ok {
+					logger.Warn("message rejected, attachment type not allowed", "filename", name)
+					return rejectMessage(c, "attachment_type", messageID, attachmentTypeError(name))
+				}
+			}
+		}
+
+		// the rules only name themselves in the logs, the sender gets a generic reply
+		header, _ := c.Header()
+		match := contentRules.match(c, header, msg)
+		if match != nil {
+			logger = logger.With("matched_rules", match.Rules)
+
+			switch match.Action {
+			case ruleActionReject:
+				logger.Warn("message rejected by the content rules")
+				return rejectMessage(c, "content_policy", messageID, errContentPolicy)
+			case ruleActionDiscard:
+				metricMessagesDiscarded.Inc()
+				logger.Info("message discarded by the content rules")
+				return nil
+			}
+		}
+
+		// the automatic replies are accepted so the sender doesn't retry nor bounce them
+		if conf.DiscardAutoReplies && ClassifyMessage(header).AutoReply {
+			metricMessagesDiscarded.Inc()
+			logger.Info("message discarded, automatic reply")
+			return nil
+		}
+
+		// the sender retrying a message it timed out on although it was delivered
+		key := dedupeKey(messageID, c.Raw(), recipients)
+		if dedupe.seen(key, time.Now()) {
+			metricDuplicates.Inc()
+			logger.Info("duplicate message, already delivered")
+			return nil
+		}
+
+		// generated once the dedupe hashed the message, the id is a new one on each retry of the sender
+		if messageID == "" {
+			messageID = generatedMessageID(c)
+			logger = logger.With("message_id", messageID, "message_id_generated", true)
+		}
+
+		// the temp files of a message over -max-memory-per-message are removed however the handler returns,
+		// a queued message hands them over to the worker
+		spill := newSpillFiles()
+		defer func() { spill.remove() }()
+
+		// every target gets its own request, they are all posted (or published) concurrently
+		c.SetPhase(phasePayload)
+		deliveries := []*delivery{}
+		for i, group := range routeRecipients(recipients) {
+			if err := handlerTimedOut(c, logger, messageID); err != nil {
+				return err
+			}
+
+			// the attachment readers were consumed by the previous group, nothing is posted yet when the
+			// parse fails
+			if i > 0 && msg != nil {
+				parsed, err := c.Parse()
+				if err != nil {
+					logger.Warn("message rejected, cannot parse it", "error", err)
+					return rejectMessage(c, "parse_error", messageID, errUnparseable)
+				}
+				msg = parsed
+			}
+
+			var req *webhookRequest
+			if conf.RawOnly {
+				req = &webhookRequest{
+					Body:        c.Raw(),
+					ContentType: "message/rfc822",
+					Headers: map[string]string{
+						"X-Envelope-From": c.From().Address,
+						"X-Envelope-To":   strings.Join(extractEmails(group.Recipients), ", "),
+					},
+				}
+			} else if conf.PayloadFormat == payloadFormatSendGrid || conf.PayloadFormat == payloadFormatMailgun || conf.PayloadFormat == payloadFormatPostmark {
+				var err error
+				switch conf.PayloadFormat {
+				case payloadFormatSendGrid:
+					req, err = buildSendGrid(c, msg, group.Recipients, spfResult, dkimResults)
+				case payloadFormatMailgun:
+					req, err = buildMailgun(c, msg, group.Recipients, conf.WebhookSecret, time.Now())
+				case payloadFormatPostmark:
+					req, err = buildPostmark(c, msg, group.Recipients)
+				}
+
+				if err != nil {
+					logger.Warn("message rejected, cannot build the payload", "payload_format", conf.PayloadFormat, "error", err)
+					return rejectMessage(c, "part_error", messageID, errPartUnreadable)
+				}
+			} else {
+				jsonData, parts, err := buildPayload(logger, c, msg, group.Recipients, originals, spill)
+				var perr *PartError
+				switch {
+				case errors.Is(err, errAttachmentTooLarge) || errors.Is(err, errTooManyAttachments):
+					logger.Warn("message rejected, over the attachment limits", "error", err)
+					return rejectMessage(c, "attachment_limit", messageID, errAttachmentLimit)
+				case errors.As(err, &perr):
+					logger.Warn("message rejected, cannot read an attachment", "error", err)
+					return rejectMessage(c, "part_error", messageID, errPartUnreadable)
+				case err != nil:
+					logger.Error("cannot store the attachments", "error", err)
+					return errStoreFailed
+				}
+
+				jsonData.SPFResult = spfResult
+				jsonData.SPFDomain = spfDomain
+				jsonData.SPFExplanation = spfExplanation
+				jsonData.DKIM = dkimResults
+				jsonData.DMARC = dmarcResult
+				jsonData.DNSBL = c.DNSBL()
+				jsonData.FCrDNS = c.FCrDNS()
+				jsonData.HeloValid = c.HeloValid()
+				if match != nil {
+					jsonData.MatchedRules = match.Rules
+				}
+
+				// marshal once, the signature must be computed over the exact bytes we send
+				body, err := json.Marshal(jsonData)
+				if err != nil {
+					logger.Error("cannot marshal the payload", "error", err)
+					return errInternal
+				}
+
+				// pruned before anything else, the selection is exactly what is sent
+				if payloadFields != nil {
+					if body, err = pruneFields(body, payloadFields); err != nil {
+						logger.Error("cannot select the payload fields", "error", err)
+						return errInternal
+					}
+				}
+
+				req = &webhookRequest{Body: body, ContentType: "application/json"}
+				if bodyTemplate != nil {
+					if req.Body, err = renderBody(bodyTemplate, jsonData); err != nil {
+						logger.Error("cannot render the body template", "webhook_body_template", conf.WebhookBodyTemplate, "error", err)
+						return errInternal
+					}
+					req.ContentType = "text/plain; charset=utf-8"
+				}
+				if conf.NotifyFormat != "" {
+					if req.Body, err = buildNotification(conf.NotifyFormat, jsonData, conf.NotifyBodyLength); err != nil {
+						logger.Error("cannot build the notification", "notify_format", conf.NotifyFormat, "error", err)
+						return errInternal
+					}
+				}
+
+				if conf.WebhookContentType != "" {
+					req.ContentType = conf.WebhookContentType
+				}
+
+				if conf.PayloadFormat == payloadFormatCloudEvents {
+					date := msg.Date
+					if date.IsZero() {
+						date = MessageDate(msg.Header)
+					}
+					if date.IsZero() {
+						date = c.ReceivedAt()
+					}
+
+					if err := wrapCloudEvent(req, conf.CloudEventsMode, messageID, date); err != nil {
+						logger.Error("cannot build the cloudevents payload", "error", err)
+						return errInternal
+					}
+				}
+
+				switch {
+				case conf.WebhookFormat == webhookFormatMultipart && spill != nil && spill.over:
+					req.Body = nil
+					if req.BodyFile, req.ContentType, err = spill.multipart(body, parts); err != nil {
+						logger.Error("cannot write the multipart payload to a temp file", "error", err)
+						return errInternal
+					}
+				case conf.WebhookFormat == webhookFormatMultipart:
+					req.Body, req.ContentType, err = buildMultipart(body, parts)
+					if err != nil {
+						logger.Error("cannot build the multipart payload", "error", err)
+						return errInternal
+					}
+				default:
+					if req.BodyFile, err = spill.assemble(body); err != nil {
+						logger.Error("cannot write the payload to a temp file", "error", err)
+						return errInternal
+					}
+					if req.BodyFile != "" {
+						req.Body = nil
+					}
+				}
+
+				if req.BodyFile != "" {
+					logger.Info("payload written to a temp file, over the memory limit", "payload_file", req.BodyFile, "max_memory_per_message", conf.MaxMessageMemory)
+				}
+			}
+
+			// the same id on every attempt, the spool persists the headers along with the body
+			if req.Headers == nil {
+				req.Headers = map[string]string{}
+			}
+			req.Headers[deliveryIDHeader] = c.DeliveryID()
+
+			values := placeholderValues(group, c.From().Address, messageID, spfResult)
+			if !conf.DisableWebhook {
+				for _, url := range group.URLs {
+					target := *req
+					target.URL = expandWebhookURL(url, values)
+					logger.Debug("webhook url resolved", "webhook", target.URL)
+					deliveries = append(deliveries, &delivery{req: &target})
+				}
+			}
+
+			recipients := []string{}
+			for _, rcpt := range group.Recipients {
+				recipients = append(recipients, rcpt.Address)
+			}
+
+			for _, p := range publishers {
+				deliveries = append(deliveries, &delivery{
+					publisher: p,
+					publication: &publication{
+						Body:        req.Body,
+						ContentType: req.ContentType,
+						Headers:     req.Headers,
+						Recipient:   recipients[0],
+						Recipients:  recipients,
+						From:        c.From().Address,
+						MessageID:   messageID,
+						Values:      values,
+					},
+				})
+			}
+		}
+
+		// nothing is sent, the payloads are shown as the targets would receive them
+		if conf.DryRun {
+			return dryRun(logger, messageID, c.DeliveryID(), deliveries)
+		}
+
+		if err := handlerTimedOut(c, logger, messageID); err != nil {
+			return err
+		}
+
+		raw := c.Raw()
+
+		if queue != nil {
+			err := queue.enqueue(&deliveryJob{logger: logger, deliveries: deliveries, raw: raw, spill: spill, event: envelopeEvent(c, "queued_delivery", messageID)})
+			switch {
+			case err == errQueueFull:
+				logger.Warn("message rejected, the delivery queue is full")
+				return rejectMessage(c, "queue_full", messageID, errQueueFull)
+			case err != nil:
+				logger.Error("message rejected, cannot persist it to the queue", "error", err)
+				return rejectMessage(c, "queue_error", messageID, errInternal)
+			}
+			spill = nil
+
+			dedupe.add(key, time.Now())
+			logger.Info("message queued", "targets", len(deliveries), "duration_ms", time.Since(start).Milliseconds())
+			return nil
+		}
+
+		c.SetPhase(phaseDelivery)
+		targets, err := deliverAll(c.Context(), logger, deliveries, raw, start)
+		archiveMessage(logger, raw, err != nil)
+		if err != nil {
+			if err := handlerTimedOut(c, logger, messageID); err != nil {
+				return err
+			}
+
+			logger.Warn("message rejected, delivery failed", "targets", targets)
+			return notifyRejection(envelopeEvent(c, "webhook", messageID).withFailedDelivery(deliveries), err)
+		}
+
+		dedupe.add(key, time.Now())
+		logger.Info("message accepted", "targets", targets, "duration_ms", time.Since(start).Milliseconds())
+
+		return nil
+	}
+}
+
+// the phases of the handler, the one running is reported when -handler-timeout expires
+const (
+	phaseChecks   = "checks"
+	phaseParse    = "parse"
+	phasePayload  = "payload"
+	phaseDelivery = "delivery"
+)
+
+// handlerTimedOut rejects the message with a 451 4.4.2 once -handler-timeout expired, it returns nil until then.
+// The parsing and the attachments can't be interrupted, the handler checks in between its phases
+func handlerTimedOut(c *Context, logger *slog.Logger, messageID string) error {
+	if c.Context().Err() == nil {
+		return nil
+	}
+
+	metricHandlerTimeouts.WithLabelValues(c.Phase()).Inc()
+	logger.Warn("message rejected, handler timeout", "phase", c.Phase(), "handler_timeout", conf.HandlerTimeout)
+
+	return rejectMessage(c, "handler_timeout", messageID, errHandlerTimeout)
+}
+
+// deliverAll runs the deliveries concurrently, it returns the outcome of each target and the error of
+// the first failed one when -sink-policy isn't satisfied: by default a publisher failed or -fanout-policy isn't
+// satisfied by the webhooks. Canceling ctx interrupts the deliveries
+func deliverAll(ctx context.Context, logger *slog.Logger, deliveries []*delivery, raw []byte, start time.Time) (string, error) {
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func(d *delivery) {
+			defer wg.Done()
+
+			// a panic fails the delivery rather than the whole server, the temp files of the message are
+			// then removed as after any failure
+			defer func() {
+				if p := recover(); p != nil {
+					logger.Error("delivery panicked", "target", d.target(), "panic", p, "stack", string(debug.Stack()))
+					d.err = fmt.Errorf("delivery panicked: %v", p)
+				}
+			}()
+
+			d.run(ctx, logger, start, raw)
+		}(d)
+	}
+	wg.Wait()
+
+	webhooks, accepted, outputs, published := 0, 0, 0, 0
+	targets := []string{}
+	var firstErr error
+	for _, d := range deliveries {
+		targets = append(targets, d.target()+"="+d.outcome())
+		if d.err != nil && firstErr == nil {
+			firstErr = d.err
+		}
+
+		switch {
+		case d.publisher != nil:
+			outputs++
+			if d.err == nil {
+				published++
+			}
+		case d.err == nil:
+			webhooks++
+			accepted++
+		default:
+			webhooks++
+		}
+	}
+
+	// the outputs must all acknowledge the message, whatever the fanout policy of the webhooks
+	webhooksOK := webhooks == 0 || (accepted > 0 && (conf.FanoutPolicy != fanoutAll || accepted == webhooks))
+	ok := webhooksOK && published == outputs
+	if conf.SinkPolicy == sinkPolicyAny {
+		ok = (webhooks > 0 && webhooksOK) || published > 0
+	}
+
+	if !ok {
+		return strings.Join(targets, ","), firstErr
+	}
+
+	return strings.Join(targets, ","), nil
+}
+
+const (
+	// sinkPolicyAll accepts a message once the webhooks (per -fanout-policy) and every output accepted it
+	sinkPolicyAll = "all"
+
+	// sinkPolicyAny accepts a message once the webhooks or one of the outputs accepted it
+	sinkPolicyAny = "any"
+)
+
+const (
+	// fanoutAny accepts a message once any of its webhooks accepted it
+	fanoutAny = "any"
+
+	// fanoutAll accepts a message only once all of its webhooks accepted it
+	fanoutAll = "all"
+)
+
+// delivery is the delivery of a message to one webhook, or to one publisher
+type delivery struct {
+	req         *webhookRequest
+	publisher   publisher
+	publication *publication
+	status      int
+	spooled     bool
+	err         error
+
+	// retryAfter is the delay a rate limited webhook asked for
+	retryAfter time.Duration
+
+	// queued is the id of the delivery persisted in -queue-path
+	queued uint64
+}
+
+// target names the webhook or the publisher of the delivery
+func (d *delivery) target() string {
+	if d.publisher != nil {
+		return d.publisher.Name()
+	}
+
+	return d.req.URL
+}
+
+// refused reports whether the target refused the message for good: a webhook with a 4xx, an output with a 5xx reply
+func (d *delivery) refused() bool {
+	if d.publisher == nil {
+		return isPermanentFailure(d.status)
+	}
+
+	var reply *smtp.SMTPError
+	return errors.As(d.err, &reply) && reply.Code >= 500
+}
+
+// run posts the request, a failure the webhook didn't choose (unreachable or 5xx) is spooled when the spool is enabled
+func (d *delivery) run(ctx context.Context, logger *slog.Logger, start time.Time, raw []byte) {
+	if d.publisher != nil {
+		d.publish(ctx, logger.With("output", d.publisher.Name()), start)
+		return
+	}
+
+	logger = logger.With("webhook", d.req.URL)
+	d.status, d.retryAfter, d.err = deliver(ctx, logger, d.req, start)
+	if d.err == nil || spool == nil || isPermanentFailure(d.status) {
+		return
+	}
+
+	// a raw-only body already is the original message
+	if conf.RawOnly {
+		raw = nil
+	}
+
+	name, err := spool.put(d.req, raw, d.retryAfter)
+	if err != nil {
+		logger.Error("cannot spool the message", "error", err)
+		return
+	}
+
+	logger.Info("message spooled", "spool_file", name)
+	d.spooled, d.err = true, nil
+}
+
+// publish publishes the publication, waiting for the broker acknowledgement
+func (d *delivery) publish(ctx context.Context, logger *slog.Logger, start time.Time) {
+	timeout := conf.PublishTimeout
+	if p, ok := d.publisher.(timedPublisher); ok {
+		timeout = p.Timeout()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := d.publisher.Publish(ctx, d.publication); err != nil {
+		metricPublishFailures.WithLabelValues(d.publisher.Name()).Inc()
+		logger.Error("publication failed", "error", err, "duration_ms", time.Since(start).Milliseconds())
+
+		// an output may choose the reply, the exec hook refusing a message does
+		var reply *smtp.SMTPError
+		if !errors.As(err, &reply) {
+			reply = errPublishFailed
+		}
+		d.err = reply
+		return
+	}
+
+	logger.Info("message published", "duration_ms", time.Since(start).Milliseconds())
+}
+
+// outcome summarizes the delivery for the logs
+func (d *delivery) outcome() string {
+	switch {
+	case d.publisher != nil && d.err == nil:
+		return "ok"
+	case d.publisher != nil && d.refused():
+		return "refused"
+	case d.spooled:
+		return "spooled"
+	case d.status == 0:
+		return "error"
+	}
+
+	return strconv.Itoa(d.status)
+}
+
+// deliver posts the request and maps the outcome to the smtp reply, it returns the webhook status (0 when unreachable)
+// and the Retry-After of a rate limited webhook
+func deliver(ctx context.Context, logger *slog.Logger, req *webhookRequest, start time.Time) (int, time.Duration, error) {
+	resp, err := postWebhook(ctx, logger, req, start.Add(time.Duration(conf.WriteTimeout)*time.Second))
+	if err != nil && isProxyError(err) {
+		logger.Error("webhook delivery failed, proxy error", "error", err, "duration_ms", time.Since(start).Milliseconds())
+		return 0, 0, errWebhookUnreachable
+	} else if err != nil && isTokenError(err) {
+		logger.Error("webhook delivery failed, token endpoint error", "error", err, "duration_ms", time.Since(start).Milliseconds())
+		return 0, 0, errWebhookUnreachable
+	} else if err != nil {
+		logger.Error("webhook delivery failed", "error", err, "duration_ms", time.Since(start).Milliseconds())
+		return 0, 0, errWebhookUnreachable
+	} else if retryAfter, limited := rateLimited(resp, time.Now()); limited {
+		logger.Error("webhook delivery failed, rate limited",
+			"webhook_status", resp.StatusCode(),
+			"retry_after", retryAfter,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+		return resp.StatusCode(), retryAfter, errWebhookRateLimited
+	} else if !isSuccess(resp.StatusCode()) {
+		logger.Error("webhook delivery failed",
+			"webhook_status", resp.StatusCode(),
+			"response", truncate(string(resp.Body()), 512),
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+		return resp.StatusCode(), 0, webhookStatusError(resp.StatusCode(), resp.Body())
+	}
+
+	logger.Info("message delivered", "webhook_status", resp.StatusCode(), "payload_size", req.size(), "duration_ms", time.Since(start).Milliseconds())
+
+	return resp.StatusCode(), 0, nil
+}
+
+// buildConnection describes the smtp connection the message was received on
+func buildConnection(c *Context) *EmailConnection {
+	conn := &EmailConnection{
+		RemoteIP:   remoteIP(c.RemoteAddr()).String(),
+		Listener:   c.Listener(),
+		Helo:       c.Helo(),
+		TLS:        c.TLS().HandshakeComplete,
+		AuthUser:   c.User(),
+		ReceivedAt: c.ReceivedAt().UTC().Format(time.RFC3339),
+	}
+
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		conn.RemotePort = tcpAddr.Port
+	}
+
+	if conn.TLS {
+		conn.TLSVersion = tls.VersionName(c.TLS().Version)
+		conn.TLSCipher = tls.CipherSuiteName(c.TLS().CipherSuite)
+	}
+
+	return conn
+}
+
+// nestedDepth is how many levels of attached messages are parsed, none without -parse-nested
+func nestedDepth() int {
+	if !conf.ParseNested {
+		return 0
+	}
+
+	return conf.NestedDepth
+}
+
+// smimeRoots are the trusted roots of the S/MIME signatures configured via -smime-ca-bundle, nil for the system ones
+var smimeRoots *x509.CertPool
+
+// loadCABundle reads the pem certificates of path, nil when path is empty
+func loadCABundle(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// pgpKeyring are the private keys configured via -pgp-private-key, nil when the pgp messages are only detected
+var pgpKeyring openpgp.EntityList
+
+// loadPGPKeyring reads the private keys of path and decrypts them with the passphrase, or the one of passphraseFile.
+// It returns nil when path is empty
+func loadPGPKeyring(path, passphrase, passphraseFile string) (openpgp.EntityList, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	if passphraseFile != "" {
+		data, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadPGPKeyring(data, []byte(passphrase))
+}
+
+// buildPayload converts the parsed message into the json payload, along with the file parts of a multipart body,
+// originals are the addresses the aliases were received as. It fails when the attachments are over the limits,
+// can't be read or can't be stored
+func buildPayload(logger *slog.Logger, c *Context, msg *smtpsrv.Email, recipients []*mail.Address, originals map[*mail.Address]*mail.Address, spill *spillFiles) (*EmailMessage, []*filePart, error) {
+	// the bodies are kept in memory, the files are spilled once they no longer fit along with them
+	spill.keep(int64(len(msg.TextBody) + len(msg.HTMLBody)))
+	files := newFileEncoder(spill)
+	env := &Envelope{
+		DeliveryID: c.DeliveryID(),
+		From:       c.From(),
+		To:         recipients,
+		AuthUser:   c.User(),
+		Connection: buildConnection(c),
+		ReceivedAt: c.ReceivedAt(),
+		ServerName: conf.ServerName,
+		Raw:        c.Raw(),
+	}
+
+	if msg.MessageID == "" {
+		env.MessageID = generatedMessageID(c)
+	}
+
+	// the recipients as received, only when an alias rewrote one of them
+	originalTo, rewritten := []*mail.Address{}, false
+	for _, rcpt := range recipients {
+		original, ok := originals[rcpt]
+		if !ok {
+			original = rcpt
+		}
+		originalTo, rewritten = append(originalTo, original), rewritten || ok
+	}
+	if rewritten {
+		env.OriginalTo = originalTo
+	}
+
+	jsonData, err := BuildPayload(msg, env, PayloadOptions{
+		Version:              conf.PayloadVersion,
+		Headers:              conf.Headers,
+		IncludeRaw:           conf.IncludeRaw,
+		DeriveText:           conf.DeriveTextFromHTML,
+		InlineCID:            conf.InlineCID,
+		InlineCIDMaxSize:     conf.InlineCIDMaxSize,
+		InlineCIDOmit:        conf.InlineCIDOmit,
+		MaxFileSize:          conf.MaxAttachmentSize,
+		Files:                files,
+		Allowed:              attachmentTypes.allowed,
+		KeepTNEF:             conf.KeepWinmailDat,
+		NestedDepth:          nestedDepth(),
+		SubaddressSeparators: conf.SubaddressSeparator,
+		SubaddressStripDots:  conf.SubaddressStripDots,
+		SMIMERoots:           smimeRoots,
+		PGPKeyring:           pgpKeyring,
+		Logger:               logger,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jsonData.ParseWarnings = append(files.warnings, jsonData.ParseWarnings...)
+	jsonData.Producer = producer()
+
+	return jsonData, files.parts, nil
+}
+
+// missingHeader returns the name of the first of the Message-ID and Date headers the message is missing,
+// a Date that can't be parsed counting as missing. Empty when it has both
+func missingHeader(header mail.Header) string {
+	if strings.Trim(header.Get("Message-Id"), "<> ") == "" {
+		return "Message-ID"
+	}
+
+	if MessageDate(header).IsZero() {
+		return "Date"
+	}
+
+	return ""
+}
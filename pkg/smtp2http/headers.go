@@ -0,0 +1,81 @@
+package smtp2http
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// SelectHeaders returns the decoded headers forwarded in the payload according to -headers:
+// "all", "none" or a comma separated list of the header names to include
+func SelectHeaders(header mail.Header, mode string) map[string][]string {
+	mode = strings.TrimSpace(mode)
+	if mode == "none" || mode == "" {
+		return nil
+	}
+
+	var allowed map[string]bool
+	if mode != "all" {
+		allowed = map[string]bool{}
+		for _, name := range strings.Split(mode, ",") {
+			allowed[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	ret := map[string][]string{}
+	for name, values := range header {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if allowed != nil && !allowed[name] {
+			continue
+		}
+
+		for _, v := range values {
+			ret[name] = append(ret[name], DecodeHeader(v))
+		}
+	}
+
+	return ret
+}
+
+// RawHeaders returns the header block of the raw message
+func RawHeaders(raw []byte) string {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i >= 0 {
+			return string(raw[:i+len(sep)/2])
+		}
+	}
+
+	return string(raw)
+}
+
+// HeaderFields returns the decoded header fields of the raw message in the order they were received,
+// the folded lines are unfolded
+func HeaderFields(raw []byte) [][2]string {
+	fields := [][2]string{}
+
+	for _, line := range strings.Split(strings.ReplaceAll(RawHeaders(raw), "\r\n", "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+
+		// a continuation line of the previous field
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1][1] += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		fields = append(fields, [2]string{strings.TrimSpace(name), strings.TrimSpace(value)})
+	}
+
+	for i := range fields {
+		fields[i][1] = DecodeHeader(fields[i][1])
+	}
+
+	return fields
+}
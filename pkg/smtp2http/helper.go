@@ -0,0 +1,126 @@
+package smtp2http
+
+import (
+	"net/mail"
+	"strings"
+)
+
+func extractEmails(addr []*mail.Address, _ ...error) []string {
+	ret := []string{}
+
+	for _, e := range addr {
+		ret = append(ret, e.Address)
+	}
+
+	return ret
+}
+
+// parseDomains splits the comma separated -domain value
+func parseDomains(value string) []string {
+	ret := []string{}
+
+	for _, d := range strings.Split(value, ",") {
+		if d = normalizeDomain(d); d != "" {
+			ret = append(ret, asciiDomain(d))
+		}
+	}
+
+	return ret
+}
+
+// splitList splits a comma separated flag value, dropping the empty items
+func splitList(value string) []string {
+	ret := []string{}
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+
+	return ret
+}
+
+// normalizeDomain lowercases the domain and strips the surrounding spaces
+// as well as the trailing dot of the fully qualified form ("example.com.")
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// asciiDomain returns the A-label (punycode) form of an internationalized domain, the one of the dns,
+// "*." wildcards included
+func asciiDomain(domain string) string {
+	if strings.HasPrefix(domain, "*.") {
+		return "*." + asciiDomain(domain[2:])
+	}
+
+	_, ascii := IDNADomain(domain)
+	return ascii
+}
+
+// addressDomain returns the normalized domain part of an email address,
+// it is empty when either the local part or the domain is missing
+func addressDomain(address string) string {
+	sep := strings.LastIndex(address, "@")
+	if sep < 1 {
+		return ""
+	}
+
+	return normalizeDomain(address[sep+1:])
+}
+
+// domainAllowed reports whether the address belongs to one of the allowed domains, compared in their
+// A-label form. "*.example.com" matches any subdomain of example.com and an empty list accepts everything
+func domainAllowed(address string, allowed []string) bool {
+	if len(allowed) < 1 {
+		return true
+	}
+
+	domain := asciiDomain(addressDomain(address))
+	if domain == "" {
+		return false
+	}
+
+	for _, a := range allowed {
+		if strings.HasPrefix(a, "*.") {
+			if strings.HasSuffix(domain, a[1:]) {
+				return true
+			}
+		} else if domain == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return s[:n] + "..."
+}
+
+// maxReplyLength caps the text of the smtp replies built from untrusted input
+const maxReplyLength = 200
+
+// sanitizeReply makes s safe to use in an smtp reply: a single line of printable
+// ascii (anything else becomes "?") of at most maxReplyLength characters
+func sanitizeReply(s string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '?'
+		}
+		return r
+	}, s)
+
+	if len(cleaned) > maxReplyLength {
+		cleaned = cleaned[:maxReplyLength]
+	}
+
+	return strings.TrimSpace(cleaned)
+}
+
+// func smtpsrvMesssage2EmailMessage(msg *smtpsrv.Context)
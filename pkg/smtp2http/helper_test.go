@@ -0,0 +1,80 @@
+package smtp2http
+
+import "testing"
+
+func TestDomainAllowed(t *testing.T) {
+	allowed := parseDomains(" Example.COM , *.corp.example.org ")
+
+	for _, tt := range []struct {
+		address string
+		want    bool
+	}{
+		{"user@example.com", true},
+		{"user@Example.COM", true},
+		{"USER@EXAMPLE.COM", true},
+		{"user@example.com.", true},
+		{"user@ example.com ", true},
+		{"user@mail.corp.example.org", true},
+		{"user@corp.example.org", false},
+		{"user@example.net", false},
+		{"user@notexample.com", false},
+		{"@example.com", false},
+		{"user@", false},
+		{"example.com", false},
+		{"", false},
+	} {
+		if got := domainAllowed(tt.address, allowed); got != tt.want {
+			t.Errorf("domainAllowed(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestDomainAllowedWithoutDomains(t *testing.T) {
+	for _, value := range []string{"", " ", ",", " , "} {
+		if !domainAllowed("user@example.com", parseDomains(value)) {
+			t.Errorf("-domain %q refused a recipient", value)
+		}
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	for in, want := range map[string]string{
+		"Example.COM":    "example.com",
+		" example.com ":  "example.com",
+		"example.com.":   "example.com",
+		" EXAMPLE.com. ": "example.com",
+		"":               "",
+	} {
+		if got := normalizeDomain(in); got != want {
+			t.Errorf("normalizeDomain(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDomainAllowedIDNA(t *testing.T) {
+	// the punycoded müller.example, a unicode wildcard entry and a latin one a cyrillic domain imitates
+	allowed := parseDomains("xn--mller-kva.example, *.bücher.example, paypal.example")
+
+	for _, tt := range []struct {
+		address string
+		want    bool
+	}{
+		{"jürgen@müller.example", true},
+		{"jürgen@MÜLLER.example", true},
+		{"jurgen@xn--mller-kva.example", true},
+		{"jurgen@XN--MLLER-KVA.EXAMPLE", true},
+		{"δοκιμή@mail.bücher.example", true},
+		{"user@mail.xn--bcher-kva.example", true},
+		{"用户@shop.bücher.example", true},
+		{"user@bücher.example", false},
+		{"user@muller.example", false},
+		{"user@paypal.example", true},
+		// the "а" is cyrillic
+		{"user@pаypal.example", false},
+		{"пользователь@пример.example", false},
+	} {
+		if got := domainAllowed(tt.address, allowed); got != tt.want {
+			t.Errorf("domainAllowed(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package smtp2http
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// spacePattern matches the runs of white space collapsed into a single space outside of <pre>
+	spacePattern = regexp.MustCompile(`[ \t\r\n\f]+`)
+
+	// blankLinesPattern matches the runs of blank lines collapsed into a single blank line
+	blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToText renders an html body as plain text: the blocks and <br> become line breaks, the links are
+// rendered as "text (url)", the entities are decoded and the script/style contents are dropped
+func HTMLToText(body string) string {
+	var b strings.Builder
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	skip, pre := 0, 0
+
+	// the links being rendered, with where their text starts in the output
+	type link struct {
+		href  string
+		start int
+	}
+	links := []link{}
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		tok := z.Token()
+		switch tt {
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+
+			if pre > 0 {
+				b.WriteString(tok.Data)
+			} else {
+				b.WriteString(spacePattern.ReplaceAllString(tok.Data, " "))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch tok.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Noscript, atom.Template:
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case atom.Br:
+				b.WriteString("\n")
+			case atom.Pre:
+				pre++
+				b.WriteString("\n")
+			case atom.Li:
+				b.WriteString("\n- ")
+			case atom.Td, atom.Th:
+				b.WriteString(" ")
+			case atom.Hr:
+				b.WriteString("\n\n")
+			case atom.A:
+				if tt == html.StartTagToken {
+					links = append(links, link{href: attribute(tok, "href"), start: b.Len()})
+				}
+			case atom.Img:
+				if alt := attribute(tok, "alt"); alt != "" {
+					b.WriteString(alt)
+				}
+			default:
+				if isBlock(tok.DataAtom) {
+					b.WriteString("\n\n")
+				}
+			}
+		case html.EndTagToken:
+			switch tok.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Noscript, atom.Template:
+				if skip > 0 {
+					skip--
+				}
+			case atom.Pre:
+				if pre > 0 {
+					pre--
+				}
+				b.WriteString("\n")
+			case atom.A:
+				if len(links) == 0 {
+					continue
+				}
+
+				l := links[len(links)-1]
+				links = links[:len(links)-1]
+
+				text := strings.TrimSpace(b.String()[l.start:])
+				if l.href != "" && !strings.HasPrefix(l.href, "#") && strings.TrimPrefix(l.href, "mailto:") != text {
+					b.WriteString(" (" + l.href + ")")
+				}
+			default:
+				if isBlock(tok.DataAtom) {
+					b.WriteString("\n\n")
+				}
+			}
+		}
+	}
+
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// isBlock reports whether the element is rendered on its own lines
+func isBlock(a atom.Atom) bool {
+	switch a {
+	case atom.P, atom.Div, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Ul, atom.Ol, atom.Table, atom.Tr, atom.Blockquote, atom.Section, atom.Article,
+		atom.Header, atom.Footer, atom.Title, atom.Address, atom.Dl, atom.Dt, atom.Dd:
+		return true
+	}
+
+	return false
+}
+
+// attribute returns the value of an attribute of the token, empty when it isn't set
+func attribute(tok html.Token, name string) string {
+	for _, a := range tok.Attr {
+		if a.Key == name {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+
+	return ""
+}
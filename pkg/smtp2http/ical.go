@@ -0,0 +1,404 @@
+package smtp2http
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icalProperty is a content line of an iCalendar object (RFC 5545), e.g "DTSTART;TZID=Europe/Paris:20240501T100000"
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icalComponent is a BEGIN/END block, e.g VCALENDAR, VEVENT or VTIMEZONE
+type icalComponent struct {
+	Name       string
+	Properties []*icalProperty
+	Children   []*icalComponent
+}
+
+// property returns the first property named name, nil if there is none
+func (c *icalComponent) property(name string) *icalProperty {
+	for _, p := range c.Properties {
+		if p.Name == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// value returns the value of the first property named name
+func (c *icalComponent) value(name string) string {
+	if p := c.property(name); p != nil {
+		return p.Value
+	}
+
+	return ""
+}
+
+// children returns the sub components named name
+func (c *icalComponent) children(name string) []*icalComponent {
+	ret := []*icalComponent{}
+	for _, child := range c.Children {
+		if child.Name == name {
+			ret = append(ret, child)
+		}
+	}
+
+	return ret
+}
+
+// parseICal parses the iCalendar data into a tree, the returned component is a root holding the VCALENDARs
+func parseICal(data []byte) (*icalComponent, error) {
+	root := &icalComponent{}
+	stack := []*icalComponent{root}
+
+	for _, line := range unfoldICal(string(data)) {
+		p, err := parseICalLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		top := stack[len(stack)-1]
+		switch p.Name {
+		case "BEGIN":
+			c := &icalComponent{Name: strings.ToUpper(p.Value)}
+			top.Children = append(top.Children, c)
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 1 || top.Name != strings.ToUpper(p.Value) {
+				return nil, fmt.Errorf("unexpected END:%s", p.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			top.Properties = append(top.Properties, p)
+		}
+	}
+
+	if len(stack) > 1 {
+		return nil, fmt.Errorf("%s isn't terminated", stack[len(stack)-1].Name)
+	}
+
+	if len(root.children("VCALENDAR")) == 0 {
+		return nil, fmt.Errorf("no VCALENDAR")
+	}
+
+	return root, nil
+}
+
+// unfoldICal joins the folded lines, a line starting with a space or a tab continues the previous one
+func unfoldICal(data string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	ret := []string{}
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			ret = append(ret, line)
+		}
+	}
+
+	return ret
+}
+
+// parseICalLine splits a content line into its name, its parameters and its value, the parameter values
+// can be quoted to hold ':' and ';'
+func parseICalLine(line string) (*icalProperty, error) {
+	p := &icalProperty{Params: map[string]string{}}
+
+	i := strings.IndexAny(line, ";:")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid line %q", line)
+	}
+	p.Name, line = strings.ToUpper(line[:i]), line[i:]
+
+	for strings.HasPrefix(line, ";") {
+		line = line[1:]
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid parameter of %s", p.Name)
+		}
+		name := strings.ToUpper(line[:eq])
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			end := strings.IndexByte(line[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted parameter of %s", p.Name)
+			}
+			value, line = line[1:end+1], line[end+2:]
+		} else {
+			end := strings.IndexAny(line, ";:")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid parameter of %s", p.Name)
+			}
+			value, line = line[:end], line[end:]
+		}
+
+		p.Params[name] = value
+	}
+
+	if !strings.HasPrefix(line, ":") {
+		return nil, fmt.Errorf("no value for %s", p.Name)
+	}
+	p.Value = line[1:]
+
+	return p, nil
+}
+
+// icalText unescapes a TEXT value
+func icalText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// icalZones resolves the TZID parameters, from the tz database or else from the VTIMEZONE definitions
+type icalZones map[string]*icalComponent
+
+func newICalZones(calendar *icalComponent) icalZones {
+	zones := icalZones{}
+	for _, tz := range calendar.children("VTIMEZONE") {
+		zones[tz.value("TZID")] = tz
+	}
+
+	return zones
+}
+
+// parseTime parses a DATE or DATE-TIME property, a floating time (neither UTC nor with a TZID) is taken as UTC
+// like an unknown TZID is
+func (z icalZones) parseTime(p *icalProperty) (t time.Time, allDay bool, err error) {
+	value := strings.TrimSpace(p.Value)
+
+	if p.Params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err = time.Parse("20060102", value)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+
+	t, err = time.Parse("20060102T150405", value)
+	if err != nil {
+		return t, false, err
+	}
+
+	return z.localTime(p.Params["TZID"], t), false, nil
+}
+
+// localTime moves the wall clock time t (parsed as UTC) to the zone tzid
+func (z icalZones) localTime(tzid string, t time.Time) time.Time {
+	if tzid == "" {
+		return t
+	}
+
+	if loc, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+	}
+
+	// the zones outside of the tz database (the windows names of Outlook, e.g "W. Europe Standard Time")
+	tz, ok := z[tzid]
+	if !ok {
+		return t
+	}
+
+	offset, ok := vtimezoneOffset(tz, t)
+	if !ok {
+		return t
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.FixedZone(tzid, offset))
+}
+
+// vtimezoneOffset returns the offset of the VTIMEZONE at the wall clock time t, the daylight saving time
+// is only followed for the yearly BYMONTH/BYDAY rules (what the mail clients emit)
+func vtimezoneOffset(tz *icalComponent, t time.Time) (int, bool) {
+	standard, daylight := tz.children("STANDARD"), tz.children("DAYLIGHT")
+	if len(standard) == 0 {
+		standard, daylight = daylight, nil
+	}
+	if len(standard) == 0 {
+		return 0, false
+	}
+
+	stdOffset, ok := icalOffset(standard[0].value("TZOFFSETTO"))
+	if !ok {
+		return 0, false
+	}
+
+	if len(daylight) == 0 {
+		return stdOffset, true
+	}
+
+	dstOffset, ok := icalOffset(daylight[0].value("TZOFFSETTO"))
+	if !ok {
+		return stdOffset, true
+	}
+
+	dstStart, ok1 := yearlyTransition(daylight[0], t.Year())
+	stdStart, ok2 := yearlyTransition(standard[0], t.Year())
+	if !ok1 || !ok2 {
+		return stdOffset, true
+	}
+
+	// the daylight saving time spans the new year in the southern hemisphere
+	inDST := !t.Before(dstStart) && t.Before(stdStart)
+	if dstStart.After(stdStart) {
+		inDST = !t.Before(dstStart) || t.Before(stdStart)
+	}
+
+	if inDST {
+		return dstOffset, true
+	}
+
+	return stdOffset, true
+}
+
+// yearlyTransition returns the wall clock time the STANDARD or DAYLIGHT observance starts in year,
+// e.g "RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU" is the last sunday of march
+func yearlyTransition(observance *icalComponent, year int) (time.Time, bool) {
+	start, err := time.Parse("20060102T150405", observance.value("DTSTART"))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	rule := map[string]string{}
+	for _, part := range strings.Split(observance.value("RRULE"), ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			rule[strings.ToUpper(k)] = strings.ToUpper(v)
+		}
+	}
+
+	if rule["FREQ"] != "YEARLY" {
+		return time.Time{}, false
+	}
+
+	month, err := strconv.Atoi(rule["BYMONTH"])
+	if err != nil || month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+
+	byDay := rule["BYDAY"]
+	if len(byDay) < 2 {
+		return time.Time{}, false
+	}
+
+	weekday, ok := icalWeekdays[byDay[len(byDay)-2:]]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	nth := 1
+	if n := byDay[:len(byDay)-2]; n != "" {
+		if nth, err = strconv.Atoi(n); err != nil || nth == 0 {
+			return time.Time{}, false
+		}
+	}
+
+	var day time.Time
+	if nth > 0 {
+		day = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		day = day.AddDate(0, 0, (int(weekday)-int(day.Weekday())+7)%7+(nth-1)*7)
+		// a fifth week the month doesn't have is its last one
+		for day.Month() != time.Month(month) {
+			day = day.AddDate(0, 0, -7)
+		}
+	} else {
+		day = time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC)
+		day = day.AddDate(0, 0, -((int(day.Weekday())-int(weekday)+7)%7)+(nth+1)*7)
+	}
+
+	return time.Date(year, time.Month(month), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, time.UTC), true
+}
+
+var icalWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// icalOffset parses an UTC offset, e.g "+0100" or "-053000"
+func icalOffset(value string) (int, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) != 5 && len(value) != 7 {
+		return 0, false
+	}
+
+	sign := 1
+	switch value[0] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, false
+	}
+
+	hours, err1 := strconv.Atoi(value[1:3])
+	minutes, err2 := strconv.Atoi(value[3:5])
+	seconds, err3 := 0, error(nil)
+	if len(value) == 7 {
+		seconds, err3 = strconv.Atoi(value[5:7])
+	}
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, false
+	}
+
+	return sign * (hours*3600 + minutes*60 + seconds), true
+}
+
+// icalDuration parses a DURATION value, e.g "PT1H30M" or "P1D"
+func icalDuration(value string) (time.Duration, bool) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign, value = -1, value[1:]
+	}
+	value = strings.TrimPrefix(value, "+")
+
+	if !strings.HasPrefix(value, "P") || len(value) < 3 {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour}
+	timeUnits := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+
+	var d time.Duration
+	n := ""
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c >= '0' && c <= '9':
+			n += string(c)
+		case c == 'T':
+			units = timeUnits
+		default:
+			unit, ok := units[c]
+			count, err := strconv.Atoi(n)
+			if !ok || err != nil {
+				return 0, false
+			}
+			d += time.Duration(count) * unit
+			n = ""
+		}
+	}
+
+	if n != "" {
+		return 0, false
+	}
+
+	return sign * d, true
+}
@@ -0,0 +1,80 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+// cidPattern matches the cid: references of the src attributes, the second group is the content id
+var cidPattern = regexp.MustCompile(`(?i)(\bsrc\s*=\s*["']?)cid:([^"'\s>]+)`)
+
+// ErrInlineTooLarge is returned when the html would be over -inline-cid-max-size once the images are inlined
+var ErrInlineTooLarge = errors.New("the html body would be over -inline-cid-max-size once the embedded files are inlined, they were left as cid references")
+
+// InlineCIDs rewrites the cid: references of the html body to data: uris built from the matching embedded files,
+// it returns the html and the content ids that were inlined. The data of these files is buffered so they can
+// still be encoded afterwards, the ones over maxFileSize or not allowed aren't inlined. The html is left as is,
+// with ErrInlineTooLarge, when it would be larger than maxSize
+func InlineCIDs(body string, files []smtpsrv.EmbeddedFile, maxSize, maxFileSize int64, allowed func(filename, contentType string) bool) (string, map[string]bool, error) {
+	referenced := map[string]bool{}
+	for _, m := range cidPattern.FindAllStringSubmatch(body, -1) {
+		referenced[unescapeCID(m[2])] = true
+	}
+
+	uris := map[string]string{}
+	for i, f := range files {
+		if !referenced[f.CID] || uris[f.CID] != "" || !allowed("", f.ContentType) {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(f.Data)
+		if err != nil {
+			return body, nil, &PartError{Name: f.CID, Err: err}
+		}
+		files[i].Data = bytes.NewReader(data)
+
+		// a file over the attachment limits is left to the encoder
+		if maxFileSize > 0 && int64(len(data)) > maxFileSize {
+			continue
+		}
+
+		contentType := f.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		uris[f.CID] = "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+	}
+
+	inlined := map[string]bool{}
+	html := cidPattern.ReplaceAllStringFunc(body, func(ref string) string {
+		m := cidPattern.FindStringSubmatch(ref)
+		cid := unescapeCID(m[2])
+		if uris[cid] == "" {
+			return ref
+		}
+
+		inlined[cid] = true
+		return m[1] + uris[cid]
+	})
+
+	if maxSize > 0 && int64(len(html)) > maxSize {
+		return body, map[string]bool{}, ErrInlineTooLarge
+	}
+
+	return html, inlined, nil
+}
+
+// unescapeCID returns the content id of a cid: url, which may be url escaped
+func unescapeCID(ref string) string {
+	if cid, err := url.PathUnescape(ref); err == nil {
+		return cid
+	}
+
+	return ref
+}
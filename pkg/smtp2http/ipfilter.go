@@ -0,0 +1,136 @@
+package smtp2http
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// ipFilter decides which client addresses may connect, the deny list takes precedence
+// over the allow list and an empty allow list allows everything that isn't denied
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPFilter parses the comma separated allow/deny lists, it returns nil when both are empty
+func newIPFilter(allow, deny string) (*ipFilter, error) {
+	f := &ipFilter{}
+
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil, nil
+	}
+
+	return f, nil
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, a bare ip stands for itself
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	ret := []*net.IPNet{}
+
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", s)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", s)
+		}
+		ret = append(ret, ipnet)
+	}
+
+	return ret, nil
+}
+
+// allowed reports whether ip may connect
+func (f *ipFilter) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterListener refuses the connections from the addresses rejected by its filter with a 554
+type filterListener struct {
+	net.Listener
+	filter *ipFilter
+}
+
+func newFilterListener(l net.Listener, filter *ipFilter) net.Listener {
+	if filter == nil {
+		return l
+	}
+
+	return &filterListener{Listener: l, filter: filter}
+}
+
+func (l *filterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if admit(conn, l.allow) {
+			return conn, nil
+		}
+	}
+}
+
+// allow answers the connection with a 554 when its address isn't allowed
+func (l *filterListener) allow(conn net.Conn) bool {
+	ip := remoteIP(conn.RemoteAddr())
+	if l.filter.allowed(ip) {
+		return true
+	}
+
+	slog.Info("connection refused, address not allowed", "remote_ip", ip.String())
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("554 5.7.1 Access denied\r\n"))
+
+	return false
+}
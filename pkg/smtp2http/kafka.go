@@ -0,0 +1,98 @@
+package smtp2http
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+const (
+	// kafkaKeyRecipient keys the kafka messages by the recipient address
+	kafkaKeyRecipient = "recipient"
+
+	// kafkaKeyMessageID keys the kafka messages by the Message-ID
+	kafkaKeyMessageID = "message_id"
+)
+
+// kafkaConfig is the configuration of the kafka output
+type kafkaConfig struct {
+	Brokers      []string
+	Topic        string
+	Key          string
+	TLS          bool
+	TLSCA        string
+	SASLUsername string
+	SASLPassword string
+}
+
+// kafkaPublisher produces the payloads to a kafka topic, waiting for all the in-sync replicas
+type kafkaPublisher struct {
+	writer *kafka.Writer
+	key    string
+}
+
+func newKafkaPublisher(cfg kafkaConfig) (*kafkaPublisher, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("-kafka-brokers requires -kafka-topic")
+	}
+
+	if cfg.Key != kafkaKeyRecipient && cfg.Key != kafkaKeyMessageID {
+		return nil, fmt.Errorf("invalid kafka key %q, expected recipient or message_id", cfg.Key)
+	}
+
+	transport := &kafka.Transport{}
+	if cfg.TLS || cfg.TLSCA != "" {
+		tlsConfig, err := clientTLSConfig(cfg.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = tlsConfig
+	}
+
+	if cfg.SASLUsername != "" {
+		transport.SASL = plain.Mechanism{Username: cfg.SASLUsername, Password: cfg.SASLPassword}
+	}
+
+	return &kafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			// every write waits for its acks, don't hold it back to fill a batch
+			BatchTimeout: 10 * time.Millisecond,
+			Transport:    transport,
+		},
+		key: cfg.Key,
+	}, nil
+}
+
+func (p *kafkaPublisher) Name() string {
+	return "kafka"
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, pub *publication) error {
+	key := strings.ToLower(pub.Recipient)
+	if p.key == kafkaKeyMessageID && pub.MessageID != "" {
+		key = pub.MessageID
+	}
+
+	headers := []kafka.Header{{Key: "Content-Type", Value: []byte(pub.ContentType)}}
+	for name, value := range pub.Headers {
+		headers = append(headers, kafka.Header{Key: name, Value: []byte(value)})
+	}
+
+	return p.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(key),
+		Value:   pub.Body,
+		Headers: headers,
+	})
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,192 @@
+package smtp2http
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// rateLimitIdle is how long a client must stay quiet before its bucket is dropped,
+// by then the bucket is full again so dropping it changes nothing
+const rateLimitIdle = time.Minute
+
+// smtpConnections is the number of open smtp connections
+var smtpConnections int64
+
+var (
+	errRateLimited = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many messages from your address, slow down",
+	}
+	errTooManyRecipients = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients",
+	}
+	errTooManyMessages = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many messages in this session, closing connection",
+	}
+)
+
+// liveConns are the open connections by client address, so a session can end its own connection
+var liveConns sync.Map
+
+// closeAfterReply closes the connection of the client at addr once the next reply is written
+func closeAfterReply(addr net.Addr) {
+	if conn, ok := liveConns.Load(addr.String()); ok {
+		atomic.StoreInt32(&conn.(*countedConn).closing, 1)
+	}
+}
+
+// limitListener counts the open connections and refuses the ones above max (0 means unlimited)
+type limitListener struct {
+	net.Listener
+	max int64
+}
+
+func newLimitListener(l net.Listener, max int) net.Listener {
+	return &limitListener{Listener: l, max: int64(max)}
+}
+
+// Accept returns the next connection, the connections above the limit are answered with a 421 and
+// closed before the smtp server ever sees them. Behind the proxy protocol a connection takes its slot
+// once its header was read
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		counted := &countedConn{Conn: conn}
+		if admit(conn, func(conn net.Conn) bool { return l.take(conn, counted) }) {
+			return counted, nil
+		}
+	}
+}
+
+// take gives a slot to the connection, or answers it with a 421 when there is none left
+func (l *limitListener) take(conn net.Conn, counted *countedConn) bool {
+	if n := atomic.AddInt64(&smtpConnections, 1); l.max > 0 && n > l.max {
+		atomic.AddInt64(&smtpConnections, -1)
+		slog.Info("connection refused, too many connections", "remote_ip", remoteIP(conn.RemoteAddr()).String())
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("421 4.7.0 Too many connections, slow down\r\n"))
+		return false
+	}
+
+	atomic.StoreInt32(&counted.held, 1)
+	liveConns.Store(conn.RemoteAddr().String(), counted)
+
+	return true
+}
+
+// countedConn releases its slot when closed
+type countedConn struct {
+	net.Conn
+	held    int32
+	closing int32
+}
+
+// Write writes a reply, the connection is closed after it when closeAfterReply was called
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if atomic.LoadInt32(&c.closing) == 1 {
+		c.Close()
+	}
+
+	return n, err
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.held, 1, 0) {
+		atomic.AddInt64(&smtpConnections, -1)
+		liveConns.Delete(c.Conn.RemoteAddr().String())
+	}
+
+	return c.Conn.Close()
+}
+
+// rateLimiter is a token bucket per client ip, a nil limiter allows everything
+type rateLimiter struct {
+	perSecond float64
+	burst     float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter allows perMinute messages per minute and client ip, it returns nil when perMinute is 0
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+
+	l := &rateLimiter{
+		perSecond: float64(perMinute) / 60,
+		burst:     float64(perMinute),
+		buckets:   map[string]*bucket{},
+	}
+
+	go func() {
+		for now := range time.Tick(rateLimitIdle) {
+			l.cleanup(now)
+		}
+	}()
+
+	return l
+}
+
+// allow takes a token from the bucket of ip
+func (l *rateLimiter) allow(ip string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[ip]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.perSecond
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// cleanup drops the buckets of the clients idle for rateLimitIdle
+func (l *rateLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) >= rateLimitIdle {
+			delete(l.buckets, ip)
+		}
+	}
+}
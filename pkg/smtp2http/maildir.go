@@ -0,0 +1,97 @@
+package smtp2http
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maildir is the archive configured via -maildir, nil when disabled
+var maildir *maildirArchive
+
+// maildirArchive writes the messages to a maildir, see https://cr.yp.to/proto/maildir.html
+type maildirArchive struct {
+	dir      string
+	hostname string
+	count    uint64
+}
+
+// openMaildir creates the tmp, new and cur directories of the maildir
+func openMaildir(dir string) (*maildirArchive, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	// the slash and the colon have a meaning in a maildir filename
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	return &maildirArchive{dir: dir, hostname: hostname}, nil
+}
+
+// write delivers the message to tmp then moves it to new, so a reader never sees a partial message
+func (m *maildirArchive) write(raw []byte) (string, error) {
+	now := time.Now()
+	name := strconv.FormatInt(now.Unix(), 10) +
+		".M" + strconv.Itoa(now.Nanosecond()/1000) +
+		"P" + strconv.Itoa(os.Getpid()) +
+		"Q" + strconv.FormatUint(atomic.AddUint64(&m.count, 1), 10) +
+		"." + m.hostname
+
+	tmp := filepath.Join(m.dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+
+	// the message must be on disk before it shows up in new
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(m.dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return name, nil
+}
+
+// archiveMessage writes the message as it was received to -maildir, or only
+// when its delivery failed with -maildir-on-failure-only
+func archiveMessage(logger *slog.Logger, raw []byte, failed bool) {
+	if maildir == nil || (conf.MaildirOnFailureOnly && !failed) {
+		return
+	}
+
+	name, err := maildir.write(raw)
+	if err != nil {
+		logger.Error("cannot write the message to the maildir", "error", err)
+		return
+	}
+
+	logger.Debug("message archived", "maildir_file", name)
+}
@@ -0,0 +1,156 @@
+package smtp2http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+// payloadFormatMailgun posts the multipart/form-data body of a Mailgun route forwarding to an url
+const payloadFormatMailgun = "mailgun"
+
+// buildMailgun builds the request a Mailgun route would have forwarded for the message, one per recipient
+// on Mailgun's side so the first recipient is the "recipient" field. The signature is Mailgun's:
+// the hex encoded HMAC-SHA256 of timestamp+token keyed by -webhook-secret, empty without a secret
+func buildMailgun(c *Context, msg *smtpsrv.Email, recipients []*mail.Address, secret string, now time.Time) (*webhookRequest, error) {
+	header, err := c.Header()
+	if err != nil {
+		header = mail.Header{}
+	}
+
+	text, html, err := ExtractBodies(c.Raw())
+	if err != nil {
+		text, html = msg.TextBody, msg.HTMLBody
+	}
+
+	messageHeaders, err := json.Marshal(HeaderFields(c.Raw()))
+	if err != nil {
+		return nil, err
+	}
+
+	strippedText, strippedSignature := stripReply(text)
+	timestamp, token, signature := mailgunSignature(secret, now)
+
+	fields := [][2]string{
+		{"recipient", recipients[0].Address},
+		{"sender", c.From().Address},
+		{"from", DecodeHeader(header.Get("From"))},
+		{"subject", DecodeHeader(header.Get("Subject"))},
+		{"body-plain", text},
+		{"body-html", html},
+		{"stripped-text", strippedText},
+		{"stripped-signature", strippedSignature},
+		// mailgun strips the quoted parts of the html with its own heuristics, they can't be reproduced
+		{"stripped-html", ""},
+		{"message-headers", string(messageHeaders)},
+		{"timestamp", timestamp},
+		{"token", token},
+		{"signature", signature},
+	}
+
+	parts := []*filePart{}
+	contentIDs := map[string]string{}
+
+	for _, a := range msg.Attachments {
+		if !attachmentTypes.allowed(a.Filename, a.ContentType) {
+			continue
+		}
+
+		field := "attachment-" + strconv.Itoa(len(parts)+1)
+		parts = append(parts, &filePart{field: field, filename: a.Filename, contentType: a.ContentType, data: a.Data})
+	}
+
+	for _, e := range msg.EmbeddedFiles {
+		if !attachmentTypes.allowed("", e.ContentType) {
+			continue
+		}
+
+		field := "attachment-" + strconv.Itoa(len(parts)+1)
+		contentIDs["<"+e.CID+">"] = field
+		parts = append(parts, &filePart{field: field, filename: e.CID, contentType: e.ContentType, data: e.Data})
+	}
+
+	fields = append(fields, [2]string{"attachment-count", strconv.Itoa(len(parts))})
+
+	if len(contentIDs) > 0 {
+		ids, err := json.Marshal(contentIDs)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, [2]string{"content-id-map", string(ids)})
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	for _, f := range fields {
+		if err := w.WriteField(f[0], f[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range parts {
+		if err := writeFilePart(w, p.field, p.filename, p.contentType, p.data); err != nil {
+			return nil, readError(p.filename, err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return &webhookRequest{Body: buf.Bytes(), ContentType: w.FormDataContentType()}, nil
+}
+
+// mailgunSignature returns the timestamp, the random token and their signature
+func mailgunSignature(secret string, now time.Time) (string, string, string) {
+	b := make([]byte, 25)
+	rand.Read(b)
+
+	timestamp, token := strconv.FormatInt(now.Unix(), 10), hex.EncodeToString(b)
+	if secret == "" {
+		return timestamp, token, ""
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + token))
+
+	return timestamp, token, hex.EncodeToString(mac.Sum(nil))
+}
+
+// stripReply splits a plain text body into its new content and its signature: the quoted ("> ")
+// lines, and everything after an "On ... wrote:" line, are dropped and the signature starts at the
+// "-- " delimiter. It is much simpler than the detection of Mailgun
+func stripReply(text string) (string, string) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	kept := []string{}
+	signature := ""
+
+	for i, line := range lines {
+		if line == "-- " {
+			signature = strings.TrimSpace(strings.Join(lines[i+1:], "\n"))
+			break
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "On ") && strings.HasSuffix(trimmed, "wrote:") {
+			break
+		}
+
+		if !strings.HasPrefix(trimmed, ">") {
+			kept = append(kept, line)
+		}
+	}
+
+	return strings.TrimSpace(strings.Join(kept, "\n")), signature
+}
@@ -0,0 +1,301 @@
+// Package smtp2http turns the emails received over smtp into the json payload posted to the webhooks,
+// it is the part of the smtp2http server that can be embedded in another service
+package smtp2http
+
+// EmailAddress ...
+type EmailAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address,omitempty"`
+
+	// LocalPart is the local part without its tag ("support" of "support+billing@example.com"), Tag is empty when
+	// there is none and NormalizedAddress is the address without its tag, the domain lowercased
+	LocalPart         string `json:"local_part,omitempty"`
+	Tag               string `json:"tag"`
+	NormalizedAddress string `json:"normalized_address,omitempty"`
+
+	// DomainUnicode and DomainASCII are the U-label and the A-label (punycode) forms of the domain
+	DomainUnicode string `json:"domain_unicode,omitempty"`
+	DomainASCII   string `json:"domain_ascii,omitempty"`
+}
+
+// EmailFile is the content of an attachment or embedded file, depending on -attachments
+type EmailFile struct {
+	Field     string `json:"field,omitempty"`
+	Path      string `json:"path,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Stripped  bool   `json:"stripped,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Data      string `json:"data,omitempty"`
+}
+
+// AttachmentSourceTNEF is the source of the attachments extracted from a TNEF one
+const AttachmentSourceTNEF = "tnef"
+
+// AttachmentSourcePGP is the source of the encrypted OpenPGP message exposed as an attachment
+const AttachmentSourcePGP = "pgp"
+
+// EmailAttachment ...
+type EmailAttachment struct {
+	Filename    string `json:"filename"`
+	FilenameRaw string `json:"filename_raw,omitempty"`
+	ContentType string `json:"content_type"`
+
+	// Source is AttachmentSourceTNEF for the files extracted from a winmail.dat, AttachmentSourcePGP for
+	// the encrypted OpenPGP message
+	Source string `json:"source,omitempty"`
+	EmailFile
+}
+
+// EmailEmbeddedFile ...
+type EmailEmbeddedFile struct {
+	CID         string `json:"cid"`
+	Filename    string `json:"filename,omitempty"`
+	FilenameRaw string `json:"filename_raw,omitempty"`
+	ContentType string `json:"content_type"`
+
+	// Inlined is set when the html body references the file as a data: uri instead of a cid: one
+	Inlined bool `json:"inlined,omitempty"`
+	EmailFile
+}
+
+// EmailDKIMResult ...
+type EmailDKIMResult struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	Result   string `json:"result"`
+	Error    string `json:"error,omitempty"`
+}
+
+// EmailDMARCResult ...
+type EmailDMARCResult struct {
+	Domain      string `json:"domain"`
+	Result      string `json:"result"`
+	Policy      string `json:"policy,omitempty"`
+	Disposition string `json:"disposition"`
+	SPFAligned  bool   `json:"spf_aligned"`
+	DKIMAligned bool   `json:"dkim_aligned"`
+	Error       string `json:"error,omitempty"`
+}
+
+// EmailDNSBLResult ...
+type EmailDNSBLResult struct {
+	List   string   `json:"list"`
+	Listed bool     `json:"listed"`
+	Codes  []string `json:"codes,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// EmailReceived is a Received header, the fields that couldn't be extracted are empty
+type EmailReceived struct {
+	From      string `json:"from,omitempty"`
+	FromIP    string `json:"from_ip,omitempty"`
+	By        string `json:"by,omitempty"`
+	With      string `json:"with,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Raw       string `json:"raw"`
+}
+
+// EmailDSN is the delivery status of a bounce, FailedRecipients comes from the X-Failed-Recipients header
+type EmailDSN struct {
+	ReportingMTA     string               `json:"reporting_mta,omitempty"`
+	Recipients       []*EmailDSNRecipient `json:"recipients,omitempty"`
+	FailedRecipients []string             `json:"failed_recipients,omitempty"`
+}
+
+// EmailDSNRecipient is the status reported for a recipient, the types of the values (rfc822, dns, smtp) are dropped
+type EmailDSNRecipient struct {
+	FinalRecipient    string `json:"final_recipient"`
+	OriginalRecipient string `json:"original_recipient,omitempty"`
+	Action            string `json:"action,omitempty"`
+	Status            string `json:"status,omitempty"`
+	DiagnosticCode    string `json:"diagnostic_code,omitempty"`
+	RemoteMTA         string `json:"remote_mta,omitempty"`
+}
+
+// EmailCalendar is the iCalendar data of a message, Method is REQUEST, REPLY, CANCEL...
+type EmailCalendar struct {
+	Method string                `json:"method,omitempty"`
+	Events []*EmailCalendarEvent `json:"events"`
+}
+
+// EmailCalendarEvent is a VEVENT, Start and End are RFC3339 in the zone of the event or YYYY-MM-DD for the all-day events
+type EmailCalendarEvent struct {
+	UID            string                   `json:"uid,omitempty"`
+	Summary        string                   `json:"summary,omitempty"`
+	Location       string                   `json:"location,omitempty"`
+	Status         string                   `json:"status,omitempty"`
+	Sequence       int                      `json:"sequence,omitempty"`
+	Organizer      *EmailCalendarAttendee   `json:"organizer,omitempty"`
+	Attendees      []*EmailCalendarAttendee `json:"attendees"`
+	Start          string                   `json:"start,omitempty"`
+	End            string                   `json:"end,omitempty"`
+	AllDay         bool                     `json:"all_day,omitempty"`
+	Timezone       string                   `json:"timezone,omitempty"`
+	RecurrenceRule string                   `json:"rrule,omitempty"`
+	RecurrenceID   string                   `json:"recurrence_id,omitempty"`
+}
+
+// EmailCalendarAttendee is an ORGANIZER or an ATTENDEE along with its participation status (ACCEPTED, DECLINED...)
+type EmailCalendarAttendee struct {
+	Address  string `json:"address"`
+	Name     string `json:"name,omitempty"`
+	PartStat string `json:"partstat,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+// EmailSMIME is the S/MIME status of a message: Valid is set when the signature matches the signed content and
+// the signer certificate chains to a trusted root, Error tells why otherwise. The encrypted messages are only marked
+type EmailSMIME struct {
+	Signed    bool              `json:"signed"`
+	Valid     bool              `json:"valid"`
+	Encrypted bool              `json:"encrypted,omitempty"`
+	Signer    *EmailSMIMESigner `json:"signer,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// EmailSMIMESigner is the certificate of the signer, its validity window is RFC3339 in UTC
+type EmailSMIMESigner struct {
+	Subject   string   `json:"subject"`
+	Issuer    string   `json:"issuer"`
+	Serial    string   `json:"serial"`
+	Emails    []string `json:"emails,omitempty"`
+	NotBefore string   `json:"not_before"`
+	NotAfter  string   `json:"not_after"`
+}
+
+// EmailPGP is the OpenPGP status of a message, Inline is set for the armored messages of the text body rather
+// than PGP/MIME. Decrypted is set once the bodies are the decrypted ones, Error tells why they aren't
+type EmailPGP struct {
+	Encrypted bool   `json:"encrypted"`
+	Signed    bool   `json:"signed"`
+	Inline    bool   `json:"inline"`
+	Decrypted bool   `json:"decrypted"`
+	Error     string `json:"error,omitempty"`
+}
+
+// EmailConnection ...
+type EmailConnection struct {
+	RemoteIP   string `json:"remote_ip"`
+	RemotePort int    `json:"remote_port,omitempty"`
+	Listener   string `json:"listener,omitempty"`
+	Helo       string `json:"helo"`
+	TLS        bool   `json:"tls"`
+	TLSVersion string `json:"tls_version,omitempty"`
+	TLSCipher  string `json:"tls_cipher,omitempty"`
+	AuthUser   string `json:"auth_user,omitempty"`
+	ReceivedAt string `json:"received_at"`
+}
+
+// EmailMessage ...
+type EmailMessage struct {
+	// Producer names the build that produced the payload, e.g "smtp2http/1.2.3"
+	Producer string `json:"producer,omitempty"`
+
+	References     []string `json:"references,omitempty"`
+	SPFResult      string   `json:"spf,omitempty"`
+	SPFDomain      string   `json:"spf_domain,omitempty"`
+	SPFExplanation string   `json:"spf_explanation,omitempty"`
+	FCrDNS         string   `json:"fcrdns,omitempty"`
+	HeloValid      *bool    `json:"helo_valid,omitempty"`
+	AuthUser       string   `json:"auth_user,omitempty"`
+
+	Connection *EmailConnection `json:"connection"`
+
+	ParseWarnings []string `json:"parse_warnings,omitempty"`
+
+	// MatchedRules names the content rules of -filter-file that matched the message
+	MatchedRules []string `json:"matched_rules,omitempty"`
+
+	DKIM  []*EmailDKIMResult  `json:"dkim,omitempty"`
+	DMARC *EmailDMARCResult   `json:"dmarc,omitempty"`
+	DNSBL []*EmailDNSBLResult `json:"dnsbl,omitempty"`
+
+	ID         string `json:"id,omitempty"`
+	DeliveryID string `json:"delivery_id"`
+	Date       string `json:"date,omitempty"`
+	Subject    string `json:"subject,omitempty"`
+
+	ResentDate string `json:"resent_date,omitempty"`
+	ResentID   string `json:"resent_id,omitempty"`
+
+	// MessageIDGenerated is set when the message had no Message-ID, ID is then the one generated by the server.
+	// DateSynthesized when its Date was missing or unparseable, Date is then when the message was received
+	MessageIDGenerated bool `json:"message_id_generated,omitempty"`
+	DateSynthesized    bool `json:"date_synthesized,omitempty"`
+
+	// DateUnix and ResentDateUnix are the dates as unix timestamps, only set with the payload version 2
+	DateUnix       *int64 `json:"date_unix,omitempty"`
+	ResentDateUnix *int64 `json:"resent_date_unix,omitempty"`
+
+	// ReceivedAt is when the server received the message, RFC3339 in UTC
+	ReceivedAt string `json:"received_at,omitempty"`
+
+	Body struct {
+		Text string `json:"text,omitempty"`
+		HTML string `json:"html,omitempty"`
+
+		// TextDerived is set when Text was rendered from HTML, the message having no text part
+		TextDerived bool `json:"text_derived,omitempty"`
+
+		// RTF is the rtf body of a TNEF attachment
+		RTF string `json:"rtf,omitempty"`
+
+		// TextEncodingApplied and HTMLEncodingApplied name the repairs of the broken encodings, see Bodies
+		TextEncodingApplied []string `json:"text_encoding_applied,omitempty"`
+		HTMLEncodingApplied []string `json:"html_encoding_applied,omitempty"`
+	} `json:"body"`
+
+	Addresses struct {
+		From       *EmailAddress   `json:"from"`
+		To         []*EmailAddress `json:"to"`
+		OriginalTo []*EmailAddress `json:"original_to,omitempty"`
+		HeaderFrom []*EmailAddress `json:"header_from,omitempty"`
+		HeaderTo   []*EmailAddress `json:"header_to,omitempty"`
+		ReplyTo    []*EmailAddress `json:"reply_to,omitempty"`
+		Cc         []*EmailAddress `json:"cc,omitempty"`
+		Bcc        []*EmailAddress `json:"bcc,omitempty"`
+		InReplyTo  []string        `json:"in_reply_to,omitempty"`
+
+		ResentFrom *EmailAddress   `json:"resent_from,omitempty"`
+		ResentTo   []*EmailAddress `json:"resent_to,omitempty"`
+		ResentCc   []*EmailAddress `json:"resent_cc,omitempty"`
+		ResentBcc  []*EmailAddress `json:"resent_bcc,omitempty"`
+	} `json:"addresses"`
+
+	Headers map[string][]string `json:"headers,omitempty"`
+
+	// IsBounce is set on the delivery status notifications, DSN holds the status they report when it could be parsed
+	IsBounce bool      `json:"is_bounce"`
+	DSN      *EmailDSN `json:"dsn,omitempty"`
+
+	// IsAutoReply and IsMailingList are set on the automatic replies and the list traffic, see ClassifyMessage
+	IsAutoReply     bool   `json:"is_auto_reply"`
+	IsMailingList   bool   `json:"is_mailing_list"`
+	ListID          string `json:"list_id,omitempty"`
+	ListUnsubscribe string `json:"list_unsubscribe,omitempty"`
+
+	// Calendar holds the events of the text/calendar parts, the parts stay in the attachments
+	Calendar *EmailCalendar `json:"calendar,omitempty"`
+
+	// SMIME is set on the S/MIME signed or encrypted messages, see VerifySMIME
+	SMIME *EmailSMIME `json:"smime,omitempty"`
+
+	// PGP is set on the OpenPGP encrypted or signed messages, see DetectPGP
+	PGP *EmailPGP `json:"pgp,omitempty"`
+
+	// ReceivedChain are the Received headers newest first, the first one is the hop to this server
+	ReceivedChain []*EmailReceived `json:"received_chain,omitempty"`
+
+	Attachments   []*EmailAttachment   `json:"attachments,omitempty"`
+	EmbeddedFiles []*EmailEmbeddedFile `json:"embedded_files,omitempty"`
+
+	// NestedMessages are the attached messages (forwarded as attachment, the original of a bounce), only
+	// parsed up to PayloadOptions.NestedDepth
+	NestedMessages []*EmailMessage `json:"nested_messages,omitempty"`
+
+	// Raw is the base64 encoded message as received, only set with -include-raw
+	Raw string `json:"raw,omitempty"`
+}
@@ -0,0 +1,187 @@
+package smtp2http
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricMessagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "messages_received_total",
+		Help:      "The number of messages received over smtp.",
+	})
+	metricMessagesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "messages_rejected_total",
+		Help:      "The number of messages rejected, by reason.",
+	}, []string{"reason"})
+	metricMessagesDiscarded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "messages_discarded_total",
+		Help:      "The number of messages accepted without delivery by a discard content rule.",
+	})
+	metricDuplicates = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "duplicates_suppressed_total",
+		Help:      "The number of messages accepted without delivery, being duplicates of a message already delivered.",
+	})
+	metricWebhookFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "webhook_failures_total",
+		Help:      "The number of failed webhook requests, by response status class.",
+	}, []string{"status_class"})
+	metricPublishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "publish_failures_total",
+		Help:      "The number of failed publications to a message broker, by output.",
+	}, []string{"output"})
+	metricWebhookDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "smtp2http",
+		Name:      "webhook_duration_seconds",
+		Help:      "The duration of the webhook requests.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricWebhookRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "webhook_rate_limited_total",
+		Help:      "The number of webhook requests answered with a 429, or a 503 with a Retry-After, they aren't counted as failures.",
+	})
+	metricOAuth2Failures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "oauth2_token_failures_total",
+		Help:      "The number of failed requests to the oauth2 token endpoint, the webhook wasn't called.",
+	})
+	metricWebhookInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtp2http",
+		Name:      "webhook_requests_in_flight",
+		Help:      "The number of webhook requests being sent.",
+	})
+	metricWebhookWaiting = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "smtp2http",
+		Name:      "webhook_requests_waiting",
+		Help:      "The number of webhook requests waiting for a free slot of -webhook-concurrency.",
+	})
+	metricCircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "smtp2http",
+		Name:      "webhook_circuit_state",
+		Help:      "The state of the circuit breaker of a webhook: 0 closed, 1 half-open, 2 open.",
+	}, []string{"webhook"})
+	metricCircuitTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "webhook_circuit_transitions_total",
+		Help:      "The number of state changes of the circuit breaker of a webhook, by new state.",
+	}, []string{"webhook", "state"})
+	metricMessageSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "smtp2http",
+		Name:      "message_size_bytes",
+		Help:      "The size of the received messages.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	metricConnections = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtp2http",
+		Name:      "connections",
+		Help:      "The number of open smtp connections.",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&smtpConnections))
+	})
+	metricSpoolDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtp2http",
+		Name:      "spool_depth",
+		Help:      "The number of messages waiting in the spool.",
+	}, func() float64 {
+		return float64(spool.depth())
+	})
+	metricSpoolOldestAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtp2http",
+		Name:      "spool_oldest_age_seconds",
+		Help:      "The age of the oldest message waiting in the spool.",
+	}, func() float64 {
+		return spool.oldestAge().Seconds()
+	})
+	metricQueueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtp2http",
+		Name:      "queue_depth",
+		Help:      "The number of accepted messages waiting for a delivery worker.",
+	}, func() float64 {
+		return float64(queue.depth())
+	})
+	metricQueueUtilization = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtp2http",
+		Name:      "queue_worker_utilization",
+		Help:      "The ratio of the delivery workers busy delivering a message.",
+	}, func() float64 {
+		return queue.utilization()
+	})
+	metricQueueFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "queue_failures_total",
+		Help:      "The number of queued messages whose delivery failed and that weren't spooled.",
+	})
+	metricDeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "dead_letters_total",
+		Help:      "The number of deliveries given up on and kept as dead letters, by reason.",
+	}, []string{"reason"})
+	metricDNSBLListings = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "dnsbl_listings_total",
+		Help:      "The number of transactions from a client ip listed by a dns blocklist, by list.",
+	}, []string{"list"})
+	metricRcptChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "rcpt_checks_total",
+		Help:      "The number of recipient checks, by result (accepted, refused, error or cached).",
+	}, []string{"result"})
+	metricRejectEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "reject_events_dropped_total",
+		Help:      "The number of reject events dropped because the -reject-webhook queue was full.",
+	})
+	metricHandlerTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "smtp2http",
+		Name:      "handler_timeouts_total",
+		Help:      "The number of messages refused because their handling exceeded -handler-timeout, by phase.",
+	}, []string{"phase"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricMessagesReceived,
+		metricMessagesRejected,
+		metricMessagesDiscarded,
+		metricDuplicates,
+		metricWebhookFailures,
+		metricPublishFailures,
+		metricWebhookDuration,
+		metricWebhookRateLimited,
+		metricOAuth2Failures,
+		metricWebhookInFlight,
+		metricWebhookWaiting,
+		metricCircuitState,
+		metricCircuitTransitions,
+		metricMessageSize,
+		metricConnections,
+		metricSpoolDepth,
+		metricSpoolOldestAge,
+		metricQueueDepth,
+		metricQueueUtilization,
+		metricQueueFailures,
+		metricDeadLetters,
+		metricDNSBLListings,
+		metricRcptChecks,
+		metricRejectEventsDropped,
+		metricHandlerTimeouts,
+	)
+}
+
+// statusClass returns the label used for a webhook failure, "error" when no response was received
+func statusClass(code int) string {
+	if code < 100 {
+		return "error"
+	}
+
+	return strconv.Itoa(code/100) + "xx"
+}
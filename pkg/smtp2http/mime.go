@@ -0,0 +1,116 @@
+package smtp2http
+
+import (
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/net/idna"
+)
+
+// wordDecoder decodes RFC 2047 encoded-words in any charset known to x/net/html/charset
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(label string, input io.Reader) (io.Reader, error) {
+		return charset.NewReaderLabel(label, input)
+	},
+}
+
+// DecodeHeader decodes the encoded-words of a header value to UTF-8,
+// the raw value is returned when it can't be decoded
+func DecodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+
+	return decoded
+}
+
+// addressParser parses address lists decoding the display names with wordDecoder
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// ParseAddressList parses the named address header, fallback is returned when
+// the header is missing or can't be parsed
+func ParseAddressList(header mail.Header, name string, fallback []*mail.Address) []*mail.Address {
+	value := header.Get(name)
+	if value == "" {
+		return fallback
+	}
+
+	list, err := addressParser.ParseList(value)
+	if err != nil {
+		return fallback
+	}
+
+	return list
+}
+
+// EmailAddresses converts the addresses to their payload form, the display names are decoded
+func EmailAddresses(addr []*mail.Address) []*EmailAddress {
+	ret := []*EmailAddress{}
+
+	for _, e := range addr {
+		ret = append(ret, &EmailAddress{
+			Address: e.Address,
+			Name:    DecodeHeader(e.Name),
+		})
+	}
+
+	return ret
+}
+
+// SplitSubaddress splits the local part of address on the first of the separators characters, e.g
+// "support+billing@example.com" is "support" tagged "billing". normalized is the address without its tag and
+// with its domain lowercased, stripDots also drops the dots of its local part the way gmail ignores them
+func SplitSubaddress(address, separators string, stripDots bool) (local, tag, normalized string) {
+	local, domain := address, ""
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		local, domain = address[:at], address[at+1:]
+	}
+
+	if i := strings.IndexAny(local, separators); i > 0 && separators != "" {
+		local, tag = local[:i], local[i+1:]
+	}
+
+	normalized = local
+	if stripDots {
+		normalized = strings.ReplaceAll(normalized, ".", "")
+	}
+	if domain != "" {
+		normalized += "@" + strings.ToLower(domain)
+	}
+
+	return local, tag, normalized
+}
+
+// IDNADomain returns the U-label (unicode) and the A-label (punycode) forms of an internationalized domain,
+// both lowercased. A domain that isn't a valid IDNA one is returned as is in both forms
+func IDNADomain(domain string) (unicode, ascii string) {
+	domain = strings.ToLower(domain)
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return domain, domain
+	}
+
+	unicode, err = idna.Lookup.ToUnicode(ascii)
+	if err != nil {
+		return domain, ascii
+	}
+
+	return unicode, ascii
+}
+
+// MessageDate returns the date of the Date header, the zero time when it's missing or unparseable. net/mail
+// knows more layouts than the go-smtpsrv parser, the dates without their day of the week among them
+func MessageDate(header mail.Header) time.Time {
+	date, err := mail.ParseDate(header.Get("Date"))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return date
+}
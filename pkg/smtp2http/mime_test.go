@@ -0,0 +1,92 @@
+package smtp2http
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name, value, want string
+	}{
+		{"plain", "Hello world", "Hello world"},
+		{"utf-8 B", "=?UTF-8?B?R3LDvMOfZQ==?=", "Grüße"},
+		{"utf-8 Q", "=?utf-8?Q?Gr=C3=BC=C3=9Fe_aus_Berlin?=", "Grüße aus Berlin"},
+		{"windows-1255 B", "=?windows-1255?B?+ezl7Q==?=", "שלום"},
+		{"windows-1255 Q", "=?windows-1255?Q?=F9=EC=E5=ED?=", "שלום"},
+		{"iso-2022-jp", "=?ISO-2022-JP?B?GyRCRnxLXDhsGyhC?=", "日本語"},
+		{"adjacent words", "=?UTF-8?Q?Gr=C3=BC?= =?UTF-8?Q?=C3=9Fe?=", "Grüße"},
+		{"mixed plain and encoded", "Re: =?UTF-8?B?R3LDvMOfZQ==?= from Berlin", "Re: Grüße from Berlin"},
+		{"lowercase encoding", "=?utf-8?b?R3LDvMOfZQ==?=", "Grüße"},
+	} {
+		if got := DecodeHeader(tt.value); got != tt.want {
+			t.Errorf("%s: DecodeHeader(%q) = %q, want %q", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeHeaderFallback(t *testing.T) {
+	for _, value := range []string{
+		"=?unknown-charset?B?R3LDvMOfZQ==?=",
+		"=?UTF-8?B?not base64!?=",
+	} {
+		if got := DecodeHeader(value); got != value {
+			t.Errorf("DecodeHeader(%q) = %q, want the raw value", value, got)
+		}
+	}
+}
+
+func TestEmailAddressesDecodeTheNames(t *testing.T) {
+	header := mail.Header{
+		"From": {"=?windows-1255?B?+ezl7Q==?= <shalom@example.com>"},
+		"To":   {"=?UTF-8?Q?J=C3=BCrgen_M=C3=BCller?= <jm@example.com>, \"Plain Name\" <plain@example.com>"},
+		"Cc":   {"not an address list"},
+	}
+
+	from := EmailAddresses(ParseAddressList(header, "From", nil))
+	if len(from) != 1 || from[0].Name != "שלום" || from[0].Address != "shalom@example.com" {
+		t.Errorf("From = %+v, want the decoded hebrew name", from)
+	}
+
+	to := EmailAddresses(ParseAddressList(header, "To", nil))
+	if len(to) != 2 || to[0].Name != "Jürgen Müller" || to[1].Name != "Plain Name" {
+		t.Errorf("To = %+v, want both names decoded", to)
+	}
+
+	fallback := []*mail.Address{{Address: "envelope@example.com"}}
+	if cc := ParseAddressList(header, "Cc", fallback); len(cc) != 1 || cc[0] != fallback[0] {
+		t.Errorf("Cc = %v, want the fallback", cc)
+	}
+	if bcc := ParseAddressList(header, "Bcc", nil); bcc != nil {
+		t.Errorf("Bcc = %v, want nil for a missing header", bcc)
+	}
+}
+
+func TestEmailAddressesEncodedNameInsideQuotes(t *testing.T) {
+	// an encoded-word in a quoted string isn't decoded by net/mail, EmailAddresses decodes it
+	got := EmailAddresses([]*mail.Address{{Name: "=?UTF-8?B?R3LDvMOfZQ==?=", Address: "g@example.com"}})
+	if len(got) != 1 || got[0].Name != "Grüße" {
+		t.Errorf("name = %q, want Grüße", got[0].Name)
+	}
+}
+
+func TestIDNADomain(t *testing.T) {
+	for _, tt := range []struct {
+		domain, unicode, ascii string
+	}{
+		{"example.com", "example.com", "example.com"},
+		{"Müller.Example", "müller.example", "xn--mller-kva.example"},
+		{"xn--mller-kva.example", "müller.example", "xn--mller-kva.example"},
+		{"XN--MLLER-KVA.EXAMPLE", "müller.example", "xn--mller-kva.example"},
+		{"例え.jp", "例え.jp", "xn--r8jz45g.jp"},
+		{"παράδειγμα.δοκιμή", "παράδειγμα.δοκιμή", "xn--hxajbheg2az3al.xn--jxalpdlp"},
+		// a latin domain with a cyrillic "а" has its own A-label
+		{"pаypal.example", "pаypal.example", "xn--pypal-4ve.example"},
+		// not a valid IDNA domain
+		{"bad_domain..example", "bad_domain..example", "bad_domain..example"},
+	} {
+		if unicode, ascii := IDNADomain(tt.domain); unicode != tt.unicode || ascii != tt.ascii {
+			t.Errorf("IDNADomain(%q) = %q, %q, want %q, %q", tt.domain, unicode, ascii, tt.unicode, tt.ascii)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package smtp2http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	// webhookFormatJSON posts the payload as json, the files being base64 encoded in it
+	webhookFormatJSON = "json"
+
+	// webhookFormatMultipart posts the payload as a "message" form field and the files as file parts
+	webhookFormatMultipart = "multipart"
+)
+
+// quoteEscaper escapes the quoted parameters of the Content-Disposition header
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// filePart is a file sent as its own part of a multipart body
+type filePart struct {
+	field       string
+	filename    string
+	contentType string
+	data        io.Reader
+}
+
+// buildMultipart builds the multipart/form-data body of a payload, every file is copied
+// from its reader straight into the body. It returns the body and its content type
+func buildMultipart(message []byte, parts []*filePart) ([]byte, string, error) {
+	var buf bytes.Buffer
+	contentType, err := writeMultipart(&buf, message, parts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), contentType, nil
+}
+
+// writeMultipart writes the multipart body to out, it returns its content type
+func writeMultipart(out io.Writer, message []byte, parts []*filePart) (string, error) {
+	w := multipart.NewWriter(out)
+
+	field, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="message"`},
+		"Content-Type":        {"application/json"},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := field.Write(message); err != nil {
+		return "", err
+	}
+
+	for _, p := range parts {
+		if err := writeFilePart(w, p.field, p.filename, p.contentType, p.data); err != nil {
+			return "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return w.FormDataContentType(), nil
+}
+
+// writeFilePart adds a file part, its content type is the one of the mime part
+func writeFilePart(w *multipart.Writer, name, filename, contentType string, data io.Reader) error {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {fmt.Sprintf(`form-data; name="%s"; filename="%s"`, quoteEscaper.Replace(name), quoteEscaper.Replace(filename))},
+		"Content-Type":        {contentType},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(part, data)
+
+	return err
+}
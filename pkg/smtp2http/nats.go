@@ -0,0 +1,128 @@
+package smtp2http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// errNATSNoStream is returned by -nats-require-ack when no jetstream stream captures the subject
+var errNATSNoStream = errors.New("no jetstream stream captures the nats subject")
+
+// natsConfig is the configuration of the nats output
+type natsConfig struct {
+	URL             string
+	Subject         string
+	RequireAck      bool
+	CredentialsFile string
+	NKeySeedFile    string
+}
+
+// natsPublisher publishes the payloads to a nats subject. They are published to jetstream when a stream
+// captures the subject so the message is only accepted once it is persisted, with a plain publish otherwise
+type natsPublisher struct {
+	conn       *nats.Conn
+	js         nats.JetStreamContext
+	subject    string
+	requireAck bool
+}
+
+// newNATSPublisher connects to the nats servers, the client reconnects on its own when the connection is lost
+func newNATSPublisher(cfg natsConfig) (*natsPublisher, error) {
+	if cfg.Subject == "" {
+		return nil, fmt.Errorf("-nats-url requires -nats-subject")
+	}
+
+	opts := []nats.Option{
+		nats.Name("smtp2http"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("nats connection lost", "error", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("reconnected to nats", "server", nc.ConnectedUrlRedacted())
+		}),
+	}
+
+	if cfg.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.CredentialsFile))
+	}
+
+	if cfg.NKeySeedFile != "" {
+		opt, err := nats.NkeyOptionFromSeed(cfg.NKeySeedFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+
+	conn, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &natsPublisher{conn: conn, js: js, subject: cfg.Subject, requireAck: cfg.RequireAck}, nil
+}
+
+func (p *natsPublisher) Name() string {
+	return "nats"
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, pub *publication) error {
+	msg := nats.NewMsg(expandPlaceholders(p.subject, pub.Values, natsToken))
+	msg.Data = pub.Body
+	msg.Header.Set("Content-Type", pub.ContentType)
+	for name, value := range pub.Headers {
+		msg.Header.Set(name, value)
+	}
+
+	// a jetstream publish to a subject no stream captures would wait for an ack that never comes
+	// (or get one from a core subscriber), look the stream up first
+	_, err := p.js.StreamNameBySubject(msg.Subject, nats.Context(ctx))
+	switch {
+	case err == nil:
+		// the message id lets the stream drop the duplicates of a message the sender retried
+		if pub.MessageID != "" {
+			msg.Header.Set(nats.MsgIdHdr, pub.MessageID)
+		}
+
+		_, err = p.js.PublishMsg(msg, nats.Context(ctx), nats.RetryAttempts(0))
+		return err
+	case !errors.Is(err, nats.ErrNoMatchingStream) && !errors.Is(err, nats.ErrJetStreamNotEnabled):
+		return err
+	case p.requireAck:
+		return errNATSNoStream
+	}
+
+	// no stream, the flush only tells the server received it
+	if err := p.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+
+	return p.conn.FlushWithContext(ctx)
+}
+
+func (p *natsPublisher) Close() error {
+	return p.conn.Drain()
+}
+
+// natsToken makes a placeholder value safe in a subject, the dots of a domain are kept as token separators
+func natsToken(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '*' || r == '>' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, value)
+}
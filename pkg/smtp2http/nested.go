@@ -0,0 +1,109 @@
+package smtp2http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+// buildNested converts the message/rfc822 parts of the raw message with the options of the enclosing one,
+// the files of the i-th nested message use the "nested[i]." form fields. A part that can't be parsed is
+// reported in the warnings
+func buildNested(raw []byte, opts PayloadOptions) ([]*EmailMessage, []string, error) {
+	parts := [][]byte{}
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		walkNested(textproto.MIMEHeader(msg.Header), msg.Body, &parts, 0, true)
+	}
+
+	files := opts.Files
+	if files == nil {
+		files = base64Encoder{}
+	}
+
+	opts.NestedDepth--
+	opts.IncludeRaw = false
+
+	ret, warnings := []*EmailMessage{}, []string{}
+	for i, part := range parts {
+		msg, err := smtpsrv.ParseEmail(bytes.NewReader(part))
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("cannot parse the nested message %d: %s", i, err.Error()))
+			continue
+		}
+
+		// the envelope sender is the author, the message wasn't sent with the null sender of the bounces
+		env := &Envelope{Raw: part}
+		var header mail.Header
+		if m, err := mail.ReadMessage(bytes.NewReader(part)); err == nil {
+			header = m.Header
+		}
+		if from := ParseAddressList(header, "From", msg.From); len(from) > 0 {
+			env.From = from[0]
+		}
+
+		nestedOpts := opts
+		nestedOpts.Files = prefixEncoder{FileEncoder: files, prefix: fmt.Sprintf("nested[%d].", i)}
+
+		nested, err := BuildPayload(msg, env, nestedOpts)
+		if err != nil {
+			return nil, nil, err
+		}
+		ret = append(ret, nested)
+	}
+
+	return ret, warnings, nil
+}
+
+// walkNested collects the decoded message/rfc822 parts, without looking into them. The top level
+// isn't one, it is the message itself
+func walkNested(header textproto.MIMEHeader, body io.Reader, parts *[][]byte, depth int, top bool) {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+
+	if strings.HasPrefix(contentType, "multipart/") {
+		if depth >= maxPartDepth {
+			return
+		}
+
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+
+			walkNested(part.Header, part, parts, depth+1, false)
+		}
+	}
+
+	if top || (contentType != "message/rfc822" && contentType != "message/global") {
+		return
+	}
+
+	data, err := ioutil.ReadAll(decodeTransferEncoding(body, header.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return
+	}
+
+	*parts = append(*parts, data)
+}
+
+// prefixEncoder prefixes the form fields of the files of a nested message
+type prefixEncoder struct {
+	FileEncoder
+	prefix string
+}
+
+func (e prefixEncoder) Encode(f *EmailFile, name, contentType, field string, r io.Reader) error {
+	return e.FileEncoder.Encode(f, name, contentType, e.prefix+field, r)
+}
@@ -0,0 +1,86 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/smtp"
+	"testing"
+)
+
+// postNested sends testdata/name from sender with -parse-nested up to depth and returns the payload
+func postNested(t *testing.T, name, sender string, depth int) *EmailMessage {
+	t.Helper()
+
+	webhook, payloads := payloadWebhook(t)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.ParseNested = true
+	cfg.NestedDepth = depth
+	addr := newTestServer(t, cfg)
+
+	_, raw := readFixture(t, name)
+	if err := smtp.SendMail(addr, nil, sender, []string{"dave@example.com"}, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	return <-payloads
+}
+
+func TestNestedBounce(t *testing.T) {
+	p := postNested(t, "dsn/exchange.eml", "", 3)
+
+	if len(p.NestedMessages) != 1 {
+		t.Fatalf("%d nested messages, want the original of the bounce", len(p.NestedMessages))
+	}
+	original := p.NestedMessages[0]
+	if original.Subject != "hello" || original.ID != "1@example.com" || original.Addresses.From == nil || original.Addresses.From.Address != "alice@example.com" {
+		t.Errorf("nested = %q %q from %+v, want the original message", original.Subject, original.ID, original.Addresses.From)
+	}
+	if original.Body.Text != "hello" {
+		t.Errorf("nested text = %q, want hello", original.Body.Text)
+	}
+	if original.IsBounce {
+		t.Error("the original of the bounce is marked as a bounce")
+	}
+}
+
+func TestNestedDoubleForward(t *testing.T) {
+	p := postNested(t, "nested/double-forward.eml", "carol@example.com", 3)
+
+	// the raw part stays an attachment
+	if len(p.Attachments) != 1 || p.Attachments[0].Filename != "Fwd: invoice.eml" {
+		t.Fatalf("attachments = %+v, want the forwarded message", p.Attachments)
+	}
+	if data, _ := base64.StdEncoding.DecodeString(p.Attachments[0].Data); !bytes.HasPrefix(data, []byte("From: Bob <bob@example.com>\n")) {
+		t.Errorf("attachment data = %q, want the raw forwarded message", data)
+	}
+
+	if len(p.NestedMessages) != 1 || p.NestedMessages[0].Subject != "Fwd: invoice" {
+		t.Fatalf("nested = %+v, want the first forward", p.NestedMessages)
+	}
+	fwd := p.NestedMessages[0]
+	if fwd.Body.Text != "forwarding the invoice" || len(fwd.NestedMessages) != 1 {
+		t.Fatalf("first forward = %q with %d nested, want its text and the original", fwd.Body.Text, len(fwd.NestedMessages))
+	}
+
+	original := fwd.NestedMessages[0]
+	if original.Subject != "invoice" || original.Addresses.From.Address != "alice@example.com" || original.Body.Text != "the invoice is attached" {
+		t.Errorf("original = %q from %+v: %q, want the invoice", original.Subject, original.Addresses.From, original.Body.Text)
+	}
+	if len(original.Attachments) != 1 || original.Attachments[0].Filename != "invoice-42.pdf" || original.Attachments[0].Data != "JVBERi0xLjQK" {
+		t.Errorf("original attachments = %+v, want the pdf", original.Attachments)
+	}
+}
+
+func TestNestedDepth(t *testing.T) {
+	p := postNested(t, "nested/double-forward.eml", "carol@example.com", 1)
+
+	if len(p.NestedMessages) != 1 {
+		t.Fatalf("%d nested messages, want the first forward", len(p.NestedMessages))
+	}
+	if n := len(p.NestedMessages[0].NestedMessages); n != 0 {
+		t.Errorf("%d messages parsed past -nested-depth 1", n)
+	}
+}
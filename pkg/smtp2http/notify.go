@@ -0,0 +1,194 @@
+package smtp2http
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// the chat platforms of -notify-format, the webhook is their incoming webhook url
+const (
+	notifySlack   = "slack"
+	notifyDiscord = "discord"
+	notifyTeams   = "teams"
+)
+
+// notifyLimits are the lengths in characters the platforms accept for the subject and the body of a
+// notification, -notify-body-length can only lower the one of the body
+var notifyLimits = map[string]struct{ subject, body int }{
+	// the header block and the section block text
+	notifySlack: {150, 3000},
+	// the embed title and description
+	notifyDiscord: {256, 4096},
+	// no hard limit on a text block, the whole card must stay under 28KB
+	notifyTeams: {256, 10000},
+}
+
+// notification is what a notification tells of a message
+type notification struct {
+	from        string
+	subject     string
+	text        string
+	attachments int
+}
+
+// buildNotification renders the compact notification of the payload in the webhook schema of format: the
+// sender, the subject, the start of the text body and how many attachments are left out
+func buildNotification(format string, msg *EmailMessage, bodyLength int) ([]byte, error) {
+	limits, ok := notifyLimits[format]
+	if !ok {
+		return nil, fmt.Errorf("invalid notify format %q", format)
+	}
+	if bodyLength < limits.body {
+		limits.body = bodyLength
+	}
+
+	n := &notification{
+		from:        "unknown sender",
+		subject:     truncateRunes(strings.Join(strings.Fields(msg.Subject), " "), limits.subject),
+		text:        truncateRunes(strings.TrimSpace(msg.Body.Text), limits.body),
+		attachments: len(msg.Attachments),
+	}
+	if len(msg.Addresses.HeaderFrom) > 0 {
+		n.from = formatAddress(msg.Addresses.HeaderFrom[0])
+	} else if msg.Addresses.From != nil && msg.Addresses.From.Address != "" {
+		n.from = formatAddress(msg.Addresses.From)
+	}
+	if n.subject == "" {
+		n.subject = "(no subject)"
+	}
+
+	switch format {
+	case notifySlack:
+		return json.Marshal(n.slack())
+	case notifyDiscord:
+		return json.Marshal(n.discord())
+	}
+
+	return json.Marshal(n.teams())
+}
+
+func formatAddress(addr *EmailAddress) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+
+	return addr.Name + " <" + addr.Address + ">"
+}
+
+// truncateRunes keeps the first n characters of s, the last one becomes an ellipsis when s is cut
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	if n < 1 {
+		return ""
+	}
+
+	return string(runes[:n-1]) + "…"
+}
+
+func (n *notification) attachmentsLine() string {
+	if n.attachments == 1 {
+		return "1 attachment"
+	}
+
+	return fmt.Sprintf("%d attachments", n.attachments)
+}
+
+// slack renders a message with blocks, the email content is only put in plain_text objects since slack has no
+// escape for its mrkdwn; the fallback text of the notifications only needs &, < and > escaped
+func (n *notification) slack() interface{} {
+	type text struct {
+		Type  string `json:"type"`
+		Text  string `json:"text"`
+		Emoji bool   `json:"emoji"`
+	}
+	type block struct {
+		Type     string  `json:"type"`
+		Text     *text   `json:"text,omitempty"`
+		Elements []*text `json:"elements,omitempty"`
+	}
+
+	plain := func(s string) *text {
+		return &text{Type: "plain_text", Text: s}
+	}
+
+	blocks := []*block{
+		{Type: "header", Text: plain(n.subject)},
+		{Type: "context", Elements: []*text{plain(truncateRunes("From "+n.from, 2000))}},
+	}
+	if n.text != "" {
+		blocks = append(blocks, &block{Type: "section", Text: plain(n.text)})
+	}
+	if n.attachments > 0 {
+		blocks = append(blocks, &block{Type: "context", Elements: []*text{plain(n.attachmentsLine())}})
+	}
+
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	return map[string]interface{}{
+		"text":   escape.Replace(truncateRunes(n.subject+" from "+n.from, 3000)),
+		"blocks": blocks,
+	}
+}
+
+// discordEscaper escapes the markdown of discord, and the @ of the mentions
+var discordEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`, ">", `\>`, "#", `\#`, "-", `\-`,
+	"[", `\[`, "]", `\]`, "@", "@\u200b",
+)
+
+// discord renders a message with an embed, nobody is mentioned whatever the content
+func (n *notification) discord() interface{} {
+	embed := map[string]interface{}{
+		"title":  truncateRunes(discordEscaper.Replace(n.subject), notifyLimits[notifyDiscord].subject),
+		"author": map[string]string{"name": truncateRunes(n.from, 256)},
+	}
+	if n.text != "" {
+		// the escapes count in the limit
+		embed["description"] = truncateRunes(discordEscaper.Replace(n.text), notifyLimits[notifyDiscord].body)
+	}
+	if n.attachments > 0 {
+		embed["footer"] = map[string]string{"text": n.attachmentsLine()}
+	}
+
+	return map[string]interface{}{
+		"embeds":           []interface{}{embed},
+		"allowed_mentions": map[string][]string{"parse": {}},
+	}
+}
+
+// teamsEscaper escapes the markdown of the adaptive cards text blocks
+var teamsEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "#", `\#`, "-", `\-`, "+", `\+`, "[", `\[`, "]", `\]`,
+)
+
+// teams renders an adaptive card message, what the workflows and the connectors incoming webhooks accept
+func (n *notification) teams() interface{} {
+	type element map[string]interface{}
+
+	body := []element{
+		{"type": "TextBlock", "text": teamsEscaper.Replace(n.subject), "weight": "bolder", "size": "medium", "wrap": true},
+		{"type": "TextBlock", "text": teamsEscaper.Replace("From " + n.from), "isSubtle": true, "spacing": "none", "wrap": true},
+	}
+	if n.text != "" {
+		body = append(body, element{"type": "TextBlock", "text": teamsEscaper.Replace(n.text), "wrap": true})
+	}
+	if n.attachments > 0 {
+		body = append(body, element{"type": "TextBlock", "text": n.attachmentsLine(), "isSubtle": true, "wrap": true})
+	}
+
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []element{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": element{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    body,
+			},
+		}},
+	}
+}
@@ -0,0 +1,79 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// notifyMessages are the payloads the golden notifications are rendered from, by the suffix of their file
+func notifyMessages() map[string]*EmailMessage {
+	// the markdown and the mentions of the platforms must reach them escaped
+	full := testMessage()
+	full.Addresses.HeaderFrom = []*EmailAddress{{Name: "Alice [billing]", Address: "alice@example.com"}}
+	full.Body.Text = "  Hello Bob,\n\nyour *invoice* is attached - see `#42` or <https://example.com|pay>, @everyone\n"
+	full.Attachments = append(full.Attachments, &EmailAttachment{Filename: "terms.txt", ContentType: "text/plain"})
+
+	// the envelope sender, a single attachment
+	minimal := testMessage()
+	minimal.Subject, minimal.Body.Text = " \t", ""
+
+	empty := &EmailMessage{}
+
+	long := testMessage()
+	long.Subject = strings.Repeat("Grüße  und\tmehr ", 30)
+	long.Body.Text = strings.Repeat("Hello Bob, your invoice is attached. ", 10)
+
+	return map[string]*EmailMessage{"": full, "-minimal": minimal, "-empty": empty, "-truncated": long}
+}
+
+func TestNotificationGolden(t *testing.T) {
+	for _, format := range []string{notifySlack, notifyDiscord, notifyTeams} {
+		for suffix, msg := range notifyMessages() {
+			bodyLength := DefaultConfig().NotifyBodyLength
+			if suffix == "-truncated" {
+				bodyLength = 100
+			}
+
+			data, err := buildNotification(format, msg, bodyLength)
+			if err != nil {
+				t.Fatalf("%s%s: %v", format, suffix, err)
+			}
+
+			var got bytes.Buffer
+			if err := json.Indent(&got, data, "", "  "); err != nil {
+				t.Fatal(err)
+			}
+			got.WriteString("\n")
+
+			golden(t, "notify-"+format+suffix+".golden", got.Bytes())
+		}
+	}
+}
+
+func TestBuildNotificationInvalidFormat(t *testing.T) {
+	if _, err := buildNotification("mattermost", testMessage(), 500); err == nil {
+		t.Error("buildNotification accepted the mattermost format")
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"hello", 5, "hello"},
+		{"hello", 10, "hello"},
+		{"hello", 4, "hel…"},
+		{"שלום עולם", 5, "שלום…"},
+		{"hello", 1, "…"},
+		{"hello", 0, ""},
+		{"", 0, ""},
+	} {
+		if got := truncateRunes(c.s, c.n); got != c.want {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", c.s, c.n, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package smtp2http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// webhookTokens are the oauth2 tokens of -oauth2-token-url sent to the webhook, nil when disabled
+var webhookTokens *oauth2Tokens
+
+// tokenError is a failure of the token endpoint rather than of the webhook
+type tokenError struct {
+	err error
+}
+
+func (e *tokenError) Error() string {
+	return "oauth2 token endpoint: " + e.err.Error()
+}
+
+func (e *tokenError) Unwrap() error {
+	return e.err
+}
+
+// isTokenError reports whether the webhook request wasn't sent for lack of a token
+func isTokenError(err error) bool {
+	var te *tokenError
+	return errors.As(err, &te)
+}
+
+// oauth2Tokens gets the tokens of the client credentials grant and caches them, a token is renewed shortly
+// before it expires or when the webhook doesn't accept it anymore
+type oauth2Tokens struct {
+	config *clientcredentials.Config
+	client *http.Client
+
+	mu     sync.Mutex
+	source oauth2.TokenSource
+}
+
+// newOAuth2Tokens returns the tokens of config, requested with client
+func newOAuth2Tokens(config *clientcredentials.Config, client *http.Client) *oauth2Tokens {
+	t := &oauth2Tokens{config: config, client: client}
+	t.source = t.newSource()
+
+	return t
+}
+
+func (t *oauth2Tokens) newSource() oauth2.TokenSource {
+	return t.config.TokenSource(context.WithValue(context.Background(), oauth2.HTTPClient, t.client))
+}
+
+// authorization returns the Authorization header of the current token, requesting one when needed
+func (t *oauth2Tokens) authorization() (string, error) {
+	t.mu.Lock()
+	source := t.source
+	t.mu.Unlock()
+
+	token, err := source.Token()
+	if err != nil {
+		metricOAuth2Failures.Inc()
+		return "", &tokenError{err: err}
+	}
+
+	return token.Type() + " " + token.AccessToken, nil
+}
+
+// expire drops the token of the authorization refused by the webhook, the next request gets a new one. Nothing
+// changes when another request already replaced it
+func (t *oauth2Tokens) expire(authorization string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if token, err := t.source.Token(); err == nil && token.Type()+" "+token.AccessToken == authorization {
+		t.source = t.newSource()
+	}
+}
@@ -0,0 +1,520 @@
+package smtp2http
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/alash3al/go-smtpsrv"
+	"golang.org/x/crypto/openpgp"
+)
+
+// PartError is returned when the content of a file can't be read, e.g. a truncated mime part
+type PartError struct {
+	Name string
+	Err  error
+}
+
+func (e *PartError) Error() string {
+	return "cannot read " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *PartError) Unwrap() error {
+	return e.Err
+}
+
+// Envelope is the smtp transaction a message was received in
+type Envelope struct {
+	DeliveryID string
+	From       *mail.Address
+	To         []*mail.Address
+	AuthUser   string
+	Connection *EmailConnection
+	ReceivedAt time.Time
+
+	// MessageID is the id generated for a message without a Message-ID header, the payload id and
+	// message_id_generated are then set from it
+	MessageID string
+
+	// OriginalTo are the recipients as received when some of To were rewritten by an alias, OriginalTo[i]
+	// being the one To[i] was received as
+	OriginalTo []*mail.Address
+
+	// ServerName is the name of the receiving server in the Received header of the last hop
+	ServerName string
+
+	// Raw is the message exactly as it was received
+	Raw []byte
+}
+
+// FileEncoder fills the payload entry of an attachment or an embedded file from its content,
+// field is the name of its part when the files are sent as parts of a multipart body
+type FileEncoder interface {
+	Encode(f *EmailFile, name, contentType, field string, r io.Reader) error
+}
+
+// PayloadOptions tune what BuildPayload puts in the payload, the zero value forwards all the
+// headers and the base64 encoded files
+type PayloadOptions struct {
+	// Version is the payload version: 1 (the default) formats the dates the go way ("2006-01-02 15:04:05 -0700 MST"),
+	// the zero time included, 2 as RFC3339 in UTC along with their unix timestamp, omitting the missing ones
+	Version int
+
+	// Headers are the headers included: "all" (or empty), "none" or a comma separated list of names
+	Headers string
+
+	// IncludeRaw adds the base64 encoded message as received
+	IncludeRaw bool
+
+	// DeriveText renders the html body as the text one when the message has no text part
+	DeriveText bool
+
+	// InlineCID rewrites the cid: references of the html body to data: uris, up to InlineCIDMaxSize bytes
+	// (unlimited when 0), the inlined files are left out of the embedded files with InlineCIDOmit
+	InlineCID        bool
+	InlineCIDMaxSize int64
+	InlineCIDOmit    bool
+
+	// MaxFileSize is the size over which the files are never inlined, Files decides what becomes of them
+	MaxFileSize int64
+
+	// Files encodes the content of the files, they are base64 encoded in the payload when nil
+	Files FileEncoder
+
+	// Allowed reports whether a file may be forwarded, the others are marked as stripped. All of them are when nil
+	Allowed func(filename, contentType string) bool
+
+	// KeepTNEF keeps the TNEF attachments (winmail.dat) along with the files extracted from them
+	KeepTNEF bool
+
+	// NestedDepth is how many levels of attached messages (message/rfc822 parts) are parsed into
+	// NestedMessages, none when 0
+	NestedDepth int
+
+	// SubaddressSeparators are the characters separating the tag of a local part ("+" when empty),
+	// SubaddressStripDots drops the dots of the local parts of the normalized addresses
+	SubaddressSeparators string
+	SubaddressStripDots  bool
+
+	// SMIMERoots are the trusted roots of the S/MIME signer certificates, the system ones when nil
+	SMIMERoots *x509.CertPool
+
+	// PGPKeyring decrypts the OpenPGP encrypted messages, its private keys already decrypted. They are
+	// only detected when nil
+	PGPKeyring openpgp.EntityList
+
+	// Logger receives the debug details of the conversion, slog.Default() when nil
+	Logger *slog.Logger
+}
+
+// BuildPayload converts the parsed message received in env into its json payload,
+// it fails when a file can't be encoded
+func BuildPayload(msg *smtpsrv.Email, env *Envelope, opts PayloadOptions) (*EmailMessage, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	files := opts.Files
+	if files == nil {
+		files = base64Encoder{}
+	}
+
+	allowed := opts.Allowed
+	if allowed == nil {
+		allowed = func(string, string) bool { return true }
+	}
+
+	headers := opts.Headers
+	if headers == "" {
+		headers = "all"
+	}
+
+	// a message without a date is dated when it was received
+	date := msg.Date
+	if date.IsZero() {
+		date = MessageDate(msg.Header)
+	}
+	dateSynthesized := date.IsZero() && !env.ReceivedAt.IsZero()
+	if dateSynthesized {
+		date = env.ReceivedAt.Round(0)
+	}
+
+	jsonData := &EmailMessage{
+		ID:              msg.MessageID,
+		DeliveryID:      env.DeliveryID,
+		Date:            date.String(),
+		DateSynthesized: dateSynthesized,
+		References:      msg.References,
+		ResentDate:      msg.ResentDate.String(),
+		ResentID:        msg.ResentMessageID,
+		Subject:         msg.Subject,
+		AuthUser:        env.AuthUser,
+		Connection:      env.Connection,
+		Attachments:     []*EmailAttachment{},
+		EmbeddedFiles:   []*EmailEmbeddedFile{},
+	}
+
+	if jsonData.ID == "" && env.MessageID != "" {
+		jsonData.ID, jsonData.MessageIDGenerated = env.MessageID, true
+	}
+
+	if opts.Version >= 2 {
+		jsonData.Date, jsonData.DateUnix = formatDate(date)
+		jsonData.ResentDate, jsonData.ResentDateUnix = formatDate(msg.ResentDate)
+	}
+
+	if !env.ReceivedAt.IsZero() {
+		jsonData.ReceivedAt = env.ReceivedAt.UTC().Format(time.RFC3339)
+	}
+
+	header := mail.Header{}
+	if m, err := mail.ReadMessage(bytes.NewReader(env.Raw)); err == nil {
+		header = m.Header
+	}
+
+	jsonData.Headers = SelectHeaders(header, headers)
+
+	// the message doesn't carry the header of the last hop, it is added so the chain is complete
+	if env.Connection != nil {
+		jsonData.ReceivedChain = append(jsonData.ReceivedChain, ownReceived(env))
+	}
+	jsonData.ReceivedChain = append(jsonData.ReceivedChain, ReceivedChain(header)...)
+
+	if jsonData.IsBounce = IsBounce(header, env); jsonData.IsBounce {
+		jsonData.DSN = ParseDSN(header, env.Raw)
+	}
+
+	kind := ClassifyMessage(header)
+	jsonData.IsAutoReply, jsonData.IsMailingList = kind.AutoReply, kind.MailingList
+	jsonData.ListID, jsonData.ListUnsubscribe = kind.ListID, kind.ListUnsubscribe
+
+	if subject := header.Get("Subject"); subject != "" {
+		jsonData.Subject = DecodeHeader(subject)
+	}
+
+	if opts.IncludeRaw {
+		jsonData.Raw = base64.StdEncoding.EncodeToString(env.Raw)
+	}
+
+	// the bodies are extracted from the raw message, the parser only knows a couple of charsets
+	bodies, err := ParseBodies(env.Raw)
+	if err != nil {
+		logger.Debug("cannot extract the bodies, using the parsed ones", "error", err)
+		bodies = &Bodies{}
+		bodies.Text, bodies.TextEncodingApplied = RepairBody(msg.TextBody)
+		bodies.HTML, bodies.HTMLEncodingApplied = RepairBody(msg.HTMLBody)
+	}
+	jsonData.Body.Text, jsonData.Body.HTML = bodies.Text, bodies.HTML
+	jsonData.Body.TextEncodingApplied, jsonData.Body.HTMLEncodingApplied = bodies.TextEncodingApplied, bodies.HTMLEncodingApplied
+	if len(bodies.TextEncodingApplied) > 0 || len(bodies.HTMLEncodingApplied) > 0 {
+		logger.Info("body encoding repaired", "text", bodies.TextEncodingApplied, "html", bodies.HTMLEncodingApplied)
+	}
+
+	// the bodies are the decrypted ones when the message can be
+	var armored []byte
+	if jsonData.PGP, armored = DetectPGP(env.Raw, jsonData.Body.Text); armored != nil && len(opts.PGPKeyring) > 0 {
+		decryptPGP(jsonData, armored, opts.PGPKeyring, logger)
+	}
+
+	if opts.DeriveText && strings.TrimSpace(jsonData.Body.Text) == "" && jsonData.Body.HTML != "" {
+		jsonData.Body.Text, jsonData.Body.TextDerived = HTMLToText(jsonData.Body.HTML), true
+	}
+
+	// a calendar that can't be parsed doesn't fail the message, it is noted in the warnings
+	var calendarWarnings []string
+	jsonData.Calendar, calendarWarnings = ExtractCalendar(env.Raw)
+	jsonData.ParseWarnings = append(jsonData.ParseWarnings, calendarWarnings...)
+
+	jsonData.SMIME = VerifySMIME(env.Raw, opts.SMIMERoots)
+	if jsonData.SMIME != nil && jsonData.SMIME.Signed && !jsonData.SMIME.Valid {
+		logger.Debug("invalid smime signature", "error", jsonData.SMIME.Error)
+	}
+
+	// Address handling
+	separators := opts.SubaddressSeparators
+	if separators == "" {
+		separators = "+"
+	}
+	addresses := func(list []*mail.Address) []*EmailAddress {
+		ret := EmailAddresses(list)
+		for _, a := range ret {
+			if a.Address != "" {
+				a.LocalPart, a.Tag, a.NormalizedAddress = SplitSubaddress(a.Address, separators, opts.SubaddressStripDots)
+			}
+			if at := strings.LastIndex(a.Address, "@"); at >= 0 {
+				a.DomainUnicode, a.DomainASCII = IDNADomain(a.Address[at+1:])
+			}
+		}
+		return ret
+	}
+
+	if env.From != nil {
+		jsonData.Addresses.From = addresses([]*mail.Address{env.From})[0]
+	}
+	jsonData.Addresses.To = addresses(env.To)
+	if env.OriginalTo != nil {
+		jsonData.Addresses.OriginalTo = addresses(env.OriginalTo)
+	}
+	jsonData.Addresses.HeaderFrom = addresses(ParseAddressList(header, "From", msg.From))
+	jsonData.Addresses.HeaderTo = addresses(ParseAddressList(header, "To", msg.To))
+	jsonData.Addresses.Cc = addresses(ParseAddressList(header, "Cc", msg.Cc))
+	jsonData.Addresses.Bcc = addresses(ParseAddressList(header, "Bcc", msg.Bcc))
+	jsonData.Addresses.ReplyTo = addresses(ParseAddressList(header, "Reply-To", msg.ReplyTo))
+	jsonData.Addresses.InReplyTo = msg.InReplyTo
+
+	if resentFrom := addresses(ParseAddressList(header, "Resent-From", msg.ResentFrom)); len(resentFrom) > 0 {
+		jsonData.Addresses.ResentFrom = resentFrom[0]
+	}
+
+	jsonData.Addresses.ResentTo = addresses(ParseAddressList(header, "Resent-To", msg.ResentTo))
+	jsonData.Addresses.ResentCc = addresses(ParseAddressList(header, "Resent-Cc", msg.ResentCc))
+	jsonData.Addresses.ResentBcc = addresses(ParseAddressList(header, "Resent-Bcc", msg.ResentBcc))
+
+	// the names are decoded again from the raw message, the parser leaves most charsets encoded
+	attachmentNames, embeddedNames := PartNames(env.Raw)
+	if len(attachmentNames) != len(msg.Attachments) {
+		attachmentNames = nil
+	}
+	if len(embeddedNames) != len(msg.EmbeddedFiles) {
+		embeddedNames = nil
+	}
+
+	// the field of an attachment is its position in the payload, a TNEF one being expanded to its files
+	addAttachment := func(attachment *EmailAttachment, r io.Reader) error {
+		logger.Debug("attachment", "filename", attachment.Filename, "content_type", attachment.ContentType)
+		if !allowed(attachment.Filename, attachment.ContentType) {
+			logger.Info("attachment stripped, type not allowed", "filename", attachment.Filename)
+			attachment.Stripped = true
+			jsonData.Attachments = append(jsonData.Attachments, attachment)
+			return nil
+		}
+
+		if err := files.Encode(&attachment.EmailFile, attachment.Filename, attachment.ContentType, AttachmentField(len(jsonData.Attachments)), r); err != nil {
+			return err
+		}
+		if attachment.Truncated {
+			logger.Warn("attachment dropped, over the attachment limits", "filename", attachment.Filename)
+		}
+		jsonData.Attachments = append(jsonData.Attachments, attachment)
+
+		return nil
+	}
+
+	for i, a := range msg.Attachments {
+		attachment := &EmailAttachment{Filename: cleanFilename(a.Filename), ContentType: a.ContentType}
+		if attachmentNames != nil && attachmentNames[i].Name != "" {
+			attachment.Filename, attachment.FilenameRaw = attachmentNames[i].Name, attachmentNames[i].Raw
+		}
+
+		data := a.Data
+		if IsTNEF(attachment.Filename, attachment.ContentType) {
+			tnef, r, err := readTNEF(a.Data)
+			if err != nil {
+				logger.Warn("cannot decode the tnef attachment", "filename", attachment.Filename, "error", err)
+				jsonData.ParseWarnings = append(jsonData.ParseWarnings, fmt.Sprintf("cannot decode the tnef attachment %s: %s", attachment.Filename, err.Error()))
+			}
+			data = r
+
+			if tnef != nil {
+				if tnef.RTF != "" {
+					jsonData.Body.RTF = tnef.RTF
+				}
+
+				for _, f := range tnef.Files {
+					file := &EmailAttachment{Filename: cleanFilename(f.Name), ContentType: f.ContentType, Source: AttachmentSourceTNEF}
+					if err := addAttachment(file, bytes.NewReader(f.Data)); err != nil {
+						return nil, err
+					}
+				}
+
+				if !opts.KeepTNEF {
+					continue
+				}
+			}
+		}
+
+		if err := addAttachment(attachment, data); err != nil {
+			return nil, err
+		}
+	}
+
+	// the encrypted message is exposed as an attachment
+	if armored != nil {
+		attachment := &EmailAttachment{Filename: PGPAttachmentName, ContentType: "application/pgp-encrypted", Source: AttachmentSourcePGP}
+		if err := addAttachment(attachment, bytes.NewReader(armored)); err != nil {
+			return nil, err
+		}
+	}
+
+	inlined := map[string]bool{}
+	if opts.InlineCID && jsonData.Body.HTML != "" {
+		jsonData.Body.HTML, inlined, err = InlineCIDs(jsonData.Body.HTML, msg.EmbeddedFiles, opts.InlineCIDMaxSize, opts.MaxFileSize, allowed)
+		if errors.Is(err, ErrInlineTooLarge) {
+			logger.Warn("embedded files not inlined", "error", err)
+			jsonData.ParseWarnings = append(jsonData.ParseWarnings, err.Error())
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, a := range msg.EmbeddedFiles {
+		logger.Debug("embedded file", "cid", a.CID, "content_type", a.ContentType)
+		embedded := &EmailEmbeddedFile{CID: a.CID, ContentType: a.ContentType, Inlined: inlined[a.CID]}
+		if embeddedNames != nil {
+			embedded.Filename, embedded.FilenameRaw = embeddedNames[i].Name, embeddedNames[i].Raw
+		}
+		if !allowed(embedded.Filename, a.ContentType) {
+			logger.Info("embedded file stripped, type not allowed", "cid", a.CID)
+			embedded.Stripped = true
+			jsonData.EmbeddedFiles = append(jsonData.EmbeddedFiles, embedded)
+			continue
+		}
+
+		// its content already is in the html
+		if embedded.Inlined && opts.InlineCIDOmit {
+			continue
+		}
+
+		if err := files.Encode(&embedded.EmailFile, a.CID, a.ContentType, EmbeddedField(i), a.Data); err != nil {
+			return nil, err
+		}
+		if embedded.Truncated {
+			logger.Warn("embedded file dropped, over the attachment limits", "cid", a.CID)
+		}
+		jsonData.EmbeddedFiles = append(jsonData.EmbeddedFiles, embedded)
+	}
+
+	if opts.NestedDepth > 0 {
+		nested, warnings, err := buildNested(env.Raw, opts)
+		if err != nil {
+			return nil, err
+		}
+		jsonData.NestedMessages = nested
+		jsonData.ParseWarnings = append(jsonData.ParseWarnings, warnings...)
+	}
+
+	return jsonData, nil
+}
+
+// decryptPGP replaces the bodies of jsonData by the ones of the encrypted message, the armored block of
+// an inline one by its plain text. A message that can't be decrypted is left as is
+func decryptPGP(jsonData *EmailMessage, armored []byte, keyring openpgp.EntityList, logger *slog.Logger) {
+	plain, signed, err := DecryptPGP(armored, keyring)
+	if err != nil {
+		logger.Warn("cannot decrypt the pgp message", "error", err)
+		jsonData.PGP.Error = err.Error()
+		return
+	}
+
+	if jsonData.PGP.Inline {
+		jsonData.Body.Text = strings.Replace(jsonData.Body.Text, string(armored), decodeBodyCharset(plain, ""), 1)
+	} else {
+		bodies, err := ParseBodies(plain)
+		if err != nil {
+			logger.Warn("cannot parse the decrypted pgp message", "error", err)
+			jsonData.PGP.Error = fmt.Sprintf("cannot parse the decrypted message: %s", err.Error())
+			return
+		}
+		jsonData.Body.Text, jsonData.Body.HTML = bodies.Text, bodies.HTML
+		jsonData.Body.TextEncodingApplied, jsonData.Body.HTMLEncodingApplied = bodies.TextEncodingApplied, bodies.HTMLEncodingApplied
+
+		// a signed then encrypted PGP/MIME message is a multipart/signed once decrypted
+		if pgp, _ := DetectPGP(plain, ""); pgp != nil && pgp.Signed {
+			signed = true
+		}
+	}
+
+	jsonData.PGP.Decrypted = true
+	jsonData.PGP.Signed = jsonData.PGP.Signed || signed
+}
+
+// readTNEF reads and decodes a TNEF attachment, r replays what was read for the attachment to be
+// forwarded as is. A read error is left for the encoder of the files to handle
+func readTNEF(data io.Reader) (tnef *TNEF, r io.Reader, err error) {
+	raw, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, io.MultiReader(bytes.NewReader(raw), &errorReader{err: err}), nil
+	}
+
+	tnef, err = DecodeTNEF(raw)
+	return tnef, bytes.NewReader(raw), err
+}
+
+// errorReader fails the reads with err
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// formatDate returns the RFC3339 date in UTC and the unix timestamp of t, nothing for the zero time
+// of a missing or unparseable date header
+func formatDate(t time.Time) (string, *int64) {
+	if t.IsZero() {
+		return "", nil
+	}
+
+	unix := t.Unix()
+
+	return t.UTC().Format(time.RFC3339), &unix
+}
+
+// AttachmentField returns the form field name of the i-th attachment
+func AttachmentField(i int) string {
+	return fmt.Sprintf("attachment[%d]", i)
+}
+
+// EmbeddedField returns the form field name of the i-th embedded file
+func EmbeddedField(i int) string {
+	return fmt.Sprintf("embedded[%d]", i)
+}
+
+// base64Encoder puts the content of the files in the payload
+type base64Encoder struct{}
+
+func (base64Encoder) Encode(f *EmailFile, name, contentType, field string, r io.Reader) error {
+	data, err := EncodeBase64(r)
+	if err != nil {
+		return &PartError{Name: name, Err: err}
+	}
+	f.Data = data
+
+	return nil
+}
+
+// encodeBufferSize is the initial size of the encoded data when the size of the content isn't known
+const encodeBufferSize = 64 * 1024
+
+// EncodeBase64 returns the base64 encoded content of r, encoded while it is read so the content is never
+// copied whole before being encoded. A reader that knows its length (a bytes.Reader) gets the encoded data
+// allocated at once
+func EncodeBase64(r io.Reader) (string, error) {
+	size := encodeBufferSize
+	if l, ok := r.(interface{ Len() int }); ok {
+		size = base64.StdEncoding.EncodedLen(l.Len())
+	}
+
+	out := &strings.Builder{}
+	out.Grow(size)
+
+	enc := base64.NewEncoder(base64.StdEncoding, out)
+	if _, err := io.Copy(enc, r); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
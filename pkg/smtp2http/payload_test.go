@@ -0,0 +1,115 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+// benchmarkFileSize is the size of the attachment of the benchmarks, a large message of the container limits
+const benchmarkFileSize = 20 << 20
+
+func TestEncodeBase64(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, size := range []int{0, 1, 2, 3, 57, encodeBufferSize + 1, 1 << 20} {
+		data := make([]byte, size)
+		rng.Read(data)
+		want := base64.StdEncoding.EncodeToString(data)
+
+		// the size is known to a bytes.Reader, not to the other readers
+		for name, r := range map[string]io.Reader{
+			"bytes.Reader": bytes.NewReader(data),
+			"reader":       struct{ io.Reader }{bytes.NewReader(data)},
+		} {
+			got, err := EncodeBase64(r)
+			if err != nil {
+				t.Fatalf("%d bytes, %s: %v", size, name, err)
+			}
+			if got != want {
+				t.Errorf("%d bytes, %s: encoded %d bytes, want the %d of base64.StdEncoding", size, name, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestEncodeBase64Error(t *testing.T) {
+	broken := errors.New("unexpected EOF")
+	r := io.MultiReader(strings.NewReader("partial content"), &errorReader{err: broken})
+
+	if _, err := EncodeBase64(r); !errors.Is(err, broken) {
+		t.Errorf("EncodeBase64 of a broken part returned %v, want its error", err)
+	}
+}
+
+// benchmarkFile is the content of the attachment of the benchmarks
+func benchmarkFile() []byte {
+	data := make([]byte, benchmarkFileSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	return data
+}
+
+func BenchmarkEncodeBase64(b *testing.B) {
+	data := benchmarkFile()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeBase64(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEncodeBase64ReadAll is the encoding EncodeBase64 replaced, the content read whole before being
+// encoded in a string of its own
+func BenchmarkEncodeBase64ReadAll(b *testing.B) {
+	data := benchmarkFile()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		read, err := ioutil.ReadAll(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = base64.StdEncoding.EncodeToString(read)
+	}
+}
+
+func BenchmarkBuildPayload(b *testing.B) {
+	raw := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: large\r\nMessage-ID: <large@example.com>\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nsee the attachment\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=large.bin\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		wrapLines(base64.StdEncoding.EncodeToString(benchmarkFile()), 76) +
+		"--b--\r\n"
+	b.SetBytes(benchmarkFileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg, err := smtpsrv.ParseEmail(strings.NewReader(raw))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		p, err := BuildPayload(msg, &Envelope{Raw: []byte(raw)}, PayloadOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(p.Attachments) != 1 || len(p.Attachments[0].Data) != base64.StdEncoding.EncodedLen(benchmarkFileSize) {
+			b.Fatalf("attachments = %d, want the large file", len(p.Attachments))
+		}
+	}
+}
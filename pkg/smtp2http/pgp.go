@@ -0,0 +1,138 @@
+package smtp2http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// PGPAttachmentName is the filename of the encrypted OpenPGP message once exposed as an attachment
+const PGPAttachmentName = "encrypted.asc"
+
+const (
+	pgpMessageBegin = "-----BEGIN PGP MESSAGE-----"
+	pgpMessageEnd   = "-----END PGP MESSAGE-----"
+	pgpSignedBegin  = "-----BEGIN PGP SIGNED MESSAGE-----"
+)
+
+// DetectPGP detects the OpenPGP content of the raw message: the PGP/MIME encrypted (multipart/encrypted) or
+// signed (multipart/signed) messages (RFC 3156), and else the inline armored messages of its text body. It
+// returns the encrypted message, armored, along with the status, and nil when the message isn't an OpenPGP one
+func DetectPGP(raw []byte, text string) (*EmailPGP, []byte) {
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		contentType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		switch protocol := strings.ToLower(params["protocol"]); {
+		case err != nil:
+		case contentType == "multipart/encrypted" && protocol == "application/pgp-encrypted":
+			return &EmailPGP{Encrypted: true}, encryptedPart(msg, params["boundary"])
+		case contentType == "multipart/signed" && protocol == "application/pgp-signature":
+			return &EmailPGP{Signed: true}, nil
+		}
+	}
+
+	if begin := strings.Index(text, pgpMessageBegin); begin >= 0 {
+		if end := strings.Index(text[begin:], pgpMessageEnd); end >= 0 {
+			return &EmailPGP{Encrypted: true, Inline: true}, []byte(text[begin : begin+end+len(pgpMessageEnd)])
+		}
+	}
+
+	if strings.Contains(text, pgpSignedBegin) {
+		return &EmailPGP{Signed: true, Inline: true}, nil
+	}
+
+	return nil, nil
+}
+
+// encryptedPart returns the decoded second part of a multipart/encrypted message, the first one being
+// the version identification
+func encryptedPart(msg *mail.Message, boundary string) []byte {
+	mr := multipart.NewReader(msg.Body, boundary)
+	for i := 0; ; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil
+		}
+
+		if i == 1 {
+			data, err := ioutil.ReadAll(decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding")))
+			if err != nil {
+				return nil
+			}
+			return data
+		}
+	}
+}
+
+// DecryptPGP decrypts an armored (or binary) OpenPGP message with the private keys of keyring, which must
+// be decrypted already. signed tells whether the message was signed too, the signature isn't verified
+func DecryptPGP(data []byte, keyring openpgp.KeyRing) (plain []byte, signed bool, err error) {
+	var r io.Reader = bytes.NewReader(data)
+	if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+		if block.Type != "PGP MESSAGE" {
+			return nil, false, fmt.Errorf("not an encrypted message but a %s", strings.ToLower(block.Type))
+		}
+		r = block.Body
+	}
+
+	md, err := openpgp.ReadMessage(r, keyring, nil, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot decrypt the message: %s", err.Error())
+	}
+
+	if !md.IsEncrypted {
+		return nil, false, errors.New("the message isn't encrypted")
+	}
+
+	plain, err = ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot decrypt the message: %s", err.Error())
+	}
+
+	return plain, md.IsSigned, nil
+}
+
+// ReadPGPKeyring reads the armored private keys of a keyring and decrypts them with passphrase
+func ReadPGPKeyring(data []byte, passphrase []byte) (openpgp.EntityList, error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the pgp keyring: %s", err.Error())
+	}
+
+	decrypted := 0
+	for _, entity := range keyring {
+		keys := []*packet.PrivateKey{}
+		if entity.PrivateKey != nil {
+			keys = append(keys, entity.PrivateKey)
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil {
+				keys = append(keys, subkey.PrivateKey)
+			}
+		}
+
+		for _, key := range keys {
+			if key.Encrypted {
+				if err := key.Decrypt(passphrase); err != nil {
+					return nil, fmt.Errorf("cannot decrypt the pgp private key %s: %s", key.KeyIdString(), err.Error())
+				}
+			}
+			decrypted++
+		}
+	}
+
+	if decrypted == 0 {
+		return nil, errors.New("no private key in the pgp keyring")
+	}
+
+	return keyring, nil
+}
@@ -0,0 +1,178 @@
+package smtp2http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+// payloadFormatPostmark posts the json body of the Postmark inbound webhook
+const payloadFormatPostmark = "postmark"
+
+// postmarkAddress is an address of a Postmark payload
+type postmarkAddress struct {
+	Email       string
+	Name        string
+	MailboxHash string
+}
+
+// postmarkHeader is a header of a Postmark payload
+type postmarkHeader struct {
+	Name  string
+	Value string
+}
+
+// postmarkAttachment is an attachment (or an embedded file) of a Postmark payload
+type postmarkAttachment struct {
+	Name          string
+	Content       string
+	ContentType   string
+	ContentLength int
+	ContentID     string `json:",omitempty"`
+}
+
+// postmarkMessage is the json body of the Postmark inbound webhook
+type postmarkMessage struct {
+	FromName          string
+	MessageStream     string
+	From              string
+	FromFull          *postmarkAddress
+	To                string
+	ToFull            []*postmarkAddress
+	Cc                string
+	CcFull            []*postmarkAddress
+	Bcc               string
+	BccFull           []*postmarkAddress
+	OriginalRecipient string
+	Subject           string
+	MessageID         string
+	ReplyTo           string
+	MailboxHash       string
+	Date              string
+	TextBody          string
+	HTMLBody          string `json:"HtmlBody"`
+	StrippedTextReply string
+	Tag               string
+	Headers           []*postmarkHeader
+	Attachments       []*postmarkAttachment
+}
+
+// buildPostmark builds the request the Postmark inbound webhook would have posted for the message,
+// the original recipient is the first recipient and its plus addressing tag is the MailboxHash
+func buildPostmark(c *Context, msg *smtpsrv.Email, recipients []*mail.Address) (*webhookRequest, error) {
+	header, err := c.Header()
+	if err != nil {
+		header = mail.Header{}
+	}
+
+	text, html, err := ExtractBodies(c.Raw())
+	if err != nil {
+		text, html = msg.TextBody, msg.HTMLBody
+	}
+
+	from := postmarkAddresses(ParseAddressList(header, "From", msg.From))
+	if len(from) == 0 {
+		from = postmarkAddresses([]*mail.Address{c.From()})
+	}
+
+	stripped, _ := stripReply(text)
+
+	payload := &postmarkMessage{
+		FromName:          from[0].Name,
+		MessageStream:     "inbound",
+		From:              from[0].Email,
+		FromFull:          from[0],
+		To:                DecodeHeader(header.Get("To")),
+		ToFull:            postmarkAddresses(ParseAddressList(header, "To", msg.To)),
+		Cc:                DecodeHeader(header.Get("Cc")),
+		CcFull:            postmarkAddresses(ParseAddressList(header, "Cc", msg.Cc)),
+		Bcc:               DecodeHeader(header.Get("Bcc")),
+		BccFull:           postmarkAddresses(ParseAddressList(header, "Bcc", msg.Bcc)),
+		OriginalRecipient: recipients[0].Address,
+		Subject:           DecodeHeader(header.Get("Subject")),
+		MessageID:         newUUID(),
+		ReplyTo:           DecodeHeader(header.Get("Reply-To")),
+		MailboxHash:       mailboxHash(recipients[0].Address),
+		Date:              header.Get("Date"),
+		TextBody:          text,
+		HTMLBody:          html,
+		StrippedTextReply: stripped,
+		Headers:           []*postmarkHeader{},
+		Attachments:       []*postmarkAttachment{},
+	}
+
+	for _, f := range HeaderFields(c.Raw()) {
+		payload.Headers = append(payload.Headers, &postmarkHeader{Name: f[0], Value: f[1]})
+	}
+
+	for _, a := range msg.Attachments {
+		if !attachmentTypes.allowed(a.Filename, a.ContentType) {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(a.Data)
+		if err != nil {
+			return nil, readError(a.Filename, err)
+		}
+
+		payload.Attachments = append(payload.Attachments, &postmarkAttachment{
+			Name:          a.Filename,
+			Content:       base64.StdEncoding.EncodeToString(data),
+			ContentType:   a.ContentType,
+			ContentLength: len(data),
+		})
+	}
+
+	for _, e := range msg.EmbeddedFiles {
+		if !attachmentTypes.allowed("", e.ContentType) {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(e.Data)
+		if err != nil {
+			return nil, readError(e.CID, err)
+		}
+
+		payload.Attachments = append(payload.Attachments, &postmarkAttachment{
+			Name:          e.CID,
+			Content:       base64.StdEncoding.EncodeToString(data),
+			ContentType:   e.ContentType,
+			ContentLength: len(data),
+			ContentID:     e.CID,
+		})
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhookRequest{Body: body, ContentType: "application/json"}, nil
+}
+
+func postmarkAddresses(addresses []*mail.Address) []*postmarkAddress {
+	ret := []*postmarkAddress{}
+	for _, a := range addresses {
+		ret = append(ret, &postmarkAddress{Email: a.Address, Name: a.Name, MailboxHash: mailboxHash(a.Address)})
+	}
+
+	return ret
+}
+
+// mailboxHash returns the plus addressing tag of an address: "hash" for "user+hash@example.com"
+func mailboxHash(address string) string {
+	local := address
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		local = address[:i]
+	}
+
+	if _, hash, ok := strings.Cut(local, "+"); ok {
+		return hash
+	}
+
+	return ""
+}
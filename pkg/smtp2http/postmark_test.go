@@ -0,0 +1,37 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestPostmarkPayload(t *testing.T) {
+	r := postFixture(t, payloadFormatPostmark, "inbound.eml")
+
+	if r.contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", r.contentType)
+	}
+
+	msg := &postmarkMessage{}
+	if err := json.Unmarshal(r.body, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.ToFull) != 2 || msg.ToFull[0].MailboxHash != "orders" || msg.ToFull[1].MailboxHash != "" || msg.MailboxHash != "orders" {
+		t.Errorf("MailboxHash = %q, ToFull = %+v, want the plus addressing tag of bob", msg.MailboxHash, msg.ToFull)
+	}
+
+	// postmark gives each message an id of its own
+	if msg.MessageID == "" {
+		t.Error("no MessageID")
+	}
+	body := bytes.Replace(r.body, []byte(`"MessageID":"`+msg.MessageID+`"`), []byte(`"MessageID":"<generated>"`), 1)
+
+	var got bytes.Buffer
+	if err := json.Indent(&got, body, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	got.WriteString("\n")
+
+	golden(t, "inbound.postmark.golden", got.Bytes())
+}
@@ -0,0 +1,121 @@
+package smtp2http
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyHeaderTimeout is how long a connection has to send its PROXY header, the load balancer sends it right away
+const proxyHeaderTimeout = 3 * time.Second
+
+// errConnRefused is returned by the reads and writes of a connection whose header was missing or that a check refused
+var errConnRefused = errors.New("connection refused")
+
+// proxyListener requires a PROXY protocol (v1 or v2) header on every connection and substitutes the client
+// address it carries for the one of the load balancer. The connections are returned right away, their header
+// is read with their first read, write or RemoteAddr, in their own goroutine, so a client slow to send it
+// doesn't hold the accept loop. A connection without a valid header is closed
+type proxyListener struct {
+	net.Listener
+}
+
+func newProxyListener(l net.Listener, enabled bool) net.Listener {
+	if !enabled {
+		return l
+	}
+
+	return &proxyListener{Listener: &proxyproto.Listener{
+		Listener:          l,
+		ReadHeaderTimeout: proxyHeaderTimeout,
+		Policy: func(net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+	}}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if pc, ok := conn.(*proxyproto.Conn); ok {
+		return &proxyConn{Conn: pc}, nil
+	}
+
+	return conn, nil
+}
+
+// proxyConn reads the PROXY header of its connection once, then runs the checks the listeners
+// wrapping it deferred until the client address was known
+type proxyConn struct {
+	*proxyproto.Conn
+	once   sync.Once
+	err    error
+	checks []func(net.Conn) bool
+}
+
+func (c *proxyConn) handshake() error {
+	c.once.Do(func() {
+		// reading the header, a connection without one could spoof its address
+		if c.Conn.ProxyHeader() == nil {
+			slog.Warn("connection refused, no valid proxy protocol header", "remote_addr", c.Conn.Raw().RemoteAddr().String())
+			c.err = errConnRefused
+		}
+
+		for _, check := range c.checks {
+			if c.err == nil && !check(c.Conn) {
+				c.err = errConnRefused
+			}
+		}
+
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.handshake()
+	return c.Conn.RemoteAddr()
+}
+
+// admit runs check on conn once its client address is known: right away for a plain connection, which is
+// closed when refused, and with the header of a proxyConn. It returns false when conn was refused and closed,
+// the check writes its own reply to the connection it is given
+func admit(conn net.Conn, check func(net.Conn) bool) bool {
+	if pc, ok := conn.(*proxyConn); ok {
+		pc.checks = append(pc.checks, check)
+		return true
+	}
+
+	if !check(conn) {
+		conn.Close()
+		return false
+	}
+
+	return true
+}
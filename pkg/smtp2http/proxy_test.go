@@ -0,0 +1,134 @@
+package smtp2http
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyTestListener listens on a free port behind the proxy protocol, with the ip filter and the limits
+func proxyTestListener(t *testing.T, filter *ipFilter) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := newLimitListener(newFilterListener(newProxyListener(l, true), filter), 0)
+	t.Cleanup(func() { pl.Close() })
+
+	return pl
+}
+
+func dial(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func accept(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("Accept blocked")
+	}
+
+	return nil
+}
+
+func TestProxyHeader(t *testing.T) {
+	for _, version := range []byte{1, 2} {
+		l := proxyTestListener(t, nil)
+		client := dial(t, l)
+
+		source := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+		header := proxyproto.HeaderProxyFromAddrs(version, source, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25})
+		if _, err := header.WriteTo(client); err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("EHLO client\r\n"))
+
+		conn := accept(t, l)
+		if got := conn.RemoteAddr().String(); got != source.String() {
+			t.Errorf("v%d: RemoteAddr = %s, want %s", version, got, source)
+		}
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "EHLO client\r\n" {
+			t.Errorf("v%d: read %q, %v, want the command after the header", version, line, err)
+		}
+	}
+}
+
+func TestProxyHeaderDoesNotBlockAccept(t *testing.T) {
+	l := proxyTestListener(t, nil)
+
+	// the first client sends nothing, the second one is accepted all the same
+	dial(t, l)
+	silent := accept(t, l)
+
+	client := dial(t, l)
+	proxyproto.HeaderProxyFromAddrs(1, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}).WriteTo(client)
+	if got := accept(t, l).RemoteAddr().String(); got != "203.0.113.7:40000" {
+		t.Errorf("RemoteAddr = %s, want the address of the header", got)
+	}
+
+	// the silent one is refused with its first read, once the header timed out
+	if _, err := silent.Read(make([]byte, 1)); err == nil {
+		t.Error("a connection without a header was read")
+	}
+}
+
+func TestProxyHeaderMissing(t *testing.T) {
+	l := proxyTestListener(t, nil)
+	client := dial(t, l)
+	client.Write([]byte("EHLO client\r\n"))
+
+	if _, err := accept(t, l).Write([]byte("220 ready\r\n")); err == nil {
+		t.Error("wrote to a connection without a header")
+	}
+}
+
+func TestProxyHeaderFilter(t *testing.T) {
+	filter, err := newIPFilter("", "203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := proxyTestListener(t, filter)
+	client := dial(t, l)
+	proxyproto.HeaderProxyFromAddrs(2, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}).WriteTo(client)
+
+	if _, err := accept(t, l).Write([]byte("220 ready\r\n")); err == nil {
+		t.Error("wrote to a connection from a denied address")
+	}
+
+	reply, _ := bufio.NewReader(client).ReadString('\n')
+	if !strings.HasPrefix(reply, "554 ") {
+		t.Errorf("reply = %q, want a 554", reply)
+	}
+}
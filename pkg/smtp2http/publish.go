@@ -0,0 +1,197 @@
+package smtp2http
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// publishers are the message brokers every payload is published to, alongside or instead of the webhooks
+var publishers []publisher
+
+var errPublishFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Cannot accept your message due to internal error, please try again later",
+}
+
+// publisher is a message broker output
+type publisher interface {
+	// Name identifies the output in the logs and the metrics
+	Name() string
+
+	// Publish returns once the broker acknowledged the message
+	Publish(ctx context.Context, p *publication) error
+
+	// Close flushes and closes the connection to the broker
+	Close() error
+}
+
+// timedPublisher is a publisher with a timeout of its own instead of -publish-timeout
+type timedPublisher interface {
+	publisher
+
+	Timeout() time.Duration
+}
+
+// publication is a payload to publish with what the outputs need to key or route it
+type publication struct {
+	Body        []byte
+	ContentType string
+	Headers     map[string]string
+
+	// Recipient is the first recipient of the payload, Recipients all of them
+	Recipient  string
+	Recipients []string
+	From       string
+	MessageID  string
+
+	// Values are the placeholder values of the payload, see placeholderValues
+	Values map[string]string
+}
+
+// closePublishers closes every publisher, errors are only worth logging at this point
+func closePublishers() []error {
+	errs := []error{}
+	for _, p := range publishers {
+		if err := p.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", p.Name(), err.Error()))
+		}
+	}
+
+	return errs
+}
+
+// clientTLSConfig returns the tls config used to connect to a broker, caFile replaces the system pool when set
+func clientTLSConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RootCAs = x509.NewCertPool()
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+
+	return cfg, nil
+}
+
+// publicationAttributes returns the attributes the managed queues publish a payload with, the empty ones left out
+func publicationAttributes(pub *publication) map[string]string {
+	attrs := map[string]string{}
+	for name, value := range map[string]string{
+		"from_domain": pub.Values["from_domain"],
+		"to_domain":   pub.Values["to_domain"],
+		"spf_result":  pub.Values["spf"],
+		"delivery_id": pub.Headers[deliveryIDHeader],
+	} {
+		if value != "" {
+			attrs[name] = value
+		}
+	}
+
+	return attrs
+}
+
+// fitPayload returns the body of pub, or when it is over limit bytes the default json payload with the content of
+// its files left out: written to -attachment-store-dir and linked when set, only their metadata otherwise
+func fitPayload(output string, pub *publication, limit int) ([]byte, error) {
+	if len(pub.Body) <= limit {
+		return pub.Body, nil
+	}
+	if !defaultJSONPayload() {
+		return nil, fmt.Errorf("the payload of %d bytes is over the %d bytes %s accepts", len(pub.Body), limit, output)
+	}
+
+	msg := &EmailMessage{}
+	if err := json.Unmarshal(pub.Body, msg); err != nil {
+		return nil, fmt.Errorf("cannot read the payload: %s", err.Error())
+	}
+
+	shrink := fileMetadata
+	if attachmentStore != nil {
+		shrink = storeFile
+	}
+	for _, a := range msg.Attachments {
+		if err := shrink(&a.EmailFile, a.Filename, a.ContentType); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range msg.EmbeddedFiles {
+		if err := shrink(&e.EmailFile, e.Filename, e.ContentType); err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, fmt.Errorf("the payload of %d bytes without its files is still over the %d bytes %s accepts", len(body), limit, output)
+	}
+
+	slog.Info("payload over the size limit of the output, its files were left out", "output", output, "delivery_id", pub.Headers[deliveryIDHeader],
+		"payload_size", len(pub.Body), "size", len(body), "stored", attachmentStore != nil)
+
+	return body, nil
+}
+
+// defaultJSONPayload tells whether the payloads are the default json ones, which the outputs can rewrite
+func defaultJSONPayload() bool {
+	return !conf.RawOnly && conf.PayloadFormat == payloadFormatDefault && conf.WebhookFormat == webhookFormatJSON && payloadFields == nil &&
+		bodyTemplate == nil && conf.NotifyFormat == ""
+}
+
+// fileMetadata replaces the content of an inline file by its size and sha256
+func fileMetadata(f *EmailFile, _, _ string) error {
+	if f.Data == "" {
+		return nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(f.Data)
+	if err != nil {
+		return fmt.Errorf("cannot decode a file of the payload: %s", err.Error())
+	}
+
+	sum := sha256.Sum256(data)
+	f.Size, f.SHA256, f.Data = int64(len(data)), hex.EncodeToString(sum[:]), ""
+
+	return nil
+}
+
+// storeFile writes the content of an inline file to the attachment store and replaces it by its location
+func storeFile(f *EmailFile, name, contentType string) error {
+	if f.Data == "" {
+		return nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(f.Data)
+	if err != nil {
+		return fmt.Errorf("cannot decode a file of the payload: %s", err.Error())
+	}
+
+	if f.Path, f.URL, err = attachmentStore.Put(storeKey(name), contentType, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	f.Size, f.Data = int64(len(data)), ""
+
+	return nil
+}
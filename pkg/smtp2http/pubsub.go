@@ -0,0 +1,122 @@
+package smtp2http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// pubsubMaxPayload is the largest payload published as is, the data of a message is base64 encoded in the
+// publish request which the api limits to 10MB
+const pubsubMaxPayload = 7 << 20
+
+const pubsubScope = "https://www.googleapis.com/auth/pubsub"
+
+var pubsubTopicPattern = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+// pubsubPublisher publishes the payloads to a google cloud pub/sub topic with the rest api, authenticated with
+// the application default credentials (GOOGLE_APPLICATION_CREDENTIALS, gcloud, the metadata server). The
+// emulator of PUBSUB_EMULATOR_HOST is used without credentials when set
+type pubsubPublisher struct {
+	client   *http.Client
+	endpoint string
+	topic    string
+}
+
+func newPubSubPublisher(topic string) (*pubsubPublisher, error) {
+	if !pubsubTopicPattern.MatchString(topic) {
+		return nil, fmt.Errorf("invalid -pubsub-topic %q, expected projects/PROJECT/topics/TOPIC", topic)
+	}
+
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		return &pubsubPublisher{client: &http.Client{}, endpoint: "http://" + host, topic: topic}, nil
+	}
+
+	ctx := context.Background()
+	creds, err := google.FindDefaultCredentials(ctx, pubsubScope)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the google credentials: %s", err.Error())
+	}
+
+	// a key file or the metadata server is found without being used, a token is only issued by valid credentials
+	if _, err := creds.TokenSource.Token(); err != nil {
+		return nil, fmt.Errorf("cannot get a google access token: %s", err.Error())
+	}
+
+	return &pubsubPublisher{client: oauth2.NewClient(ctx, creds.TokenSource), endpoint: "https://pubsub.googleapis.com", topic: topic}, nil
+}
+
+func (p *pubsubPublisher) Name() string {
+	return "pubsub"
+}
+
+// Publish returns once pub/sub stored the message, the payload is its data
+func (p *pubsubPublisher) Publish(ctx context.Context, pub *publication) error {
+	body, err := fitPayload(p.Name(), pub, pubsubMaxPayload)
+	if err != nil {
+		return err
+	}
+
+	type message struct {
+		Data       []byte            `json:"data"`
+		Attributes map[string]string `json:"attributes,omitempty"`
+	}
+	data, err := json.Marshal(map[string][]message{"messages": {{Data: body, Attributes: publicationAttributes(pub)}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/v1/"+p.topic+":publish", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Error.Message != "" {
+			return fmt.Errorf("pub/sub returned %d: %s", resp.StatusCode, apiErr.Error.Message)
+		}
+		return fmt.Errorf("pub/sub returned %d", resp.StatusCode)
+	}
+
+	ids := struct {
+		MessageIDs []string `json:"messageIds"`
+	}{}
+	if err := json.Unmarshal(respBody, &ids); err != nil || len(ids.MessageIDs) != 1 {
+		return errors.New("pub/sub returned no message id")
+	}
+
+	return nil
+}
+
+func (p *pubsubPublisher) Close() error {
+	p.client.CloseIdleConnections()
+
+	return nil
+}
@@ -0,0 +1,135 @@
+package smtp2http
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testPublication is the payload the tests of the outputs publish
+func testPublication() *publication {
+	return &publication{
+		Body:        []byte(`{"id":"1"}`),
+		ContentType: "application/json",
+		Headers:     map[string]string{deliveryIDHeader: "delivery-1"},
+		Recipient:   "bob@example.com",
+		Recipients:  []string{"bob@example.com", "carol@example.com"},
+		From:        "alice@example.com",
+		MessageID:   "1@example.com",
+		Values:      map[string]string{"spf": "pass"},
+	}
+}
+
+// pubsubRequest is a publish request the pub/sub emulator received
+type pubsubRequest struct {
+	path     string
+	messages []struct {
+		Data       []byte            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+	}
+}
+
+// pubsubEmulator serves PUBSUB_EMULATOR_HOST until the test ends, it answers status and body to the
+// publish requests it sends on the returned channel
+func pubsubEmulator(t *testing.T, status int, body string) chan pubsubRequest {
+	t.Helper()
+
+	requests := make(chan pubsubRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		req := pubsubRequest{path: r.URL.Path}
+		if err := json.Unmarshal(data, &struct {
+			Messages interface{} `json:"messages"`
+		}{&req.messages}); err != nil {
+			t.Errorf("publish request %s: %v", data, err)
+		}
+		requests <- req
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(srv.URL, "http://"))
+
+	return requests
+}
+
+func TestNewPubSubPublisherInvalidTopic(t *testing.T) {
+	t.Setenv("PUBSUB_EMULATOR_HOST", "127.0.0.1:1")
+
+	for _, topic := range []string{"", "emails", "projects/p", "projects/p/topics/", "projects//topics/t", "projects/p/subscriptions/s", "projects/p/topics/t/extra"} {
+		if _, err := newPubSubPublisher(topic); err == nil {
+			t.Errorf("newPubSubPublisher(%q) accepted", topic)
+		}
+	}
+}
+
+func TestPubSubPublish(t *testing.T) {
+	requests := pubsubEmulator(t, http.StatusOK, `{"messageIds":["1"]}`)
+
+	p, err := newPubSubPublisher("projects/my-project/topics/emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	pub := testPublication()
+	pub.Values["to_domain"] = "example.com"
+	if err := p.Publish(context.Background(), pub); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if req.path != "/v1/projects/my-project/topics/emails:publish" {
+		t.Errorf("published to %s, want the publish method of the topic", req.path)
+	}
+	if len(req.messages) != 1 {
+		t.Fatalf("%d messages published, want 1", len(req.messages))
+	}
+	if got := string(req.messages[0].Data); got != string(pub.Body) {
+		t.Errorf("data = %s, want the payload %s", got, pub.Body)
+	}
+	want := map[string]string{"to_domain": "example.com", "spf_result": "pass", "delivery_id": "delivery-1"}
+	if len(req.messages[0].Attributes) != len(want) {
+		t.Errorf("attributes = %v, want %v", req.messages[0].Attributes, want)
+	}
+	for name, value := range want {
+		if got := req.messages[0].Attributes[name]; got != value {
+			t.Errorf("attribute %s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestPubSubPublishErrors(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"the api error", http.StatusForbidden, `{"error":{"code":403,"message":"User not authorized to perform this action."}}`, "pub/sub returned 403: User not authorized to perform this action."},
+		{"no api error", http.StatusBadGateway, "bad gateway", "pub/sub returned 502"},
+		{"no message id", http.StatusOK, `{"messageIds":[]}`, "pub/sub returned no message id"},
+		{"not json", http.StatusOK, "ok", "pub/sub returned no message id"},
+	} {
+		requests := pubsubEmulator(t, c.status, c.body)
+
+		p, err := newPubSubPublisher("projects/my-project/topics/emails")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = p.Publish(context.Background(), testPublication())
+		if err == nil || err.Error() != c.want {
+			t.Errorf("%s: %v, want %q", c.name, err, c.want)
+		}
+		<-requests
+		p.Close()
+	}
+}
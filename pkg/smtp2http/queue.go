@@ -0,0 +1,299 @@
+package smtp2http
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// deliveryModeSync replies to the smtp client once the webhooks answered
+	deliveryModeSync = "sync"
+
+	// deliveryModeAsync replies as soon as the message is queued, the workers deliver it in the background
+	deliveryModeAsync = "async"
+)
+
+var errQueueFull = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Too busy to accept your message, please try again later",
+}
+
+// queue is the delivery queue of -delivery-mode=async, nil when delivering synchronously
+var queue *deliveryQueue
+
+// deliveryJob is a queued message, ready to be posted to its webhooks
+type deliveryJob struct {
+	logger     *slog.Logger
+	deliveries []*delivery
+	raw        []byte
+
+	// the temp files of the message, removed once delivered
+	spill *spillFiles
+
+	// the reject event notified when the delivery fails
+	event *rejectEvent
+
+	// resumed is set for a delivery read back from -queue-path, the message was archived on its first attempt
+	resumed bool
+}
+
+// deliveryQueue is a bounded queue of messages served by a fixed pool of workers
+type deliveryQueue struct {
+	jobs    chan *deliveryJob
+	workers int
+	busy    int64
+	wg      sync.WaitGroup
+
+	// db persists the deliveries when -queue-path is set, the scheduler feeds the workers the due ones
+	db        *queueDB
+	stop      chan struct{}
+	scheduled chan struct{}
+}
+
+// newDeliveryQueue starts the workers of a queue holding up to size messages, the deliveries are persisted
+// in db when not nil
+func newDeliveryQueue(size, workers int, db *queueDB) *deliveryQueue {
+	q := &deliveryQueue{jobs: make(chan *deliveryJob, size), workers: workers, db: db}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	if db != nil {
+		q.stop, q.scheduled = make(chan struct{}), make(chan struct{})
+		go q.schedule()
+	}
+
+	return q
+}
+
+// enqueue queues the job without waiting, it returns errQueueFull when the queue is full. With -queue-path the
+// deliveries are persisted first, the job is only accepted once they are
+func (q *deliveryQueue) enqueue(job *deliveryJob) error {
+	if q.db != nil {
+		if err := q.db.put(job.deliveries, job.raw, job.event); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		if q.db != nil {
+			ids := make([]uint64, len(job.deliveries))
+			for i, d := range job.deliveries {
+				ids[i] = d.queued
+			}
+			q.db.remove(ids...)
+		}
+		return errQueueFull
+	}
+}
+
+// schedule queues the persisted deliveries once their next attempt is due, those left by a previous process
+// included, as long as the workers have room for them
+func (q *deliveryQueue) schedule() {
+	defer close(q.scheduled)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, id := range q.db.due(time.Now(), cap(q.jobs)-len(q.jobs)) {
+			job, err := q.resume(id)
+			if err != nil {
+				slog.Error("cannot read the queued delivery, moving it aside", "queue_id", id, "error", err)
+				q.db.moveAside(id)
+				continue
+			}
+
+			select {
+			case q.jobs <- job:
+			default:
+				q.db.release(id)
+			}
+		}
+	}
+}
+
+// resume returns the job of a persisted delivery
+func (q *deliveryQueue) resume(id uint64) (*deliveryJob, error) {
+	entry, err := q.db.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := entry.delivery(id)
+	if err != nil {
+		return nil, err
+	}
+
+	event := entry.Event
+	if event == nil {
+		event = &rejectEvent{Reason: "queued_delivery", DeliveryID: entry.Headers[deliveryIDHeader]}
+	}
+
+	logger := slog.With("delivery_id", event.DeliveryID, "message_id", event.MessageID, "attempts", entry.Attempts)
+
+	return &deliveryJob{logger: logger, deliveries: []*delivery{d}, raw: entry.Raw, event: event, resumed: true}, nil
+}
+
+func (q *deliveryQueue) work() {
+	defer q.wg.Done()
+
+	for job := range q.jobs {
+		atomic.AddInt64(&q.busy, 1)
+
+		start := time.Now()
+		targets, err := deliverAll(context.Background(), job.logger, job.deliveries, job.raw, start)
+		if !job.resumed {
+			archiveMessage(job.logger, job.raw, err != nil)
+		}
+
+		// the message was already accepted, without -queue-path the spool and the dead letters are the only way
+		// left to keep it when the delivery fails
+		switch {
+		case q.db != nil:
+			q.settle(job, start)
+		case err != nil:
+			metricQueueFailures.Inc()
+			job.logger.Error("queued message lost, webhook delivery failed", "targets", targets, "error", err)
+			ev := job.event.withFailedDelivery(job.deliveries)
+			ev.DeadLetters = buryFailed(job, start)
+			rejectHook.notify(ev)
+		default:
+			job.logger.Info("queued message delivered", "targets", targets, "duration_ms", time.Since(start).Milliseconds())
+		}
+		job.spill.remove()
+
+		atomic.AddInt64(&q.busy, -1)
+	}
+}
+
+// buryFailed moves the failed deliveries of the job to the dead letters, it returns the ids of the letters
+func buryFailed(job *deliveryJob, start time.Time) []string {
+	if deadLetters == nil {
+		return nil
+	}
+
+	letters := []string{}
+	for _, d := range job.deliveries {
+		if d.err == nil {
+			continue
+		}
+
+		logger := job.logger.With("target", d.target())
+		entry, err := newQueueEntry(d, job.raw, job.event, start)
+		if err != nil {
+			logger.Error("cannot read the failed delivery, it is lost", "error", err)
+			continue
+		}
+		entry.Attempts, entry.LastError = 1, d.err.Error()
+		entry.History = []deliveryAttempt{newDeliveryAttempt(d, start)}
+
+		if id := buryEntry(logger, entry, deadLetterFailed); id != "" {
+			letters = append(letters, id)
+		}
+	}
+
+	return letters
+}
+
+// settle updates the persisted deliveries of the job: the accepted ones are removed, the refused and the
+// expired ones move to the dead letters, the others are retried later
+func (q *deliveryQueue) settle(job *deliveryJob, start time.Time) {
+	for _, d := range job.deliveries {
+		logger := job.logger.With("target", d.target(), "queue_id", d.queued)
+		attempt := newDeliveryAttempt(d, start)
+
+		var letter string
+		switch {
+		case d.err == nil:
+			q.db.remove(d.queued)
+			logger.Info("queued delivery done", "outcome", d.outcome(), "duration_ms", time.Since(start).Milliseconds())
+			continue
+		case d.refused():
+			metricQueueFailures.Inc()
+			logger.Error("queued delivery refused", "webhook_status", d.status, "error", d.err)
+			letter = q.db.bury(logger, d.queued, attempt, deadLetterRefused)
+		default:
+			next, ok := q.db.reschedule(d.queued, attempt, d.retryAfter)
+			if ok {
+				logger.Warn("queued delivery failed, retrying later", "error", d.err, "next_attempt", next.Format(time.RFC3339))
+				continue
+			}
+			metricQueueFailures.Inc()
+			logger.Error("queued delivery expired", "error", d.err, "queue_max_age", q.db.maxAge)
+			letter = q.db.bury(logger, d.queued, attempt, deadLetterExpired)
+		}
+
+		ev := *job.event
+		if letter != "" {
+			ev.DeadLetters = []string{letter}
+		}
+		rejectHook.notify(ev.withFailedDelivery([]*delivery{d}))
+	}
+}
+
+// close stops accepting jobs and waits for the queued ones to be delivered, the persisted deliveries not due
+// yet are left for the next process
+func (q *deliveryQueue) close(timeout time.Duration) error {
+	if q.db != nil {
+		close(q.stop)
+		<-q.scheduled
+	}
+
+	close(q.jobs)
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		if q.db != nil {
+			return q.db.close()
+		}
+		return nil
+	case <-time.After(timeout):
+		return errors.New("timed out with queued messages left")
+	}
+}
+
+// depth returns the number of queued messages, the number of pending deliveries with -queue-path
+func (q *deliveryQueue) depth() int {
+	if q == nil {
+		return 0
+	}
+	if q.db != nil {
+		return q.db.depth()
+	}
+
+	return len(q.jobs)
+}
+
+// utilization returns the ratio of the workers busy delivering a message
+func (q *deliveryQueue) utilization() float64 {
+	if q == nil || q.workers == 0 {
+		return 0
+	}
+
+	return float64(atomic.LoadInt64(&q.busy)) / float64(q.workers)
+}
@@ -0,0 +1,174 @@
+package smtp2http
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// queueCommand is the subcommand inspecting the deliveries of -queue-path, see runQueueCommand
+const queueCommand = "queue"
+
+const queueUsage = "usage: smtp2http queue ls|retry [ID...]|rm ID... -queue-path FILE"
+
+// runQueueCommand lists the pending deliveries of the queue file (ls), makes them due now (retry, every one
+// without ids) or removes them (rm). The file is locked by the server using it, which must be stopped first.
+// It returns the exit code: 0 on success, 1 when an id isn't found, 2 on a usage or a queue error
+func runQueueCommand(path string, args []string) int {
+	if len(args) == 0 || path == "" {
+		fmt.Fprintln(os.Stderr, queueUsage)
+		return 2
+	}
+
+	ids := []uint64{}
+	for _, arg := range args[1:] {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid queue id %q\n", arg)
+			return 2
+		}
+		ids = append(ids, id)
+	}
+
+	db, err := openQueueFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer db.Close()
+
+	switch {
+	case args[0] == "ls" && len(ids) == 0:
+		err = listQueue(db)
+	case args[0] == "retry":
+		err = retryQueue(db, ids)
+	case args[0] == "rm" && len(ids) > 0:
+		err = removeQueue(db, ids)
+	default:
+		fmt.Fprintln(os.Stderr, queueUsage)
+		return 2
+	}
+
+	if _, ok := err.(queueNotFound); ok {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	return 0
+}
+
+// queueNotFound is the error of an id missing from the queue
+type queueNotFound uint64
+
+func (e queueNotFound) Error() string {
+	return fmt.Sprintf("no queued delivery %d", uint64(e))
+}
+
+// listQueue prints the pending deliveries, and the count of the corrupt entries moved aside
+func listQueue(db *bolt.DB) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tATTEMPTS\tNEXT\tTARGET\tDELIVERY ID\tLAST ERROR")
+
+	corrupt := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		corrupt = tx.Bucket(queueCorruptBucket).Stats().KeyN
+
+		return tx.Bucket(queuePendingBucket).ForEach(func(k, v []byte) error {
+			entry := &queueEntry{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				fmt.Fprintf(w, "%d\t-\t-\t-\t-\t-\tunreadable: %s\n", queueID(k), err.Error())
+				return nil
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%s\n", queueID(k), entry.Created.Format(time.RFC3339), entry.Attempts,
+				entry.Next.Format(time.RFC3339), entry.target(), entry.Headers[deliveryIDHeader], entry.LastError)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if corrupt > 0 {
+		fmt.Printf("%d corrupt entries moved aside\n", corrupt)
+	}
+
+	return nil
+}
+
+// retryQueue makes the deliveries of ids, or all of them, due now
+func retryQueue(db *bolt.DB, ids []uint64) error {
+	now := time.Now()
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queuePendingBucket)
+		if len(ids) == 0 {
+			b.ForEach(func(k, _ []byte) error {
+				ids = append(ids, queueID(k))
+				return nil
+			})
+		}
+
+		for _, id := range ids {
+			data := b.Get(queueKey(id))
+			if data == nil {
+				return queueNotFound(id)
+			}
+
+			entry := &queueEntry{}
+			if err := json.Unmarshal(data, entry); err != nil {
+				return fmt.Errorf("cannot read the queued delivery %d: %s", id, err.Error())
+			}
+			entry.Next = now
+
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(queueKey(id), data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err == nil {
+		fmt.Printf("%d deliveries due now\n", len(ids))
+	}
+
+	return err
+}
+
+// removeQueue removes the deliveries of ids, they are never retried
+func removeQueue(db *bolt.DB, ids []uint64) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queuePendingBucket)
+		for _, id := range ids {
+			if b.Get(queueKey(id)) == nil {
+				return queueNotFound(id)
+			}
+			if err := b.Delete(queueKey(id)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err == nil {
+		fmt.Printf("%d deliveries removed\n", len(ids))
+	}
+
+	return err
+}
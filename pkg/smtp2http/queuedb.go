@@ -0,0 +1,439 @@
+package smtp2http
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// queuePendingBucket holds the deliveries of -queue-path not accepted yet, keyed by their id
+	queuePendingBucket = []byte("pending")
+
+	// queueCorruptBucket receives the entries that can't be read back, kept for inspection
+	queueCorruptBucket = []byte("corrupt")
+
+	// queueDeadBucket holds the dead letters when -dead-letter-dir isn't set, keyed by their id
+	queueDeadBucket = []byte("dead")
+)
+
+// queueEntry is a persisted delivery, to a webhook or to an output, of a message accepted with -queue-path
+type queueEntry struct {
+	Created   time.Time         `json:"created"`
+	Next      time.Time         `json:"next"`
+	Attempts  int               `json:"attempts"`
+	LastError string            `json:"last_error,omitempty"`
+	History   []deliveryAttempt `json:"history,omitempty"`
+
+	// URL is the webhook of the delivery, Output the name of the broker output otherwise
+	URL         string            `json:"url,omitempty"`
+	Output      string            `json:"output,omitempty"`
+	ContentType string            `json:"content_type"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+
+	// the publication fields the outputs key or route the message with
+	Recipient  string            `json:"recipient,omitempty"`
+	Recipients []string          `json:"recipients,omitempty"`
+	From       string            `json:"from,omitempty"`
+	MessageID  string            `json:"message_id,omitempty"`
+	Values     map[string]string `json:"values,omitempty"`
+
+	// Raw is the original message, only kept for the spool and the dead letters
+	Raw []byte `json:"raw,omitempty"`
+
+	// Event is the reject event notified when the delivery fails for good
+	Event *rejectEvent `json:"event,omitempty"`
+}
+
+// target names the webhook or the output of the entry
+func (e *queueEntry) target() string {
+	if e.Output != "" {
+		return e.Output
+	}
+
+	return e.URL
+}
+
+// queueItem tracks a pending entry in memory, so the due ones are found without reading the file
+type queueItem struct {
+	created time.Time
+	next    time.Time
+
+	// running is set while a worker holds the entry
+	running bool
+}
+
+// queueDB persists the deliveries of the queue in a bbolt file: every delivery of a message is written
+// before the 250 is sent, updated after each failed attempt and removed once accepted, so a restart resumes
+// them. Unreadable entries are moved to the corrupt bucket
+type queueDB struct {
+	db         *bolt.DB
+	maxEntries int
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	pending map[uint64]*queueItem
+}
+
+// openQueueDB opens the queue file, created when missing, and loads its pending entries
+func openQueueDB(path string, maxEntries int, maxAge time.Duration) (*queueDB, error) {
+	db, err := openQueueFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queueDB{db: db, maxEntries: maxEntries, maxAge: maxAge, pending: map[uint64]*queueItem{}}
+
+	corrupt := []uint64{}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(queuePendingBucket).ForEach(func(k, v []byte) error {
+			id := queueID(k)
+			entry := &queueEntry{}
+			if err := json.Unmarshal(v, entry); err != nil {
+				slog.Error("cannot read the queued delivery, moving it aside", "queue_id", id, "error", err)
+				corrupt = append(corrupt, id)
+				return nil
+			}
+
+			q.pending[id] = &queueItem{created: entry.Created, next: entry.Next}
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, id := range corrupt {
+		q.moveAside(id)
+	}
+
+	slog.Info("queue opened", "queue_path", path, "pending", len(q.pending))
+
+	return q, nil
+}
+
+// openQueueFile opens the bbolt file and creates its buckets. The file is locked while open, a second process
+// gives up after a second
+func openQueueFile(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("cannot open the queue %s: it is used by another smtp2http process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the queue %s: %s", path, err.Error())
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{queuePendingBucket, queueCorruptBucket, queueDeadBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open the queue %s: %s", path, err.Error())
+	}
+
+	return db, nil
+}
+
+// put persists the deliveries of a message in a single transaction and sets their id, they are running until
+// released. errQueueFull is returned when they would exceed maxEntries
+func (q *queueDB) put(deliveries []*delivery, raw []byte, event *rejectEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.maxEntries > 0 && len(q.pending)+len(deliveries) > q.maxEntries {
+		return errQueueFull
+	}
+
+	now := time.Now()
+	ids := make([]uint64, len(deliveries))
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queuePendingBucket)
+		for i, d := range deliveries {
+			entry, err := newQueueEntry(d, raw, event, now)
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+
+			if ids[i], err = b.NextSequence(); err != nil {
+				return err
+			}
+			if err := b.Put(queueKey(ids[i]), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, d := range deliveries {
+		d.queued = ids[i]
+		q.pending[ids[i]] = &queueItem{created: now, next: now, running: true}
+	}
+
+	return nil
+}
+
+// newQueueEntry returns the entry persisting d, raw is only kept when the spool or the dead letters may need it
+func newQueueEntry(d *delivery, raw []byte, event *rejectEvent, now time.Time) (*queueEntry, error) {
+	entry := &queueEntry{Created: now, Next: now, Event: event}
+
+	if d.publisher != nil {
+		entry.Output = d.publisher.Name()
+		entry.ContentType = d.publication.ContentType
+		entry.Headers = d.publication.Headers
+		entry.Body = d.publication.Body
+		entry.Recipient = d.publication.Recipient
+		entry.Recipients = d.publication.Recipients
+		entry.From = d.publication.From
+		entry.MessageID = d.publication.MessageID
+		entry.Values = d.publication.Values
+		return entry, nil
+	}
+
+	body, err := d.req.bodyBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	entry.URL = d.req.URL
+	entry.ContentType = d.req.ContentType
+	entry.Headers = d.req.Headers
+	entry.Body = body
+	if (spool != nil || deadLetters != nil) && !conf.RawOnly {
+		entry.Raw = raw
+	}
+
+	return entry, nil
+}
+
+// delivery rebuilds the delivery of the entry, it fails when its output is no longer configured
+func (e *queueEntry) delivery(id uint64) (*delivery, error) {
+	if e.Output == "" {
+		return &delivery{queued: id, req: &webhookRequest{URL: e.URL, Body: e.Body, ContentType: e.ContentType, Headers: e.Headers}}, nil
+	}
+
+	for _, p := range publishers {
+		if p.Name() == e.Output {
+			return &delivery{queued: id, publisher: p, publication: &publication{
+				Body:        e.Body,
+				ContentType: e.ContentType,
+				Headers:     e.Headers,
+				Recipient:   e.Recipient,
+				Recipients:  e.Recipients,
+				From:        e.From,
+				MessageID:   e.MessageID,
+				Values:      e.Values,
+			}}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("the output %s is not configured", e.Output)
+}
+
+// due marks up to max entries whose next attempt is due as running and returns their ids
+func (q *queueDB) due(now time.Time, max int) []uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ids := []uint64{}
+	for id, item := range q.pending {
+		if len(ids) >= max {
+			break
+		}
+		if !item.running && !item.next.After(now) {
+			item.running = true
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// load reads the entry of id
+func (q *queueDB) load(id uint64) (*queueEntry, error) {
+	var entry *queueEntry
+	err := q.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(queuePendingBucket).Get(queueKey(id))
+		if data == nil {
+			return errors.New("entry not found")
+		}
+
+		entry = &queueEntry{}
+		return json.Unmarshal(data, entry)
+	})
+
+	return entry, err
+}
+
+// release lets the scheduler pick the entry again
+func (q *queueDB) release(id uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if item, ok := q.pending[id]; ok {
+		item.running = false
+	}
+}
+
+// remove deletes the entries, their deliveries are done
+func (q *queueDB) remove(ids ...uint64) {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queuePendingBucket)
+		for _, id := range ids {
+			if err := b.Delete(queueKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("cannot remove the delivered entries from the queue", "queue_ids", ids, "error", err)
+	}
+
+	q.mu.Lock()
+	for _, id := range ids {
+		delete(q.pending, id)
+	}
+	q.mu.Unlock()
+}
+
+// reschedule records the failed attempt of the entry and computes its next one, with the backoff of the spool
+// or the delay a rate limited webhook asked for. It returns false when the entry is older than maxAge, it is
+// then left running for bury
+func (q *queueDB) reschedule(id uint64, attempt deliveryAttempt, retryAfter time.Duration) (time.Time, bool) {
+	var next time.Time
+	expired := false
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queuePendingBucket)
+		entry := &queueEntry{}
+		if err := json.Unmarshal(b.Get(queueKey(id)), entry); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if q.maxAge > 0 && now.Sub(entry.Created) > q.maxAge {
+			expired = true
+			return nil
+		}
+
+		entry.Attempts++
+		delay := spoolRetryDelay << uint(entry.Attempts-1)
+		if delay > spoolMaxRetryDelay || delay <= 0 {
+			delay = spoolMaxRetryDelay
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		entry.Next, next = now.Add(delay), now.Add(delay)
+		entry.LastError = attempt.Error
+		entry.History = append(entry.History, attempt)
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(queueKey(id), data)
+	})
+	if expired {
+		return time.Time{}, false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.pending[id]
+	switch {
+	case !ok:
+	case err != nil:
+		// the entry is retried as it was on the next startup, in the meantime as often as the spool would
+		slog.Error("cannot update the queued delivery", "queue_id", id, "error", err)
+		item.next, item.running = time.Now().Add(spoolMaxRetryDelay), false
+	default:
+		item.next, item.running = next, false
+	}
+
+	return next, true
+}
+
+// bury records the last attempt of the entry, moves it to the dead letters and removes it, it returns the id of
+// the dead letter, empty without one
+func (q *queueDB) bury(logger *slog.Logger, id uint64, attempt deliveryAttempt, reason string) string {
+	letter := ""
+	if entry, err := q.load(id); err != nil {
+		logger.Error("cannot read the queued delivery, it is lost", "error", err)
+	} else {
+		entry.Attempts++
+		entry.LastError = attempt.Error
+		entry.History = append(entry.History, attempt)
+		letter = buryEntry(logger, entry, reason)
+	}
+
+	q.remove(id)
+
+	return letter
+}
+
+// moveAside moves an unreadable entry to the corrupt bucket
+func (q *queueDB) moveAside(id uint64) {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(queuePendingBucket)
+		if err := tx.Bucket(queueCorruptBucket).Put(queueKey(id), pending.Get(queueKey(id))); err != nil {
+			return err
+		}
+		return pending.Delete(queueKey(id))
+	})
+	if err != nil {
+		slog.Error("cannot move the queued delivery aside", "queue_id", id, "error", err)
+	}
+
+	q.mu.Lock()
+	delete(q.pending, id)
+	q.mu.Unlock()
+}
+
+// depth returns the number of pending entries
+func (q *queueDB) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending)
+}
+
+func (q *queueDB) close() error {
+	return q.db.Close()
+}
+
+// queueKey is the key of id, big endian so the entries are listed in the order they were queued
+func queueKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+
+	return k
+}
+
+func queueID(k []byte) uint64 {
+	if len(k) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(k)
+}
@@ -0,0 +1,180 @@
+package smtp2http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// rcptCacheMaxEntries caps the cached recipient checks, the expired ones are evicted first
+const rcptCacheMaxEntries = 10000
+
+var (
+	errMailboxUnavailable = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Mailbox unavailable",
+	}
+	errRcptCheckFailed = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+		Message:      "Cannot verify the recipient, please try again later",
+	}
+)
+
+// rcptCheckConfig holds the settings of the recipient check
+type rcptCheckConfig struct {
+	URL      string
+	Method   string
+	Timeout  time.Duration
+	TTL      time.Duration
+	FailOpen bool
+}
+
+// rcptCacheEntry is the cached answer of the recipient check endpoint
+type rcptCacheEntry struct {
+	accepted bool
+	expires  time.Time
+}
+
+// rcptChecker asks an endpoint whether each envelope recipient exists, the answers are cached for the ttl
+type rcptChecker struct {
+	cfg rcptCheckConfig
+
+	mu    sync.Mutex
+	cache map[string]rcptCacheEntry
+}
+
+// newRcptChecker returns the RcptFunc asking cfg.URL about each recipient
+func newRcptChecker(cfg rcptCheckConfig) (RcptFunc, error) {
+	cfg.Method = strings.ToUpper(cfg.Method)
+	if cfg.Method != http.MethodGet && cfg.Method != http.MethodPost {
+		return nil, fmt.Errorf("invalid recipient check method %q, expected GET or POST", cfg.Method)
+	}
+
+	r := &rcptChecker{cfg: cfg, cache: map[string]rcptCacheEntry{}}
+
+	return r.check, nil
+}
+
+// check accepts the recipient on a 2xx, refuses it with a 550 on a 4xx, and follows
+// -rcpt-check-fail-open when the endpoint answered a 5xx or didn't answer
+func (r *rcptChecker) check(from, to *mail.Address) error {
+	address := strings.ToLower(to.Address)
+	logger := slog.With("recipient", to.Address)
+
+	if accepted, ok := r.cached(address, time.Now()); ok {
+		metricRcptChecks.WithLabelValues("cached").Inc()
+		if !accepted {
+			logger.Info("recipient refused, cached answer")
+			return errMailboxUnavailable
+		}
+		return nil
+	}
+
+	status, err := r.ask(from, to)
+	switch {
+	case err == nil && isSuccess(status):
+		metricRcptChecks.WithLabelValues("accepted").Inc()
+		r.store(address, true, time.Now())
+		return nil
+	case err == nil && isPermanentFailure(status):
+		metricRcptChecks.WithLabelValues("refused").Inc()
+		r.store(address, false, time.Now())
+		logger.Info("recipient refused by the check endpoint", "rcpt_check_status", status)
+		return errMailboxUnavailable
+	}
+
+	metricRcptChecks.WithLabelValues("error").Inc()
+	if err != nil {
+		logger.Warn("recipient check failed", "fail_open", r.cfg.FailOpen, "error", err)
+	} else {
+		logger.Warn("recipient check failed", "fail_open", r.cfg.FailOpen, "rcpt_check_status", status)
+	}
+
+	if r.cfg.FailOpen {
+		return nil
+	}
+
+	return errRcptCheckFailed
+}
+
+// ask calls the endpoint, GET passes the addresses as the rcpt and from query parameters, POST as a json body
+func (r *rcptChecker) ask(from, to *mail.Address) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+
+	sender := ""
+	if from != nil {
+		sender = from.Address
+	}
+
+	// the -webhook-header values may be credentials of the webhooks, only the version is sent along
+	req := callbackClient.R().SetContext(ctx).SetHeader(versionHeader, conf.Version)
+
+	var body []byte
+	if r.cfg.Method == http.MethodGet {
+		req.SetQueryParams(map[string]string{"rcpt": to.Address, "from": sender})
+	} else {
+		var err error
+		if body, err = json.Marshal(map[string]string{"rcpt": to.Address, "from": sender}); err != nil {
+			return 0, err
+		}
+		req.SetHeader("Content-Type", "application/json").SetBody(body)
+	}
+
+	if conf.WebhookSecret != "" {
+		req.SetHeader(signatureHeader, signPayload(conf.WebhookSecret, body, time.Now()))
+	}
+
+	resp, err := req.Execute(r.cfg.Method, r.cfg.URL)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.StatusCode(), nil
+}
+
+func (r *rcptChecker) cached(address string, now time.Time) (bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[address]
+	if !ok || now.After(entry.expires) {
+		return false, false
+	}
+
+	return entry.accepted, true
+}
+
+func (r *rcptChecker) store(address string, accepted bool, now time.Time) {
+	if r.cfg.TTL <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.cache) >= rcptCacheMaxEntries {
+		for key, entry := range r.cache {
+			if now.After(entry.expires) {
+				delete(r.cache, key)
+			}
+		}
+
+		// still full of live answers, start over rather than tracking their order
+		if len(r.cache) >= rcptCacheMaxEntries {
+			r.cache = map[string]rcptCacheEntry{}
+		}
+	}
+
+	r.cache[address] = rcptCacheEntry{accepted: accepted, expires: now.Add(r.cfg.TTL)}
+}
@@ -0,0 +1,115 @@
+package smtp2http
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// receivedIPPattern matches an address literal of a Received comment, e.g "(mail.example.com [192.0.2.1])"
+var receivedIPPattern = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// ParseReceived extracts the clauses of a Received header value, a value that can't be parsed only has its Raw field set
+func ParseReceived(value string) *EmailReceived {
+	ret := &EmailReceived{Raw: value}
+
+	clauses, date := value, ""
+	if i := strings.LastIndex(value, ";"); i >= 0 {
+		clauses, date = value[:i], strings.TrimSpace(value[i+1:])
+	}
+
+	if t, err := mail.ParseDate(date); err == nil {
+		ret.Timestamp = t.UTC().Format(time.RFC3339)
+	}
+
+	// the words outside of the comments, the comment following a word is kept along with it
+	words, comments := []string{}, []string{}
+	depth := 0
+	var word, comment strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			words, comments = append(words, word.String()), append(comments, "")
+			word.Reset()
+		}
+	}
+
+	for _, r := range clauses {
+		switch {
+		case r == '(':
+			flush()
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+			if depth == 0 && len(comments) > 0 {
+				comments[len(comments)-1] += comment.String()
+			}
+			if depth == 0 {
+				comment.Reset()
+			}
+		case depth > 0:
+			comment.WriteRune(r)
+		case r == ' ' || r == '\t' || r == '\r' || r == '\n':
+			flush()
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+
+	for i := 0; i+1 < len(words); i++ {
+		switch strings.ToLower(words[i]) {
+		case "from":
+			ret.From = words[i+1]
+			if m := receivedIPPattern.FindStringSubmatch(comments[i+1]); m != nil {
+				ret.FromIP = m[1]
+			} else if m := receivedIPPattern.FindStringSubmatch(words[i+1]); m != nil {
+				ret.FromIP = m[1]
+			}
+		case "by":
+			ret.By = words[i+1]
+		case "with":
+			ret.With = words[i+1]
+		}
+	}
+
+	return ret
+}
+
+// ReceivedChain returns the Received headers, newest first as they appear in the message
+func ReceivedChain(header mail.Header) []*EmailReceived {
+	ret := []*EmailReceived{}
+	for _, value := range header["Received"] {
+		ret = append(ret, ParseReceived(value))
+	}
+
+	return ret
+}
+
+// ownReceived is the Received header the server would have added for the message received in env
+func ownReceived(env *Envelope) *EmailReceived {
+	conn := env.Connection
+
+	with := "ESMTP"
+	if conn.TLS {
+		with += "S"
+	}
+	if conn.AuthUser != "" {
+		with += "A"
+	}
+
+	ret := &EmailReceived{From: conn.Helo, FromIP: conn.RemoteIP, By: env.ServerName, With: with}
+
+	raw := "from " + conn.Helo + " ([" + conn.RemoteIP + "]) by " + env.ServerName + " with " + with
+	if env.DeliveryID != "" {
+		raw += " id " + env.DeliveryID
+	}
+
+	if !env.ReceivedAt.IsZero() {
+		ret.Timestamp = env.ReceivedAt.UTC().Format(time.RFC3339)
+		raw += "; " + env.ReceivedAt.Format(time.RFC1123Z)
+	}
+	ret.Raw = raw
+
+	return ret
+}
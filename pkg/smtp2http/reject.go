@@ -0,0 +1,143 @@
+package smtp2http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// rejectQueueSize caps the reject events waiting to be posted, the extra ones are dropped
+const rejectQueueSize = 1000
+
+// rejectHook posts the rejected and failed messages to -reject-webhook, nil when disabled
+var rejectHook *rejectNotifier
+
+// rejectEvent describes a message that was rejected or whose delivery failed
+type rejectEvent struct {
+	Timestamp     string   `json:"timestamp"`
+	Reason        string   `json:"reason"`
+	DeliveryID    string   `json:"delivery_id,omitempty"`
+	SMTPReply     string   `json:"smtp_reply,omitempty"`
+	From          string   `json:"from,omitempty"`
+	To            []string `json:"to,omitempty"`
+	RemoteIP      string   `json:"remote_ip,omitempty"`
+	MessageID     string   `json:"message_id,omitempty"`
+	Webhook       string   `json:"webhook,omitempty"`
+	WebhookStatus int      `json:"webhook_status,omitempty"`
+
+	// DeadLetters are the ids of the dead letters keeping the failed deliveries, see -dead-letter-dir
+	DeadLetters []string `json:"dead_letters,omitempty"`
+}
+
+// rejectNotifier posts the events from a bounded queue in the background,
+// so a slow or failing reject webhook never delays the smtp replies
+type rejectNotifier struct {
+	url    string
+	events chan *rejectEvent
+}
+
+// newRejectNotifier starts the worker posting the events to url
+func newRejectNotifier(url string) *rejectNotifier {
+	n := &rejectNotifier{url: url, events: make(chan *rejectEvent, rejectQueueSize)}
+	go n.run()
+
+	return n
+}
+
+// notify queues the event, it is dropped when the queue is full
+func (n *rejectNotifier) notify(ev *rejectEvent) {
+	if n == nil {
+		return
+	}
+
+	ev.Timestamp = time.Now().UTC().Format(time.RFC3339)
+
+	select {
+	case n.events <- ev:
+	default:
+		metricRejectEventsDropped.Inc()
+		slog.Warn("reject event dropped, the queue is full", "reason", ev.Reason)
+	}
+}
+
+func (n *rejectNotifier) run() {
+	for ev := range n.events {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			slog.Error("cannot marshal the reject event", "error", err)
+			continue
+		}
+
+		req := callbackClient.R().
+			SetHeader("Content-Type", "application/json").
+			SetHeader(versionHeader, conf.Version).
+			SetBody(body)
+		if conf.WebhookSecret != "" {
+			req.SetHeader(signatureHeader, signPayload(conf.WebhookSecret, body, time.Now()))
+		}
+
+		// a single attempt, the events are informative and never replayed
+		resp, err := req.Post(n.url)
+		switch {
+		case err != nil:
+			slog.Warn("cannot post the reject event", "reject_webhook", n.url, "reason", ev.Reason, "error", err)
+		case !isSuccess(resp.StatusCode()):
+			slog.Warn("cannot post the reject event", "reject_webhook", n.url, "reason", ev.Reason, "webhook_status", resp.StatusCode())
+		}
+	}
+}
+
+// rejectMessage counts the rejection of the message being handled and notifies the reject webhook, it returns err
+func rejectMessage(c *Context, reason, messageID string, err error) error {
+	return notifyRejection(envelopeEvent(c, reason, messageID), err)
+}
+
+// notifyRejection counts the rejection described by ev and notifies the reject webhook, it returns err
+func notifyRejection(ev *rejectEvent, err error) error {
+	metricMessagesRejected.WithLabelValues(ev.Reason).Inc()
+
+	ev.SMTPReply = smtpReply(err)
+	rejectHook.notify(ev)
+
+	return err
+}
+
+// envelopeEvent returns an event describing the envelope of the message being handled
+func envelopeEvent(c *Context, reason, messageID string) *rejectEvent {
+	ev := &rejectEvent{
+		Reason:     reason,
+		DeliveryID: c.DeliveryID(),
+		To:         extractEmails(c.To()),
+		RemoteIP:   remoteIP(c.RemoteAddr()).String(),
+		MessageID:  messageID,
+	}
+
+	if c.From() != nil {
+		ev.From = c.From().Address
+	}
+
+	return ev
+}
+
+// withFailedDelivery records the target and the webhook status of the first failed delivery
+func (ev *rejectEvent) withFailedDelivery(deliveries []*delivery) *rejectEvent {
+	for _, d := range deliveries {
+		if d.err != nil {
+			ev.Webhook, ev.WebhookStatus = d.target(), d.status
+			break
+		}
+	}
+
+	return ev
+}
+
+// smtpReply formats the reply the smtp server sends for err, see finalReply
+func smtpReply(err error) string {
+	reply := finalReply(err).(*smtp.SMTPError)
+	code := reply.EnhancedCode
+
+	return fmt.Sprintf("%d %d.%d.%d %s", reply.Code, code[0], code[1], code[2], reply.Message)
+}
@@ -0,0 +1,113 @@
+package smtp2http
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/mail"
+	"os"
+
+	"github.com/emersion/go-smtp"
+)
+
+// replayCommand is the subcommand running saved messages through the handler, see runReplay
+const replayCommand = "replay"
+
+// runReplay runs the .eml files through the same handler as the messages received over smtp and prints the
+// reply the client would have got. The envelope is -replay-from/-replay-to, or the From and To/Cc headers.
+// It returns the exit code: 0 when every message was accepted, 1 when one was rejected, 2 when one can't be read
+func runReplay(handler HandlerFunc, files []string) int {
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: smtp2http replay message.eml... [-webhook URL] [-replay-from ADDR] [-replay-to ADDR]")
+		return 2
+	}
+
+	code := 0
+	for _, file := range files {
+		reply, err := replayFile(handler, file)
+		if err != nil {
+			slog.Error("cannot replay the message", "file", file, "error", err)
+			return 2
+		}
+
+		fmt.Printf("%s: %s\n", file, reply)
+		if reply[0] != '2' {
+			code = 1
+		}
+	}
+
+	return code
+}
+
+// replayFile passes the message of file to the handler through a session, as the DATA command does
+func replayFile(handler HandlerFunc, file string) (string, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	from, to, err := replayEnvelope(raw)
+	if err != nil {
+		return "", err
+	}
+
+	state := &smtp.ConnectionState{
+		Hostname:   "localhost",
+		RemoteAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+	}
+
+	s := NewSession(state, handler, "")
+	s.listener = replayCommand
+	s.limits.HandlerTimeout = conf.HandlerTimeout
+	s.From, s.To = from, to
+
+	if err := s.Data(bytes.NewReader(raw)); err != nil {
+		return smtpReply(err), nil
+	}
+
+	return "250 2.0.0 OK: queued", nil
+}
+
+// replayEnvelope returns the envelope of a replayed message
+func replayEnvelope(raw []byte) (*mail.Address, []*mail.Address, error) {
+	var header mail.Header
+	if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		header = msg.Header
+	}
+
+	var from *mail.Address
+	if conf.ReplayFrom != "" {
+		addr, err := mail.ParseAddress(conf.ReplayFrom)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid -replay-from: %s", err.Error())
+		}
+		from = addr
+	} else if list := ParseAddressList(header, "From", nil); len(list) > 0 {
+		from = list[0]
+	} else {
+		return nil, nil, fmt.Errorf("no sender, the message has no From header and -replay-from isn't set")
+	}
+
+	to := []*mail.Address{}
+	if len(conf.ReplayTo) > 0 {
+		for _, value := range conf.ReplayTo {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid -replay-to: %s", err.Error())
+			}
+			to = append(to, list...)
+		}
+	} else {
+		for _, name := range []string{"To", "Cc"} {
+			to = append(to, ParseAddressList(header, name, nil)...)
+		}
+	}
+
+	if len(to) == 0 {
+		return nil, nil, fmt.Errorf("no recipient, the message has no To/Cc header and -replay-to isn't set")
+	}
+
+	return from, to, nil
+}
@@ -0,0 +1,83 @@
+package smtp2http
+
+import (
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errInternal = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Cannot accept your message due to an internal error, please try again later",
+	}
+	errUnparseable = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Cannot parse your message",
+	}
+	errBadSender = &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+		Message:      "Bad sender address syntax",
+	}
+	errBadRecipient = &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      "Bad recipient address syntax",
+	}
+	errHandlerTimeout = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+		Message:      "Timed out processing your message, please try again later",
+	}
+)
+
+// domainError is the reply when none of the recipients is in -domain
+func domainError(domains []string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Recipient domain not allowed: " + strings.Join(domains, ", "),
+	}
+}
+
+// missingHeaderError is the reply with -strict-headers when the message has no valid header name
+func missingHeaderError(name string) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Missing or invalid " + name + " header",
+	}
+}
+
+// finalReply returns the reply actually sent for err: the plain go errors become an internal error so their
+// text never reaches the client, the enhanced code gets the class of the basic code, and the text is
+// prefixed with -reply-prefix and reduced to a single line of printable ascii
+func finalReply(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		smtpErr = errInternal
+	}
+
+	// a copy, the replies are shared package variables
+	reply := *smtpErr
+
+	if reply.EnhancedCode == smtp.EnhancedCodeNotSet {
+		reply.EnhancedCode = smtp.EnhancedCode{reply.Code / 100, 0, 0}
+	}
+	reply.EnhancedCode[0] = reply.Code / 100
+
+	text := reply.Message
+	if conf.ReplyPrefix != "" {
+		text = conf.ReplyPrefix + " " + text
+	}
+	reply.Message = sanitizeReply(text)
+
+	return &reply
+}
@@ -0,0 +1,127 @@
+package smtp2http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestFinalReply(t *testing.T) {
+	restoreGlobals(t)
+	conf = DefaultConfig()
+
+	for _, c := range []struct {
+		err    error
+		prefix string
+		want   string
+	}{
+		{errors.New("dial tcp: connection refused"), "", "451 4.3.0 Cannot accept your message due to an internal error, please try again later"},
+		{errUnparseable, "", "554 5.6.0 Cannot parse your message"},
+		{domainError([]string{"example.org"}), "", "550 5.7.1 Recipient domain not allowed: example.org"},
+		{&smtp.SMTPError{Code: 452, Message: "no enhanced code"}, "", "452 4.0.0 no enhanced code"},
+		{&smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "wrong class"}, "", "450 4.2.2 wrong class"},
+		{&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "user unknown\r\n250 OK"}, "", "550 5.1.1 user unknown??250 OK"},
+		{errUnparseable, "mx1.example.com:", "554 5.6.0 mx1.example.com: Cannot parse your message"},
+	} {
+		conf.ReplyPrefix = c.prefix
+		if got := smtpReply(c.err); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.err, got, c.want)
+		}
+	}
+
+	// the shared replies are left untouched
+	if errUnparseable.Message != "Cannot parse your message" {
+		t.Errorf("errUnparseable changed to %q", errUnparseable.Message)
+	}
+}
+
+// scriptedReply sends data from alice to rcpt over a plain text connection and returns the reply
+// to the first refused command, or to the end of the data
+func scriptedReply(t *testing.T, addr, rcpt, data string) string {
+	t.Helper()
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	step := func(expect int, format string, args ...interface{}) (string, bool) {
+		if format != "" {
+			if err := conn.PrintfLine(format, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		code, message, err := conn.ReadResponse(expect)
+		// the EHLO reply lists the extensions
+		if strings.Contains(message, "\n") && !strings.HasPrefix(format, "EHLO") {
+			t.Errorf("multiline reply %q", message)
+		}
+		return fmt.Sprintf("%d %s", code, message), err == nil
+	}
+
+	for _, s := range []struct {
+		expect int
+		cmd    string
+	}{
+		{220, ""},
+		{250, "EHLO client.example.com"},
+		{250, "MAIL FROM:<alice@example.com>"},
+		{250, "RCPT TO:<" + rcpt + ">"},
+		{354, "DATA"},
+	} {
+		if reply, ok := step(s.expect, s.cmd); !ok {
+			return reply
+		}
+	}
+
+	w := conn.DotWriter()
+	w.Write([]byte(data))
+	w.Close()
+
+	reply, _ := step(250, "")
+
+	return reply
+}
+
+func TestReplies(t *testing.T) {
+	status := http.StatusOK
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer webhook.Close()
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.Domain = "example.com"
+	cfg.MaxMessageSize = 4096
+	cfg.ReplyPrefix = "mx1:"
+	addr := newTestServer(t, cfg)
+
+	for _, c := range []struct {
+		name   string
+		status int
+		rcpt   string
+		data   string
+		want   string
+	}{
+		{"accepted", http.StatusOK, "bob@example.com", testMail, "250 2.0.0 OK: queued"},
+		{"domain", http.StatusOK, "bob@example.org", testMail, "550 5.7.1 mx1: Recipient domain not allowed: example.org"},
+		{"size", http.StatusOK, "bob@example.com", testMail + strings.Repeat("0123456789\r\n", 500), "552 5.3.4 mx1: Maximum message size exceeded"},
+		{"unparseable", http.StatusOK, "bob@example.com", "From: alice@example.com\r\nContent-Type: multipart/mixed\r\n\r\nhello\r\n", "554 5.6.0 mx1: Cannot parse your message"},
+		{"webhook failure", http.StatusBadGateway, "bob@example.com", testMail, "451 4.4.1 mx1: Cannot deliver your message right now, please try again later"},
+		{"webhook refusal", http.StatusForbidden, "bob@example.com", testMail, "550 5.7.1 mx1: Your message was rejected by the recipient system"},
+	} {
+		status = c.status
+		if got := scriptedReply(t, addr, c.rcpt, c.data); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package smtp2http
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// placeholderPattern matches the "{name}" placeholders of a webhook url
+var placeholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// defaultWebhook is used when -webhook isn't set
+const defaultWebhook = "http://localhost:8080/my/webhook"
+
+// webhookURLs are the webhooks configured via -webhook, every message not routed elsewhere is delivered to each of them
+var webhookURLs = []string{defaultWebhook}
+
+// webhookRoutes maps a recipient address or domain to its webhook, configured via -route
+var webhookRoutes = map[string]string{}
+
+// routeGroup is a set of recipients delivered to the same webhooks
+type routeGroup struct {
+	URLs       []string
+	Recipients []*mail.Address
+}
+
+// parseWebhookURLs splits the comma separated -webhook values, the default webhook is used when there is none
+func parseWebhookURLs(values []string) []string {
+	ret := []string{}
+
+	for _, value := range values {
+		for _, url := range strings.Split(value, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				ret = append(ret, url)
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		return []string{defaultWebhook}
+	}
+
+	return ret
+}
+
+// parseRoutes parses the "key=url" route specs, the key is either a full address or a domain
+func parseRoutes(specs []string) (map[string]string, error) {
+	ret := map[string]string{}
+
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid route %q, expected \"domain=url\" or \"address=url\"", spec)
+		}
+
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		if !strings.Contains(key, "@") {
+			key = asciiDomain(normalizeDomain(key))
+		}
+
+		ret[key] = strings.TrimSpace(kv[1])
+	}
+
+	return ret, nil
+}
+
+// routeFor returns the webhooks of a recipient: its full address takes precedence
+// over its domain and -webhook is the fallback
+func routeFor(address string) []string {
+	if url, ok := webhookRoutes[strings.ToLower(address)]; ok {
+		return []string{url}
+	}
+
+	if url, ok := webhookRoutes[asciiDomain(addressDomain(address))]; ok {
+		return []string{url}
+	}
+
+	return webhookURLs
+}
+
+// routeRecipients groups the recipients by webhooks, keeping the order they were received in
+func routeRecipients(recipients []*mail.Address) []*routeGroup {
+	groups := []*routeGroup{}
+	byURLs := map[string]*routeGroup{}
+
+	for _, rcpt := range recipients {
+		urls := routeFor(rcpt.Address)
+		key := strings.Join(urls, "\n")
+		if byURLs[key] == nil {
+			byURLs[key] = &routeGroup{URLs: urls}
+			groups = append(groups, byURLs[key])
+		}
+
+		byURLs[key].Recipients = append(byURLs[key].Recipients, rcpt)
+	}
+
+	return groups
+}
+
+// expandWebhookURL substitutes the placeholders of the webhook url with their url escaped value,
+// an unknown placeholder or one without a value is replaced by an empty string.
+// Everything but the unreserved characters is escaped so the value is safe in a path as well as in a query
+func expandWebhookURL(tmpl string, values map[string]string) string {
+	return expandPlaceholders(tmpl, values, func(value string) string {
+		return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+	})
+}
+
+// expandPlaceholders substitutes the placeholders of tmpl with their escaped value,
+// an unknown placeholder or one without a value is replaced by an empty string
+func expandPlaceholders(tmpl string, values map[string]string, escape func(string) string) string {
+	return placeholderPattern.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		return escape(values[placeholder[1:len(placeholder)-1]])
+	})
+}
+
+// placeholderValues returns the placeholders available to the url of a webhook,
+// the recipient ones are taken from the first recipient of the group
+func placeholderValues(group *routeGroup, from, messageID, spf string) map[string]string {
+	values := map[string]string{
+		"message_id":  messageID,
+		"spf":         spf,
+		"from_domain": addressDomain(from),
+	}
+
+	if len(group.Recipients) > 0 {
+		address := group.Recipients[0].Address
+		if i := strings.LastIndex(address, "@"); i >= 0 {
+			values["to_local"] = address[:i]
+		}
+		values["to_domain"] = addressDomain(address)
+	}
+
+	return values
+}
@@ -0,0 +1,47 @@
+package smtp2http
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestExpandWebhookURL(t *testing.T) {
+	for _, c := range []struct {
+		tmpl   string
+		values map[string]string
+		want   string
+	}{
+		{"https://api.example.com/inbound/{to_local}", map[string]string{"to_local": "bob"}, "https://api.example.com/inbound/bob"},
+		{"https://api.example.com/inbound/{to_local}", map[string]string{"to_local": "bob+orders"}, "https://api.example.com/inbound/bob%2Borders"},
+		{"https://api.example.com/inbound/{to_local}", map[string]string{"to_local": "jürgen"}, "https://api.example.com/inbound/j%C3%BCrgen"},
+		{"https://api.example.com/inbound/{to_local}", map[string]string{"to_local": "a b/c?d"}, "https://api.example.com/inbound/a%20b%2Fc%3Fd"},
+		{"https://api.example.com/{to_domain}?id={message_id}&spf={spf}", map[string]string{"to_domain": "example.com", "message_id": "<1@example.com>", "spf": "pass"}, "https://api.example.com/example.com?id=%3C1%40example.com%3E&spf=pass"},
+		{"https://api.example.com/inbound/{to_local}/{unknown}", map[string]string{}, "https://api.example.com/inbound//"},
+		{"https://api.example.com/inbound", map[string]string{"to_local": "bob"}, "https://api.example.com/inbound"},
+	} {
+		if got := expandWebhookURL(c.tmpl, c.values); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.tmpl, got, c.want)
+		}
+	}
+}
+
+func TestPlaceholderValues(t *testing.T) {
+	group := &routeGroup{Recipients: []*mail.Address{{Address: "bob+orders@example.com"}, {Address: "carol@example.org"}}}
+	values := placeholderValues(group, "alice@sender.example", "<1@example.com>", "pass")
+
+	for name, want := range map[string]string{
+		"to_local":    "bob+orders",
+		"to_domain":   "example.com",
+		"from_domain": "sender.example",
+		"message_id":  "<1@example.com>",
+		"spf":         "pass",
+	} {
+		if values[name] != want {
+			t.Errorf("%s: got %q, want %q", name, values[name], want)
+		}
+	}
+
+	if values := placeholderValues(&routeGroup{}, "", "", ""); values["to_local"] != "" || values["to_domain"] != "" {
+		t.Errorf("no recipient: got %v, want empty recipient values", values)
+	}
+}
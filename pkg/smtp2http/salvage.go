@@ -0,0 +1,283 @@
+package smtp2http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+// unreadableMarker is the content given to the unreadable files of a salvaged message, followed by their index
+const unreadableMarker = "smtp2http:unreadable:"
+
+// salvageEmail parses a message whose files or bodies go-smtpsrv can't read: it fails on a part cut short or
+// badly encoded and on the encodings it doesn't know (8bit, binary, BASE64), and loses the content of the files
+// without a Content-Transfer-Encoding (e.g a forwarded message/rfc822). The files and the bodies of such
+// encodings are rewritten in base64 before the message is parsed, the unreadable files without their content
+// and reading them returns their error: the encoder of the files then rejects or annotates the message per
+// -on-part-error. ok is false when no part had to be rewritten, the message is broken elsewhere
+func salvageEmail(raw []byte) (msg *smtpsrv.Email, ok bool) {
+	split := bytes.Index(raw, []byte("\r\n\r\n"))
+	sep := 4
+	if lf := bytes.Index(raw, []byte("\n\n")); split < 0 || (lf >= 0 && lf < split) {
+		split, sep = lf, 2
+	}
+	if split < 0 {
+		return nil, false
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw[:split+sep]))).ReadMIMEHeader()
+	if err != nil {
+		return nil, false
+	}
+
+	s := &salvager{}
+	head, body := raw[:split+sep], &bytes.Buffer{}
+	if !s.multipart(body, header, bytes.NewReader(raw[split+sep:]), 0) {
+		// a single part message, e.g a text/plain one in 8bit
+		encoded, ok := s.reencodeBody(header, raw[split+sep:])
+		if !ok {
+			return nil, false
+		}
+		head = replaceTransferEncoding(head, "base64")
+		body.WriteString(encoded)
+	}
+	if !s.rewritten {
+		return nil, false
+	}
+
+	repaired := append(append([]byte{}, head...), body.Bytes()...)
+	msg, err = smtpsrv.ParseEmail(bytes.NewReader(repaired))
+	if err != nil {
+		return nil, false
+	}
+
+	for i := range msg.Attachments {
+		msg.Attachments[i].Data = s.restore(msg.Attachments[i].Data)
+	}
+	for i := range msg.EmbeddedFiles {
+		msg.EmbeddedFiles[i].Data = s.restore(msg.EmbeddedFiles[i].Data)
+	}
+
+	return msg, true
+}
+
+// lostFiles reports whether go-smtpsrv left a file to be read from its part, which it already went past:
+// the files without a Content-Transfer-Encoding then read empty
+func lostFiles(msg *smtpsrv.Email) bool {
+	for _, a := range msg.Attachments {
+		if _, read := a.Data.(*bytes.Reader); !read {
+			return true
+		}
+	}
+
+	return false
+}
+
+// salvager rewrites the parts of a message, the errors of the unreadable files are indexed by their marker
+type salvager struct {
+	errs []error
+
+	// rewritten is set once a file go-smtpsrv would have failed on or lost is rewritten
+	rewritten bool
+}
+
+// multipart rewrites the multipart body of header in out, it reports false when the body isn't a multipart
+func (s *salvager) multipart(out *bytes.Buffer, header textproto.MIMEHeader, body io.Reader, depth int) bool {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(contentType, "multipart/") || params["boundary"] == "" || depth >= maxPartDepth {
+		return false
+	}
+
+	boundary := params["boundary"]
+	mr := multipart.NewReader(body, boundary)
+	for {
+		// a part cut short has been rewritten already, the multipart just lacks its closing boundary
+		part, err := mr.NextRawPart()
+		if err != nil {
+			break
+		}
+
+		data, readErr := ioutil.ReadAll(part)
+
+		// a nested multipart cut short is rewritten with what was read of it
+		var nested bytes.Buffer
+		if s.multipart(&nested, part.Header, bytes.NewReader(data), depth+1) {
+			writePartHeader(out, boundary, part.Header)
+			out.Write(nested.Bytes())
+			continue
+		}
+
+		if !isFilePart(part.Header) {
+			if encoded, ok := s.reencodeBody(part.Header, data); ok {
+				writePartHeader(out, boundary, withTransferEncoding(part.Header, "base64"))
+				out.WriteString(encoded)
+				continue
+			}
+
+			writePartHeader(out, boundary, part.Header)
+			out.Write(data)
+			out.WriteString("\r\n")
+			continue
+		}
+
+		encoding := strings.TrimSpace(part.Header.Get("Content-Transfer-Encoding"))
+		content, err := decodePart(encoding, data, readErr)
+		if err != nil {
+			content = []byte(unreadableMarker + strconv.Itoa(len(s.errs)))
+			s.errs = append(s.errs, err)
+		}
+		s.rewritten = s.rewritten || err != nil || (encoding != "base64" && encoding != "quoted-printable" && encoding != "7bit")
+
+		writePartHeader(out, boundary, withTransferEncoding(part.Header, "base64"))
+		out.WriteString(wrapLines(base64.StdEncoding.EncodeToString(content), 76))
+	}
+
+	out.WriteString("--" + boundary + "--\r\n")
+
+	return true
+}
+
+// isFilePart reports whether go-smtpsrv takes the part for an attachment or an embedded file: a part with a
+// filename, or a transfer encoded one that isn't a body
+func isFilePart(header textproto.MIMEHeader) bool {
+	if _, params, _ := mime.ParseMediaType(header.Get("Content-Disposition")); params["filename"] != "" {
+		return true
+	}
+
+	contentType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+
+	return header.Get("Content-Transfer-Encoding") != "" && contentType != "text/plain" && contentType != "text/html"
+}
+
+// reencodeBody returns a body in base64 when go-smtpsrv doesn't know its transfer encoding, the bodies of
+// the other encodings, or the ones no one knows, are kept as they are (ok is false)
+func (s *salvager) reencodeBody(header textproto.MIMEHeader, data []byte) (encoded string, ok bool) {
+	encoding := strings.TrimSpace(header.Get("Content-Transfer-Encoding"))
+	switch encoding {
+	case "", "base64", "quoted-printable", "7bit":
+		return "", false
+	}
+
+	content, err := decodePart(encoding, data, nil)
+	if err != nil {
+		return "", false
+	}
+	s.rewritten = true
+
+	return wrapLines(base64.StdEncoding.EncodeToString(content), 76), true
+}
+
+// withTransferEncoding returns a copy of header with its Content-Transfer-Encoding set to encoding
+func withTransferEncoding(header textproto.MIMEHeader, encoding string) textproto.MIMEHeader {
+	ret := textproto.MIMEHeader{}
+	for k, v := range header {
+		ret[k] = v
+	}
+	ret.Set("Content-Transfer-Encoding", encoding)
+
+	return ret
+}
+
+// replaceTransferEncoding sets the Content-Transfer-Encoding of the raw header of a message, the other
+// fields being kept as they were sent
+func replaceTransferEncoding(head []byte, encoding string) []byte {
+	ret := make([]byte, 0, len(head)+len(encoding)+32)
+	skipping := false
+	for _, line := range bytes.SplitAfter(head, []byte("\n")) {
+		// the continuation lines of a folded field
+		if skipping && len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			continue
+		}
+
+		skipping = bytes.HasPrefix(bytes.ToLower(line), []byte("content-transfer-encoding:"))
+		if skipping {
+			continue
+		}
+
+		if len(line) > 0 && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			ret = append(ret, "Content-Transfer-Encoding: "+encoding+"\r\n"...)
+		}
+		ret = append(ret, line...)
+	}
+
+	return ret
+}
+
+// decodePart undoes the transfer encoding of a part whatever its case, the part may have been cut short
+func decodePart(encoding string, data []byte, readErr error) ([]byte, error) {
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: bytes.NewReader(data)}))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+	case "", "7bit", "8bit", "binary":
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("unsupported transfer encoding %q", encoding)
+}
+
+// restore returns the error of a file given the marker content, or a reader of its content otherwise
+func (s *salvager) restore(r io.Reader) io.Reader {
+	if r == nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return &errorReader{err: err}
+	}
+
+	if index := strings.TrimPrefix(string(data), unreadableMarker); index != string(data) {
+		if i, err := strconv.Atoi(index); err == nil && i >= 0 && i < len(s.errs) {
+			return &errorReader{err: s.errs[i]}
+		}
+	}
+
+	return bytes.NewReader(data)
+}
+
+// writePartHeader starts a part of the multipart with header, the fields in a stable order
+func writePartHeader(out *bytes.Buffer, boundary string, header textproto.MIMEHeader) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out.WriteString("--" + boundary + "\r\n")
+	for _, k := range keys {
+		for _, v := range header[k] {
+			out.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	out.WriteString("\r\n")
+}
+
+// wrapLines splits s in CRLF terminated lines of n characters
+func wrapLines(s string, n int) string {
+	var b strings.Builder
+	for len(s) > n {
+		b.WriteString(s[:n] + "\r\n")
+		s = s[n:]
+	}
+	b.WriteString(s + "\r\n")
+
+	return b.String()
+}
@@ -0,0 +1,192 @@
+package smtp2http
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+// truncatedMail has a readable attachment and a second one cut short before its closing boundary
+const truncatedMail = "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: invoices\r\nMessage-ID: <truncated@example.com>\r\n" +
+	"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+	"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+	"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=notes.txt\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8=\r\n" +
+	"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=invoice.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0xLjQK\r\nJVBER"
+
+// corruptMail has an attachment whose base64 is corrupt, the multipart itself is complete
+const corruptMail = "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: invoices\r\n" +
+	"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+	"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+	"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=invoice.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBE*i0xLjQK\r\n" +
+	"--b--\r\n"
+
+func TestSalvageEmail(t *testing.T) {
+	for name, raw := range map[string]string{"truncated": truncatedMail, "corrupt": corruptMail} {
+		if _, err := smtpsrv.ParseEmail(strings.NewReader(raw)); err == nil {
+			t.Fatalf("%s: go-smtpsrv parsed the fixture, it no longer tests anything", name)
+		}
+
+		msg, ok := salvageEmail([]byte(raw))
+		if !ok {
+			t.Fatalf("%s: not salvaged", name)
+		}
+		if msg.TextBody != "see attached" {
+			t.Errorf("%s: text %q, want the body", name, msg.TextBody)
+		}
+
+		for _, a := range msg.Attachments {
+			data, err := ioutil.ReadAll(a.Data)
+			switch a.Filename {
+			case "notes.txt":
+				if err != nil || string(data) != "hello" {
+					t.Errorf("%s: notes.txt read %q, %v, want its content", name, data, err)
+				}
+			case "invoice.pdf":
+				if err == nil {
+					t.Errorf("%s: invoice.pdf read %q, want its error", name, data)
+				}
+			default:
+				t.Errorf("%s: unexpected attachment %q", name, a.Filename)
+			}
+		}
+	}
+}
+
+func TestSalvageEmailOnlyFiles(t *testing.T) {
+	// broken elsewhere than in a file, e.g. a multipart without its boundary
+	for _, raw := range []string{
+		"From: alice@example.com\r\nContent-Type: multipart/mixed\r\n\r\nhello\r\n",
+		"From: alice@example.com\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: x-unknown\r\n\r\nhello\r\n",
+		"From: alice@example.com\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: application/x-unknown\r\n\r\nhello\r\n--b--\r\n",
+	} {
+		if _, ok := salvageEmail([]byte(raw)); ok {
+			t.Errorf("%q: salvaged", raw)
+		}
+	}
+}
+
+func TestPartErrorReject(t *testing.T) {
+	webhook, payloads := payloadWebhook(t)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	addr := newTestServer(t, cfg)
+
+	err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(truncatedMail))
+	if replyCode(err) != 451 {
+		t.Errorf("SendMail: %v, want a 451", err)
+	}
+
+	select {
+	case p := <-payloads:
+		t.Errorf("webhook called with %+v", p)
+	default:
+	}
+}
+
+func TestPartErrorAnnotate(t *testing.T) {
+	webhook, payloads := payloadWebhook(t)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.OnPartError = partErrorAnnotate
+	addr := newTestServer(t, cfg)
+
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(truncatedMail)); err != nil {
+		t.Fatal(err)
+	}
+
+	p := <-payloads
+	if len(p.Attachments) != 2 {
+		t.Fatalf("attachments = %+v, want both files", p.Attachments)
+	}
+	if a := p.Attachments[0]; a.Filename != "notes.txt" || a.Data != "aGVsbG8=" || a.Error != "" {
+		t.Errorf("notes.txt = %+v, want its content", a)
+	}
+	if a := p.Attachments[1]; a.Filename != "invoice.pdf" || a.Data != "" || a.Error == "" {
+		t.Errorf("invoice.pdf = %+v, want its error", a)
+	}
+	if len(p.ParseWarnings) != 1 || !strings.Contains(p.ParseWarnings[0], "invoice.pdf") {
+		t.Errorf("parse_warnings = %v, want the unreadable file", p.ParseWarnings)
+	}
+	if !bytes.Contains([]byte(p.Body.Text), []byte("see attached")) {
+		t.Errorf("text = %q, want the body", p.Body.Text)
+	}
+}
+
+func TestSalvageEmailUnencodedFiles(t *testing.T) {
+	for _, encoding := range []string{"", "8bit", "binary", "BASE64"} {
+		content := "plain content"
+		header := ""
+		if encoding != "" {
+			header = "Content-Transfer-Encoding: " + encoding + "\r\n"
+		}
+		if encoding == "BASE64" {
+			content = "cGxhaW4gY29udGVudA=="
+		}
+
+		raw := "From: alice@example.com\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nbody\r\n" +
+			"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=file.bin\r\n" + header + "\r\n" + content + "\r\n" +
+			"--b--\r\n"
+
+		msg, ok := salvageEmail([]byte(raw))
+		if !ok {
+			t.Fatalf("%q: not salvaged", encoding)
+		}
+		if len(msg.Attachments) != 1 {
+			t.Fatalf("%q: %d attachments, want the file", encoding, len(msg.Attachments))
+		}
+		if data, err := ioutil.ReadAll(msg.Attachments[0].Data); err != nil || string(data) != "plain content" {
+			t.Errorf("%q: read %q, %v, want the content of the file", encoding, data, err)
+		}
+	}
+}
+
+func TestSalvageEmailBodies(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		raw  string
+		text string
+		html string
+	}{
+		{
+			"single part in 8bit",
+			"From: alice@example.com\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\nSubject: hi\r\n\r\nGrüße\r\n",
+			"Grüße", "",
+		},
+		{
+			"single part, a folded encoding",
+			"From: alice@example.com\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding:\r\n binary\r\n\r\n<p>Grüße</p>\r\n",
+			"", "<p>Grüße</p>",
+		},
+		{
+			"multipart bodies in 8bit and Quoted-Printable",
+			"From: alice@example.com\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\nGrüße\r\n" +
+				"--b\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: Quoted-Printable\r\n\r\n<p>Gr=C3=BC=C3=9Fe</p>\r\n" +
+				"--b--\r\n",
+			"Grüße", "<p>Grüße</p>",
+		},
+	} {
+		msg, ok := salvageEmail([]byte(c.raw))
+		if !ok {
+			t.Fatalf("%s: not salvaged", c.name)
+		}
+		// go-smtpsrv only trims the LF of the last line
+		if text, html := strings.TrimSuffix(msg.TextBody, "\r"), strings.TrimSuffix(msg.HTMLBody, "\r"); text != c.text || html != c.html {
+			t.Errorf("%s: text %q, html %q, want %q, %q", c.name, msg.TextBody, msg.HTMLBody, c.text, c.html)
+		}
+	}
+
+	// the encodings go-smtpsrv knows need no salvage
+	if _, ok := salvageEmail([]byte("From: alice@example.com\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: 7bit\r\n\r\nhello\r\n")); ok {
+		t.Error("a 7bit body was salvaged")
+	}
+}
@@ -0,0 +1,153 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/alash3al/go-smtpsrv"
+)
+
+// payloadFormatSendGrid posts the multipart/form-data body of the SendGrid Inbound Parse webhook
+const payloadFormatSendGrid = "sendgrid"
+
+// sendGridEnvelope is the "envelope" field of a SendGrid payload
+type sendGridEnvelope struct {
+	To   []string `json:"to"`
+	From string   `json:"from"`
+}
+
+// sendGridFile is an entry of the "attachment-info" field of a SendGrid payload
+type sendGridFile struct {
+	Filename  string `json:"filename"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	ContentID string `json:"content-id,omitempty"`
+}
+
+// buildSendGrid builds the request the SendGrid Inbound Parse webhook would have posted for the message.
+// The attachments and the embedded files are the attachment1..N file parts, the embedded ones are
+// mapped from their content id by the "content-ids" field
+func buildSendGrid(c *Context, msg *smtpsrv.Email, recipients []*mail.Address, spf string, dkimResults []*EmailDKIMResult) (*webhookRequest, error) {
+	header, err := c.Header()
+	if err != nil {
+		header = mail.Header{}
+	}
+
+	text, html, err := ExtractBodies(c.Raw())
+	if err != nil {
+		text, html = msg.TextBody, msg.HTMLBody
+	}
+
+	envelope, err := json.Marshal(&sendGridEnvelope{To: extractEmails(recipients), From: c.From().Address})
+	if err != nil {
+		return nil, err
+	}
+
+	// every field is decoded to utf-8
+	charsets, err := json.Marshal(map[string]string{
+		"to": "UTF-8", "from": "UTF-8", "cc": "UTF-8", "subject": "UTF-8", "text": "UTF-8", "html": "UTF-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fields := [][2]string{
+		{"headers", RawHeaders(c.Raw())},
+		{"dkim", sendGridDKIM(dkimResults)},
+		{"to", DecodeHeader(header.Get("To"))},
+		{"from", DecodeHeader(header.Get("From"))},
+		{"subject", DecodeHeader(header.Get("Subject"))},
+		{"text", text},
+		{"html", html},
+		{"sender_ip", remoteIP(c.RemoteAddr()).String()},
+		{"envelope", string(envelope)},
+		{"charsets", string(charsets)},
+		{"SPF", spf},
+	}
+
+	if cc := header.Get("Cc"); cc != "" {
+		fields = append(fields, [2]string{"cc", DecodeHeader(cc)})
+	}
+
+	parts := []*filePart{}
+	files := map[string]*sendGridFile{}
+	contentIDs := map[string]string{}
+
+	for _, a := range msg.Attachments {
+		if !attachmentTypes.allowed(a.Filename, a.ContentType) {
+			continue
+		}
+
+		field := "attachment" + strconv.Itoa(len(parts)+1)
+		files[field] = &sendGridFile{Filename: a.Filename, Name: a.Filename, Type: a.ContentType}
+		parts = append(parts, &filePart{field: field, filename: a.Filename, contentType: a.ContentType, data: a.Data})
+	}
+
+	for _, e := range msg.EmbeddedFiles {
+		if !attachmentTypes.allowed("", e.ContentType) {
+			continue
+		}
+
+		field := "attachment" + strconv.Itoa(len(parts)+1)
+		files[field] = &sendGridFile{Filename: e.CID, Name: e.CID, Type: e.ContentType, ContentID: e.CID}
+		contentIDs[e.CID] = field
+		parts = append(parts, &filePart{field: field, filename: e.CID, contentType: e.ContentType, data: e.Data})
+	}
+
+	fields = append(fields, [2]string{"attachments", strconv.Itoa(len(parts))})
+
+	if len(parts) > 0 {
+		info, err := json.Marshal(files)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, [2]string{"attachment-info", string(info)})
+	}
+
+	if len(contentIDs) > 0 {
+		ids, err := json.Marshal(contentIDs)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, [2]string{"content-ids", string(ids)})
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	for _, f := range fields {
+		if err := w.WriteField(f[0], f[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range parts {
+		if err := writeFilePart(w, p.field, p.filename, p.contentType, p.data); err != nil {
+			return nil, readError(p.filename, err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return &webhookRequest{Body: buf.Bytes(), ContentType: w.FormDataContentType()}, nil
+}
+
+// sendGridDKIM formats the dkim results the way SendGrid does: "{@example.com : pass, @example.org : fail}"
+func sendGridDKIM(results []*EmailDKIMResult) string {
+	if len(results) == 0 {
+		return "none"
+	}
+
+	items := []string{}
+	for _, r := range results {
+		items = append(items, "@"+r.Domain+" : "+r.Result)
+	}
+
+	return "{" + strings.Join(items, ", ") + "}"
+}
@@ -0,0 +1,95 @@
+package smtp2http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+
+	"github.com/zaccone/spf"
+)
+
+// capturedRequest is the body and content type of a request the test webhook received
+type capturedRequest struct {
+	contentType string
+	body        []byte
+}
+
+// postFixture sends testdata/name to a server with -payload-format format and returns what its webhook got
+func postFixture(t *testing.T, format, name string) capturedRequest {
+	t.Helper()
+
+	stubSPF(t, spf.Pass, "", nil)
+
+	requests := make(chan capturedRequest, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- capturedRequest{contentType: r.Header.Get("Content-Type"), body: body}
+	}))
+	t.Cleanup(webhook.Close)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.PayloadFormat = format
+	addr := newTestServer(t, cfg)
+
+	raw, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob+orders@example.com", "carol@example.com"}, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	return <-requests
+}
+
+func TestSendGridPayload(t *testing.T) {
+	r := postFixture(t, payloadFormatSendGrid, "inbound.eml")
+
+	mediaType, params, err := mime.ParseMediaType(r.contentType)
+	if err != nil || mediaType != "multipart/form-data" {
+		t.Fatalf("Content-Type = %q, want multipart/form-data", r.contentType)
+	}
+
+	// the form is written one part after the other, the boundary left out
+	var got bytes.Buffer
+	fields := map[string]bool{}
+	mr := multipart.NewReader(bytes.NewReader(r.body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields[part.FormName()] = true
+		if part.FileName() != "" {
+			fmt.Fprintf(&got, "== %s (file %s, %s)\n%q\n", part.FormName(), part.FileName(), part.Header.Get("Content-Type"), value)
+		} else {
+			fmt.Fprintf(&got, "== %s\n%s\n", part.FormName(), value)
+		}
+	}
+
+	for _, name := range []string{"headers", "dkim", "to", "from", "cc", "subject", "text", "html", "sender_ip", "envelope", "charsets", "SPF", "attachments", "attachment-info", "content-ids", "attachment1", "attachment2"} {
+		if !fields[name] {
+			t.Errorf("no %s field", name)
+		}
+	}
+
+	golden(t, "inbound.sendgrid.golden", got.Bytes())
+}
@@ -0,0 +1,312 @@
+package smtp2http
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// defaultListenAddr is the address listened on when -listen isn't set
+const defaultListenAddr = ":smtp"
+
+// implicitTLSScheme prefixes the listen addresses speaking tls from the first byte (smtps, port 465)
+const implicitTLSScheme = "smtps://"
+
+// tlsVersions maps the -tls-min-version values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// listenerConfig holds the settings of an smtp listener
+type listenerConfig struct {
+	ListenAddr      string
+	BannerDomain    string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	Handler         HandlerFunc
+	Auther          AuthFunc
+	RcptCheck       RcptFunc
+	DNSBL           *dnsblChecker
+	ClientChecks    *clientChecker
+	MaxMessageBytes int
+	TLSConfig       *tls.Config
+	MaxConnections  int
+	SessionLimits   sessionLimits
+	RateLimit       int
+	IPFilter        *ipFilter
+	ProxyProtocol   bool
+	RequireTLS      bool
+
+	// limiter is shared by the servers created from the same config
+	limiter *rateLimiter
+}
+
+// smtpServer wraps the smtp server so it can be shut down gracefully
+type smtpServer struct {
+	smtp           *smtp.Server
+	backend        *Backend
+	listener       net.Listener
+	maxConnections int
+	ipFilter       *ipFilter
+	proxyProtocol  bool
+	implicitTLS    bool
+	closing        int32
+}
+
+// newSMTPServer configures the smtp server, STARTTLS is advertised when
+// cfg.TLSConfig is set and AUTH when cfg.Auther is set. A cfg.ListenAddr
+// prefixed with smtps:// speaks tls from the first byte instead
+func newSMTPServer(cfg *listenerConfig) *smtpServer {
+	be := NewBackend(cfg.Auther, cfg.Handler)
+	be.requireTLS = cfg.RequireTLS
+	be.rcptCheck = cfg.RcptCheck
+	be.dnsbl = cfg.DNSBL
+	be.client = cfg.ClientChecks
+	be.limits = cfg.SessionLimits
+	if cfg.limiter == nil {
+		cfg.limiter = newRateLimiter(cfg.RateLimit)
+	}
+	be.limiter = cfg.limiter
+	be.listener = cfg.ListenAddr
+	s := smtp.NewServer(be)
+
+	s.Addr = strings.TrimPrefix(cfg.ListenAddr, implicitTLSScheme)
+	s.Domain = cfg.BannerDomain
+	s.ReadTimeout = cfg.ReadTimeout
+	s.WriteTimeout = cfg.WriteTimeout
+	s.MaxMessageBytes = cfg.MaxMessageBytes
+	s.EnableSMTPUTF8 = true
+	s.TLSConfig = cfg.TLSConfig
+
+	s.AuthDisabled = cfg.Auther == nil
+	// credentials may only travel in the clear when there is no way to upgrade the connection
+	s.AllowInsecureAuth = cfg.TLSConfig == nil
+	s.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+		return sasl.NewLoginServer(func(username, password string) error {
+			state := conn.State()
+			session, err := be.Login(&state, username, password)
+			if err != nil {
+				return err
+			}
+
+			conn.SetSession(session)
+			return nil
+		})
+	})
+
+	return &smtpServer{
+		smtp:           s,
+		backend:        be,
+		maxConnections: cfg.MaxConnections,
+		ipFilter:       cfg.IPFilter,
+		proxyProtocol:  cfg.ProxyProtocol,
+		implicitTLS:    strings.HasPrefix(cfg.ListenAddr, implicitTLSScheme),
+	}
+}
+
+// parseListenAddrs splits the comma separated -listen values, it defaults to defaultListenAddr
+func parseListenAddrs(values []string) []string {
+	ret := []string{}
+
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				ret = append(ret, addr)
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		return []string{defaultListenAddr}
+	}
+
+	return ret
+}
+
+// ListenAndServe binds the listener and serves until Shutdown is called
+func (s *smtpServer) ListenAndServe() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+
+	return s.Serve()
+}
+
+// Listen binds the listener without accepting the connections yet,
+// so every address can be bound before any of them is served
+func (s *smtpServer) Listen() error {
+	if s.implicitTLS && s.smtp.TLSConfig == nil {
+		return fmt.Errorf("the smtps listener %s requires -tls-cert and -tls-key or -acme-domain", s.smtp.Addr)
+	}
+
+	l, err := net.Listen("tcp", s.smtp.Addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %s", s.smtp.Addr, err.Error())
+	}
+
+	// the refused addresses never take a connection slot, and they are the real
+	// client addresses once the proxy protocol header was read
+	s.listener = newLimitListener(newFilterListener(newProxyListener(l, s.proxyProtocol), s.ipFilter), s.maxConnections)
+
+	// outermost so the smtp server sees the *tls.Conn and reports the connections as tls
+	if s.implicitTLS {
+		s.listener = tls.NewListener(s.listener, s.smtp.TLSConfig)
+	}
+
+	slog.Info("smtp listener bound", "addr", s.smtp.Addr, "bound_addr", l.Addr().String(), "implicit_tls", s.implicitTLS)
+
+	return nil
+}
+
+// Serve accepts the connections of the bound listener until Shutdown is called
+func (s *smtpServer) Serve() error {
+	atomic.StoreInt32(&smtpListening, 1)
+	slog.Info("smtp server started", "addr", s.smtp.Addr)
+
+	err := s.smtp.Serve(s.listener)
+	if atomic.LoadInt32(&s.closing) == 1 {
+		return nil
+	}
+
+	return err
+}
+
+// Shutdown stops accepting new connections and waits up to timeout for the
+// messages being handled to complete, it returns how many of them were drained
+func (s *smtpServer) Shutdown(timeout time.Duration) (int64, error) {
+	atomic.StoreInt32(&s.closing, 1)
+	atomic.StoreInt32(&smtpListening, 0)
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	pending := s.backend.InFlight()
+	deadline := time.Now().Add(timeout)
+
+	for s.backend.InFlight() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	remaining := s.backend.InFlight()
+	s.smtp.Close()
+
+	if remaining > 0 {
+		return pending - remaining, fmt.Errorf("%d messages were still being handled after %s", remaining, timeout)
+	}
+
+	return pending, nil
+}
+
+// shutdownServers shuts the servers down concurrently so they share the same
+// timeout, it returns how many messages were drained by all of them
+func shutdownServers(servers []*smtpServer, timeout time.Duration) (int64, error) {
+	var (
+		wg      sync.WaitGroup
+		drained int64
+		mu      sync.Mutex
+		errs    []string
+	)
+
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *smtpServer) {
+			defer wg.Done()
+
+			n, err := srv.Shutdown(timeout)
+			atomic.AddInt64(&drained, n)
+
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, srv.smtp.Addr+": "+err.Error())
+				mu.Unlock()
+			}
+		}(srv)
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return drained, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+
+	return drained, nil
+}
+
+// loadTLSConfig loads the certificate/key pair configured via the flags, minVersion
+// and ciphers restrict the handshakes. It returns a nil config when TLS isn't configured
+func loadTLSConfig(certFile, keyFile, minVersion, ciphers string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both -tls-cert and -tls-key are required to enable tls")
+	}
+
+	cfg, err := tlsPolicy(minVersion, ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the tls keypair: %s", err.Error())
+	}
+
+	cfg.Certificates = []tls.Certificate{cert}
+
+	return cfg, nil
+}
+
+// tlsPolicy returns a config without certificate restricted to minVersion and ciphers
+func tlsPolicy(minVersion, ciphers string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls min version %q, expected 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+
+	suites, err := parseCipherSuites(ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{MinVersion: version, CipherSuites: suites}, nil
+}
+
+// parseCipherSuites resolves the comma separated cipher suite names, nil keeps the go defaults.
+// The tls 1.3 suites aren't configurable and are always enabled
+func parseCipherSuites(value string) ([]uint16, error) {
+	names := splitList(value)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	ret := []uint16{}
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls cipher suite %q", name)
+		}
+
+		ret = append(ret, id)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,338 @@
+package smtp2http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMail is a minimal message the test clients send
+const testMail = "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: test\r\nMessage-ID: <1@example.com>\r\n\r\nhello\r\n"
+
+// startSMTP serves cfg on a free local port until the test ends and returns its address
+func startSMTP(t *testing.T, cfg *listenerConfig) string {
+	t.Helper()
+
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.BannerDomain = "smtp2http.test"
+	cfg.ReadTimeout, cfg.WriteTimeout = 5*time.Second, 5*time.Second
+	if cfg.MaxMessageBytes == 0 {
+		cfg.MaxMessageBytes = 1 << 20
+	}
+	if cfg.Handler == nil {
+		cfg.Handler = func(*Context) error { return nil }
+	}
+
+	s := newSMTPServer(cfg)
+	if err := s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Shutdown(time.Second) })
+
+	return s.listener.Addr().String()
+}
+
+// sendMail sends testMail from alice to bob over c and returns the error of the first refused command
+func sendMail(c *smtp.Client) error {
+	if err := c.Mail("alice@example.com"); err != nil {
+		return err
+	}
+	if err := c.Rcpt("bob@example.com"); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(testMail)); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// replyCode returns the smtp code of err, 0 when it isn't a reply
+func replyCode(err error) int {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code
+	}
+
+	return 0
+}
+
+func TestAuthDisabledByDefault(t *testing.T) {
+	users := make(chan string, 1)
+	addr := startSMTP(t, &listenerConfig{Handler: func(c *Context) error {
+		users <- c.User()
+		return nil
+	}})
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH advertised without -auth-username")
+	}
+	if err := sendMail(c); err != nil {
+		t.Fatalf("anonymous message refused: %v", err)
+	}
+	if user := <-users; user != "" {
+		t.Errorf("User() = %q, want none", user)
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	users := make(chan string, 1)
+	addr := startSMTP(t, &listenerConfig{
+		Auther: staticAuther("myapp", "secret"),
+		Handler: func(c *Context) error {
+			users <- c.User()
+			return nil
+		},
+	})
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, mechanisms := c.Extension("AUTH"); !ok || !strings.Contains(mechanisms, "PLAIN") || !strings.Contains(mechanisms, "LOGIN") {
+		t.Errorf("AUTH %q advertised, want PLAIN and LOGIN", mechanisms)
+	}
+
+	if err := c.Mail("alice@example.com"); replyCode(err) != 530 {
+		t.Errorf("MAIL FROM before AUTH: %v, want a 530", err)
+	}
+
+	// the client quits on a failed AUTH
+	if err := c.Auth(smtp.PlainAuth("", "myapp", "wrong", "127.0.0.1")); replyCode(err) != 535 {
+		t.Errorf("AUTH with a wrong password: %v, want a 535", err)
+	}
+
+	c, err = smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Auth(smtp.PlainAuth("", "myapp", "secret", "127.0.0.1")); err != nil {
+		t.Fatalf("AUTH refused: %v", err)
+	}
+	if err := sendMail(c); err != nil {
+		t.Fatalf("authenticated message refused: %v", err)
+	}
+	if user := <-users; user != "myapp" {
+		t.Errorf("User() = %q, want myapp", user)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key in a temp dir
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smtp2http.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestStartTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	tlsConfig, err := loadTLSConfig(certFile, keyFile, "1.2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overTLS := make(chan bool, 1)
+	addr := startSMTP(t, &listenerConfig{TLSConfig: tlsConfig, Handler: func(c *Context) error {
+		overTLS <- c.TLS().HandshakeComplete
+		return nil
+	}})
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("STARTTLS not advertised with -tls-cert and -tls-key")
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendMail(c); err != nil {
+		t.Fatal(err)
+	}
+	if !<-overTLS {
+		t.Error("the message wasn't received over tls")
+	}
+}
+
+func TestStartTLSNotAdvertisedWithoutCert(t *testing.T) {
+	c, err := smtp.Dial(startSMTP(t, &listenerConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS advertised without a certificate")
+	}
+}
+
+func TestLoadTLSConfigErrors(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, files := range [][2]string{
+		{certFile, ""},
+		{"", keyFile},
+		{filepath.Join(t.TempDir(), "missing.pem"), keyFile},
+		{garbage, keyFile},
+	} {
+		if _, err := loadTLSConfig(files[0], files[1], "1.2", ""); err == nil {
+			t.Errorf("loadTLSConfig(%q, %q) loaded", files[0], files[1])
+		}
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	webhook, payloads := payloadWebhook(t)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.Domain = "xn--mller-kva.example"
+
+	c, err := smtp.Dial(newTestServer(t, cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); !ok {
+		t.Fatal("SMTPUTF8 not advertised")
+	}
+
+	// the client adds SMTPUTF8 to MAIL FROM once the server advertised it
+	if err := c.Mail("δοκιμή@παράδειγμα.δοκιμή"); err != nil {
+		t.Fatalf("MAIL FROM an EAI sender refused: %v", err)
+	}
+	if err := c.Rcpt("jürgen@müller.example"); err != nil {
+		t.Fatalf("RCPT TO a unicode recipient of the punycoded domain refused: %v", err)
+	}
+	if err := c.Rcpt("用户@xn--mller-kva.example"); err != nil {
+		t.Fatalf("RCPT TO a punycoded recipient refused: %v", err)
+	}
+	// the "а" is cyrillic, the recipients of the other domains are dropped from the payload
+	if err := c.Rcpt("user@pаypal.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := "From: Δοκιμή <δοκιμή@παράδειγμα.δοκιμή>\r\nTo: Jürgen <jürgen@müller.example>\r\nSubject: Grüße\r\nMessage-ID: <utf8@example.com>\r\n\r\nhello\r\n"
+	if _, err := w.Write([]byte(mail)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("message refused: %v", err)
+	}
+
+	p := <-payloads
+	from := p.Addresses.From
+	if from == nil || from.Address != "δοκιμή@παράδειγμα.δοκιμή" || from.DomainUnicode != "παράδειγμα.δοκιμή" || from.DomainASCII != "xn--hxajbheg2az3al.xn--jxalpdlp" {
+		t.Errorf("from = %+v, want the EAI sender in UTF-8 and its domain in both forms", from)
+	}
+
+	want := []struct{ address, unicode, ascii string }{
+		{"jürgen@müller.example", "müller.example", "xn--mller-kva.example"},
+		{"用户@xn--mller-kva.example", "müller.example", "xn--mller-kva.example"},
+	}
+	if len(p.Addresses.To) != len(want) {
+		t.Fatalf("to = %+v, want the accepted recipients", p.Addresses.To)
+	}
+	for i, w := range want {
+		if to := p.Addresses.To[i]; to.Address != w.address || to.DomainUnicode != w.unicode || to.DomainASCII != w.ascii {
+			t.Errorf("to %d = %+v, want %s, %s, %s", i, to, w.address, w.unicode, w.ascii)
+		}
+	}
+
+	if len(p.Addresses.HeaderFrom) != 1 || p.Addresses.HeaderFrom[0].Name != "Δοκιμή" || p.Addresses.HeaderFrom[0].Address != "δοκιμή@παράδειγμα.δοκιμή" {
+		t.Errorf("header from = %+v, want the UTF-8 header address", p.Addresses.HeaderFrom)
+	}
+	if p.Subject != "Grüße" {
+		t.Errorf("subject = %q, want the UTF-8 header", p.Subject)
+	}
+}
@@ -0,0 +1,145 @@
+//go:build unix
+
+package smtp2http
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sendSIGHUP sends a SIGHUP to the test process, a channel of the test is notified of it too so the signal
+// never gets its default action of killing the process
+func sendSIGHUP(t *testing.T) {
+	t.Helper()
+
+	guard := make(chan os.Signal, 1)
+	signal.Notify(guard, syscall.SIGHUP)
+	t.Cleanup(func() { signal.Stop(guard) })
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reloadedOnSIGHUP sends SIGHUPs until reloaded reports the file was reloaded, the reloader may not be
+// notified of them yet
+func reloadedOnSIGHUP(t *testing.T, reloaded func() bool) bool {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sendSIGHUP(t)
+		time.Sleep(20 * time.Millisecond)
+		if reloaded() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stopReloader closes done and waits for the reloader to return
+func stopReloader(t *testing.T, done, stopped chan struct{}) {
+	t.Helper()
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reloader didn't stop")
+	}
+}
+
+func TestContentFilterReloadOnSIGHUP(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "filter.yaml")
+	rule := "- name: spam\n  target: subject\n  pattern: viagra\n  action: reject\n"
+	if err := ioutil.WriteFile(file, []byte(rule), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openContentFilter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := func() int {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		return len(f.rules)
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		f.reloadOnSIGHUP(done)
+		close(stopped)
+	}()
+
+	if err := ioutil.WriteFile(file, []byte(rule+rule), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !reloadedOnSIGHUP(t, func() bool { return rules() == 2 }) {
+		t.Fatalf("%d rules after a SIGHUP, want the 2 of the file", rules())
+	}
+
+	stopReloader(t, done, stopped)
+
+	if err := ioutil.WriteFile(file, []byte(rule+rule+rule), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sendSIGHUP(t)
+	time.Sleep(100 * time.Millisecond)
+	if rules() != 2 {
+		t.Errorf("%d rules, want the filter no longer reloaded once stopped", rules())
+	}
+}
+
+func TestAliasMapReloadOnSIGHUP(t *testing.T) {
+	file := writeAliasFile(t, "sales@example.com = bob@example.com\n")
+	m, err := openAliasMap(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := func() string {
+		addr, _ := m.rewrite(&mail.Address{Address: "sales@example.com"})
+		return addr.Address
+	}
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		m.reloadOnSIGHUP(done)
+		close(stopped)
+	}()
+
+	// an invalid file keeps the current aliases
+	if err := ioutil.WriteFile(file, []byte("sales@example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sendSIGHUP(t)
+	time.Sleep(50 * time.Millisecond)
+	if got := target(); got != "bob@example.com" {
+		t.Errorf("sales@example.com rewritten to %s after an invalid file, want the current alias", got)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("sales@example.com = carol@example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !reloadedOnSIGHUP(t, func() bool { return target() == "carol@example.com" }) {
+		t.Fatalf("sales@example.com rewritten to %s after a SIGHUP, want the alias of the file", target())
+	}
+
+	stopReloader(t, done, stopped)
+
+	if err := ioutil.WriteFile(file, []byte("sales@example.com = dave@example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sendSIGHUP(t)
+	time.Sleep(100 * time.Millisecond)
+	if got := target(); got != "carol@example.com" {
+		t.Errorf("sales@example.com rewritten to %s, want the aliases no longer reloaded once stopped", got)
+	}
+}
@@ -0,0 +1,103 @@
+package smtp2http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signatureHeader is the request header carrying the webhook signature
+const signatureHeader = "X-Smtp2http-Signature"
+
+// signPayload computes the value of the X-Smtp2http-Signature header,
+// formatted as "t=<unix timestamp>,v1=<hex encoded hmac>".
+//
+// The HMAC-SHA256 is computed with the webhook secret over the string
+// "<unix timestamp>.<raw request body>". With -webhook-compress it is the
+// body before compression, the receiver verifies the decompressed body.
+func signPayload(secret string, body []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+
+	return "t=" + ts + ",v1=" + computeSignature(secret, ts, body)
+}
+
+// signRequest signs the body of the request, streamed from its temp file when it has one
+func signRequest(secret string, r *webhookRequest, t time.Time) (string, error) {
+	if r.BodyFile == "" {
+		return signPayload(secret, r.Body, t), nil
+	}
+
+	f, err := os.Open(r.BodyFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	if _, err := io.Copy(mac, f); err != nil {
+		return "", err
+	}
+
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifySignature is the receiving side of signPayload, it is a reference
+// implementation of what the webhook should do with the header:
+//
+//  1. split the header on "," and read the "t" and "v1" values
+//  2. reject the request if "t" is older than the accepted tolerance (replay protection)
+//  3. compute HMAC-SHA256(secret, t + "." + body) and hex encode it
+//  4. compare it against "v1" in constant time
+func verifySignature(secret string, body []byte, header string, tolerance time.Duration, now time.Time) error {
+	var ts, sig string
+
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			sig = kv[1]
+		}
+	}
+
+	if ts == "" || sig == "" {
+		return errors.New("malformed signature header")
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("malformed signature timestamp")
+	}
+
+	if tolerance > 0 && now.Sub(time.Unix(unix, 0)) > tolerance {
+		return errors.New("signature timestamp is outside of the tolerance")
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(computeSignature(secret, ts, body))) {
+		return errors.New("signature mismatch")
+	}
+
+	return nil
+}
+
+func computeSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,163 @@
+package smtp2http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatureRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"1"}`)
+	header := signPayload("secret", body, now)
+
+	if !strings.HasPrefix(header, "t=1700000000,v1=") {
+		t.Errorf("header = %q, want t=<unix>,v1=<hex>", header)
+	}
+	if err := verifySignature("secret", body, header, 5*time.Minute, now.Add(time.Minute)); err != nil {
+		t.Errorf("valid signature refused: %v", err)
+	}
+}
+
+func TestSignatureTampered(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	header := signPayload("secret", []byte(`{"id":"1"}`), now)
+
+	if err := verifySignature("secret", []byte(`{"id":"2"}`), header, 5*time.Minute, now); err == nil {
+		t.Error("tampered body accepted")
+	}
+	if err := verifySignature("other", []byte(`{"id":"1"}`), header, 5*time.Minute, now); err == nil {
+		t.Error("wrong secret accepted")
+	}
+	if err := verifySignature("secret", []byte(`{"id":"1"}`), "v1=abc", 5*time.Minute, now); err == nil {
+		t.Error("header without timestamp accepted")
+	}
+}
+
+func TestSignatureExpired(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"1"}`)
+	header := signPayload("secret", body, now)
+
+	if err := verifySignature("secret", body, header, 5*time.Minute, now.Add(6*time.Minute)); err == nil {
+		t.Error("expired timestamp accepted")
+	}
+}
+
+func TestSignRequestFromFile(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(strings.Repeat("payload ", 1000))
+
+	path := filepath.Join(t.TempDir(), "body")
+	if err := ioutil.WriteFile(path, body, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := signRequest("secret", &webhookRequest{BodyFile: path}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := signPayload("secret", body, now); got != want {
+		t.Errorf("file signature = %q, want %q", got, want)
+	}
+}
+
+func TestSignatureCoversTheUncompressedBody(t *testing.T) {
+	setupWebhookClients(t)
+	webhookTokens = nil
+	conf.WebhookSecret = "secret"
+	conf.WebhookCompress = true
+
+	body := []byte(`{"text":"` + strings.Repeat("a", 2*compressMinSize) + `"}`)
+
+	verified := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			verified <- os.ErrInvalid
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			verified <- err
+			return
+		}
+		received, err := ioutil.ReadAll(zr)
+		if err != nil {
+			verified <- err
+			return
+		}
+		verified <- verifySignature("secret", received, r.Header.Get(signatureHeader), time.Minute, time.Now())
+	}))
+	defer srv.Close()
+
+	_, err := postWebhook(context.Background(), slog.Default(), &webhookRequest{URL: srv.URL, ContentType: "application/json", Body: body}, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-verified; err != nil {
+		t.Errorf("the decompressed body doesn't verify: %v", err)
+	}
+}
+
+func TestSignatureOfLargePayload(t *testing.T) {
+	content := bytes.Repeat([]byte("large attachment "), 1<<18)
+
+	type received struct {
+		body []byte
+		err  error
+	}
+	requests := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = verifySignature("secret", body, r.Header.Get(signatureHeader), time.Minute, time.Now())
+		}
+		requests <- received{body, err}
+	}))
+	defer srv.Close()
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{srv.URL}
+	cfg.WebhookRetries = 0
+	cfg.WebhookSecret = "secret"
+	cfg.MaxMessageSize = 16 << 20
+	addr := newTestServer(t, cfg)
+
+	raw := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: large\r\nMessage-ID: <large@example.com>\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nsee the attachment\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=large.bin\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		wrapLines(base64.StdEncoding.EncodeToString(content), 76) +
+		"--b--\r\n"
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.err != nil {
+		t.Fatalf("the payload doesn't verify: %v", r.err)
+	}
+
+	p := &EmailMessage{}
+	if err := json.Unmarshal(r.body, p); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Attachments) != 1 {
+		t.Fatalf("%d attachments, want the large file", len(p.Attachments))
+	}
+	if data, _ := base64.StdEncoding.DecodeString(p.Attachments[0].Data); !bytes.Equal(data, content) {
+		t.Errorf("attachment of %d bytes, want the %d sent", len(data), len(content))
+	}
+}
@@ -0,0 +1,140 @@
+package smtp2http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// webhookAuthSigV4 is the -webhook-auth signing the requests with the aws signature version 4, for the IAM
+// authorized API Gateway endpoints and Lambda function urls
+const webhookAuthSigV4 = "aws-sigv4"
+
+// awsSigner signs the webhook requests with -webhook-auth=aws-sigv4, nil when disabled
+var awsSigner *sigV4Signer
+
+// sigV4Signer signs the requests with the credentials of the standard aws chain (environment, shared config,
+// instance or task role, IRSA), the cache of the sdk renews them before they expire
+type sigV4Signer struct {
+	credentials aws.CredentialsProvider
+	region      string
+	service     string
+	signer      *v4.Signer
+	now         func() time.Time // the signing time
+}
+
+// newSigV4Signer loads the aws credentials, region is the one of the aws config when empty
+func newSigV4Signer(region, service string) (*sigV4Signer, error) {
+	opts := []func(*config.LoadOptions) error{}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the aws config: %s", err.Error())
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("-webhook-auth=aws-sigv4 requires -aws-region or AWS_REGION")
+	}
+
+	// the chain is only walked once credentials are asked for, one of its providers must have some. Whether
+	// the endpoint accepts them is only known from its reply to the first webhook
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, fmt.Errorf("cannot get the aws credentials: %s", err.Error())
+	}
+
+	return &sigV4Signer{credentials: cfg.Credentials, region: cfg.Region, service: service, signer: v4.NewSigner(), now: time.Now}, nil
+}
+
+// payloadHashKey is the context key of the hex sha256 of the body a webhook request sends
+type payloadHashKey struct{}
+
+// withPayloadHash returns ctx carrying the hash of body, which is rewound for the request to send it. ctx is
+// returned unchanged when the requests aren't signed
+func (s *sigV4Signer) withPayloadHash(ctx context.Context, body io.Reader) (context.Context, error) {
+	if s == nil {
+		return ctx, nil
+	}
+
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		return nil, errors.New("cannot sign a streamed request body")
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, seeker); err != nil {
+		return nil, err
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return context.WithValue(ctx, payloadHashKey{}, hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// sign signs the request as it is about to be sent, its headers included. The webhook requests carry the hash
+// of their body in their context, the body of the others (the HEAD of the readiness probe) is hashed here. Only
+// the requests of webhookClient are signed, the other endpoints aren't the ones -webhook-auth is for
+func (s *sigV4Signer) sign(req *http.Request) error {
+	if s == nil {
+		return nil
+	}
+
+	hash, ok := req.Context().Value(payloadHashKey{}).(string)
+	if !ok {
+		h := sha256.New()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			if body != nil {
+				_, err = io.Copy(h, body)
+				body.Close()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		hash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	// signed along, the receiver can check the body it got is the one signed
+	req.Header.Set("X-Amz-Content-Sha256", hash)
+
+	creds, err := s.credentials.Retrieve(req.Context())
+	if err != nil {
+		return fmt.Errorf("cannot get the aws credentials: %s", err.Error())
+	}
+
+	return s.signer.SignHTTP(req.Context(), creds, req, hash, s.service, s.region, s.now())
+}
+
+// gzipBuffer compresses data in memory, the signed requests can't stream their compressed body
+func gzipBuffer(data io.Reader) (*bytes.Reader, error) {
+	buf := &bytes.Buffer{}
+
+	gw := gzip.NewWriter(buf)
+	if _, err := io.Copy(gw, data); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(buf.Bytes()), nil
+}
@@ -0,0 +1,160 @@
+package smtp2http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+func TestSigV4SignsOnlyTheWebhookRequests(t *testing.T) {
+	setupWebhookClients(t)
+	webhookTokens = nil
+
+	saved := awsSigner
+	t.Cleanup(func() { awsSigner = saved })
+	awsSigner = &sigV4Signer{
+		credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+		region:  "eu-west-1",
+		service: "execute-api",
+		signer:  v4.NewSigner(),
+		now:     time.Now,
+	}
+
+	srv, requests := recordingServer(t)
+
+	// compressed, the signature covers the gzip body
+	conf.WebhookCompress = true
+	body := []byte(`{"text":"` + strings.Repeat("a", 2*compressMinSize) + `"}`)
+	_, err := postWebhook(context.Background(), slog.Default(), &webhookRequest{URL: srv.URL + "/webhook", ContentType: "application/json", Body: body}, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhook := receive(t, requests)
+	if got := webhook.header.Get("Authorization"); !strings.HasPrefix(got, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(got, "/eu-west-1/execute-api/") {
+		t.Errorf("webhook Authorization = %q, want a sigv4 signature", got)
+	}
+	if webhook.header.Get("X-Amz-Date") == "" {
+		t.Error("the webhook request has no X-Amz-Date")
+	}
+
+	checker := &rcptChecker{cfg: rcptCheckConfig{URL: srv.URL + "/rcpt", Method: http.MethodGet, Timeout: 5 * time.Second}}
+	if _, err := checker.ask(nil, &mail.Address{Address: "to@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	newRejectNotifier(srv.URL + "/reject").notify(&rejectEvent{Reason: "test"})
+
+	for i := 0; i < 2; i++ {
+		r := receive(t, requests)
+		if got := r.header.Get("Authorization"); got != "" {
+			t.Errorf("%s Authorization = %q, want none", r.path, got)
+		}
+		for _, name := range []string{"X-Amz-Date", "X-Amz-Content-Sha256"} {
+			if got := r.header.Get(name); got != "" {
+				t.Errorf("%s %s = %q, want none", r.path, name, got)
+			}
+		}
+	}
+}
+
+// roundTripFunc is an http.RoundTripper answering the requests without sending them
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestSigV4Signature(t *testing.T) {
+	restoreGlobals(t)
+	conf = DefaultConfig()
+	conf.WebhookRetries = 0
+	webhookHeaders = map[string]string{}
+	awsSigner = &sigV4Signer{
+		credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, nil
+		}),
+		region:  "eu-west-1",
+		service: "execute-api",
+		signer:  v4.NewSigner(),
+		now:     func() time.Time { return time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC) },
+	}
+
+	var sent *http.Request
+	var sentBody []byte
+	webhookClient = newWebhookClient(5*time.Second, 0, nil, nil)
+	webhookClient.SetTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req
+		sentBody, _ = ioutil.ReadAll(req.Body)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: http.Header{}, Request: req}, nil
+	}))
+
+	// the signatures are the ones of an independent sigv4 implementation given the same request, the hash of
+	// the compressed body is the one of the gzip output of the standard library
+	body := []byte(`{"subject":"invoice","text":"` + strings.Repeat("hello bob, ", 100) + `"}`)
+	for _, c := range []struct {
+		compress      bool
+		signedHeaders string
+		signature     string
+		contentHash   string
+	}{
+		{
+			false,
+			"accept;content-length;content-type;host;x-amz-content-sha256;x-amz-date",
+			"e8d7ae3f874c243f0e14bb27c3980d4bf9717874edeb55f96ab68b272c80c9c4",
+			"ca4276699af42f65fb8c772d13021dcd5a51c0a1f1b1c8584983d4df20a84397",
+		},
+		{
+			true,
+			"accept;content-encoding;content-length;content-type;host;x-amz-content-sha256;x-amz-date",
+			"dd0297c3aed877712198352097c7b43db5477f96b9e2efcda121e5fe768fc259",
+			"1f6fe3510d2648fce8783d152daffca89fdbd7d5f1c130702b8e5b0f5728affd",
+		},
+	} {
+		conf.WebhookCompress = c.compress
+		req := &webhookRequest{URL: "https://abcdef1234.execute-api.eu-west-1.amazonaws.com/prod/webhook", ContentType: "application/json", Body: body}
+		if _, err := postWebhook(context.Background(), slog.Default(), req, time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240501/eu-west-1/execute-api/aws4_request, SignedHeaders=" + c.signedHeaders + ", Signature=" + c.signature
+		if got := sent.Header.Get("Authorization"); got != want {
+			t.Errorf("compress %t: Authorization = %q, want %q", c.compress, got, want)
+		}
+		if got := sent.Header.Get("X-Amz-Date"); got != "20240501T123000Z" {
+			t.Errorf("compress %t: X-Amz-Date = %q, want the signing time", c.compress, got)
+		}
+		if got := sent.Header.Get("X-Amz-Content-Sha256"); got != c.contentHash {
+			t.Errorf("compress %t: X-Amz-Content-Sha256 = %q, want %q", c.compress, got, c.contentHash)
+		}
+
+		// the hash is the one of the body as sent
+		if got := fmt.Sprintf("%x", sha256.Sum256(sentBody)); got != c.contentHash {
+			t.Errorf("compress %t: sent a body hashed %s, want the signed one", c.compress, got)
+		}
+		if c.compress {
+			gr, err := gzip.NewReader(bytes.NewReader(sentBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sentBody, err = ioutil.ReadAll(gr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(sentBody, body) {
+			t.Errorf("compress %t: sent %q, want the body", c.compress, sentBody)
+		}
+	}
+}
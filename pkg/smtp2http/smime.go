@@ -0,0 +1,411 @@
+package smtp2http
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"time"
+
+	// the hashes of the signed messages
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// the content types of the PKCS #7 / CMS structures (RFC 5652)
+var (
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAuthEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 23}
+	oidMessageDigest     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidRSASSAPSS         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+)
+
+// smimeDigests are the digest algorithms of the signer infos
+var smimeDigests = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, crypto.SHA1},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, crypto.SHA256},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}, crypto.SHA384},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}, crypto.SHA512},
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// VerifySMIME checks the signature of a multipart/signed (detached) or an application/pkcs7-mime signed-data
+// (opaque) message against the signed content of raw, the signer certificate is verified against roots (the
+// system pool when nil). The enveloped messages can't be decrypted, they are only marked as encrypted. It
+// returns nil when the message isn't an S/MIME one
+func VerifySMIME(raw []byte, roots *x509.CertPool) *EmailSMIME {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+
+	contentType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+
+	// the body, as large as the message, is only read for the S/MIME messages
+	protocol := strings.ToLower(params["protocol"])
+	switch {
+	case contentType == "multipart/signed" && (protocol == "application/pkcs7-signature" || protocol == "application/x-pkcs7-signature"):
+	case contentType == "application/pkcs7-mime" || contentType == "application/x-pkcs7-mime":
+	default:
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil
+	}
+
+	switch contentType {
+	case "multipart/signed":
+		ret := &EmailSMIME{Signed: true}
+		content, signature, err := signedParts(body, params["boundary"])
+		if err != nil {
+			ret.Error = err.Error()
+			return ret
+		}
+
+		sd, err := parseSignedData(signature)
+		if err != nil {
+			ret.Error = err.Error()
+			return ret
+		}
+
+		verifySignedData(ret, sd, content, roots)
+		return ret
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		data, err := ioutil.ReadAll(decodeTransferEncoding(bytes.NewReader(body), msg.Header.Get("Content-Transfer-Encoding")))
+		if err != nil {
+			return &EmailSMIME{Error: err.Error()}
+		}
+
+		var ci pkcs7ContentInfo
+		_, ciErr := asn1.Unmarshal(data, &ci)
+
+		smimeType := strings.ToLower(params["smime-type"])
+		switch {
+		case smimeType == "enveloped-data" || smimeType == "authenveloped-data",
+			ciErr == nil && (ci.ContentType.Equal(oidEnvelopedData) || ci.ContentType.Equal(oidAuthEnvelopedData)):
+			return &EmailSMIME{Encrypted: true}
+		case smimeType == "signed-data" || (ciErr == nil && ci.ContentType.Equal(oidSignedData)):
+			ret := &EmailSMIME{Signed: true}
+			sd, err := parseSignedData(data)
+			if err != nil {
+				ret.Error = err.Error()
+				return ret
+			}
+
+			verifySignedData(ret, sd, nil, roots)
+			return ret
+		}
+	}
+
+	return nil
+}
+
+// signedParts splits the body of a multipart/signed message into the signed part, as it was sent with its
+// header and the CRLF line endings it was signed with, and the decoded signature
+func signedParts(body []byte, boundary string) ([]byte, []byte, error) {
+	if boundary == "" {
+		return nil, nil, errors.New("no boundary in the multipart/signed content type")
+	}
+
+	body = canonicalLineEndings(body)
+	delimiter := []byte("--" + boundary)
+
+	start := bytes.Index(body, delimiter)
+	for start > 0 && !bytes.HasSuffix(body[:start], []byte("\r\n")) {
+		next := bytes.Index(body[start+1:], delimiter)
+		if next < 0 {
+			start = -1
+			break
+		}
+		start += next + 1
+	}
+	if start < 0 {
+		return nil, nil, errors.New("the signed part is missing")
+	}
+
+	eol := bytes.Index(body[start:], []byte("\r\n"))
+	if eol < 0 {
+		return nil, nil, errors.New("the signed part is missing")
+	}
+	start += eol + 2
+
+	end := bytes.Index(body[start:], append([]byte("\r\n"), delimiter...))
+	if end < 0 {
+		return nil, nil, errors.New("the signature part is missing")
+	}
+	content := body[start : start+end]
+
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	if _, err := mr.NextPart(); err != nil {
+		return nil, nil, fmt.Errorf("cannot read the signed part: %s", err.Error())
+	}
+
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, errors.New("the signature part is missing")
+	}
+
+	signature, err := ioutil.ReadAll(decodeTransferEncoding(part, part.Header.Get("Content-Transfer-Encoding")))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read the signature: %s", err.Error())
+	}
+
+	return content, signature, nil
+}
+
+// canonicalLineEndings converts the bare LF line endings to CRLF, the messages are signed in their canonical form
+func canonicalLineEndings(data []byte) []byte {
+	return bytes.ReplaceAll(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+// parseSignedData decodes a DER encoded ContentInfo holding a SignedData
+func parseSignedData(data []byte) (*pkcs7SignedData, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return nil, fmt.Errorf("cannot parse the signature: %s", err.Error())
+	}
+
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("the signature isn't a signed data but a %s", ci.ContentType)
+	}
+
+	sd := &pkcs7SignedData{}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, sd); err != nil {
+		return nil, fmt.Errorf("cannot parse the signed data: %s", err.Error())
+	}
+
+	return sd, nil
+}
+
+// verifySignedData verifies the first signer of sd over content (the encapsulated content when nil) and
+// fills ret with the signer certificate and the result
+func verifySignedData(ret *EmailSMIME, sd *pkcs7SignedData, content []byte, roots *x509.CertPool) {
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		ret.Error = fmt.Sprintf("cannot parse the certificates: %s", err.Error())
+		return
+	}
+
+	if len(sd.SignerInfos) == 0 {
+		ret.Error = "the signature has no signer"
+		return
+	}
+	signer := sd.SignerInfos[0]
+
+	cert := signerCertificate(signer, certs)
+	if cert == nil {
+		ret.Error = "the signer certificate is missing"
+		return
+	}
+	ret.Signer = smimeSigner(cert)
+
+	if content == nil {
+		if len(sd.ContentInfo.Content.Bytes) == 0 {
+			ret.Error = "the signed content is missing"
+			return
+		}
+		if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+			ret.Error = fmt.Sprintf("cannot parse the signed content: %s", err.Error())
+			return
+		}
+	}
+
+	if err := checkSignerInfo(signer, cert, content); err != nil {
+		ret.Error = err.Error()
+		return
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		if c != cert {
+			intermediates.AddCert(c)
+		}
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	})
+	if err != nil {
+		ret.Error = fmt.Sprintf("untrusted signer certificate: %s", err.Error())
+		return
+	}
+
+	ret.Valid = true
+}
+
+// signerCertificate returns the certificate of the signer, identified by its issuer and serial number or its
+// subject key identifier
+func signerCertificate(signer pkcs7SignerInfo, certs []*x509.Certificate) *x509.Certificate {
+	if signer.SID.Class == asn1.ClassContextSpecific && signer.SID.Tag == 0 {
+		for _, c := range certs {
+			if bytes.Equal(c.SubjectKeyId, signer.SID.Bytes) {
+				return c
+			}
+		}
+		return nil
+	}
+
+	var sid pkcs7IssuerAndSerial
+	if _, err := asn1.Unmarshal(signer.SID.FullBytes, &sid); err != nil {
+		return nil
+	}
+
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, sid.Issuer.FullBytes) && c.SerialNumber.Cmp(sid.Serial) == 0 {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// checkSignerInfo checks the signature of signer: over the signed attributes, whose message digest must be
+// the one of content, or over content itself when there are none
+func checkSignerInfo(signer pkcs7SignerInfo, cert *x509.Certificate, content []byte) error {
+	hash := crypto.Hash(0)
+	for _, d := range smimeDigests {
+		if d.oid.Equal(signer.DigestAlgorithm.Algorithm) {
+			hash = d.hash
+		}
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported digest algorithm %s", signer.DigestAlgorithm.Algorithm)
+	}
+
+	signed := content
+	if len(signer.SignedAttrs.FullBytes) > 0 {
+		// the attributes are signed with their SET OF tag, not the implicit [0] they are sent with
+		signed = append([]byte{0x31}, signer.SignedAttrs.FullBytes[1:]...)
+
+		var attrs []pkcs7Attribute
+		if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+			return fmt.Errorf("cannot parse the signed attributes: %s", err.Error())
+		}
+
+		var digest []byte
+		for _, attr := range attrs {
+			if attr.Type.Equal(oidMessageDigest) {
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+					return fmt.Errorf("cannot parse the message digest: %s", err.Error())
+				}
+			}
+		}
+
+		h := hash.New()
+		h.Write(content)
+		if !bytes.Equal(digest, h.Sum(nil)) {
+			return errors.New("the message digest doesn't match the content, the message was modified")
+		}
+	}
+
+	algorithm, err := signatureAlgorithm(cert, hash, signer.SignatureAlgorithm.Algorithm.Equal(oidRSASSAPSS))
+	if err != nil {
+		return err
+	}
+
+	if err := cert.CheckSignature(algorithm, signed, signer.Signature); err != nil {
+		return fmt.Errorf("invalid signature: %s", err.Error())
+	}
+
+	return nil
+}
+
+// signatureAlgorithm returns the x509 algorithm of a signature made with the key of cert and hash
+func signatureAlgorithm(cert *x509.Certificate, hash crypto.Hash, pss bool) (x509.SignatureAlgorithm, error) {
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algorithms := map[crypto.Hash]x509.SignatureAlgorithm{
+			crypto.SHA1: x509.SHA1WithRSA, crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA, crypto.SHA512: x509.SHA512WithRSA,
+		}
+		if pss {
+			algorithms = map[crypto.Hash]x509.SignatureAlgorithm{
+				crypto.SHA256: x509.SHA256WithRSAPSS, crypto.SHA384: x509.SHA384WithRSAPSS, crypto.SHA512: x509.SHA512WithRSAPSS,
+			}
+		}
+		if algorithm, ok := algorithms[hash]; ok {
+			return algorithm, nil
+		}
+	case *ecdsa.PublicKey:
+		algorithms := map[crypto.Hash]x509.SignatureAlgorithm{
+			crypto.SHA1: x509.ECDSAWithSHA1, crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384, crypto.SHA512: x509.ECDSAWithSHA512,
+		}
+		if algorithm, ok := algorithms[hash]; ok {
+			return algorithm, nil
+		}
+	case ed25519.PublicKey:
+		return x509.PureEd25519, nil
+	}
+
+	return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm, a %T key with %s", cert.PublicKey, hash)
+}
+
+// smimeSigner returns the details of the signer certificate
+func smimeSigner(cert *x509.Certificate) *EmailSMIMESigner {
+	return &EmailSMIMESigner{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.Text(16),
+		Emails:    cert.EmailAddresses,
+		NotBefore: cert.NotBefore.UTC().Format(time.RFC3339),
+		NotAfter:  cert.NotAfter.UTC().Format(time.RFC3339),
+	}
+}
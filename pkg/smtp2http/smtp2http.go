@@ -0,0 +1,701 @@
+package smtp2http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// versionHeader carries the version of the producer on the webhook requests
+const versionHeader = "X-Smtp2http-Version"
+
+// conf is the configuration of the running Server, set by New
+var conf = DefaultConfig()
+
+// Server receives the messages on the smtp listeners and delivers them to the webhooks and the outputs
+type Server struct {
+	handler  HandlerFunc
+	listener listenerConfig
+
+	// clientCert is the certificate of -webhook-client-cert, reloaded while the server is served
+	clientCert *clientCertificate
+}
+
+// New validates cfg and sets up what the messages are delivered with: the webhook client, the outputs and
+// the dead letters, in place of what a previous New set up. That state and the metrics are process wide, a
+// process serves a single Server at a time
+func New(cfg Config) (*Server, error) {
+	resetState()
+	conf = cfg
+
+	tlsConfig, err := loadTLSConfig(conf.TLSCert, conf.TLSKey, conf.TLSMinVersion, conf.TLSCiphers)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.ACMEDomains != "" {
+		if tlsConfig != nil {
+			slog.Warn("both -tls-cert and -acme-domain are set, using the static certificate")
+		} else {
+			tlsConfig, err = newACMETLSConfig(acmeConfig{
+				Domains:       splitList(conf.ACMEDomains),
+				CacheDir:      conf.ACMECacheDir,
+				Email:         conf.ACMEEmail,
+				Challenge:     conf.ACMEChallenge,
+				ChallengeAddr: conf.ACMEChallengeAddr,
+			}, conf.TLSMinVersion, conf.TLSCiphers)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if conf.RequireTLS && tlsConfig == nil {
+		return nil, errors.New("-require-tls requires -tls-cert and -tls-key or -acme-domain")
+	}
+
+	if conf.WebhookConcurrency < 0 {
+		return nil, errors.New("-webhook-concurrency can't be negative")
+	}
+
+	// the jitter of the retries is drawn from the delay, a negative one would panic
+	switch {
+	case conf.WebhookRetries < 0:
+		return nil, errors.New("-webhook-retries can't be negative")
+	case conf.WebhookRetryDelay < 0:
+		return nil, errors.New("-webhook-retry-delay can't be negative")
+	}
+
+	proxy, err := parseWebhookProxy(conf.WebhookProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookTLS, clientCert, err := webhookTLSConfig(conf.WebhookClientCert, conf.WebhookClientKey, conf.WebhookCAFile, conf.WebhookInsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	switch conf.WebhookAuth {
+	case "":
+	case webhookAuthSigV4:
+		if awsSigner, err = newSigV4Signer(conf.AWSRegion, conf.AWSService); err != nil {
+			return nil, err
+		}
+		slog.Info("webhook requests signed with aws sigv4", "aws_region", awsSigner.region, "aws_service", awsSigner.service)
+	default:
+		return nil, fmt.Errorf("invalid -webhook-auth %q, expected aws-sigv4", conf.WebhookAuth)
+	}
+
+	webhookClient = newWebhookClient(conf.WebhookTimeout, conf.WebhookConcurrency, proxy, webhookTLS)
+	callbackClient = newCallbackClient(webhookClient)
+	if conf.WebhookConcurrency > 0 {
+		webhookSlots = make(chan struct{}, conf.WebhookConcurrency)
+	}
+
+	switch {
+	case conf.BreakerThreshold < 0:
+		return nil, errors.New("-breaker-threshold can't be negative")
+	case conf.BreakerThreshold > 0 && conf.BreakerOpenDuration <= 0:
+		return nil, errors.New("-breaker-open-duration must be positive")
+	case conf.BreakerThreshold > 0:
+		breakers = newWebhookBreakers(conf.BreakerThreshold, conf.BreakerOpenDuration)
+	}
+
+	if conf.WebhookFormat != webhookFormatJSON && conf.WebhookFormat != webhookFormatMultipart {
+		return nil, fmt.Errorf("invalid webhook format %q, expected json or multipart", conf.WebhookFormat)
+	}
+
+	switch conf.PayloadFormat {
+	case payloadFormatDefault:
+	case payloadFormatCloudEvents:
+		if conf.CloudEventsMode != cloudEventsStructured && conf.CloudEventsMode != cloudEventsBinary {
+			return nil, fmt.Errorf("invalid cloudevents mode %q, expected structured or binary", conf.CloudEventsMode)
+		}
+
+		if conf.WebhookFormat != webhookFormatJSON {
+			return nil, errors.New("-payload-format=cloudevents requires -webhook-format=json")
+		}
+	case payloadFormatSendGrid, payloadFormatMailgun, payloadFormatPostmark:
+		if conf.WebhookFormat != webhookFormatJSON || conf.Attachments != attachmentsInline {
+			return nil, fmt.Errorf("-payload-format=%s builds its own body, it requires -webhook-format=json and -attachments=inline", conf.PayloadFormat)
+		}
+	default:
+		return nil, fmt.Errorf("invalid payload format %q, expected default, cloudevents, sendgrid, mailgun or postmark", conf.PayloadFormat)
+	}
+
+	switch conf.Attachments {
+	case attachmentsInline, attachmentsMetadata:
+	case attachmentsStore:
+		if conf.AttachmentStoreDir == "" {
+			return nil, errors.New("-attachments=store requires -attachment-store-dir")
+		}
+	default:
+		return nil, fmt.Errorf("invalid attachments mode %q, expected inline, metadata or store", conf.Attachments)
+	}
+
+	// also opened without -attachments=store, the outputs move the files of the payloads over their size limit there
+	if conf.AttachmentStoreDir != "" {
+		attachmentStore, err = openFileStore(conf.AttachmentStoreDir, conf.AttachmentStoreRetention)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.AttachmentOverflow != overflowDrop && conf.AttachmentOverflow != overflowReject {
+		return nil, fmt.Errorf("invalid attachment overflow %q, expected drop or reject", conf.AttachmentOverflow)
+	}
+
+	if conf.OnPartError != partErrorReject && conf.OnPartError != partErrorAnnotate {
+		return nil, fmt.Errorf("invalid part error action %q, expected reject or annotate", conf.OnPartError)
+	}
+
+	if conf.AttachmentFilter != filterReject && conf.AttachmentFilter != filterStrip {
+		return nil, fmt.Errorf("invalid attachment filter %q, expected reject or strip", conf.AttachmentFilter)
+	}
+
+	attachmentTypes, err = newAttachmentFilter(conf.AllowedAttachmentTypes, conf.BlockedAttachmentExtensions)
+	if err != nil {
+		return nil, err
+	}
+
+	webhookHeaders, err = parseWebhookHeaders(conf.WebhookHeaders)
+	if err != nil {
+		return nil, err
+	}
+	webhookHeaders[versionHeader] = conf.Version
+
+	for name, value := range webhookHeaders {
+		slog.Info("webhook header configured", "name", name, "value", RedactHeader(name, value))
+	}
+
+	if conf.OAuth2TokenURL != "" {
+		if conf.OAuth2ClientID == "" {
+			return nil, errors.New("-oauth2-token-url requires -oauth2-client-id")
+		}
+		if _, ok := webhookHeaders["Authorization"]; ok {
+			return nil, errors.New("-oauth2-token-url and an Authorization -webhook-header can't be used together")
+		}
+
+		webhookTokens = newOAuth2Tokens(&clientcredentials.Config{
+			ClientID:     conf.OAuth2ClientID,
+			ClientSecret: conf.OAuth2ClientSecret,
+			TokenURL:     conf.OAuth2TokenURL,
+			Scopes:       splitList(conf.OAuth2Scopes),
+		}, webhookClient.GetClient())
+	}
+
+	if conf.PayloadVersion != 1 && conf.PayloadVersion != 2 {
+		return nil, fmt.Errorf("invalid payload version %d, expected 1 or 2", conf.PayloadVersion)
+	}
+
+	if conf.NestedDepth < 1 {
+		return nil, fmt.Errorf("invalid nested depth %d, expected at least 1", conf.NestedDepth)
+	}
+
+	smimeRoots, err = loadCABundle(conf.SMIMECABundle)
+	if err != nil {
+		return nil, err
+	}
+
+	pgpKeyring, err = loadPGPKeyring(conf.PGPPrivateKey, conf.PGPPassphrase, conf.PGPPassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := conf.Fields
+	switch conf.Payload {
+	case payloadFull:
+	case payloadMinimal:
+		if fields != "" {
+			return nil, errors.New("-payload=minimal and -fields are exclusive")
+		}
+		fields = minimalFields
+	default:
+		return nil, fmt.Errorf("invalid payload %q, expected full or minimal", conf.Payload)
+	}
+
+	if fields != "" {
+		if (conf.PayloadFormat != payloadFormatDefault && conf.PayloadFormat != payloadFormatCloudEvents) || conf.WebhookFormat != webhookFormatJSON || conf.RawOnly || conf.WebhookBodyTemplate != "" {
+			return nil, errors.New("-fields and -payload=minimal select the fields of the json payload, they require -payload-format=default or cloudevents, -webhook-format=json and no -webhook-body-template")
+		}
+
+		if payloadFields, err = parseFields(fields); err != nil {
+			return nil, err
+		}
+	}
+
+	conf.WebhookMethod = strings.ToUpper(conf.WebhookMethod)
+	if conf.WebhookMethod != http.MethodPost && conf.WebhookMethod != http.MethodPut && conf.WebhookMethod != http.MethodPatch {
+		return nil, fmt.Errorf("invalid webhook method %q, expected POST, PUT or PATCH", conf.WebhookMethod)
+	}
+
+	if conf.WebhookBodyTemplate != "" {
+		if conf.PayloadFormat != payloadFormatDefault || conf.WebhookFormat != webhookFormatJSON || conf.RawOnly {
+			return nil, errors.New("-webhook-body-template renders the default payload, it requires -payload-format=default and -webhook-format=json")
+		}
+
+		if bodyTemplate, err = loadBodyTemplate(conf.WebhookBodyTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.NotifyFormat != "" {
+		if _, ok := notifyLimits[conf.NotifyFormat]; !ok {
+			return nil, fmt.Errorf("invalid notify format %q, expected slack, discord or teams", conf.NotifyFormat)
+		}
+		if conf.PayloadFormat != payloadFormatDefault || conf.WebhookFormat != webhookFormatJSON || conf.RawOnly || payloadFields != nil || bodyTemplate != nil {
+			return nil, errors.New("-notify-format renders the default payload, it requires -payload-format=default, -webhook-format=json and no -fields or -webhook-body-template")
+		}
+		if conf.NotifyBodyLength < 0 {
+			return nil, errors.New("-notify-body-length must be positive")
+		}
+	}
+
+	webhookURLs = parseWebhookURLs(conf.Webhooks)
+	if conf.FanoutPolicy != fanoutAny && conf.FanoutPolicy != fanoutAll {
+		return nil, fmt.Errorf("invalid fanout policy %q, expected any or all", conf.FanoutPolicy)
+	}
+
+	if conf.FilterFile != "" {
+		contentRules, err = openContentFilter(conf.FilterFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.AliasFile != "" {
+		recipientAliases, err = openAliasMap(conf.AliasFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.RejectWebhook != "" {
+		rejectHook = newRejectNotifier(conf.RejectWebhook)
+	}
+
+	webhookRoutes, err = parseRoutes(conf.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.DedupeWindow > 0 {
+		if conf.DedupeMaxEntries < 1 {
+			return nil, errors.New("-dedupe-window requires a -dedupe-max-entries of at least 1")
+		}
+
+		dedupe = newDedupeCache(conf.DedupeWindow, conf.DedupeMaxEntries)
+	}
+
+	if conf.Maildir != "" {
+		maildir, err = openMaildir(conf.Maildir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := openPublishers(); err != nil {
+		return nil, err
+	}
+
+	if conf.DisableWebhook && len(publishers) == 0 {
+		return nil, errors.New("-disable-webhook requires an output (-kafka-brokers, -amqp-url, -nats-url, -pubsub-topic, -sqs-queue-url, -sns-topic-arn, -db-dsn, -elastic-url or -exec)")
+	}
+
+	if conf.SinkPolicy != sinkPolicyAll && conf.SinkPolicy != sinkPolicyAny {
+		return nil, fmt.Errorf("invalid sink policy %q, expected all or any", conf.SinkPolicy)
+	}
+
+	if conf.MaxMessageMemory < 0 {
+		return nil, errors.New("-max-memory-per-message can't be negative")
+	}
+
+	if conf.MaxMessageMemory > 0 {
+		if !spillSupported() {
+			slog.Warn("-max-memory-per-message ignored, the payloads are kept in memory with -raw-only, -payload-format, -fields, -webhook-body-template, -notify-format or an output")
+		}
+
+		sweepSpillFiles(conf.TmpDir)
+	}
+
+	if (conf.DryRunDir != "" || conf.FailDryRun) && !conf.DryRun {
+		return nil, errors.New("-dry-run-dir and -fail-dry-run require -dry-run")
+	}
+
+	if conf.DryRunDir != "" {
+		if err := os.MkdirAll(conf.DryRunDir, 0700); err != nil {
+			return nil, fmt.Errorf("cannot create the dry run directory: %s", err.Error())
+		}
+	}
+
+	switch conf.DeliveryMode {
+	case deliveryModeSync:
+	case deliveryModeAsync:
+		if conf.Workers < 1 || conf.QueueSize < 1 {
+			return nil, errors.New("-delivery-mode=async requires at least one worker and a queue size of at least 1")
+		}
+	default:
+		return nil, fmt.Errorf("invalid delivery mode %q, expected sync or async", conf.DeliveryMode)
+	}
+
+	if conf.DeadLetterDir != "" {
+		if deadLetters, err = openDeadLetterDir(conf.DeadLetterDir); err != nil {
+			return nil, fmt.Errorf("cannot create the dead letter directory: %s", err.Error())
+		}
+	}
+
+	var auther AuthFunc
+	if conf.AuthUsername != "" {
+		auther = staticAuther(conf.AuthUsername, conf.AuthPassword)
+	}
+
+	var rcptCheck RcptFunc
+	if conf.RcptCheckURL != "" {
+		rcptCheck, err = newRcptChecker(rcptCheckConfig{
+			URL:      conf.RcptCheckURL,
+			Method:   conf.RcptCheckMethod,
+			Timeout:  conf.RcptCheckTimeout,
+			TTL:      conf.RcptCheckTTL,
+			FailOpen: conf.RcptCheckFailOpen,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var dnsbl *dnsblChecker
+	if conf.DNSBL != "" {
+		dnsbl, err = newDNSBLChecker(splitList(conf.DNSBL), conf.DNSBLAction, conf.DNSBLTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	clientChecks, err := newClientChecker(conf.FCrDNSPolicy, conf.HeloPolicy, conf.DNSTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ipFilter, err := newIPFilter(conf.AllowIPs, conf.DenyIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies messagePolicies
+	if policies.SPF, err = parseSPFPolicy(conf.SPFPolicy); err != nil {
+		return nil, err
+	}
+
+	if policies.DKIM, err = parseDKIMPolicy(conf.DKIMPolicy); err != nil {
+		return nil, err
+	}
+
+	if policies.DMARC, err = parseDMARCMode(conf.DMARCPolicy); err != nil {
+		return nil, err
+	}
+
+	s := &Server{handler: newHandler(parseDomains(conf.Domain), policies), clientCert: clientCert}
+	s.listener = listenerConfig{
+		TLSConfig:       tlsConfig,
+		Auther:          auther,
+		RcptCheck:       rcptCheck,
+		DNSBL:           dnsbl,
+		ClientChecks:    clientChecks,
+		ReadTimeout:     conf.ReadTimeout,
+		WriteTimeout:    conf.WriteTimeout,
+		MaxMessageBytes: int(conf.MaxMessageSize),
+		BannerDomain:    conf.ServerName,
+		Handler:         s.handler,
+		MaxConnections:  conf.MaxConnections,
+		SessionLimits:   sessionLimits{MaxRecipients: conf.MaxRecipients, MaxMessages: conf.MaxSessionMessages, HandlerTimeout: conf.HandlerTimeout},
+		RateLimit:       conf.RateLimit,
+		IPFilter:        ipFilter,
+		ProxyProtocol:   conf.ProxyProtocol,
+		RequireTLS:      conf.RequireTLS,
+	}
+
+	return s, nil
+}
+
+// resetState drops the state of a previous New, most of it is only set when its option is on and would
+// otherwise outlive the option being turned off
+func resetState() {
+	webhookClient, callbackClient = resty.New(), resty.New()
+	webhookHeaders, webhookTokens, awsSigner, webhookSlots, breakers = map[string]string{}, nil, nil, nil, nil
+	webhookURLs, webhookRoutes = []string{defaultWebhook}, map[string]string{}
+	bodyTemplate, payloadFields, publishers, rejectHook = nil, nil, nil, nil
+	dedupe, deadLetters, attachmentStore, maildir = nil, nil, nil, nil
+	contentRules, recipientAliases, attachmentTypes, pgpKeyring, smimeRoots = nil, nil, nil, nil, nil
+	queue, spool = nil, nil
+}
+
+// openPublishers opens the outputs configured besides the webhooks
+func openPublishers() error {
+	if conf.KafkaBrokers != "" {
+		p, err := newKafkaPublisher(kafkaConfig{
+			Brokers:      splitList(conf.KafkaBrokers),
+			Topic:        conf.KafkaTopic,
+			Key:          conf.KafkaKey,
+			TLS:          conf.KafkaTLS,
+			TLSCA:        conf.KafkaTLSCA,
+			SASLUsername: conf.KafkaUsername,
+			SASLPassword: conf.KafkaPassword,
+		})
+		if err != nil {
+			return err
+		}
+
+		publishers = append(publishers, p)
+	}
+
+	if conf.AMQPURL != "" {
+		publishers = append(publishers, newAMQPPublisher(conf.AMQPURL, conf.AMQPExchange, conf.AMQPRoutingKey))
+	}
+
+	if conf.NATSURL != "" {
+		p, err := newNATSPublisher(natsConfig{
+			URL:             conf.NATSURL,
+			Subject:         conf.NATSSubject,
+			RequireAck:      conf.NATSRequireAck,
+			CredentialsFile: conf.NATSCredentials,
+			NKeySeedFile:    conf.NATSNKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		publishers = append(publishers, p)
+	}
+
+	if conf.DBDSN != "" {
+		if !defaultJSONPayload() {
+			return errors.New("-db-dsn stores the default json payload, it doesn't support -raw-only, -payload-format, -webhook-format=multipart, -fields or -webhook-body-template")
+		}
+
+		p, err := newSQLPublisher(conf.DBDSN, conf.DBMaxConns)
+		if err != nil {
+			return fmt.Errorf("cannot open -db-dsn: %s", err.Error())
+		}
+
+		publishers = append(publishers, p)
+	}
+
+	if conf.ElasticURL != "" {
+		if !defaultJSONPayload() {
+			return errors.New("-elastic-url indexes the default json payload, it doesn't support -raw-only, -payload-format, -webhook-format=multipart, -fields or -webhook-body-template")
+		}
+
+		p, err := newElasticPublisher(elasticConfig{
+			URL:           conf.ElasticURL,
+			Index:         conf.ElasticIndex,
+			Username:      conf.ElasticUsername,
+			Password:      conf.ElasticPassword,
+			APIKey:        conf.ElasticAPIKey,
+			CAFile:        conf.ElasticCAFile,
+			BatchSize:     conf.ElasticBatchSize,
+			FlushInterval: conf.ElasticFlushInterval,
+		})
+		if err != nil {
+			return err
+		}
+
+		publishers = append(publishers, p)
+	}
+
+	if conf.PubSubTopic != "" {
+		p, err := newPubSubPublisher(conf.PubSubTopic)
+		if err != nil {
+			return err
+		}
+
+		publishers = append(publishers, p)
+	}
+
+	if conf.SQSQueueURL != "" {
+		p, err := newSQSPublisher(conf.SQSQueueURL)
+		if err != nil {
+			return err
+		}
+
+		publishers = append(publishers, p)
+	}
+
+	if conf.SNSTopicARN != "" {
+		p, err := newSNSPublisher(conf.SNSTopicARN)
+		if err != nil {
+			return err
+		}
+
+		publishers = append(publishers, p)
+	}
+
+	if conf.Exec != "" {
+		p, err := newExecPublisher(conf.Exec, conf.ExecTimeout)
+		if err != nil {
+			return err
+		}
+
+		publishers = append(publishers, p)
+	}
+
+	return nil
+}
+
+// Handle runs a received message through the pipeline: the checks, the payload and its deliveries. The
+// error is the smtp reply of the message, nil accepts it
+func (s *Server) Handle(c *Context) error {
+	return s.handler(c)
+}
+
+// Serve starts the queue of -delivery-mode=async, the spool and the admin endpoints, binds every -listen address and
+// serves them until ctx is done. The messages being handled are then drained and the queued ones delivered,
+// within -shutdown-timeout
+func (s *Server) Serve(ctx context.Context) error {
+	if conf.QueuePath != "" && conf.DeliveryMode != deliveryModeAsync {
+		return errors.New("-queue-path requires -delivery-mode=async")
+	}
+
+	// the background tasks stop when Serve returns
+	done := make(chan struct{})
+	defer close(done)
+
+	if s.clientCert != nil {
+		go s.clientCert.watch(clientCertPollInterval, done)
+	}
+	if contentRules != nil {
+		go contentRules.reloadOnSIGHUP(done)
+	}
+	if recipientAliases != nil {
+		go recipientAliases.reloadOnSIGHUP(done)
+	}
+
+	if conf.DeliveryMode == deliveryModeAsync {
+		var db *queueDB
+		if conf.QueuePath != "" {
+			var err error
+			if db, err = openQueueDB(conf.QueuePath, conf.QueueMaxEntries, conf.QueueMaxAge); err != nil {
+				return err
+			}
+		}
+
+		if db != nil && deadLetters == nil {
+			deadLetters = &deadLetterBucket{db: db.db}
+		}
+
+		queue = newDeliveryQueue(conf.QueueSize, conf.Workers, db)
+	}
+
+	// after the dead letters, the files of the spool that can't be read are moved to them
+	if conf.SpoolDir != "" {
+		var err error
+		if spool, err = openSpool(conf.SpoolDir, conf.SpoolMaxAge); err != nil {
+			return err
+		}
+
+		go spool.run(spoolPollInterval)
+		defer spool.close()
+	}
+
+	if deadLetters != nil && conf.DeadLetterMaxAge > 0 {
+		go pruneDeadLetters(deadLetters, conf.DeadLetterMaxAge, deadLetterPruneInterval)
+	}
+
+	addrs := parseListenAddrs(conf.ListenAddrs)
+	errc := make(chan error, len(addrs)+2)
+
+	startAdminServers(conf.MetricsAddr, conf.HealthAddr, errc)
+
+	// the rate limit is per client ip whatever the listener
+	s.listener.limiter = newRateLimiter(s.listener.RateLimit)
+
+	// every address is bound before any of them is served, a single failure aborts the startup
+	servers := []*smtpServer{}
+	for _, addr := range addrs {
+		cfg := s.listener
+		cfg.ListenAddr = addr
+
+		srv := newSMTPServer(&cfg)
+		if err := srv.Listen(); err != nil {
+			for _, bound := range servers {
+				bound.listener.Close()
+			}
+			return err
+		}
+
+		servers = append(servers, srv)
+	}
+
+	for _, srv := range servers {
+		go func(srv *smtpServer) {
+			errc <- srv.Serve()
+		}(srv)
+	}
+
+	select {
+	case err := <-errc:
+		return fmt.Errorf("smtp server stopped: %s", err.Error())
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down", "timeout", conf.ShutdownTimeout.String())
+
+	drained, err := shutdownServers(servers, conf.ShutdownTimeout)
+	if err != nil {
+		return fmt.Errorf("shutdown timed out with %d messages drained: %s", drained, err.Error())
+	}
+
+	if queue != nil {
+		slog.Info("delivering the queued messages", "queued", queue.depth())
+		if err := queue.close(conf.ShutdownTimeout); err != nil {
+			return fmt.Errorf("shutdown timed out with %d messages queued: %s", queue.depth(), err.Error())
+		}
+	}
+
+	// the spool stops retrying before the outputs are closed
+	if spool != nil {
+		spool.close()
+	}
+
+	for _, err := range closePublishers() {
+		slog.Warn("cannot close the publisher", "error", err)
+	}
+
+	slog.Info("shutdown complete", "drained", drained)
+
+	return nil
+}
+
+// Run runs a subcommand (replay or deadletter) with the server configuration and returns its exit code. A
+// replayed message is delivered before it returns, the queue is never started
+func (s *Server) Run(args []string) int {
+	switch args[0] {
+	case replayCommand:
+		return runReplay(s.handler, args[1:])
+	case deadLetterCommand:
+		return runDeadLetterCommand(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q, expected replay, queue or deadletter\n", args[0])
+	return 2
+}
+
+// QueueCommand is the subcommand inspecting the deliveries of -queue-path, it only needs the queue file
+const QueueCommand = queueCommand
+
+// RunQueueCommand runs the queue subcommand on the queue file at path and returns its exit code
+func RunQueueCommand(path string, args []string) int {
+	return runQueueCommand(path, args)
+}
+
+// producer names the build in the payloads
+func producer() string {
+	return "smtp2http/" + conf.Version
+}
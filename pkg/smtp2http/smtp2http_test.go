@@ -0,0 +1,134 @@
+package smtp2http
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewRejectsNegativeRetries(t *testing.T) {
+	saved := conf
+	t.Cleanup(func() { conf = saved })
+
+	for flag, set := range map[string]func(*Config){
+		"-webhook-retries":     func(c *Config) { c.WebhookRetries = -1 },
+		"-webhook-retry-delay": func(c *Config) { c.WebhookRetryDelay = -time.Second },
+	} {
+		cfg := DefaultConfig()
+		set(&cfg)
+
+		_, err := New(cfg)
+		if err == nil || !strings.Contains(err.Error(), flag+" can't be negative") {
+			t.Errorf("%s: New returned %v, want it refused", flag, err)
+		}
+	}
+}
+
+// restoreGlobals restores the package state New sets up when the test ends
+func restoreGlobals(t *testing.T) {
+	t.Helper()
+
+	savedConf, savedWebhook, savedCallback, savedHeaders, savedTokens, savedSigner := conf, webhookClient, callbackClient, webhookHeaders, webhookTokens, awsSigner
+	savedURLs, savedRoutes, savedSlots, savedBreakers := webhookURLs, webhookRoutes, webhookSlots, breakers
+	savedTemplate, savedFields, savedPublishers, savedReject := bodyTemplate, payloadFields, publishers, rejectHook
+	savedDedupe, savedDeadLetters, savedStore, savedMaildir := dedupe, deadLetters, attachmentStore, maildir
+	savedRules, savedAliases, savedTypes, savedPGP, savedSMIME := contentRules, recipientAliases, attachmentTypes, pgpKeyring, smimeRoots
+	savedQueue, savedSpool := queue, spool
+
+	t.Cleanup(func() {
+		conf, webhookClient, callbackClient, webhookHeaders, webhookTokens, awsSigner = savedConf, savedWebhook, savedCallback, savedHeaders, savedTokens, savedSigner
+		webhookURLs, webhookRoutes, webhookSlots, breakers = savedURLs, savedRoutes, savedSlots, savedBreakers
+		bodyTemplate, payloadFields, publishers, rejectHook = savedTemplate, savedFields, savedPublishers, savedReject
+		dedupe, deadLetters, attachmentStore, maildir = savedDedupe, savedDeadLetters, savedStore, savedMaildir
+		contentRules, recipientAliases, attachmentTypes, pgpKeyring, smimeRoots = savedRules, savedAliases, savedTypes, savedPGP, savedSMIME
+		queue, spool = savedQueue, savedSpool
+	})
+}
+
+// newTestServer runs New with cfg and serves its handler on a free local port until the test ends, it returns
+// the address of the listener
+func newTestServer(t *testing.T, cfg Config) string {
+	t.Helper()
+
+	restoreGlobals(t)
+	srv, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closePublishers() })
+
+	listener := srv.listener
+
+	return startSMTP(t, &listener)
+}
+
+func TestNewReplacesThePreviousState(t *testing.T) {
+	restoreGlobals(t)
+	t.Cleanup(func() { closePublishers() })
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	dir := t.TempDir()
+	filterFile, aliasFile := filepath.Join(dir, "filter.yaml"), filepath.Join(dir, "aliases")
+	if err := ioutil.WriteFile(filterFile, []byte("- name: spam\n  target: subject\n  pattern: viagra\n  action: reject\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(aliasFile, []byte("sales@example.com = bob@example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, configure := range []func(*Config){
+		func(c *Config) {
+			c.WebhookAuth = webhookAuthSigV4
+			c.WebhookConcurrency = 2
+			c.BreakerThreshold = 3
+			c.Fields = "subject"
+			c.FilterFile, c.AliasFile = filterFile, aliasFile
+			c.RejectWebhook = "http://127.0.0.1:1/reject"
+			c.DedupeWindow = time.Minute
+			c.Maildir = filepath.Join(dir, "maildir")
+			c.DeadLetterDir = filepath.Join(dir, "deadletters")
+			c.AttachmentStoreDir = filepath.Join(dir, "store")
+		},
+		func(c *Config) {
+			c.OAuth2TokenURL, c.OAuth2ClientID = "http://127.0.0.1:1/token", "smtp2http"
+			c.WebhookBodyTemplate = filepath.Join("testdata", "legacy-form.tmpl")
+			c.Routes = []string{"example.com=http://127.0.0.1:1/example"}
+		},
+	} {
+		cfg := DefaultConfig()
+		configure(&cfg)
+		if _, err := New(cfg); err != nil {
+			t.Fatal(err)
+		}
+
+		// every option off
+		if _, err := New(DefaultConfig()); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, left := range map[string]bool{
+			"-webhook-auth":          awsSigner != nil,
+			"-webhook-concurrency":   webhookSlots != nil,
+			"-breaker-threshold":     breakers != nil,
+			"-fields":                payloadFields != nil,
+			"-filter-file":           contentRules != nil,
+			"-alias-file":            recipientAliases != nil,
+			"-reject-webhook":        rejectHook != nil,
+			"-dedupe-window":         dedupe != nil,
+			"-maildir":               maildir != nil,
+			"-dead-letter-dir":       deadLetters != nil,
+			"-attachment-store-dir":  attachmentStore != nil,
+			"-oauth2-token-url":      webhookTokens != nil,
+			"-webhook-body-template": bodyTemplate != nil,
+			"-route":                 len(webhookRoutes) > 0,
+		} {
+			if left {
+				t.Errorf("%s: the state of the previous New is left", name)
+			}
+		}
+	}
+}
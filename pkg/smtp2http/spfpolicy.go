@@ -0,0 +1,57 @@
+package smtp2http
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+	"github.com/zaccone/spf"
+)
+
+// spfPolicy is the action taken on the spf result, configured via -spf-policy
+type spfPolicy string
+
+const (
+	// spfPolicyNone skips the spf check
+	spfPolicyNone spfPolicy = "none"
+
+	// spfPolicyMark forwards the spf result in the payload
+	spfPolicyMark spfPolicy = "mark"
+
+	// spfPolicySoftfailReject refuses the messages failing or softfailing the check
+	spfPolicySoftfailReject spfPolicy = "softfail-reject"
+
+	// spfPolicyFailReject refuses the messages failing the check
+	spfPolicyFailReject spfPolicy = "fail-reject"
+)
+
+// parseSPFPolicy validates the -spf-policy value
+func parseSPFPolicy(s string) (spfPolicy, error) {
+	switch p := spfPolicy(s); p {
+	case spfPolicyNone, spfPolicyMark, spfPolicySoftfailReject, spfPolicyFailReject:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("invalid spf policy %q, expected none, mark, softfail-reject or fail-reject", s)
+}
+
+// rejects reports whether a message with the given spf result must be refused,
+// a temperror/permerror never is as it says nothing about the sender
+func (p spfPolicy) rejects(result spf.Result) bool {
+	switch p {
+	case spfPolicyFailReject:
+		return result == spf.Fail
+	case spfPolicySoftfailReject:
+		return result == spf.Fail || result == spf.Softfail
+	}
+
+	return false
+}
+
+// spfError is the reply sent when the spf policy refuses a message
+func spfError(domain string, result spf.Result) error {
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+		Message:      fmt.Sprintf("SPF check %s for %s, the client is not allowed to send mail for this domain", result, domain),
+	}
+}
@@ -0,0 +1,144 @@
+package smtp2http
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zaccone/spf"
+)
+
+// stubSPF makes the spf checks return result and explanation until the test ends
+func stubSPF(t *testing.T, result spf.Result, explanation string, err error) {
+	t.Helper()
+
+	saved := checkSPF
+	t.Cleanup(func() { checkSPF = saved })
+	checkSPF = func(net.IP, string, string) (spf.Result, string, error) {
+		return result, explanation, err
+	}
+}
+
+// payloadWebhook sends the payloads it receives on the returned channel
+func payloadWebhook(t *testing.T) (*httptest.Server, chan *EmailMessage) {
+	t.Helper()
+
+	payloads := make(chan *EmailMessage, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		payload := &EmailMessage{}
+		if err := json.Unmarshal(body, payload); err != nil {
+			t.Errorf("payload %s: %v", body, err)
+		}
+		payloads <- payload
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, payloads
+}
+
+// spfTestServer serves New with -spf-policy policy and the webhook of payloads
+func spfTestServer(t *testing.T, policy string) (string, chan *EmailMessage) {
+	t.Helper()
+
+	webhook, payloads := payloadWebhook(t)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.SPFPolicy = policy
+
+	return newTestServer(t, cfg), payloads
+}
+
+func TestSPFPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy string
+		result spf.Result
+		reject bool
+	}{
+		{"fail-reject", spf.Fail, true},
+		{"fail-reject", spf.Softfail, false},
+		{"fail-reject", spf.Pass, false},
+		{"softfail-reject", spf.Fail, true},
+		{"softfail-reject", spf.Softfail, true},
+		{"softfail-reject", spf.Neutral, false},
+		{"mark", spf.Fail, false},
+		{"none", spf.Fail, false},
+	} {
+		if got := spfPolicy(c.policy).rejects(c.result); got != c.reject {
+			t.Errorf("%s %s: rejects = %v, want %v", c.policy, c.result, got, c.reject)
+		}
+	}
+}
+
+func TestSPFPolicyInconclusiveNeverRejects(t *testing.T) {
+	for _, policy := range []spfPolicy{spfPolicyFailReject, spfPolicySoftfailReject} {
+		for _, result := range []spf.Result{spf.Temperror, spf.Permerror} {
+			if policy.rejects(result) {
+				t.Errorf("%s: %s rejected", policy, result)
+			}
+		}
+	}
+}
+
+func TestParseSPFPolicy(t *testing.T) {
+	for _, s := range []string{"none", "mark", "softfail-reject", "fail-reject"} {
+		if p, err := parseSPFPolicy(s); err != nil || string(p) != s {
+			t.Errorf("%s: got %q, %v", s, p, err)
+		}
+	}
+
+	if _, err := parseSPFPolicy("reject"); err == nil {
+		t.Error("reject: parsed")
+	}
+}
+
+func TestSPFFailRejected(t *testing.T) {
+	stubSPF(t, spf.Fail, "not allowed", nil)
+	addr, payloads := spfTestServer(t, "fail-reject")
+
+	err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(testMail))
+	if replyCode(err) != 550 || !strings.Contains(err.Error(), "SPF check fail for example.com") {
+		t.Errorf("SendMail: %v, want a 550 explaining the spf failure", err)
+	}
+
+	select {
+	case p := <-payloads:
+		t.Errorf("webhook called with %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSPFInconclusiveDelivered(t *testing.T) {
+	stubSPF(t, spf.Temperror, "", errors.New("dns timeout"))
+	addr, payloads := spfTestServer(t, "fail-reject")
+
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(testMail)); err != nil {
+		t.Fatalf("SendMail: %v, want the message accepted", err)
+	}
+	if p := <-payloads; p.SPFResult != "temperror" {
+		t.Errorf("spf = %q, want temperror", p.SPFResult)
+	}
+}
+
+func TestSPFMark(t *testing.T) {
+	stubSPF(t, spf.Softfail, "see https://example.com/spf", nil)
+	addr, payloads := spfTestServer(t, "mark")
+
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(testMail)); err != nil {
+		t.Fatal(err)
+	}
+
+	p := <-payloads
+	if p.SPFResult != "softfail" || p.SPFDomain != "example.com" || p.SPFExplanation != "see https://example.com/spf" {
+		t.Errorf("spf = %q, %q, %q, want the stubbed result, the domain checked and the explanation", p.SPFResult, p.SPFDomain, p.SPFExplanation)
+	}
+}
@@ -0,0 +1,211 @@
+package smtp2http
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// spillPrefix prefixes the temp files of the messages over -max-memory-per-message, the ones a crash left
+// behind are removed at startup
+const spillPrefix = "smtp2http-spill-"
+
+// spillFiles are the temp files of a message over -max-memory-per-message: the encoded files taken out of its
+// payload, replaced by a placeholder until the body is assembled, and the request bodies themselves
+type spillFiles struct {
+	dir       string
+	maxMemory int64
+
+	// memory is what the bodies and the files kept in memory add up to, over is set once one didn't fit
+	memory int64
+	over   bool
+
+	// token marks the placeholders of the message, placeholders[i] is the file of the i-th one
+	token        string
+	placeholders []string
+	names        []string
+}
+
+// newSpillFiles returns the temp files of a message, nil when it stays in memory whatever its size: the spill
+// is disabled or the payload is transformed or published as a whole
+func newSpillFiles() *spillFiles {
+	if conf.MaxMessageMemory <= 0 || !spillSupported() {
+		return nil
+	}
+
+	token := make([]byte, 8)
+	rand.Read(token)
+
+	return &spillFiles{dir: conf.TmpDir, maxMemory: conf.MaxMessageMemory, token: hex.EncodeToString(token)}
+}
+
+// spillSupported reports whether the bodies can be streamed from the temp files, only the json and multipart
+// payloads posted as they are can. The templates, the notifications and the outputs read the payload in memory
+func spillSupported() bool {
+	return !conf.RawOnly && conf.PayloadFormat == payloadFormatDefault && payloadFields == nil && bodyTemplate == nil && conf.NotifyFormat == "" && len(publishers) == 0
+}
+
+// keep reports whether n more bytes fit in memory, they are then counted
+func (s *spillFiles) keep(n int64) bool {
+	if s == nil {
+		return true
+	}
+
+	if s.memory+n > s.maxMemory {
+		s.over = true
+		return false
+	}
+	s.memory += n
+
+	return true
+}
+
+// create creates a temp file, removed along with the others by remove
+func (s *spillFiles) create() (*os.File, error) {
+	f, err := os.CreateTemp(s.dir, spillPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	s.names = append(s.names, f.Name())
+
+	return f, nil
+}
+
+// encode writes the base64 encoded content of r to a temp file, it returns the placeholder standing for it
+// in the payload
+func (s *spillFiles) encode(r io.Reader) (string, error) {
+	f, err := s.create()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	enc := base64.NewEncoder(base64.StdEncoding, f)
+	if _, err := io.Copy(enc, r); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+
+	s.placeholders = append(s.placeholders, f.Name())
+
+	return "\x00" + s.token + strconv.Itoa(len(s.placeholders)-1), nil
+}
+
+// assemble writes the marshaled payload to a temp file, the encoded files in place of their placeholders. It
+// returns an empty name when the payload has none
+func (s *spillFiles) assemble(body []byte) (string, error) {
+	if s == nil || len(s.placeholders) == 0 {
+		return "", nil
+	}
+
+	f, err := s.create()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// a placeholder is marshaled as "\u0000<token><index>", the base64 data needs no escaping
+	marker := []byte(`"\u0000` + s.token)
+	for {
+		i := bytes.Index(body, marker)
+		if i < 0 {
+			break
+		}
+
+		end := bytes.IndexByte(body[i+len(marker):], '"')
+		if end < 0 {
+			return "", errors.New("invalid spill placeholder in the payload")
+		}
+		index, err := strconv.Atoi(string(body[i+len(marker) : i+len(marker)+end]))
+		if err != nil || index >= len(s.placeholders) {
+			return "", errors.New("invalid spill placeholder in the payload")
+		}
+
+		if _, err := f.Write(body[:i+1]); err != nil {
+			return "", err
+		}
+		if err := copyFile(f, s.placeholders[index]); err != nil {
+			return "", err
+		}
+		if _, err := f.Write([]byte(`"`)); err != nil {
+			return "", err
+		}
+
+		body = body[i+len(marker)+end+1:]
+	}
+
+	if _, err := f.Write(body); err != nil {
+		return "", err
+	}
+
+	return f.Name(), f.Close()
+}
+
+// multipart writes the multipart body to a temp file
+func (s *spillFiles) multipart(message []byte, parts []*filePart) (string, string, error) {
+	f, err := s.create()
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	contentType, err := writeMultipart(f, message, parts)
+	if err != nil {
+		return "", "", err
+	}
+
+	return f.Name(), contentType, f.Close()
+}
+
+// remove removes the temp files of the message
+func (s *spillFiles) remove() {
+	if s == nil {
+		return
+	}
+
+	for _, name := range s.names {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("cannot remove the temp file", "file", name, "error", err)
+		}
+	}
+	s.names, s.placeholders = nil, nil
+}
+
+// copyFile appends the content of the file name to w
+func copyFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// sweepSpillFiles removes the temp files left behind in dir by a previous process
+func sweepSpillFiles(dir string) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, spillPrefix+"*"))
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		if err := os.Remove(name); err == nil {
+			slog.Info("stale temp file removed", "file", name)
+		}
+	}
+}
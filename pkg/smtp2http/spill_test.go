@@ -0,0 +1,333 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// spillRequest is what the webhook of the spill tests received
+type spillRequest struct {
+	body       []byte
+	length     int64
+	spillFiles int
+}
+
+// spillWebhook records the requests along with the spill files of dir while they are sent
+func spillWebhook(t *testing.T, dir string) (*httptest.Server, chan spillRequest) {
+	t.Helper()
+
+	requests := make(chan spillRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		files, _ := ioutil.ReadDir(dir)
+		n := 0
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), spillPrefix) {
+				n++
+			}
+		}
+		requests <- spillRequest{body: body, length: r.ContentLength, spillFiles: n}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, requests
+}
+
+// wrapBase64 encodes data in lines of 76 characters
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n")
+
+	return b.String()
+}
+
+// sendAttachment sends a message with an attachment of data
+func sendAttachment(t *testing.T, addr string, data []byte) {
+	t.Helper()
+
+	msg := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: report\r\nMessage-ID: <spill@example.com>\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=report.bin\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		wrapBase64(data) + "--b--\r\n"
+
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpillStreamsTheLargePayloads(t *testing.T) {
+	dir := t.TempDir()
+	webhook, requests := spillWebhook(t, dir)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.MaxMessageMemory = 1024
+	cfg.TmpDir = dir
+	addr := newTestServer(t, cfg)
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	sendAttachment(t, addr, data)
+
+	r := <-requests
+	if r.spillFiles == 0 {
+		t.Error("no spill file while the payload was sent")
+	}
+	if r.length != int64(len(r.body)) {
+		t.Errorf("Content-Length = %d, want the %d bytes of the body", r.length, len(r.body))
+	}
+
+	payload := &EmailMessage{}
+	if err := json.Unmarshal(r.body, payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Attachments) != 1 || payload.Attachments[0].Data != base64.StdEncoding.EncodeToString(data) {
+		t.Errorf("attachments = %+v, want the spilled attachment", payload.Attachments)
+	}
+
+	// removed once the message is handled
+	time.Sleep(100 * time.Millisecond)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d temp files left", len(files))
+	}
+}
+
+func TestSpillDisabledWithANotification(t *testing.T) {
+	dir := t.TempDir()
+	webhook, requests := spillWebhook(t, dir)
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{webhook.URL}
+	cfg.WebhookRetries = 0
+	cfg.MaxMessageMemory = 1024
+	cfg.TmpDir = dir
+	cfg.NotifyFormat = "slack"
+	addr := newTestServer(t, cfg)
+
+	if spillSupported() {
+		t.Error("spillSupported with -notify-format")
+	}
+
+	sendAttachment(t, addr, bytes.Repeat([]byte("0123456789"), 1000))
+
+	r := <-requests
+	if r.spillFiles != 0 {
+		t.Errorf("%d spill files with -notify-format, want the payload in memory", r.spillFiles)
+	}
+	if !json.Valid(r.body) || !strings.Contains(string(r.body), "report") {
+		t.Errorf("body = %s, want the slack notification", r.body)
+	}
+}
+
+func TestSpillSupported(t *testing.T) {
+	restoreGlobals(t)
+
+	conf = DefaultConfig()
+	conf.MaxMessageMemory = 1024
+	if !spillSupported() || newSpillFiles() == nil {
+		t.Fatal("no spill for the default payload")
+	}
+
+	for name, set := range map[string]func(){
+		"-raw-only":              func() { conf.RawOnly = true },
+		"-payload-format":        func() { conf.PayloadFormat = payloadFormatCloudEvents },
+		"-fields":                func() { payloadFields = fieldTree{} },
+		"-webhook-body-template": func() { bodyTemplate, _ = loadBodyTemplate("../../examples/slack.tmpl") },
+		"-notify-format":         func() { conf.NotifyFormat = "slack" },
+		"an output (-exec and more)": func() {
+			p, _ := newExecPublisher("true", time.Second)
+			publishers = []publisher{p}
+		},
+	} {
+		conf, payloadFields, bodyTemplate, publishers = DefaultConfig(), nil, nil, nil
+		conf.MaxMessageMemory = 1024
+		set()
+
+		if newSpillFiles() != nil {
+			t.Errorf("%s: the payload is spilled", name)
+		}
+	}
+
+	// nothing is spilled without -max-memory-per-message
+	conf, payloadFields, bodyTemplate, publishers = DefaultConfig(), nil, nil, nil
+	none := newSpillFiles()
+	if none != nil || !none.keep(1<<30) {
+		t.Error("a payload is spilled without -max-memory-per-message")
+	}
+}
+
+func TestSpillPayloadIdentical(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	payloads := map[bool]map[string]interface{}{}
+	for _, spilled := range []bool{false, true} {
+		dir := t.TempDir()
+		webhook, requests := spillWebhook(t, dir)
+
+		cfg := DefaultConfig()
+		cfg.Webhooks = []string{webhook.URL}
+		cfg.WebhookRetries = 0
+		cfg.TmpDir = dir
+		if spilled {
+			cfg.MaxMessageMemory = 1024
+		}
+		sendAttachment(t, newTestServer(t, cfg), data)
+
+		r := <-requests
+		if (r.spillFiles > 0) != spilled {
+			t.Fatalf("spilled %v: %d spill files while the payload was sent", spilled, r.spillFiles)
+		}
+
+		p := map[string]interface{}{}
+		if err := json.Unmarshal(r.body, &p); err != nil {
+			t.Fatal(err)
+		}
+
+		// the delivery and its connection differ from one message to the other
+		for _, k := range []string{"delivery_id", "date", "connection", "received_chain"} {
+			delete(p, k)
+		}
+		payloads[spilled] = p
+	}
+
+	for k, v := range payloads[false] {
+		if !reflect.DeepEqual(v, payloads[true][k]) {
+			t.Errorf("%s = %v spilled, want %v", k, payloads[true][k], v)
+		}
+	}
+	if len(payloads[false]) != len(payloads[true]) {
+		t.Errorf("%d fields spilled, want %d", len(payloads[true]), len(payloads[false]))
+	}
+}
+
+func TestSpillRemovedOnFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadRequest} {
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}))
+		defer webhook.Close()
+
+		cfg := DefaultConfig()
+		cfg.Webhooks = []string{webhook.URL}
+		cfg.WebhookRetries = 0
+		cfg.MaxMessageMemory = 1024
+		cfg.TmpDir = dir
+		addr := newTestServer(t, cfg)
+
+		msg := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: report\r\nMessage-ID: <spill@example.com>\r\n" +
+			"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=report.bin\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			wrapBase64(bytes.Repeat([]byte("0123456789"), 1000)) + "--b--\r\n"
+		if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"bob@example.com"}, []byte(msg)); err == nil {
+			t.Fatalf("%d: the message was accepted", status)
+		}
+
+		if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+			t.Errorf("%d: %d temp files left", status, len(files))
+		}
+	}
+}
+
+// panicTransport panics when a request is sent, after counting the spill files of dir
+type panicTransport struct {
+	dir        string
+	spillFiles chan int
+}
+
+func (p *panicTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	files, _ := ioutil.ReadDir(p.dir)
+	p.spillFiles <- len(files)
+	panic("webhook transport")
+}
+
+func TestSpillRemovedOnPanic(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{"http://webhook.test"}
+	cfg.WebhookRetries = 0
+	cfg.MaxMessageMemory = 1024
+	cfg.TmpDir = dir
+	addr := newTestServer(t, cfg)
+
+	transport := &panicTransport{dir: dir, spillFiles: make(chan int, 1)}
+	webhookClient.SetTransport(transport)
+
+	// the panic fails the delivery, the message is deferred
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: report\r\nMessage-ID: <spill@example.com>\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=report.bin\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+		wrapBase64(bytes.Repeat([]byte("0123456789"), 1000)) + "--b--\r\n"
+	w.Write([]byte(msg))
+	if err := w.Close(); replyCode(err) != 451 {
+		t.Errorf("DATA with a panicking delivery: %v, want a 451", err)
+	}
+
+	if n := <-transport.spillFiles; n == 0 {
+		t.Error("no spill file while the payload was sent")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d temp files left after the panic", len(files))
+	}
+}
+
+func TestSweepSpillFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{spillPrefix + "1234", spillPrefix + "5678", "other.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("stale"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// New sweeps -tmp-dir at startup
+	cfg := DefaultConfig()
+	cfg.Webhooks = []string{"http://webhook.test"}
+	cfg.MaxMessageMemory = 1024
+	cfg.TmpDir = dir
+	newTestServer(t, cfg)
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != "other.txt" {
+		names := []string{}
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("files left %v, want only other.txt", names)
+	}
+}
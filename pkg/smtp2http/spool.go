@@ -0,0 +1,387 @@
+package smtp2http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// spoolRetryDelay is the delay before the first retry of a spooled message, doubled on each retry
+	spoolRetryDelay = 10 * time.Second
+
+	// spoolMaxRetryDelay caps the delay between the retries of a spooled message
+	spoolMaxRetryDelay = 10 * time.Minute
+
+	// spoolPollInterval is how often the spool looks for the files due for a retry
+	spoolPollInterval = time.Second
+)
+
+// spool is the disk spool configured via -spool-dir, nil when disabled
+var spool *diskSpool
+
+// spoolEntry is the content of a spooled file
+type spoolEntry struct {
+	Created     time.Time         `json:"created"`
+	URL         string            `json:"url"`
+	ContentType string            `json:"content_type"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body"`
+	Raw         []byte            `json:"raw,omitempty"`
+}
+
+// spoolItem tracks a pending spooled file
+type spoolItem struct {
+	created  time.Time
+	next     time.Time
+	attempts int
+	history  []deliveryAttempt
+}
+
+// diskSpool persists the webhook requests that couldn't be delivered and retries them in the background
+// until they are accepted or older than maxAge, at which point they are moved to the dead letters
+type diskSpool struct {
+	dir    string
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*spoolItem
+
+	// stop is closed by close, stopped once run returned
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// openSpool creates the spool directory and re-queues the files left by a previous run
+func openSpool(dir string, maxAge time.Duration) (*diskSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &diskSpool{dir: dir, maxAge: maxAge, pending: map[string]*spoolItem{}, stop: make(chan struct{}), stopped: make(chan struct{})}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		switch {
+		case f.IsDir():
+			continue
+		case strings.HasSuffix(f.Name(), ".tmp"):
+			// an interrupted write, the smtp client was never told the message was accepted
+			os.Remove(filepath.Join(dir, f.Name()))
+		case strings.HasSuffix(f.Name(), ".json"):
+			entry, err := s.load(f.Name())
+			if err != nil {
+				slog.Error("cannot read spooled file, moving it to the dead letters", "spool_file", f.Name(), "error", err)
+				s.buryUnreadable(slog.With("spool_file", f.Name()), f.Name(), err)
+				continue
+			}
+			s.pending[f.Name()] = &spoolItem{created: entry.Created}
+		}
+	}
+
+	slog.Info("spool opened", "dir", dir, "pending", len(s.pending))
+
+	return s, nil
+}
+
+// put persists the request, raw is the original message kept alongside the payload. The first retry waits for
+// retryAfter when the webhook asked for longer than spoolRetryDelay
+func (s *diskSpool) put(r *webhookRequest, raw []byte, retryAfter time.Duration) (string, error) {
+	body, err := r.bodyBytes()
+	if err != nil {
+		return "", err
+	}
+
+	entry := &spoolEntry{
+		Created:     time.Now(),
+		URL:         r.URL,
+		ContentType: r.ContentType,
+		Headers:     r.Headers,
+		Body:        body,
+		Raw:         raw,
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := strconv.FormatInt(entry.Created.UnixNano(), 10) + "-" + hex.EncodeToString(suffix) + ".json"
+
+	// write then rename so the worker never picks up a partial file
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	s.mu.Lock()
+	delay := spoolRetryDelay
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	s.pending[name] = &spoolItem{created: entry.Created, next: entry.Created.Add(delay)}
+	s.mu.Unlock()
+
+	return name, nil
+}
+
+// run retries the due spooled files every interval until the spool is closed
+func (s *diskSpool) run(interval time.Duration) {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		for _, name := range s.due(time.Now()) {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+
+			s.retry(name)
+		}
+	}
+}
+
+// close stops run once the retry in progress is over, the files left are retried by the next run
+func (s *diskSpool) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.stopped
+}
+
+// due returns the files whose next attempt is due
+func (s *diskSpool) due(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ret := []string{}
+	for name, item := range s.pending {
+		if !item.next.After(now) {
+			ret = append(ret, name)
+		}
+	}
+
+	return ret
+}
+
+// retry posts a spooled file once, it is removed on success and moved to the
+// dead letters when the webhook refuses it or it is too old
+func (s *diskSpool) retry(name string) {
+	logger := slog.With("spool_file", name)
+
+	entry, err := s.load(name)
+	if err != nil {
+		logger.Error("cannot read spooled file, moving it to the dead letters", "error", err)
+		s.buryUnreadable(logger, name, err)
+		return
+	}
+
+	logger = logger.With("webhook", entry.URL, "delivery_id", entry.Headers[deliveryIDHeader])
+	req := &webhookRequest{URL: entry.URL, Body: entry.Body, ContentType: entry.ContentType, Headers: entry.Headers}
+
+	// a single attempt, the spool does its own backoff
+	start := time.Now()
+	resp, err := postWebhook(context.Background(), logger, req, start)
+	s.record(name, start, resp, err)
+	switch {
+	case err == nil && isSuccess(resp.StatusCode()):
+		logger.Info("spooled message delivered", "webhook_status", resp.StatusCode(), "age", time.Since(entry.Created).String())
+		os.Remove(filepath.Join(s.dir, name))
+		s.forget(name)
+		return
+	case err == nil && isPermanentFailure(resp.StatusCode()):
+		logger.Warn("spooled message rejected by the webhook, moving it to the dead letters", "webhook_status", resp.StatusCode())
+		ev := &rejectEvent{Reason: "spool_rejected", DeliveryID: entry.Headers[deliveryIDHeader], Webhook: entry.URL, WebhookStatus: resp.StatusCode()}
+		if letter := s.bury(logger, name, entry, deadLetterRefused); letter != "" {
+			ev.DeadLetters = []string{letter}
+		}
+		rejectHook.notify(ev)
+		return
+	case time.Since(entry.Created) > s.maxAge:
+		logger.Warn("spooled message expired, moving it to the dead letters", "age", time.Since(entry.Created).String())
+		ev := &rejectEvent{Reason: "spool_expired", DeliveryID: entry.Headers[deliveryIDHeader], Webhook: entry.URL}
+		if resp != nil {
+			ev.WebhookStatus = resp.StatusCode()
+		}
+		if letter := s.bury(logger, name, entry, deadLetterExpired); letter != "" {
+			ev.DeadLetters = []string{letter}
+		}
+		rejectHook.notify(ev)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item := s.pending[name]
+	item.attempts++
+	delay := spoolRetryDelay << uint(item.attempts)
+	if delay > spoolMaxRetryDelay || delay <= 0 {
+		delay = spoolMaxRetryDelay
+	}
+	// a rate limited webhook may ask for longer than the backoff
+	if err == nil {
+		if retryAfter, limited := rateLimited(resp, time.Now()); limited && retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+	item.next = time.Now().Add(delay)
+}
+
+func (s *diskSpool) load(name string) (*spoolEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &spoolEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// record adds the attempt made at t to the history of the file, the one its dead letter keeps
+func (s *diskSpool) record(name string, t time.Time, resp *resty.Response, err error) {
+	a := deliveryAttempt{Time: t}
+	if resp != nil {
+		a.WebhookStatus = resp.StatusCode()
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, ok := s.pending[name]; ok {
+		item.history = append(item.history, a)
+	}
+}
+
+// bury moves a file given up on to the dead letters, like the deliveries of the queue, and removes it from the
+// spool. It returns the id of the letter, empty when the dead letters are disabled and the message is dropped
+func (s *diskSpool) bury(logger *slog.Logger, name string, entry *spoolEntry, reason string) string {
+	s.mu.Lock()
+	var history []deliveryAttempt
+	if item, ok := s.pending[name]; ok {
+		history = item.history
+	}
+	s.mu.Unlock()
+
+	queued := &queueEntry{
+		Created:     entry.Created,
+		Next:        entry.Created,
+		Attempts:    len(history),
+		History:     history,
+		URL:         entry.URL,
+		ContentType: entry.ContentType,
+		Headers:     entry.Headers,
+		Body:        entry.Body,
+		Raw:         entry.Raw,
+	}
+	if len(history) > 0 {
+		queued.LastError = history[len(history)-1].Error
+	}
+
+	letter := buryEntry(logger, queued, reason)
+	if letter == "" {
+		logger.Warn("spooled message dropped, no dead letter keeps it")
+	}
+
+	os.Remove(filepath.Join(s.dir, name))
+	s.forget(name)
+
+	return letter
+}
+
+// buryUnreadable moves a file that can't be parsed to the dead letters, its content as the body
+func (s *diskSpool) buryUnreadable(logger *slog.Logger, name string, readErr error) {
+	data, _ := ioutil.ReadFile(filepath.Join(s.dir, name))
+	entry := &spoolEntry{Created: time.Now(), Body: data}
+
+	s.mu.Lock()
+	item, ok := s.pending[name]
+	if !ok {
+		item = &spoolItem{created: entry.Created}
+		s.pending[name] = item
+	}
+	item.history = append(item.history, deliveryAttempt{Time: entry.Created, Error: readErr.Error()})
+	s.mu.Unlock()
+
+	s.bury(logger, name, entry, deadLetterFailed)
+}
+
+func (s *diskSpool) forget(name string) {
+	s.mu.Lock()
+	delete(s.pending, name)
+	s.mu.Unlock()
+}
+
+// depth returns the number of pending spooled files
+func (s *diskSpool) depth() int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.pending)
+}
+
+// oldestAge returns the age of the oldest pending spooled file
+func (s *diskSpool) oldestAge() time.Duration {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldest time.Time
+	for _, item := range s.pending {
+		if oldest.IsZero() || item.created.Before(oldest) {
+			oldest = item.created
+		}
+	}
+
+	if oldest.IsZero() {
+		return 0
+	}
+
+	return time.Since(oldest)
+}
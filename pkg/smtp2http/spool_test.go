@@ -0,0 +1,204 @@
+package smtp2http
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupSpool opens a spool in a temp dir with the dead letters of -dead-letter-dir, restored when the test ends
+func setupSpool(t *testing.T) (*diskSpool, *deadLetterDir) {
+	t.Helper()
+
+	setupWebhookClients(t)
+	webhookTokens = nil
+
+	saved := deadLetters
+	t.Cleanup(func() { deadLetters = saved })
+
+	dead, err := openDeadLetterDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters = dead
+
+	s, err := openSpool(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, dead
+}
+
+func TestSpoolRefusedMovesToTheDeadLetters(t *testing.T) {
+	s, dead := setupSpool(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	name, err := s.put(&webhookRequest{URL: srv.URL, ContentType: "application/json", Body: []byte(`{"id":"1"}`)}, []byte("raw message"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.retry(name)
+
+	if _, err := os.Stat(filepath.Join(s.dir, name)); !os.IsNotExist(err) {
+		t.Errorf("the spooled file is still there: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, "dead")); !os.IsNotExist(err) {
+		t.Errorf("the spool has a dead directory: %v", err)
+	}
+	if s.depth() != 0 {
+		t.Errorf("depth = %d, want 0", s.depth())
+	}
+
+	letters, err := dead.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("%d dead letters, want 1", len(letters))
+	}
+
+	l, err := dead.get(letters[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Reason != deadLetterRefused || l.Delivery.URL != srv.URL || string(l.Delivery.Body) != `{"id":"1"}` || string(l.Delivery.Raw) != "raw message" {
+		t.Errorf("letter = %+v, want the refused spooled request", l)
+	}
+	if len(l.Delivery.History) != 1 || l.Delivery.History[0].WebhookStatus != http.StatusBadRequest {
+		t.Errorf("history = %+v, want the refused attempt", l.Delivery.History)
+	}
+}
+
+func TestSpoolUnreadableMovesToTheDeadLetters(t *testing.T) {
+	_, dead := setupSpool(t)
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "1-abcd.json"), []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSpool(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.depth() != 0 {
+		t.Errorf("depth = %d, want 0", s.depth())
+	}
+
+	letters, err := dead.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Reason != deadLetterFailed {
+		t.Fatalf("letters = %+v, want the unreadable file", letters)
+	}
+
+	l, err := dead.get(letters[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(l.Delivery.Body) != "not json" || l.Delivery.LastError == "" {
+		t.Errorf("letter = %+v, want the content and the error of the file", l.Delivery)
+	}
+}
+
+func TestSpoolClose(t *testing.T) {
+	s, _ := setupSpool(t)
+
+	posted := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		posted <- string(body)
+	}))
+	defer srv.Close()
+
+	// put schedules the first retry later, a due file is retried on the next poll
+	spoolDue := func(body string) {
+		name, err := s.put(&webhookRequest{URL: srv.URL, ContentType: "application/json", Body: []byte(body)}, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.mu.Lock()
+		s.pending[name].next = time.Now()
+		s.mu.Unlock()
+	}
+
+	go s.run(10 * time.Millisecond)
+
+	spoolDue(`{"id":"1"}`)
+	select {
+	case body := <-posted:
+		if body != `{"id":"1"}` {
+			t.Errorf("posted %s, want the spooled body", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the due file wasn't retried")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		s.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't return")
+	}
+	s.close()
+
+	spoolDue(`{"id":"2"}`)
+	select {
+	case body := <-posted:
+		t.Errorf("posted %s after close", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if s.depth() != 1 {
+		t.Errorf("depth = %d, want the file kept for the next run", s.depth())
+	}
+}
+
+func TestServeClosesTheSpool(t *testing.T) {
+	restoreGlobals(t)
+
+	cfg := DefaultConfig()
+	cfg.ListenAddrs = []string{"127.0.0.1:0"}
+	cfg.SpoolDir = t.TempDir()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- s.Serve(ctx) }()
+
+	// Serve binds the listeners and starts the spool before it looks at ctx
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+
+	select {
+	case <-spool.stopped:
+	default:
+		t.Error("the spool still runs after Serve returned")
+	}
+}
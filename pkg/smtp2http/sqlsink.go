@@ -0,0 +1,268 @@
+package smtp2http
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// sqlDialect holds what differs between the sqlite and the postgres schemas
+type sqlDialect struct {
+	driver string
+
+	// the column types substituted in the migrations
+	types *strings.Replacer
+}
+
+var (
+	sqliteDialect = &sqlDialect{
+		driver: "sqlite",
+		types:  strings.NewReplacer("{id}", "INTEGER PRIMARY KEY AUTOINCREMENT", "{ref}", "INTEGER", "{json}", "TEXT", "{blob}", "BLOB", "{time}", "TIMESTAMP"),
+	}
+	postgresDialect = &sqlDialect{
+		driver: "postgres",
+		types:  strings.NewReplacer("{id}", "BIGSERIAL PRIMARY KEY", "{ref}", "BIGINT", "{json}", "JSONB", "{blob}", "BYTEA", "{time}", "TIMESTAMPTZ"),
+	}
+)
+
+// sqlMigrations are the schema versions of -db-dsn, the n-th one upgrades the schema to the version n+1. A
+// released migration is never edited, a change is a new one appended
+var sqlMigrations = []string{
+	`CREATE TABLE messages (
+		id          {id},
+		delivery_id TEXT NOT NULL,
+		message_id  TEXT,
+		received_at {time} NOT NULL,
+		mail_from   TEXT,
+		rcpt_to     TEXT NOT NULL,
+		subject     TEXT,
+		text_body   TEXT,
+		html_body   TEXT,
+		spf         TEXT,
+		remote_ip   TEXT,
+		payload     {json} NOT NULL
+	);
+	CREATE INDEX messages_received_at ON messages (received_at);
+	CREATE INDEX messages_message_id ON messages (message_id);
+	CREATE TABLE attachments (
+		id           {id},
+		message      {ref} NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+		embedded     BOOLEAN NOT NULL,
+		cid          TEXT,
+		filename     TEXT,
+		content_type TEXT,
+		size         BIGINT,
+		sha256       TEXT,
+		content      {blob}
+	);
+	CREATE INDEX attachments_message ON attachments (message);`,
+}
+
+// sqlPublisher inserts the messages into the messages and attachments tables of a sqlite or postgres database,
+// each message in a transaction of its own
+type sqlPublisher struct {
+	db *sql.DB
+
+	insertMessage    *sql.Stmt
+	insertAttachment *sql.Stmt
+}
+
+// newSQLPublisher opens the database of dsn, a postgres:// url or a sqlite file path, with up to maxConns
+// connections and migrates its schema
+func newSQLPublisher(dsn string, maxConns int) (*sqlPublisher, error) {
+	if maxConns < 1 {
+		return nil, fmt.Errorf("-db-max-conns must be at least 1")
+	}
+
+	dialect, source := sqliteDialect, strings.TrimPrefix(dsn, "sqlite://")
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		dialect, source = postgresDialect, dsn
+	} else if !strings.Contains(source, "?") {
+		// the concurrent transactions wait for the writer instead of failing at once
+		source += "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_time_format=sqlite"
+	}
+
+	db, err := sql.Open(dialect.driver, source)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := migrateSQL(ctx, db, dialect); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot migrate the database schema: %s", err.Error())
+	}
+
+	p := &sqlPublisher{db: db}
+	p.insertMessage, err = db.PrepareContext(ctx, `INSERT INTO messages
+		(delivery_id, message_id, received_at, mail_from, rcpt_to, subject, text_body, html_body, spf, remote_ip, payload)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	p.insertAttachment, err = db.PrepareContext(ctx, `INSERT INTO attachments
+		(message, embedded, cid, filename, content_type, size, sha256, content)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// migrateSQL brings the schema to the last of sqlMigrations, the applied versions are recorded in the
+// schema_version table. Concurrent servers starting on a postgres database wait for each other
+func migrateSQL(ctx context.Context, db *sql.DB, dialect *sqlDialect) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if dialect == postgresDialect {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(7411215761)`); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL, applied_at `+dialect.types.Replace("{time}")+` NOT NULL)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("the schema version %d is newer than this smtp2http, which knows up to %d", version, len(sqlMigrations))
+	}
+
+	for v := version; v < len(sqlMigrations); v++ {
+		for _, stmt := range strings.Split(dialect.types.Replace(sqlMigrations[v]), ";") {
+			if strings.TrimSpace(stmt) == "" {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("version %d: %s", v+1, err.Error())
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_version (version, applied_at) VALUES ($1, $2)`, v+1, time.Now().UTC()); err != nil {
+			return err
+		}
+		slog.Info("database schema migrated", "version", v+1)
+	}
+
+	return tx.Commit()
+}
+
+func (p *sqlPublisher) Name() string {
+	return "sql"
+}
+
+// Publish inserts the message of the json payload, the content of its files goes to the attachments table and
+// is left out of the payload column
+func (p *sqlPublisher) Publish(ctx context.Context, pub *publication) error {
+	msg := &EmailMessage{}
+	if err := json.Unmarshal(pub.Body, msg); err != nil {
+		return fmt.Errorf("cannot read the payload: %s", err.Error())
+	}
+
+	type file struct {
+		embedded    bool
+		cid         string
+		filename    string
+		contentType string
+		EmailFile
+	}
+	files := []*file{}
+	for _, a := range msg.Attachments {
+		files = append(files, &file{filename: a.Filename, contentType: a.ContentType, EmailFile: a.EmailFile})
+		a.Data = ""
+	}
+	for _, e := range msg.EmbeddedFiles {
+		files = append(files, &file{embedded: true, cid: e.CID, filename: e.Filename, contentType: e.ContentType, EmailFile: e.EmailFile})
+		e.Data = ""
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	receivedAt, err := time.Parse(time.RFC3339, msg.ReceivedAt)
+	if err != nil {
+		receivedAt = time.Now()
+	}
+
+	var from string
+	if msg.Addresses.From != nil {
+		from = msg.Addresses.From.Address
+	}
+	to := []string{}
+	for _, addr := range msg.Addresses.To {
+		to = append(to, addr.Address)
+	}
+	var remoteIP string
+	if msg.Connection != nil {
+		remoteIP = msg.Connection.RemoteIP
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.StmtContext(ctx, p.insertMessage).QueryRowContext(ctx, msg.DeliveryID, nullString(msg.ID), receivedAt.UTC(), nullString(from),
+		strings.Join(to, ", "), nullString(msg.Subject), nullString(msg.Body.Text), nullString(msg.Body.HTML), nullString(msg.SPFResult),
+		nullString(remoteIP), string(payload)).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	insert := tx.StmtContext(ctx, p.insertAttachment)
+	for _, f := range files {
+		// only the inline attachments carry their content, the metadata and store modes leave it out
+		var content []byte
+		if f.Data != "" {
+			if content, err = base64.StdEncoding.DecodeString(f.Data); err != nil {
+				return fmt.Errorf("cannot decode the attachment %s: %s", f.filename, err.Error())
+			}
+			if f.Size == 0 {
+				f.Size = int64(len(content))
+			}
+		}
+
+		_, err := insert.ExecContext(ctx, id, f.embedded, nullString(f.cid), nullString(f.filename), nullString(f.contentType), f.Size,
+			nullString(f.SHA256), content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (p *sqlPublisher) Close() error {
+	return p.db.Close()
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
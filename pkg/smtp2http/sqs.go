@@ -0,0 +1,190 @@
+package smtp2http
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// awsMaxMessage is the size limit of an sqs or sns message, its attributes included
+const awsMaxMessage = 256 << 10
+
+// loadAWSConfig loads the standard aws credential chain (environment, shared config, instance or task role,
+// IRSA), region is the one of the queue or the topic, the one of the aws config when empty
+func loadAWSConfig(region string) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return cfg, fmt.Errorf("cannot load the aws config: %s", err.Error())
+	}
+
+	// the chain is only walked once credentials are asked for, one of its providers must have some. The queue
+	// or the topic and the permissions on it are only checked by the first send
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return cfg, fmt.Errorf("cannot get the aws credentials: %s", err.Error())
+	}
+
+	return cfg, nil
+}
+
+// awsAttributesSize returns the size the attributes count for towards awsMaxMessage
+func awsAttributesSize(attrs map[string]string) int {
+	size := 0
+	for name, value := range attrs {
+		size += len(name) + len("String") + len(value)
+	}
+
+	return size
+}
+
+// sqsPublisher sends the payloads to an sqs queue. A fifo queue groups the messages by recipient domain
+// and deduplicates them by delivery and recipient
+type sqsPublisher struct {
+	client   *sqs.Client
+	queueURL string
+	fifo     bool
+}
+
+func newSQSPublisher(queueURL string) (*sqsPublisher, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid -sqs-queue-url %q", queueURL)
+	}
+
+	// https://sqs.REGION.amazonaws.com/ACCOUNT/QUEUE
+	var region string
+	if labels := strings.Split(u.Hostname(), "."); len(labels) > 3 && labels[0] == "sqs" {
+		region = labels[1]
+	}
+
+	cfg, err := loadAWSConfig(region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqsPublisher{client: sqs.NewFromConfig(cfg), queueURL: queueURL, fifo: strings.HasSuffix(u.Path, ".fifo")}, nil
+}
+
+func (p *sqsPublisher) Name() string {
+	return "sqs"
+}
+
+// Publish returns once sqs stored the message, the payload is its body
+func (p *sqsPublisher) Publish(ctx context.Context, pub *publication) error {
+	attrs := publicationAttributes(pub)
+	body, err := fitPayload(p.Name(), pub, awsMaxMessage-awsAttributesSize(attrs))
+	if err != nil {
+		return err
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(p.queueURL),
+		MessageBody:       aws.String(string(body)),
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{},
+	}
+	for name, value := range attrs {
+		input.MessageAttributes[name] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	if p.fifo {
+		input.MessageGroupId = aws.String(fifoGroup(pub))
+		input.MessageDeduplicationId = aws.String(fifoDeduplicationID(pub))
+	}
+
+	_, err = p.client.SendMessage(ctx, input)
+	return err
+}
+
+func (p *sqsPublisher) Close() error {
+	return nil
+}
+
+// snsPublisher publishes the payloads to an sns topic. A fifo topic groups the messages by recipient domain
+// and deduplicates them by delivery and recipient
+type snsPublisher struct {
+	client   *sns.Client
+	topicARN string
+	fifo     bool
+}
+
+func newSNSPublisher(topicARN string) (*snsPublisher, error) {
+	// arn:PARTITION:sns:REGION:ACCOUNT:TOPIC
+	fields := strings.Split(topicARN, ":")
+	if len(fields) != 6 || fields[0] != "arn" || fields[2] != "sns" {
+		return nil, fmt.Errorf("invalid -sns-topic-arn %q", topicARN)
+	}
+
+	cfg, err := loadAWSConfig(fields[3])
+	if err != nil {
+		return nil, err
+	}
+
+	return &snsPublisher{client: sns.NewFromConfig(cfg), topicARN: topicARN, fifo: strings.HasSuffix(topicARN, ".fifo")}, nil
+}
+
+func (p *snsPublisher) Name() string {
+	return "sns"
+}
+
+// Publish returns once sns accepted the message, the payload is its body
+func (p *snsPublisher) Publish(ctx context.Context, pub *publication) error {
+	attrs := publicationAttributes(pub)
+	body, err := fitPayload(p.Name(), pub, awsMaxMessage-awsAttributesSize(attrs))
+	if err != nil {
+		return err
+	}
+
+	input := &sns.PublishInput{
+		TopicArn:          aws.String(p.topicARN),
+		Message:           aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{},
+	}
+	for name, value := range attrs {
+		input.MessageAttributes[name] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+	}
+	if p.fifo {
+		input.MessageGroupId = aws.String(fifoGroup(pub))
+		input.MessageDeduplicationId = aws.String(fifoDeduplicationID(pub))
+	}
+
+	_, err = p.client.Publish(ctx, input)
+	return err
+}
+
+func (p *snsPublisher) Close() error {
+	return nil
+}
+
+// fifoGroup returns the message group of a payload on a fifo queue or topic, the messages of a domain are
+// delivered in order
+func fifoGroup(pub *publication) string {
+	if domain := pub.Values["to_domain"]; domain != "" {
+		return domain
+	}
+
+	return "smtp2http"
+}
+
+// fifoDeduplicationID returns the deduplication id of a payload, the one of its delivery and recipient as the
+// groups of -route share the delivery id
+func fifoDeduplicationID(pub *publication) string {
+	sum := sha256.Sum256([]byte(pub.Headers[deliveryIDHeader] + "/" + strings.ToLower(pub.Recipient)))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,366 @@
+package smtp2http
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// awsRequest is a request the fake aws endpoint received
+type awsRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// awsEndpoint serves the aws api of service until the test ends, it answers status and body to the requests it
+// sends on the returned channel. The aws config of the test reads static credentials from the environment and
+// nothing of the shared config of the host
+func awsEndpoint(t *testing.T, service string, status int, body func(req []byte) string) chan awsRequest {
+	t.Helper()
+
+	requests := make(chan awsRequest, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		requests <- awsRequest{header: r.Header.Clone(), body: data}
+
+		w.WriteHeader(status)
+		w.Write([]byte(body(data)))
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":                            "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY":                        "secret",
+		"AWS_SESSION_TOKEN":                            "",
+		"AWS_PROFILE":                                  "",
+		"AWS_REGION":                                   "us-east-1",
+		"AWS_CONFIG_FILE":                              filepath.Join(dir, "config"),
+		"AWS_SHARED_CREDENTIALS_FILE":                  filepath.Join(dir, "credentials"),
+		"AWS_EC2_METADATA_DISABLED":                    "true",
+		"AWS_ENDPOINT_URL_" + strings.ToUpper(service): srv.URL,
+	} {
+		t.Setenv(name, value)
+	}
+
+	return requests
+}
+
+// receiveAWS returns the request the fake aws endpoint received
+func receiveAWS(t *testing.T, requests chan awsRequest) awsRequest {
+	t.Helper()
+
+	select {
+	case r := <-requests:
+		return r
+	default:
+		t.Fatal("no request received")
+	}
+
+	return awsRequest{}
+}
+
+// checkSignature checks the sigv4 signature of a request is the one of the static credentials in region
+func checkSignature(t *testing.T, req awsRequest, region, service string) {
+	t.Helper()
+
+	if got := req.header.Get("Authorization"); !strings.HasPrefix(got, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(got, "/"+region+"/"+service+"/") {
+		t.Errorf("Authorization = %q, want a sigv4 signature of %s in %s", got, service, region)
+	}
+}
+
+// sqsSendMessage answers a SendMessage request the way sqs does
+func sqsSendMessage(req []byte) string {
+	input := struct{ MessageBody string }{}
+	json.Unmarshal(req, &input)
+	sum := md5.Sum([]byte(input.MessageBody))
+
+	return `{"MessageId":"5fea7756-0ea4-451a-a703-a558b933e274","MD5OfMessageBody":"` + hex.EncodeToString(sum[:]) + `"}`
+}
+
+// sqsInput is the SendMessage request an sqs queue received
+type sqsInput struct {
+	QueueUrl          string
+	MessageBody       string
+	MessageAttributes map[string]struct {
+		DataType    string
+		StringValue string
+	}
+	MessageGroupId         string
+	MessageDeduplicationId string
+}
+
+func TestNewSQSPublisher(t *testing.T) {
+	awsEndpoint(t, "sqs", http.StatusOK, sqsSendMessage)
+
+	for _, queueURL := range []string{"", "orders", "https://", "://sqs.eu-west-1.amazonaws.com/123456789012/orders"} {
+		if _, err := newSQSPublisher(queueURL); err == nil {
+			t.Errorf("newSQSPublisher(%q) accepted", queueURL)
+		}
+	}
+
+	for _, c := range []struct {
+		queueURL string
+		region   string
+		fifo     bool
+	}{
+		{"https://sqs.eu-west-1.amazonaws.com/123456789012/orders", "eu-west-1", false},
+		{"https://sqs.ap-southeast-2.amazonaws.com/123456789012/orders.fifo", "ap-southeast-2", true},
+		// a local queue, the region of the aws config
+		{"http://localhost:4566/000000000000/orders", "us-east-1", false},
+	} {
+		p, err := newSQSPublisher(c.queueURL)
+		if err != nil {
+			t.Fatalf("%s: %v", c.queueURL, err)
+		}
+		if region := p.client.Options().Region; region != c.region || p.fifo != c.fifo {
+			t.Errorf("%s: region %s, fifo %t, want %s, %t", c.queueURL, region, p.fifo, c.region, c.fifo)
+		}
+	}
+}
+
+func TestSQSPublish(t *testing.T) {
+	for _, c := range []struct {
+		queueURL string
+		fifo     bool
+	}{
+		{"https://sqs.eu-west-1.amazonaws.com/123456789012/orders", false},
+		{"https://sqs.eu-west-1.amazonaws.com/123456789012/orders.fifo", true},
+	} {
+		requests := awsEndpoint(t, "sqs", http.StatusOK, sqsSendMessage)
+
+		p, err := newSQSPublisher(c.queueURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pub := testPublication()
+		pub.Values["to_domain"] = "example.com"
+		if err := p.Publish(context.Background(), pub); err != nil {
+			t.Fatalf("%s: %v", c.queueURL, err)
+		}
+
+		req := receiveAWS(t, requests)
+		checkSignature(t, req, "eu-west-1", "sqs")
+		if target := req.header.Get("X-Amz-Target"); target != "AmazonSQS.SendMessage" {
+			t.Errorf("%s: X-Amz-Target = %q, want AmazonSQS.SendMessage", c.queueURL, target)
+		}
+
+		input := sqsInput{}
+		if err := json.Unmarshal(req.body, &input); err != nil {
+			t.Fatalf("%s: request %s: %v", c.queueURL, req.body, err)
+		}
+		if input.QueueUrl != c.queueURL || input.MessageBody != string(pub.Body) {
+			t.Errorf("%s: sent %s to %s, want the payload", c.queueURL, input.MessageBody, input.QueueUrl)
+		}
+		want := map[string]string{"to_domain": "example.com", "spf_result": "pass", "delivery_id": "delivery-1"}
+		if len(input.MessageAttributes) != len(want) {
+			t.Errorf("%s: attributes = %+v, want %v", c.queueURL, input.MessageAttributes, want)
+		}
+		for name, value := range want {
+			if got := input.MessageAttributes[name]; got.DataType != "String" || got.StringValue != value {
+				t.Errorf("%s: attribute %s = %+v, want the string %q", c.queueURL, name, got, value)
+			}
+		}
+
+		if !c.fifo && (input.MessageGroupId != "" || input.MessageDeduplicationId != "") {
+			t.Errorf("%s: group %q, deduplication id %q, want none on a standard queue", c.queueURL, input.MessageGroupId, input.MessageDeduplicationId)
+		}
+		if c.fifo && (input.MessageGroupId != "example.com" || input.MessageDeduplicationId != fifoDeduplicationID(pub)) {
+			t.Errorf("%s: group %q, deduplication id %q, want the recipient domain and the one of the delivery", c.queueURL, input.MessageGroupId, input.MessageDeduplicationId)
+		}
+	}
+}
+
+func TestSQSPublishOversized(t *testing.T) {
+	restoreGlobals(t)
+	conf = DefaultConfig()
+
+	requests := awsEndpoint(t, "sqs", http.StatusOK, sqsSendMessage)
+
+	p, err := newSQSPublisher("https://sqs.eu-west-1.amazonaws.com/123456789012/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// over the limit once the attributes are counted
+	pub := testPublication()
+	attrs := awsAttributesSize(publicationAttributes(pub))
+	payload := func(data []byte) []byte {
+		body, err := json.Marshal(&EmailMessage{Attachments: []*EmailAttachment{{Filename: "a.txt", EmailFile: EmailFile{Data: base64.StdEncoding.EncodeToString(data)}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+	data := make([]byte, (awsMaxMessage-attrs-len(payload(nil)))/4*3+3)
+	if size := len(payload(data)); size <= awsMaxMessage-attrs || size > awsMaxMessage {
+		t.Fatalf("the payload of %d bytes doesn't test the attributes", size)
+	}
+	pub.Body = payload(data)
+
+	if err := p.Publish(context.Background(), pub); err != nil {
+		t.Fatal(err)
+	}
+
+	input := sqsInput{}
+	if err := json.Unmarshal(receiveAWS(t, requests).body, &input); err != nil {
+		t.Fatal(err)
+	}
+	msg := &EmailMessage{}
+	if err := json.Unmarshal([]byte(input.MessageBody), msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Data != "" || msg.Attachments[0].Size != int64(len(data)) {
+		t.Errorf("attachments = %+v, want the metadata of the file without its content", msg.Attachments)
+	}
+}
+
+func TestSQSPublishError(t *testing.T) {
+	requests := awsEndpoint(t, "sqs", http.StatusBadRequest, func([]byte) string {
+		return `{"__type":"com.amazonaws.sqs#QueueDoesNotExist","message":"The specified queue does not exist."}`
+	})
+
+	p, err := newSQSPublisher("https://sqs.eu-west-1.amazonaws.com/123456789012/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Publish(context.Background(), testPublication()); err == nil || !strings.Contains(err.Error(), "The specified queue does not exist.") {
+		t.Errorf("Publish to a missing queue: %v, want the error of sqs", err)
+	}
+	receiveAWS(t, requests)
+}
+
+// snsPublish answers a Publish request the way sns does
+func snsPublish([]byte) string {
+	return `<PublishResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><PublishResult><MessageId>94f20ce6-13c5-43a0-9a9e-ca52d816e90b</MessageId></PublishResult></PublishResponse>`
+}
+
+func TestNewSNSPublisher(t *testing.T) {
+	awsEndpoint(t, "sns", http.StatusOK, snsPublish)
+
+	for _, arn := range []string{"", "emails", "arn:aws:sqs:eu-west-1:123456789012:emails", "arn:aws:sns:eu-west-1:123456789012", "arn:aws:sns:eu-west-1:123456789012:emails:extra", "urn:aws:sns:eu-west-1:123456789012:emails"} {
+		if _, err := newSNSPublisher(arn); err == nil {
+			t.Errorf("newSNSPublisher(%q) accepted", arn)
+		}
+	}
+
+	p, err := newSNSPublisher("arn:aws:sns:eu-central-1:123456789012:emails.fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region := p.client.Options().Region; region != "eu-central-1" || !p.fifo {
+		t.Errorf("region %s, fifo %t, want the region of the arn and a fifo topic", region, p.fifo)
+	}
+}
+
+func TestSNSPublish(t *testing.T) {
+	for _, c := range []struct {
+		arn  string
+		fifo bool
+	}{
+		{"arn:aws:sns:eu-west-1:123456789012:emails", false},
+		{"arn:aws:sns:eu-west-1:123456789012:emails.fifo", true},
+	} {
+		requests := awsEndpoint(t, "sns", http.StatusOK, snsPublish)
+
+		p, err := newSNSPublisher(c.arn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pub := testPublication()
+		pub.Values["to_domain"] = "example.com"
+		if err := p.Publish(context.Background(), pub); err != nil {
+			t.Fatalf("%s: %v", c.arn, err)
+		}
+
+		req := receiveAWS(t, requests)
+		checkSignature(t, req, "eu-west-1", "sns")
+
+		form, err := url.ParseQuery(string(req.body))
+		if err != nil {
+			t.Fatalf("%s: request %s: %v", c.arn, req.body, err)
+		}
+		if form.Get("Action") != "Publish" || form.Get("TopicArn") != c.arn || form.Get("Message") != string(pub.Body) {
+			t.Errorf("%s: %s %s %s, want the payload published to the topic", c.arn, form.Get("Action"), form.Get("TopicArn"), form.Get("Message"))
+		}
+
+		// MessageAttributes.entry.N.Name, .Value.DataType and .Value.StringValue
+		attrs := map[string]string{}
+		for key, values := range form {
+			if strings.HasPrefix(key, "MessageAttributes.entry.") && strings.HasSuffix(key, ".Name") {
+				entry := strings.TrimSuffix(key, "Name")
+				if form.Get(entry+"Value.DataType") != "String" {
+					t.Errorf("%s: attribute %s of type %q, want a string", c.arn, values[0], form.Get(entry+"Value.DataType"))
+				}
+				attrs[values[0]] = form.Get(entry + "Value.StringValue")
+			}
+		}
+		want := map[string]string{"to_domain": "example.com", "spf_result": "pass", "delivery_id": "delivery-1"}
+		if len(attrs) != len(want) {
+			t.Errorf("%s: attributes = %v, want %v", c.arn, attrs, want)
+		}
+		for name, value := range want {
+			if attrs[name] != value {
+				t.Errorf("%s: attribute %s = %q, want %q", c.arn, name, attrs[name], value)
+			}
+		}
+
+		group, deduplication := form.Get("MessageGroupId"), form.Get("MessageDeduplicationId")
+		if !c.fifo && (group != "" || deduplication != "") {
+			t.Errorf("%s: group %q, deduplication id %q, want none on a standard topic", c.arn, group, deduplication)
+		}
+		if c.fifo && (group != "example.com" || deduplication != fifoDeduplicationID(pub)) {
+			t.Errorf("%s: group %q, deduplication id %q, want the recipient domain and the one of the delivery", c.arn, group, deduplication)
+		}
+	}
+}
+
+func TestSNSPublishError(t *testing.T) {
+	requests := awsEndpoint(t, "sns", http.StatusNotFound, func([]byte) string {
+		return `<ErrorResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><Error><Type>Sender</Type><Code>NotFound</Code><Message>Topic does not exist</Message></Error><RequestId>1</RequestId></ErrorResponse>`
+	})
+
+	p, err := newSNSPublisher("arn:aws:sns:eu-west-1:123456789012:emails")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Publish(context.Background(), testPublication()); err == nil || !strings.Contains(err.Error(), "Topic does not exist") {
+		t.Errorf("Publish to a missing topic: %v, want the error of sns", err)
+	}
+	receiveAWS(t, requests)
+}
+
+func TestFifo(t *testing.T) {
+	pub := testPublication()
+	if group := fifoGroup(pub); group != "smtp2http" {
+		t.Errorf("group of a payload without a recipient domain = %q, want smtp2http", group)
+	}
+	pub.Values["to_domain"] = "example.com"
+	if group := fifoGroup(pub); group != "example.com" {
+		t.Errorf("group = %q, want the recipient domain", group)
+	}
+
+	// the routes of a delivery share its id, not their recipient
+	other := testPublication()
+	other.Recipient = "BOB@example.com"
+	if fifoDeduplicationID(pub) != fifoDeduplicationID(other) {
+		t.Error("the deduplication id depends on the case of the recipient")
+	}
+	other.Recipient = "carol@example.com"
+	if fifoDeduplicationID(pub) == fifoDeduplicationID(other) {
+		t.Error("two recipients of a delivery share a deduplication id")
+	}
+}
@@ -0,0 +1,212 @@
+package smtp2http
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/emersion/go-smtp"
+)
+
+// attachmentsStore writes the files to the attachment store and only sends where they are
+const attachmentsStore = "store"
+
+// storeCleanupInterval is how often the expired files are removed from a directory store
+const storeCleanupInterval = time.Hour
+
+var errStoreFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Cannot store the attachments of your message, please try again later",
+}
+
+// attachmentStore is the store configured via -attachment-store-dir, nil when disabled
+var attachmentStore fileStore
+
+// fileStore persists the attachments, it returns the path or the url of the stored file
+type fileStore interface {
+	Put(key, contentType string, r io.Reader) (path, url string, err error)
+}
+
+// openFileStore opens the store at dest, either a directory or an "s3://bucket/prefix" uri.
+// The files of a directory store older than retention are removed, 0 keeps them forever
+func openFileStore(dest string, retention time.Duration) (fileStore, error) {
+	if strings.HasPrefix(dest, "s3://") {
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(dest, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("invalid attachment store %q, expected s3://bucket/prefix", dest)
+		}
+
+		// the standard aws credential chain: environment, shared config, instance/task role...
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		return &s3Store{client: s3.NewFromConfig(cfg), bucket: bucket, prefix: strings.Trim(prefix, "/")}, nil
+	}
+
+	dir, err := filepath.Abs(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	store := &dirStore{dir: dir}
+	if retention > 0 {
+		go func() {
+			for range time.Tick(storeCleanupInterval) {
+				store.cleanup(retention)
+			}
+		}()
+	}
+
+	return store, nil
+}
+
+// storeKey returns a unique key for a file, scoped by day so old files are easy to find
+func storeKey(filename string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+
+	return path.Join(time.Now().UTC().Format("2006/01/02"), hex.EncodeToString(suffix), sanitizeFilename(filename))
+}
+
+// sanitizeFilename keeps the base name of filename without the characters unsafe in a path
+func sanitizeFilename(filename string) string {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+
+	cleaned := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	if cleaned == "" || cleaned == "." || cleaned == ".." {
+		return "attachment"
+	}
+
+	return cleaned
+}
+
+// dirStore stores the files in a local directory
+type dirStore struct {
+	dir string
+}
+
+func (s *dirStore) Put(key, contentType string, r io.Reader) (string, string, error) {
+	dest := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return "", "", err
+	}
+
+	// write then rename so a reader never sees a partial file
+	tmp := dest + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", "", err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", "", err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return "", "", err
+	}
+
+	return dest, "", nil
+}
+
+// cleanup removes the files older than retention and the directories left empty
+func (s *dirStore) cleanup(retention time.Duration) {
+	deadline := time.Now().Add(-retention)
+	dirs := []string{}
+
+	filepath.Walk(s.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() {
+			if p != s.dir {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+
+		if info.ModTime().Before(deadline) {
+			if err := os.Remove(p); err != nil {
+				slog.Warn("cannot remove expired attachment", "path", p, "error", err)
+			}
+		}
+
+		return nil
+	})
+
+	// deepest first, os.Remove refuses the directories that aren't empty
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
+
+// s3Store stores the files in an s3 bucket
+type s3Store struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) Put(key, contentType string, r io.Reader) (string, string, error) {
+	key = path.Join(s.prefix, key)
+
+	// the upload is signed so it needs a seekable body, the parsed parts already are in memory
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", "", err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.WebhookTimeout)
+	defer cancel()
+
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return "", "s3://" + s.bucket + "/" + key, nil
+}
@@ -0,0 +1,359 @@
+package smtp2http
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// TNEF is the content of a TNEF attachment (the winmail.dat of Outlook and Exchange)
+type TNEF struct {
+	Files []*TNEFFile
+
+	// RTF is the decompressed rtf body, empty when the message has none
+	RTF string
+}
+
+// TNEFFile is a file carried in a TNEF attachment
+type TNEFFile struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+const tnefSignature = 0x223E9F78
+
+// the attributes of a TNEF stream, the low word of their id
+const (
+	tnefAttachRendData = 0x9002
+	tnefAttachTitle    = 0x8010
+	tnefAttachData     = 0x800F
+	tnefAttachment     = 0x9005
+	tnefMAPIProps      = 0x9003
+)
+
+// the MAPI properties read from the attMAPIProps and attAttachment attributes
+const (
+	mapiRTFCompressed     = 0x1009
+	mapiAttachDataBin     = 0x3701
+	mapiAttachLongName    = 0x3707
+	mapiAttachMIMETag     = 0x370E
+	mapiAttachDisplayName = 0x3001
+)
+
+var errTNEFTruncated = errors.New("truncated tnef data")
+
+// IsTNEF reports whether an attachment is a TNEF one
+func IsTNEF(filename, contentType string) bool {
+	return strings.EqualFold(contentType, "application/ms-tnef") || strings.EqualFold(filename, "winmail.dat")
+}
+
+// DecodeTNEF extracts the files and the rtf body of a TNEF attachment, the content type of the files
+// is the one they were sent with or else guessed from their extension
+func DecodeTNEF(data []byte) (*TNEF, error) {
+	r := &tnefReader{data: data}
+	if r.uint32() != tnefSignature {
+		return nil, errors.New("not a tnef attachment, invalid signature")
+	}
+	r.uint16() // the legacy key
+
+	ret := &TNEF{}
+	var file *TNEFFile
+	for r.err == nil && r.pos < len(r.data) {
+		level := r.byte()
+		id := r.uint32() & 0xFFFF
+		value := r.bytes(int(r.uint32()))
+		checksum := r.uint16()
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		var sum uint16
+		for _, b := range value {
+			sum += uint16(b)
+		}
+		if sum != checksum {
+			return nil, fmt.Errorf("invalid checksum of the attribute %#x", id)
+		}
+
+		switch {
+		case level == 2 && id == tnefAttachRendData:
+			file = &TNEFFile{}
+			ret.Files = append(ret.Files, file)
+		case level == 2 && id == tnefAttachTitle && file != nil:
+			file.Name = strings.TrimRight(string(value), "\x00")
+		case level == 2 && id == tnefAttachData && file != nil:
+			file.Data = value
+		case level == 2 && id == tnefAttachment && file != nil:
+			props, err := mapiProperties(value)
+			if err != nil {
+				return nil, err
+			}
+			if name := props.text(mapiAttachLongName); name != "" {
+				file.Name = name
+			} else if name := props.text(mapiAttachDisplayName); name != "" && file.Name == "" {
+				file.Name = name
+			}
+			file.ContentType = props.text(mapiAttachMIMETag)
+			if data, ok := props[mapiAttachDataBin]; ok && file.Data == nil {
+				file.Data = data
+			}
+		case level == 1 && id == tnefMAPIProps:
+			props, err := mapiProperties(value)
+			if err != nil {
+				return nil, err
+			}
+			if compressed, ok := props[mapiRTFCompressed]; ok {
+				rtf, err := decompressRTF(compressed)
+				if err != nil {
+					return nil, err
+				}
+				ret.RTF = string(rtf)
+			}
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	for _, f := range ret.Files {
+		if f.ContentType == "" {
+			f.ContentType = mime.TypeByExtension(path.Ext(f.Name))
+		}
+		if f.ContentType == "" {
+			f.ContentType = "application/octet-stream"
+		}
+	}
+
+	return ret, nil
+}
+
+// tnefReader reads the little endian values of a TNEF stream, the first overflow is kept in err
+type tnefReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *tnefReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.data)-r.pos {
+		r.err = errTNEFTruncated
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+
+	return b
+}
+
+func (r *tnefReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+
+	return 0
+}
+
+func (r *tnefReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+
+	return 0
+}
+
+func (r *tnefReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+
+	return 0
+}
+
+// skip moves past n bytes and their padding to a multiple of 4
+func (r *tnefReader) skip(n int) {
+	r.bytes(n + (4-n%4)%4)
+}
+
+// mapiProps are the values of the MAPI properties by id, only the strings and the binaries are kept
+type mapiProps map[uint16][]byte
+
+// text returns a string property, the PT_UNICODE ones are converted from UTF-16
+func (p mapiProps) text(id uint16) string {
+	return strings.TrimRight(string(p[id]), "\x00")
+}
+
+// the MAPI property types
+const (
+	ptShort    = 0x0002
+	ptLong     = 0x0003
+	ptFloat    = 0x0004
+	ptDouble   = 0x0005
+	ptCurrency = 0x0006
+	ptAppTime  = 0x0007
+	ptError    = 0x000A
+	ptBoolean  = 0x000B
+	ptObject   = 0x000D
+	ptI8       = 0x0014
+	ptString8  = 0x001E
+	ptUnicode  = 0x001F
+	ptSysTime  = 0x0040
+	ptCLSID    = 0x0048
+	ptBinary   = 0x0102
+	ptMultiple = 0x1000
+)
+
+// mapiProperties decodes an attMAPIProps or attAttachment attribute
+func mapiProperties(data []byte) (mapiProps, error) {
+	r := &tnefReader{data: data}
+	props := mapiProps{}
+
+	count := int(r.uint32())
+	for i := 0; i < count && r.err == nil; i++ {
+		typ := r.uint16()
+		id := r.uint16()
+
+		// the named properties are followed by their guid and their name or numeric id
+		if id >= 0x8000 {
+			r.bytes(16)
+			if kind := r.uint32(); kind == 0 {
+				r.uint32()
+			} else {
+				r.skip(int(r.uint32()))
+			}
+		}
+
+		// the multiple valued properties and the variable length ones are preceded by their count of values
+		multiple := typ&ptMultiple != 0
+		typ &^= ptMultiple
+
+		values := 1
+		if multiple || typ == ptString8 || typ == ptUnicode || typ == ptBinary || typ == ptObject {
+			values = int(r.uint32())
+		}
+
+		for v := 0; v < values && r.err == nil; v++ {
+			switch typ {
+			case ptShort, ptLong, ptFloat, ptError, ptBoolean:
+				r.bytes(4)
+			case ptDouble, ptCurrency, ptAppTime, ptI8, ptSysTime:
+				r.bytes(8)
+			case ptCLSID:
+				r.bytes(16)
+			case ptString8, ptUnicode, ptBinary, ptObject:
+				length := int(r.uint32())
+				value := r.bytes(length)
+				r.bytes((4 - length%4) % 4)
+				// the ids of the named properties are only unique along with their guid
+				if _, ok := props[id]; ok || id >= 0x8000 || r.err != nil {
+					continue
+				}
+
+				switch typ {
+				case ptUnicode:
+					props[id] = []byte(decodeUTF16(value))
+				case ptObject:
+					// an embedded object starts with its interface id
+					if len(value) >= 16 {
+						props[id] = value[16:]
+					}
+				default:
+					props[id] = value
+				}
+			default:
+				return nil, fmt.Errorf("unknown mapi property type %#x", typ)
+			}
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return props, nil
+}
+
+// decodeUTF16 converts a little endian UTF-16 string
+func decodeUTF16(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, binary.LittleEndian.Uint16(data[i:]))
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// rtfPrebuffer initializes the dictionary of the compressed rtf (MS-OXRTFCP)
+const rtfPrebuffer = `{\rtf1\ansi\mac\deff0\deftab720{\fonttbl;}{\f0\fnil \froman \fswiss \fmodern \fscript \fdecor MS Sans SerifSymbolArialTimes New RomanCourier{\colortbl\red0\green0\blue0` + "\r\n" + `\par \pard\plain\f0\fs20\b\i\u\tab\tx`
+
+const (
+	rtfCompressed   = 0x75465A4C // "LZFu"
+	rtfUncompressed = 0x414C454D // "MELA"
+)
+
+// decompressRTF decodes a PR_RTF_COMPRESSED value, its references point into a 4096 bytes ring dictionary
+func decompressRTF(data []byte) ([]byte, error) {
+	r := &tnefReader{data: data}
+	r.uint32() // the compressed size
+	rawSize := int(r.uint32())
+	compType := r.uint32()
+	r.uint32() // the crc
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	switch compType {
+	case rtfUncompressed:
+		if rawSize > len(data)-r.pos {
+			rawSize = len(data) - r.pos
+		}
+		return r.bytes(rawSize), nil
+	case rtfCompressed:
+	default:
+		return nil, fmt.Errorf("unknown rtf compression %#x", compType)
+	}
+
+	var dict [4096]byte
+	copy(dict[:], rtfPrebuffer)
+	write := len(rtfPrebuffer)
+
+	out := bytes.Buffer{}
+	for r.pos < len(r.data) {
+		control := r.byte()
+		for bit := 0; bit < 8 && r.pos < len(r.data); bit++ {
+			if control&(1<<bit) == 0 {
+				b := r.byte()
+				out.WriteByte(b)
+				dict[write] = b
+				write = (write + 1) % len(dict)
+				continue
+			}
+
+			ref := int(r.byte())<<8 | int(r.byte())
+			offset, length := ref>>4, ref&0xF+2
+			if offset == write {
+				return out.Bytes(), nil
+			}
+
+			for i := 0; i < length; i++ {
+				b := dict[(offset+i)%len(dict)]
+				out.WriteByte(b)
+				dict[write] = b
+				write = (write + 1) % len(dict)
+			}
+		}
+	}
+
+	return out.Bytes(), r.err
+}
@@ -0,0 +1,553 @@
+package smtp2http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/go-resty/resty/v2"
+)
+
+// webhookClient is shared by every delivery so connections to the webhook are pooled
+var webhookClient = resty.New()
+
+// callbackClient calls the other endpoints: the recipient check, the reject webhook and the readiness url. It
+// shares the connections of webhookClient but its requests get neither the oauth2 token nor the signature of
+// -webhook-auth, which are the credentials of the webhooks only
+var callbackClient = resty.New()
+
+// newWebhookClient creates the http client used to call the webhook, every one of the concurrency requests
+// allowed in flight keeps its idle connection. The requests go through proxy, or else the proxy of the environment,
+// and the https ones use tlsConfig (the go defaults when nil)
+func newWebhookClient(timeout time.Duration, concurrency int, proxy *url.URL, tlsConfig *tls.Config) *resty.Client {
+	idlePerHost := 16
+	if concurrency > idlePerHost {
+		idlePerHost = concurrency
+	}
+
+	proxyFunc := http.ProxyFromEnvironment
+	if proxy != nil {
+		proxyFunc = http.ProxyURL(proxy)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxyFunc,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   idlePerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		OnProxyConnectResponse: func(_ context.Context, _ *url.URL, _ *http.Request, resp *http.Response) error {
+			if resp.StatusCode != http.StatusOK {
+				return &proxyError{err: fmt.Errorf("CONNECT refused: %s", resp.Status)}
+			}
+			return nil
+		},
+	}
+
+	return resty.New().SetTransport(transport).SetTimeout(timeout).SetPreRequestHook(prepareRequest)
+}
+
+// newCallbackClient returns the client of the other endpoints, over the transport and with the timeout of webhook
+func newCallbackClient(webhook *resty.Client) *resty.Client {
+	return resty.New().SetTransport(webhook.GetClient().Transport).SetTimeout(webhook.GetClient().Timeout)
+}
+
+// parseWebhookProxy parses -webhook-proxy, nil when unset
+func parseWebhookProxy(value string) (*url.URL, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -webhook-proxy: %s", err.Error())
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid -webhook-proxy scheme %q, expected http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("invalid -webhook-proxy, no host")
+	}
+
+	return u, nil
+}
+
+// proxyError is a failure of the proxy rather than of the webhook
+type proxyError struct {
+	err error
+}
+
+func (e *proxyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *proxyError) Unwrap() error {
+	return e.err
+}
+
+// isProxyError reports whether err happened on the way to the proxy or while it connected to the webhook, the
+// transport reports the dial errors as "proxyconnect" and the socks ones as "socks connect"
+func isProxyError(err error) bool {
+	var pe *proxyError
+	var oe *net.OpError
+
+	return errors.As(err, &pe) || (errors.As(err, &oe) && (oe.Op == "proxyconnect" || strings.HasPrefix(oe.Op, "socks")))
+}
+
+// webhookSlots bounds the webhook requests in flight to -webhook-concurrency, nil when they are unbounded
+var webhookSlots chan struct{}
+
+// acquireWebhookSlot waits for a free slot of -webhook-concurrency, it gives up once ctx is done
+func acquireWebhookSlot(ctx context.Context) error {
+	if webhookSlots == nil {
+		return nil
+	}
+
+	metricWebhookWaiting.Inc()
+	defer metricWebhookWaiting.Dec()
+
+	select {
+	case webhookSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// releaseWebhookSlot frees the slot of a request done
+func releaseWebhookSlot() {
+	if webhookSlots != nil {
+		<-webhookSlots
+	}
+}
+
+// executeWebhook sends the request of an attempt holding a slot, the slot is released and the request no
+// longer counted in flight once it returns, a panic of the transport included
+func executeWebhook(req *resty.Request, url string) (*resty.Response, error) {
+	defer releaseWebhookSlot()
+
+	metricWebhookInFlight.Inc()
+	defer metricWebhookInFlight.Dec()
+
+	return req.Execute(conf.WebhookMethod, url)
+}
+
+// webhookHeaders are the extra headers configured via -webhook-header
+var webhookHeaders = map[string]string{}
+
+// parseWebhookHeaders parses the "Name: Value" header specs, only the
+// first colon separates the name so the value may contain colons itself
+func parseWebhookHeaders(specs []string) (map[string]string, error) {
+	ret := map[string]string{}
+
+	for _, spec := range specs {
+		kv := strings.SplitN(spec, ":", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" {
+			return nil, fmt.Errorf("invalid webhook header %q, expected \"Name: Value\"", spec)
+		}
+
+		ret[textproto.CanonicalMIMEHeaderKey(name)] = strings.TrimSpace(kv[1])
+	}
+
+	return ret, nil
+}
+
+// RedactHeader hides the value of the headers carrying credentials
+func RedactHeader(name, value string) string {
+	switch textproto.CanonicalMIMEHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization":
+		return "<redacted>"
+	}
+
+	return value
+}
+
+// webhookRequest is the content of a webhook request, the body is sent as is
+type webhookRequest struct {
+	URL         string
+	Body        []byte
+	ContentType string
+	Headers     map[string]string
+
+	// BodyFile is the temp file holding the body instead of Body, for a message over -max-memory-per-message
+	BodyFile string
+}
+
+// body opens the body of the request, a *fileBody to close when it is read from the temp file
+func (r *webhookRequest) body() (io.Reader, error) {
+	if r.BodyFile == "" {
+		// resty copies a []byte body into a buffer of its own, a reader is sent as is
+		return bytes.NewReader(r.Body), nil
+	}
+
+	f, err := os.Open(r.BodyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fileBody{File: f, size: info.Size()}, nil
+}
+
+// fileBody is a body streamed from its temp file
+type fileBody struct {
+	*os.File
+	size int64
+}
+
+// prepareRequest completes the request about to be sent: the length of a body streamed from a file, which would
+// be chunked otherwise, the oauth2 token of the requests that didn't get one from postWebhook, then the signature
+// of -webhook-auth over the final request. It only runs for the requests of webhookClient
+func prepareRequest(_ *resty.Client, req *http.Request) error {
+	if f, ok := req.Body.(*fileBody); ok {
+		req.ContentLength = f.size
+	}
+
+	if webhookTokens != nil && req.Header.Get("Authorization") == "" {
+		authorization, err := webhookTokens.authorization()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", authorization)
+	}
+
+	return awsSigner.sign(req)
+}
+
+// size returns the size of the body
+func (r *webhookRequest) size() int64 {
+	if r.BodyFile != "" {
+		if info, err := os.Stat(r.BodyFile); err == nil {
+			return info.Size()
+		}
+	}
+
+	return int64(len(r.Body))
+}
+
+// bodyBytes returns the body, read from its temp file when needed
+func (r *webhookRequest) bodyBytes() ([]byte, error) {
+	if r.BodyFile != "" {
+		return ioutil.ReadFile(r.BodyFile)
+	}
+
+	return r.Body, nil
+}
+
+// postWebhook sends the already marshaled payload to the webhook with -webhook-method, failed attempts
+// are retried with an exponential backoff (plus jitter) as long as the next
+// attempt can still start before the deadline (or the one of ctx). A rate limited attempt is retried after its
+// Retry-After at the earliest. Canceling ctx interrupts the request being sent. An attempt isn't sent while
+// the circuit of the webhook is open, errCircuitOpen is returned instead. With -oauth2-token-url a 401 gets
+// a single retry with a new token before it is a failure, and the request isn't sent when there is no token
+func postWebhook(ctx context.Context, logger *slog.Logger, r *webhookRequest, deadline time.Time) (resp *resty.Response, err error) {
+	delay := conf.WebhookRetryDelay
+	breaker := breakers.get(r.URL)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	reauthorized := false
+
+	for attempt := 1; ; attempt++ {
+		authorization := ""
+		if webhookTokens != nil {
+			if authorization, err = webhookTokens.authorization(); err != nil {
+				logger.Warn("webhook attempt failed, token endpoint error", "attempt", attempt, "error", err)
+				return nil, err
+			}
+		}
+
+		// the slot is held for the attempt only, not while backing off
+		if err := acquireWebhookSlot(ctx); err != nil {
+			logger.Warn("webhook attempt canceled waiting for a free slot", "attempt", attempt, "webhook_concurrency", conf.WebhookConcurrency)
+			return nil, err
+		}
+
+		body, err := r.body()
+		if err != nil {
+			releaseWebhookSlot()
+			return nil, err
+		}
+
+		// the hmac covers the uncompressed body, the one the receiver gets once it decoded the Content-Encoding
+		signature := ""
+		if conf.WebhookSecret != "" {
+			if signature, err = signRequest(conf.WebhookSecret, r, time.Now()); err != nil {
+				closeBody(body)
+				releaseWebhookSlot()
+				return nil, err
+			}
+		}
+
+		// the aws signature covers the body as sent, compressed in memory beforehand
+		sent, compressed := io.Reader(body), conf.WebhookCompress && r.size() >= compressMinSize
+		switch {
+		case compressed && awsSigner != nil:
+			sent, err = gzipBuffer(body)
+		case compressed:
+			sent = gzipReader(body)
+		}
+		reqCtx := ctx
+		if err == nil {
+			reqCtx, err = awsSigner.withPayloadHash(ctx, sent)
+		}
+		if err != nil {
+			closeBody(body)
+			releaseWebhookSlot()
+			return nil, err
+		}
+
+		if !breaker.allow(time.Now()) {
+			closeBody(body)
+			releaseWebhookSlot()
+			logger.Warn("webhook attempt skipped, circuit open", "attempt", attempt)
+			return nil, errCircuitOpen
+		}
+
+		req := webhookClient.R().
+			SetContext(reqCtx).
+			SetHeader("Content-Type", r.ContentType).
+			SetHeaders(r.Headers).
+			SetHeaders(webhookHeaders).
+			SetBody(sent)
+		if compressed {
+			req.SetHeader("Content-Encoding", "gzip")
+		}
+		if authorization != "" {
+			req.SetHeader("Authorization", authorization)
+		}
+		if signature != "" {
+			req.SetHeader(signatureHeader, signature)
+		}
+
+		started := time.Now()
+		resp, err = executeWebhook(req, r.URL)
+		// a plain http request is forwarded by the proxy, which answers a 407 itself: not a refusal of the webhook
+		if err == nil && resp.StatusCode() == http.StatusProxyAuthRequired {
+			err = &proxyError{err: fmt.Errorf("proxy authentication failed: %s", resp.Status())}
+		}
+		closeBody(body)
+		metricWebhookDuration.Observe(time.Since(started).Seconds())
+
+		// the token may have been revoked or expired early, a new one gets a single retry
+		if err == nil && resp.StatusCode() == http.StatusUnauthorized && authorization != "" && !reauthorized {
+			breaker.record(false, time.Now())
+			reauthorized = true
+			webhookTokens.expire(authorization)
+			logger.Warn("webhook answered a 401, retrying with a new oauth2 token", "attempt", attempt)
+			attempt--
+			continue
+		}
+
+		// a 4xx is the answer of a working webhook
+		breaker.record(err != nil || resp.StatusCode() >= 500, time.Now())
+		if err == nil && isSuccess(resp.StatusCode()) {
+			return resp, nil
+		}
+
+		retryAfter, limited := time.Duration(0), false
+		if err == nil {
+			retryAfter, limited = rateLimited(resp, time.Now())
+		}
+
+		switch {
+		case err != nil && isProxyError(err):
+			metricWebhookFailures.WithLabelValues("proxy_error").Inc()
+			logger.Warn("webhook attempt failed, proxy error", "attempt", attempt, "error", err)
+		case err != nil:
+			metricWebhookFailures.WithLabelValues(statusClass(0)).Inc()
+			logger.Warn("webhook attempt failed, webhook error", "attempt", attempt, "error", err)
+		case limited:
+			metricWebhookRateLimited.Inc()
+			logger.Warn("webhook attempt rate limited", "attempt", attempt, "webhook_status", resp.StatusCode(), "retry_after", retryAfter)
+		default:
+			metricWebhookFailures.WithLabelValues(statusClass(resp.StatusCode())).Inc()
+			logger.Warn("webhook attempt failed", "attempt", attempt, "webhook_status", resp.StatusCode())
+		}
+
+		// a 4xx means the webhook doesn't want this message, retrying won't change its mind
+		if attempt > conf.WebhookRetries || (err == nil && isPermanentFailure(resp.StatusCode())) {
+			return resp, err
+		}
+
+		wait := delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if time.Now().Add(wait).After(deadline) {
+			logger.Warn("webhook giving up, the next retry would exceed the smtp or the handler timeout", "attempt", attempt)
+			return resp, err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return resp, err
+		}
+		delay *= 2
+	}
+}
+
+// closeBody closes the temp file of a body
+func closeBody(body io.Reader) {
+	if f, ok := body.(*fileBody); ok {
+		f.Close()
+	}
+}
+
+// compressMinSize is the size under which -webhook-compress doesn't bother compressing the body
+const compressMinSize = 1024
+
+// gzipReader returns the gzip compressed data, compressed while the request reads it so there is never a
+// second copy of the body in memory. The writer stops as soon as the transport closes the body
+func gzipReader(data io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, data)
+		if err == nil {
+			err = gw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// isSuccess reports whether the webhook accepted the message
+func isSuccess(code int) bool {
+	return code >= 200 && code < 300
+}
+
+// isPermanentFailure reports whether the webhook refused the message for good, a 429 only asks to slow down
+func isPermanentFailure(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusTooManyRequests
+}
+
+// rateLimited reports whether the webhook answered a 429, or a 503 with a Retry-After, along with the delay it
+// asked for (0 when it didn't say)
+func rateLimited(resp *resty.Response, now time.Time) (time.Duration, bool) {
+	retryAfter, ok := parseRetryAfter(resp.Header().Get("Retry-After"), now)
+
+	switch resp.StatusCode() {
+	case http.StatusTooManyRequests:
+		return retryAfter, true
+	case http.StatusServiceUnavailable:
+		return retryAfter, ok
+	}
+
+	return 0, false
+}
+
+// parseRetryAfter parses a Retry-After header, in delta-seconds or as an http date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if t.Before(now) {
+		return 0, true
+	}
+
+	return t.Sub(now), true
+}
+
+// webhookReply is the json body a webhook may answer a 4xx with to choose the smtp reply
+type webhookReply struct {
+	SMTPCode int    `json:"smtp_code"`
+	Message  string `json:"message"`
+}
+
+// errWebhookUnreachable is the reply when the webhook couldn't be reached at all
+var errWebhookUnreachable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+	Message:      "Cannot deliver your message right now, please try again later",
+}
+
+// errWebhookRateLimited is the reply when the webhook asked to slow down for longer than the message can wait
+var errWebhookRateLimited = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 5},
+	Message:      "Too many messages right now, please try again later",
+}
+
+// webhookStatusError maps a failed webhook response to the smtp reply. A 4xx is a permanent
+// rejection, the webhook may pick the code and the text with a {"smtp_code": 550, "message": "..."}
+// body, while anything else asks the sending MTA to retry later
+func webhookStatusError(code int, body []byte) error {
+	if !isPermanentFailure(code) {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+			Message:      "Cannot deliver your message right now, please try again later",
+		}
+	}
+
+	reply := &webhookReply{}
+	if json.Unmarshal(body, reply) == nil && reply.SMTPCode >= 400 && reply.SMTPCode < 600 {
+		// the text ends up in the smtp stream, it must not be able to inject another reply
+		message := sanitizeReply(reply.Message)
+		if message == "" {
+			message = "Your message was rejected by the recipient system"
+		}
+
+		return &smtp.SMTPError{
+			Code:         reply.SMTPCode,
+			EnhancedCode: smtp.EnhancedCode{reply.SMTPCode / 100, 0, 0},
+			Message:      message,
+		}
+	}
+
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Your message was rejected by the recipient system",
+	}
+}
@@ -0,0 +1,124 @@
+package smtp2http
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// clientCertPollInterval is how often the files of -webhook-client-cert and -webhook-client-key are checked
+// for a new certificate
+const clientCertPollInterval = time.Minute
+
+// webhookTLSConfig returns the tls config of the webhook client: the client certificate of certFile and keyFile,
+// the roots of caFile in place of the system ones and no verification at all when insecure. It returns nil
+// when none is set, along with the client certificate to watch (nil without one)
+func webhookTLSConfig(certFile, keyFile, caFile string, insecure bool) (*tls.Config, *clientCertificate, error) {
+	if certFile == "" && keyFile == "" && caFile == "" && !insecure {
+		return nil, nil, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	var cert *clientCertificate
+	switch {
+	case (certFile == "") != (keyFile == ""):
+		return nil, nil, errors.New("both -webhook-client-cert and -webhook-client-key are required for a client certificate")
+	case certFile != "":
+		cert = &clientCertificate{certFile: certFile, keyFile: keyFile}
+		if _, err := cert.reload(); err != nil {
+			return nil, nil, err
+		}
+		cfg.GetClientCertificate = cert.get
+	}
+
+	roots, err := loadCABundle(caFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load -webhook-ca-file: %s", err.Error())
+	}
+	cfg.RootCAs = roots
+
+	if insecure {
+		slog.Warn("INSECURE: the tls certificate of the webhook isn't verified (-webhook-insecure-skip-verify), anyone on the way can read and forge the requests, only use it in a lab")
+		cfg.InsecureSkipVerify = true
+	}
+
+	return cfg, cert, nil
+}
+
+// clientCertificate is the client certificate presented to the webhook, reloaded when its files change
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// get returns the current certificate, whatever the server asks for
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// reload loads the certificate again when one of its files was modified since the last load, it reports
+// whether it did. The current certificate is kept when the new one is invalid
+func (c *clientCertificate) reload() (bool, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot read -webhook-client-cert: %s", err.Error())
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot read -webhook-client-key: %s", err.Error())
+	}
+
+	c.mu.RLock()
+	unchanged := certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// a certificate and a key written one after the other don't match for a moment, the next poll gets both
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load the webhook client certificate: %s", err.Error())
+	}
+
+	c.mu.Lock()
+	c.cert, c.certMod, c.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	c.mu.Unlock()
+
+	return true, nil
+}
+
+// watch reloads the certificate every interval when its files changed, until done is closed
+func (c *clientCertificate) watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		reloaded, err := c.reload()
+		switch {
+		case err != nil:
+			slog.Error("cannot reload the webhook client certificate, keeping the current one", "webhook_client_cert", c.certFile, "error", err)
+		case reloaded:
+			slog.Info("webhook client certificate reloaded", "webhook_client_cert", c.certFile)
+		}
+	}
+}
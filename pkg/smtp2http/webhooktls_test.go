@@ -0,0 +1,261 @@
+package smtp2http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing the certificates of the mutual tls tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "smtp2http test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the pem certificate and key of name signed by the ca, a server certificate of 127.0.0.1 or
+// a client one
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if usage == x509.ExtKeyUsageServerAuth {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// mutualTLSServer serves a webhook over tls requiring a client certificate of the ca until the test ends, it
+// sends the common name of the client of each request on the returned channel
+func mutualTLSServer(t *testing.T, ca *testCA) (*httptest.Server, chan string) {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, "webhook.test", x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := x509.NewCertPool()
+	clients.AddCert(ca.cert)
+
+	names := make(chan string, 4)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names <- r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+	// a handshake per request, a rotated certificate is presented on the next one
+	srv.Config.SetKeepAlivesEnabled(false)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv, names
+}
+
+// writeClientCert writes the client certificate of name and its key to certFile and keyFile, modified at mod
+func writeClientCert(t *testing.T, ca *testCA, name, certFile, keyFile string, mod time.Time) {
+	t.Helper()
+
+	certPEM, keyPEM := ca.issue(t, name, x509.ExtKeyUsageClientAuth)
+	for file, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// postThroughTLS posts a webhook request to url with the tls config of the webhook client
+func postThroughTLS(t *testing.T, url string, tlsConfig *tls.Config) error {
+	t.Helper()
+
+	restoreGlobals(t)
+	conf = DefaultConfig()
+	conf.WebhookRetries = 0
+	webhookClient = newWebhookClient(5*time.Second, 0, nil, tlsConfig)
+
+	req := &webhookRequest{URL: url, ContentType: "application/json", Body: []byte(`{}`)}
+	resp, err := postWebhook(context.Background(), slog.Default(), req, time.Now().Add(time.Minute))
+	if err == nil && resp.StatusCode() != http.StatusOK {
+		t.Fatalf("webhook returned %d", resp.StatusCode())
+	}
+
+	return err
+}
+
+func TestWebhookMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	srv, names := mutualTLSServer(t, ca)
+
+	dir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeClientCert(t, ca, "client-1", certFile, keyFile, time.Now().Add(-time.Minute))
+
+	tlsConfig, cert, err := webhookTLSConfig(certFile, keyFile, caFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := postThroughTLS(t, srv.URL, tlsConfig); err != nil {
+		t.Fatalf("webhook with the client certificate: %v", err)
+	}
+	if name := <-names; name != "client-1" {
+		t.Errorf("client certificate %q presented, want client-1", name)
+	}
+
+	// the certificate is rotated, the watcher picks the files modified since the last load
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		cert.watch(10*time.Millisecond, done)
+		close(stopped)
+	}()
+
+	writeClientCert(t, ca, "client-2", certFile, keyFile, time.Now())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := postThroughTLS(t, srv.URL, tlsConfig); err != nil {
+			t.Fatal(err)
+		}
+		if name := <-names; name == "client-2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated client certificate wasn't presented")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("the watcher didn't stop")
+	}
+}
+
+func TestWebhookMutualTLSRefused(t *testing.T) {
+	ca := newTestCA(t)
+	srv, _ := mutualTLSServer(t, ca)
+
+	dir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeClientCert(t, ca, "client-1", certFile, keyFile, time.Now())
+
+	for _, c := range []struct {
+		name              string
+		cert, key, caFile string
+	}{
+		{"no client certificate", "", "", caFile},
+		// the server certificate isn't trusted by the system roots
+		{"no -webhook-ca-file", certFile, keyFile, ""},
+	} {
+		tlsConfig, _, err := webhookTLSConfig(c.cert, c.key, c.caFile, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := postThroughTLS(t, srv.URL, tlsConfig); err == nil {
+			t.Errorf("%s: the webhook was reached", c.name)
+		}
+	}
+}
+
+func TestWebhookTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := ioutil.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		cert, key, caFile string
+		want              string
+	}{
+		{certFile, "", "", "both -webhook-client-cert and -webhook-client-key are required"},
+		{"", keyFile, "", "both -webhook-client-cert and -webhook-client-key are required"},
+		{filepath.Join(dir, "missing.pem"), keyFile, "", "cannot read -webhook-client-cert"},
+		{garbage, keyFile, "", "cannot load the webhook client certificate"},
+		{"", "", filepath.Join(dir, "missing.pem"), "cannot load -webhook-ca-file"},
+	} {
+		if _, _, err := webhookTLSConfig(c.cert, c.key, c.caFile, false); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("webhookTLSConfig(%q, %q, %q): %v, want %q", c.cert, c.key, c.caFile, err, c.want)
+		}
+	}
+}
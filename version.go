@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/ShlomiPorush/smtp2http/pkg/smtp2http"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the build information, set with -ldflags "-X main.version=1.2.3 -X main.commit=abc123 -X main.buildDate=2024-05-01T10:00:00Z"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = "unknown"
+)
+
+var metricBuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "smtp2http",
+	Name:      "build_info",
+	Help:      "Always 1, the labels describe the running build.",
+}, []string{"version", "commit", "build_date", "go_version"})
+
+func init() {
+	prometheus.MustRegister(metricBuildInfo)
+}
+
+// secretFlags are the flags whose values are never logged
+var secretFlags = map[string]bool{
+	"webhook-secret":       true,
+	"kafka-sasl-password":  true,
+	"auth-password":        true,
+	"pass":                 true,
+	"pgp-passphrase":       true,
+	"oauth2-client-secret": true,
+	"elastic-password":     true,
+	"elastic-api-key":      true,
+}
+
+// urlPasswordPattern matches the password of the credentials embedded in an url
+var urlPasswordPattern = regexp.MustCompile(`(://[^:/@\s]*:)[^@/\s]+@`)
+
+// buildCommit returns the commit set at build time, or the one recorded by the go toolchain
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				return s.Value
+			}
+		}
+	}
+
+	return "unknown"
+}
+
+// versionString is the output of -version
+func versionString() string {
+	return fmt.Sprintf("smtp2http %s (commit %s, built %s, %s)", version, buildCommit(), buildDate, runtime.Version())
+}
+
+// logStartup logs the build and the effective value of every flag, the secrets redacted
+func logStartup(fs *flag.FlagSet) {
+	config := []interface{}{}
+	fs.VisitAll(func(f *flag.Flag) {
+		config = append(config, f.Name, redactFlag(f.Name, f.Value.String()))
+	})
+
+	slog.Info("smtp2http starting", "version", version, "commit", buildCommit(), "build_date", buildDate, "go_version", runtime.Version())
+	slog.Info("effective configuration", config...)
+}
+
+// redactFlag hides the secret flag values, the passwords of the urls and the credentials of the webhook headers
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+
+	if secretFlags[name] {
+		return "<redacted>"
+	}
+
+	if name == "webhook-header" {
+		headers := strings.Split(value, ", ")
+		for i, header := range headers {
+			if n, v, ok := strings.Cut(header, ":"); ok {
+				headers[i] = n + ": " + smtp2http.RedactHeader(n, strings.TrimSpace(v))
+			}
+		}
+		return strings.Join(headers, ", ")
+	}
+
+	return urlPasswordPattern.ReplaceAllString(value, "${1}<redacted>@")
+}